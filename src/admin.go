@@ -0,0 +1,290 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// userUsage compares the storage of a user in the database with its directory in filedir
+type userUsage struct {
+	User    user
+	Storage int64 // the size of the file versions in the database
+	Blobs   int   // the files in filedir/<id>
+	Disk    int64 // their size
+	Devices []storedSession
+}
+
+func (u adminUser) StorageText() string { return humanSize(u.Storage) }
+func (u userUsage) StorageText() string { return humanSize(u.Storage) }
+func (u userUsage) DiskText() string    { return humanSize(u.Disk) }
+
+func humanSize(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
+
+// diskUsage returns the number and the size of the blobs in a directory of filedir
+func diskUsage(dir string) (int, int64, error) {
+	entries, err := os.ReadDir(path.Join("./filedir", dir))
+	if errors.Is(err, os.ErrNotExist) {
+		return 0, 0, nil
+	} else if err != nil {
+		return 0, 0, err
+	}
+
+	var size int64
+	for _, e := range entries {
+		info, err := e.Info()
+		if err != nil {
+			return 0, 0, err
+		}
+		size += info.Size()
+	}
+	return len(entries), size, nil
+}
+
+// requireAdmin lets only administrators use h. Other users get 404, the console isn't advertised
+func requireAdmin(h func(HTMLWriter, *http.Request, session)) func(HTMLWriter, *http.Request, session) {
+	return func(w HTMLWriter, r *http.Request, s session) {
+		if s.user.Role != "admin" {
+			w.Status = http.StatusNotFound
+			w.WriteHeader()
+			return
+		}
+		h(w, r, s)
+	}
+}
+
+// purgeUser deletes a user with its files and ends its sessions. The spaces left without members are deleted too
+func (env *Env) purgeUser(u user) error {
+	spaces, err := env.dataManager.deleteUser(env.db, u.Username)
+	if err != nil {
+		return err
+	}
+	sessions.removeUser(u.Username)
+
+	for id, blobs := range spaces {
+		for _, blob := range blobs {
+			if err := removeBlob(id, blob); err != nil {
+				log.Printf("err: %v\n", err)
+			}
+		}
+		if err := os.Remove(path.Join("./filedir", id)); err != nil && !errors.Is(err, os.ErrNotExist) {
+			log.Printf("err: %v\n", err)
+		}
+	}
+
+	// Blobs still in quarantine are left to fsck, their versions are gone with the user
+	return os.RemoveAll(path.Join("./filedir", u.Id.String()))
+}
+
+// adminCommand gives or takes the admin role of the user in args
+func (env *Env) adminCommand(args []string, revoke bool) int {
+	if len(args) != 1 {
+		fmt.Fprintf(os.Stderr, "usage: %s admin [--revoke] <username>\n", os.Args[0])
+		return 2
+	}
+
+	role := "admin"
+	if revoke {
+		role = "user"
+	}
+	err := env.dataManager.setRole(env.db, args[0], role)
+	if errors.Is(err, pgx.ErrNoRows) {
+		fmt.Fprintf(os.Stderr, "user %q does not exist\n", args[0])
+		return 1
+	} else if err != nil {
+		log.Printf("err: %v\n", err)
+		return 2
+	}
+	fmt.Printf("%s is now a %s\n", args[0], role)
+	return 0
+}
+
+// bootstrapAdmins gives the admin role to the users in ADMIN_USERS, a comma separated list.
+// It runs at startup, users that don't exist yet get the role on the next restart
+func (env *Env) bootstrapAdmins() {
+	for _, name := range strings.Split(os.Getenv("ADMIN_USERS"), ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		err := env.dataManager.setRole(env.db, name, "admin")
+		if errors.Is(err, pgx.ErrNoRows) {
+			log.Printf("ADMIN_USERS: user %q does not exist yet\n", name)
+		} else if err != nil {
+			log.Printf("err: %v\n", err)
+		}
+	}
+}
+
+func (env *Env) adminPage() map[string]any {
+	users, err := env.dataManager.adminUsers(env.db)
+	if err != nil {
+		log.Printf("err: %v\n", err)
+	}
+	return map[string]any{"Users": users}
+}
+
+// adminTarget returns the user in the path of r. Administrators can't manage their own account
+// from the console, so they can't lock themselves out.
+// If it returns false the response has already been sent
+func (env *Env) adminTarget(w HTMLWriter, r *http.Request, s session) (user, bool) {
+	u, err := env.dataManager.userById(env.db, r.PathValue("userId"))
+	if err != nil {
+		if !errors.Is(err, pgx.ErrNoRows) {
+			log.Printf("err: %v\n", err)
+		}
+		w.Status = folderErrStatus(err)
+		w.WriteHeader()
+		return user{}, false
+	}
+	if u.Id == s.user.Id {
+		obj := env.adminPage()
+		obj["Message"] = "You can't change your own account from the console"
+		sendTemplate(w, obj, "admin", "./html/admin.html")
+		return user{}, false
+	}
+	return u, true
+}
+
+// GET //
+
+func (env *Env) getAdmin(w HTMLWriter, r *http.Request, s session) {
+	sendTemplate(w, env.adminPage(), "admin", "./html/admin.html")
+}
+
+// getAdminUser shows the storage of a user in the database and in filedir, and its devices
+func (env *Env) getAdminUser(w HTMLWriter, r *http.Request, s session) {
+	u, err := env.dataManager.userById(env.db, r.PathValue("userId"))
+	if err != nil {
+		if !errors.Is(err, pgx.ErrNoRows) {
+			log.Printf("err: %v\n", err)
+		}
+		w.Status = folderErrStatus(err)
+		w.WriteHeader()
+		return
+	}
+
+	obj := env.adminPage()
+	usage := userUsage{User: u}
+	if users, ok := obj["Users"].([]adminUser); ok {
+		for _, au := range users {
+			if au.Id == u.Id {
+				usage.Storage = au.Storage
+			}
+		}
+	}
+	if usage.Blobs, usage.Disk, err = diskUsage(u.Id.String()); err != nil {
+		log.Printf("err: %v\n", err)
+	}
+	if usage.Devices, err = env.dataManager.userSessions(env.db, u.Username); err != nil {
+		log.Printf("err: %v\n", err)
+	}
+	obj["Usage"] = usage
+	sendTemplate(w, obj, "admin", "./html/admin.html")
+}
+
+// POST //
+
+func (env *Env) postUserRole(w HTMLWriter, r *http.Request, s session) {
+	u, ok := env.adminTarget(w, r, s)
+	if !ok {
+		return
+	}
+	role := r.PostFormValue("role")
+	if role != "user" && role != "admin" {
+		w.Status = http.StatusBadRequest
+		w.WriteHeader()
+		return
+	}
+
+	if err := env.dataManager.setRole(env.db, u.Username, role); err != nil {
+		log.Printf("err: %v\n", err)
+		w.Status = folderErrStatus(err)
+		w.WriteHeader()
+		return
+	}
+	sessions.removeUser(u.Username) // The cached sessions would keep the old role for a while
+	log.Printf("admin: %s made %s a %s\n", s.user.Username, u.Username, role)
+	env.getAdmin(w, r, s)
+}
+
+// disableUser keeps the user from logging in and ends its sessions, its data is kept
+func (env *Env) disableUser(w HTMLWriter, r *http.Request, s session) {
+	env.setDisabled(w, r, s, true)
+}
+
+func (env *Env) enableUser(w HTMLWriter, r *http.Request, s session) {
+	env.setDisabled(w, r, s, false)
+}
+
+func (env *Env) setDisabled(w HTMLWriter, r *http.Request, s session, disabled bool) {
+	u, ok := env.adminTarget(w, r, s)
+	if !ok {
+		return
+	}
+	if err := env.dataManager.setDisabled(env.db, u.Username, disabled); err != nil {
+		log.Printf("err: %v\n", err)
+		w.Status = folderErrStatus(err)
+		w.WriteHeader()
+		return
+	}
+	sessions.removeUser(u.Username)
+
+	action := "enabled"
+	if disabled {
+		action = "disabled"
+	}
+	log.Printf("admin: %s %s %s\n", s.user.Username, action, u.Username)
+	env.getAdmin(w, r, s)
+}
+
+// DELETE //
+
+// logoutUser ends every session of the user
+func (env *Env) logoutUser(w HTMLWriter, r *http.Request, s session) {
+	u, ok := env.adminTarget(w, r, s)
+	if !ok {
+		return
+	}
+	if err := env.dataManager.deleteUserSessions(env.db, u.Username); err != nil {
+		log.Printf("err: %v\n", err)
+		w.Status = http.StatusInternalServerError
+		w.WriteHeader()
+		return
+	}
+	sessions.removeUser(u.Username)
+	log.Printf("admin: %s logged out %s\n", s.user.Username, u.Username)
+	env.getAdmin(w, r, s)
+}
+
+func (env *Env) adminDeleteUser(w HTMLWriter, r *http.Request, s session) {
+	u, ok := env.adminTarget(w, r, s)
+	if !ok {
+		return
+	}
+	if err := env.purgeUser(u); err != nil {
+		log.Printf("err: %v\n", err)
+		w.Status = http.StatusInternalServerError
+		w.WriteHeader()
+		return
+	}
+	log.Printf("admin: %s deleted %s\n", s.user.Username, u.Username)
+	env.getAdmin(w, r, s)
+}
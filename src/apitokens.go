@@ -0,0 +1,166 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+)
+
+// Tokens start with a prefix so they are easy to recognise in scripts and secret scanners
+const apiTokenPrefix = "cp_"
+
+var apiScopes = []string{"clips:read", "clips:write", "files:read", "files:write"}
+
+var (
+	ErrNoApiToken = errors.New("the token does not exist or it has expired")
+	ErrApiScope   = errors.New("the token does not have the scope of the route")
+	ErrApiRoute   = errors.New("the route can't be used with a token")
+)
+
+// bearerToken returns the API token in the Authorization header
+func bearerToken(r *http.Request) (string, bool) {
+	token, found := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return token, found && strings.HasPrefix(token, apiTokenPrefix)
+}
+
+// apiRoutes are the routes a token can use, by the pattern they are registered with, and the
+// scope each one needs. Every other route is refused: the account, shares, spaces and fetch codes
+// can't be managed with a token
+var apiRoutes = map[string]string{
+	"GET /clipboard":                                   "clips:read",
+	"GET /clipboard/new":                               "clips:read",
+	"GET /clipboard/{clipId}/qr":                       "clips:read",
+	"GET /clipboard/{clipId}/text":                     "clips:read",
+	"POST /clipboard/new":                              "clips:write",
+	"POST /clipboard/{clipId}/edit":                    "clips:write",
+	"DELETE /clipboard":                                "clips:write",
+	"DELETE /clipboard/all":                            "clips:write",
+	"GET /file":                                        "files:read",
+	"GET /file/download/{fileId}":                      "files:read",
+	"GET /file/versions/{fileId}":                      "files:read",
+	"GET /file/qr/{fileId}":                            "files:read",
+	"POST /file/new":                                   "files:write",
+	"POST /file/{fileId}/upload":                       "files:write",
+	"POST /file/{fileId}/move":                         "files:write",
+	"POST /file/versions/{fileId}/{versionId}/restore": "files:write",
+	"POST /folder/new":                                 "files:write",
+	"POST /folder/{folderId}/rename":                   "files:write",
+	"POST /folder/{folderId}/move":                     "files:write",
+	"DELETE /file":                                     "files:write",
+	"DELETE /folder/{folderId}":                        "files:write",
+}
+
+// apiScope returns the scope a token needs to use the route of r
+func apiScope(r *http.Request) (string, bool) {
+	scope, ok := apiRoutes[r.Pattern]
+	return scope, ok
+}
+
+// tokenSession authenticates r with its API token. The session is not stored,
+// it lives only for the request
+func (m *sessionMap) tokenSession(r *http.Request, token string) (session, error) {
+	scope, ok := apiScope(r)
+	if !ok {
+		return session{}, ErrApiRoute
+	}
+
+	t, err := m.dataManager.useApiToken(m.db, hashToken(token))
+	if errors.Is(err, pgx.ErrNoRows) {
+		return session{}, ErrNoApiToken
+	} else if err != nil {
+		return session{}, err
+	}
+	if !slices.Contains(t.Scopes, scope) {
+		return session{}, ErrApiScope
+	}
+
+	u, err := m.dataManager.userExists(m.db, t.Username)
+	if err != nil {
+		return session{}, err
+	}
+	if u.Disabled {
+		return session{}, ErrUserDisabled
+	}
+	return session{user: u, checked: time.Now()}, nil
+}
+
+// apiErrStatus returns the http status of an error from tokenSession
+func apiErrStatus(err error) int {
+	switch {
+	case errors.Is(err, ErrNoApiToken):
+		return http.StatusUnauthorized
+	case errors.Is(err, ErrApiScope), errors.Is(err, ErrApiRoute), errors.Is(err, ErrUserDisabled):
+		return http.StatusForbidden
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// POST //
+
+func (env *Env) postApiToken(w HTMLWriter, r *http.Request, s session) {
+	if err := r.ParseForm(); err != nil {
+		w.Status = http.StatusBadRequest
+		w.WriteHeader()
+		log.Printf("err: %v\n", err)
+		return
+	}
+	form := r.PostForm
+
+	t := apiToken{
+		Id:       uuid.New(),
+		Username: s.user.Username,
+		Name:     strings.TrimSpace(form.Get("name")),
+	}
+	for _, scope := range form["scope"] {
+		if slices.Contains(apiScopes, scope) && !slices.Contains(t.Scopes, scope) {
+			t.Scopes = append(t.Scopes, scope)
+		}
+	}
+	if t.Name == "" || len(t.Scopes) == 0 {
+		obj := env.userPage(s)
+		obj["TokenMessage"] = "A token needs a name and at least one scope"
+		sendTemplate(w, obj, "user", "./html/user.html")
+		return
+	}
+	if days, err := strconv.Atoi(form.Get("expires")); err == nil && days > 0 {
+		exp := time.Now().AddDate(0, 0, days)
+		t.ExpiresAt = &exp
+	}
+
+	token, err := newLinkToken()
+	if err == nil {
+		token = apiTokenPrefix + token
+		t.TokenHash = hashToken(token)
+		err = env.dataManager.insertApiToken(env.db, t)
+	}
+	if err != nil {
+		log.Printf("err: %v\n", err)
+		w.Status = http.StatusInternalServerError
+		w.WriteHeader()
+		return
+	}
+
+	obj := env.userPage(s)
+	obj["NewToken"] = token
+	sendTemplate(w, obj, "user", "./html/user.html")
+}
+
+// DELETE //
+
+func (env *Env) deleteApiToken(w HTMLWriter, r *http.Request, s session) {
+	if err := env.dataManager.deleteApiToken(env.db, s.user.Username, r.PathValue("tokenId")); err != nil {
+		log.Printf("err: %v\n", err)
+		w.Status = folderErrStatus(err)
+		w.WriteHeader()
+		return
+	}
+	env.getUser(w, r, s)
+}
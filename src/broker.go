@@ -2,24 +2,59 @@ package main
 
 import (
 	"sync"
+
+	"github.com/google/uuid"
 )
 
+// brokerEvent is what the streams receive. Scope tells which view changed (e.g. a folder),
+// Data is an optional message shown to the user
+type brokerEvent struct {
+	Scope string
+	Data  string
+}
+
+// eventBuffer is how many events a stream can fall behind before it misses some
+const eventBuffer = 16
+
+// subscription connects a stream to a channel. Every stream has its own, so the tabs of a session
+// each get all the events
+type subscription struct {
+	channel string
+	id      string
+	ch      chan brokerEvent
+}
+
+func newSubscription(channel string) subscription {
+	return subscription{channel, uuid.NewString(), make(chan brokerEvent, eventBuffer)}
+}
+
+// userChannel is the channel of the personal clipboard and files of a user
+func userChannel(username string) string {
+	return "user:" + username
+}
+
+// spaceChannel is the channel shared by the members of a space
+func spaceChannel(spaceId string) string {
+	return "space:" + spaceId
+}
+
+// brokerMap holds the streams of every channel, keyed by channel id and then by subscription id
 type brokerMap struct {
-	m map[string]map[string]chan int8
+	m map[string]map[string]chan brokerEvent
 	*sync.RWMutex
 }
 
 type EventBroker struct {
-	Subscribe   chan session
-	Unsubscribe chan session
+	Subscribe   chan subscription
+	Unsubscribe chan subscription
 	recipients  brokerMap
 }
 
 func NewEventBroker() EventBroker {
 	return EventBroker{
-		make(chan session),
-		make(chan session),
-		brokerMap{make(map[string]map[string]chan int8), &sync.RWMutex{}},
+		make(chan subscription),
+		make(chan subscription),
+		brokerMap{make(map[string]map[string]chan brokerEvent), &sync.RWMutex{}},
 	}
 }
 
@@ -27,18 +62,21 @@ func (brk *EventBroker) Init() {
 	go func() {
 		for {
 			select {
-			case s := <-brk.Subscribe:
+			case sub := <-brk.Subscribe:
 				brk.recipients.Lock()
-				if m, ok := brk.recipients.m[s.user.Username]; ok {
-					m[s.cookie.Value] = s.clipEvtCh
+				if m, ok := brk.recipients.m[sub.channel]; ok {
+					m[sub.id] = sub.ch
 				} else {
-					brk.recipients.m[s.user.Username] = map[string]chan int8{s.cookie.Value: s.clipEvtCh}
+					brk.recipients.m[sub.channel] = map[string]chan brokerEvent{sub.id: sub.ch}
 				}
 				brk.recipients.Unlock()
-			case s := <-brk.Unsubscribe:
+			case sub := <-brk.Unsubscribe:
 				brk.recipients.Lock()
-				if m, ok := brk.recipients.m[s.user.Username]; ok {
-					delete(m, s.cookie.Value)
+				if m, ok := brk.recipients.m[sub.channel]; ok {
+					delete(m, sub.id)
+					if len(m) == 0 {
+						delete(brk.recipients.m, sub.channel)
+					}
 				}
 				brk.recipients.Unlock()
 			}
@@ -46,10 +84,21 @@ func (brk *EventBroker) Init() {
 	}()
 }
 
-func (brk *EventBroker) Publish(receiver string, value int8) {
+// Publish notifies every stream subscribed to the receiver channel. The value is the scope of the event
+// (e.g. the folder that changed) and can be left empty when it is not needed
+func (brk *EventBroker) Publish(receiver string, value string) {
+	brk.PublishEvent(receiver, brokerEvent{Scope: value})
+}
+
+// PublishEvent never blocks: a stream that is too slow to keep up with eventBuffer events
+// misses the next ones, the others still get them
+func (brk *EventBroker) PublishEvent(receiver string, evt brokerEvent) {
 	brk.recipients.RLock()
 	defer brk.recipients.RUnlock()
 	for _, ch := range brk.recipients.m[receiver] {
-		ch <- value
+		select {
+		case ch <- evt:
+		default:
+		}
 	}
 }
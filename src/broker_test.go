@@ -0,0 +1,44 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// Two tabs of the same session each have a stream, both get every event
+func TestBrokerStreams(t *testing.T) {
+	brk := NewEventBroker()
+	brk.Init()
+	// The broker handles one request at a time, the next one is received once the previous is done
+	settle := func() { brk.Unsubscribe <- newSubscription("none") }
+	tab1, tab2 := newSubscription(userChannel("alice")), newSubscription(userChannel("alice"))
+	brk.Subscribe <- tab1
+	brk.Subscribe <- tab2
+	settle()
+
+	brk.Publish(userChannel("alice"), "root")
+	for i, sub := range []subscription{tab1, tab2} {
+		select {
+		case evt := <-sub.ch:
+			if evt.Scope != "root" {
+				t.Errorf("stream %d got %+v", i+1, evt)
+			}
+		case <-time.After(time.Second):
+			t.Errorf("stream %d got nothing", i+1)
+		}
+	}
+
+	brk.Unsubscribe <- tab1
+	settle()
+	brk.Publish(userChannel("alice"), "root")
+	select {
+	case <-tab2.ch:
+	case <-time.After(time.Second):
+		t.Error("the other stream stopped with the closed one")
+	}
+	select {
+	case evt := <-tab1.ch:
+		t.Errorf("a closed stream got %+v", evt)
+	default:
+	}
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"net/http"
+	"net/url"
+	"os"
+)
+
+// The pages send the token of their session in this header, index.html adds it to every HTMX request
+const csrfHeader = "X-CSRF-Token"
+
+// csrfToken returns the token that requests of the session with the given cookie must send.
+// It's derived from the cookie, so every instance can check it, and pages can't read the cookie
+func csrfToken(cookie string) string {
+	if cookie == "" {
+		return ""
+	}
+	mac := hmac.New(sha256.New, []byte(cookie))
+	mac.Write([]byte("csrf"))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// safeMethod reports whether the method of r doesn't change anything
+func safeMethod(r *http.Request) bool {
+	return r.Method == http.MethodGet || r.Method == http.MethodHead || r.Method == http.MethodOptions
+}
+
+// sameOrigin reports whether r was sent by a page of the instance. Browsers send Origin with
+// every POST and DELETE, requests without it and without Sec-Fetch-Site come from scripts
+func sameOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		site := r.Header.Get("Sec-Fetch-Site")
+		return site == "" || site == "same-origin" || site == "none"
+	}
+
+	u, err := url.Parse(origin)
+	if err != nil || u.Host == "" {
+		return false // "null" is sent by sandboxed frames and privacy sensitive redirects
+	}
+	if base := os.Getenv("PUBLIC_URL"); base != "" {
+		if p, err := url.Parse(base); err == nil && p.Scheme == u.Scheme && p.Host == u.Host {
+			return true
+		}
+	}
+	return u.Host == r.Host
+}
+
+// allowCsrf checks the requests that change something: they must come from the instance and,
+// when cookie is not empty, carry the token of its session.
+// If it returns false the response has already been sent
+func allowCsrf(w HTMLWriter, r *http.Request, cookie string) bool {
+	if safeMethod(r) {
+		return true
+	}
+	if sameOrigin(r) {
+		token := csrfToken(cookie)
+		if token == "" || subtle.ConstantTimeCompare([]byte(r.Header.Get(csrfHeader)), []byte(token)) == 1 {
+			return true
+		}
+	}
+
+	// Only pages of the instance can send HTMX requests, the page has an old token: reload it
+	if isHTMX(r) && sameOrigin(r) {
+		w.Writer.Header().Set("HX-Refresh", "true")
+	}
+	w.Status = http.StatusForbidden
+	w.WriteHeader()
+	return false
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/google/uuid"
+)
+
+func TestCsrfToken(t *testing.T) {
+	if csrfToken("") != "" {
+		t.Error("a request without a session has a token")
+	}
+	if csrfToken("cookie") != csrfToken("cookie") {
+		t.Error("the token of a session changes")
+	}
+	if csrfToken("cookie") == csrfToken("other cookie") || csrfToken("cookie") == "cookie" {
+		t.Error("the token doesn't depend on the session only")
+	}
+}
+
+func TestSameOrigin(t *testing.T) {
+	tests := []struct {
+		name      string
+		publicURL string
+		host      string
+		origin    string
+		fetchSite string
+		want      bool
+	}{
+		{"same host", "", "copypaste.example.com", "https://copypaste.example.com", "", true},
+		{"other host", "", "copypaste.example.com", "https://evil.example.com", "", false},
+		{"other port", "", "copypaste.example.com", "https://copypaste.example.com:8443", "", false},
+		{"null origin", "", "copypaste.example.com", "null", "", false},
+		{"script", "", "copypaste.example.com", "", "", true},
+		{"no origin, same origin", "", "copypaste.example.com", "", "same-origin", true},
+		{"no origin, typed in", "", "copypaste.example.com", "", "none", true},
+		{"no origin, cross site", "", "copypaste.example.com", "", "cross-site", false},
+		{"no origin, same site", "", "copypaste.example.com", "", "same-site", false},
+		{"behind a proxy", "https://copypaste.example.com", "app:8080", "https://copypaste.example.com", "", true},
+		{"behind a proxy, other scheme", "https://copypaste.example.com", "app:8080", "http://copypaste.example.com", "", false},
+		{"behind a proxy, other host", "https://copypaste.example.com", "app:8080", "https://evil.example.com", "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("PUBLIC_URL", tt.publicURL)
+			r := httptest.NewRequest("POST", "/clipboard/new", nil)
+			r.Host = tt.host
+			if tt.origin != "" {
+				r.Header.Set("Origin", tt.origin)
+			}
+			if tt.fetchSite != "" {
+				r.Header.Set("Sec-Fetch-Site", tt.fetchSite)
+			}
+			if got := sameOrigin(r); got != tt.want {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAllowCsrf(t *testing.T) {
+	const cookie = "session cookie"
+	tests := []struct {
+		name    string
+		method  string
+		origin  string
+		token   string
+		cookie  string
+		htmx    bool
+		allow   bool
+		refresh bool
+	}{
+		{"get from another site", "GET", "https://evil.example.com", "", cookie, false, true, false},
+		{"post with the token", "POST", "https://copypaste.example.com", csrfToken(cookie), cookie, false, true, false},
+		{"delete with the token", "DELETE", "https://copypaste.example.com", csrfToken(cookie), cookie, true, true, false},
+		{"post without the token", "POST", "https://copypaste.example.com", "", cookie, false, false, false},
+		{"htmx with an old token", "POST", "https://copypaste.example.com", csrfToken("old cookie"), cookie, true, false, true},
+		{"another site with the token", "POST", "https://evil.example.com", csrfToken(cookie), cookie, true, false, false},
+		{"login form", "POST", "https://copypaste.example.com", "", "", false, true, false},
+		{"login form from another site", "POST", "https://evil.example.com", "", "", false, false, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(tt.method, "https://copypaste.example.com/clipboard", nil)
+			r.Header.Set("Origin", tt.origin)
+			if tt.token != "" {
+				r.Header.Set(csrfHeader, tt.token)
+			}
+			if tt.htmx {
+				r.Header.Set("HX-Request", "true")
+			}
+			rec := httptest.NewRecorder()
+			if got := allowCsrf(HTMLWriter{Writer: rec, Status: http.StatusOK}, r, tt.cookie); got != tt.allow {
+				t.Fatalf("got %v, want %v", got, tt.allow)
+			}
+			if !tt.allow && rec.Code != http.StatusForbidden {
+				t.Errorf("status %d", rec.Code)
+			}
+			if refresh := rec.Header().Get("HX-Refresh") == "true"; refresh != tt.refresh {
+				t.Errorf("HX-Refresh %v, want %v", refresh, tt.refresh)
+			}
+		})
+	}
+}
+
+// The wrapper of the routes checks the token of cookie sessions, API tokens can't be sent by a browser on its own
+func TestHandlerWrapperCsrf(t *testing.T) {
+	alice := user{Username: "alice", Id: uuid.New()}
+	db := newFakeDb(alice)
+	useSessions(t, db)
+	const token = apiTokenPrefix + "token"
+	db.tokens[hashToken(token)] = apiToken{Id: uuid.New(), Username: "alice", Scopes: []string{"clips:write"}}
+
+	cookie, err := sessions.create(httptest.NewRequest("POST", "/login", nil), alice, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	called := 0
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /clipboard/new", handlerWrapper(func(w HTMLWriter, r *http.Request, s session) {
+		called++
+		w.WriteHeader()
+	}))
+
+	tests := []struct {
+		name   string
+		origin string
+		header map[string]string
+		cookie bool
+		status int
+	}{
+		{"session with the token", "https://copypaste.example.com", map[string]string{csrfHeader: csrfToken(cookie.Value)}, true, http.StatusOK},
+		{"session without the token", "https://copypaste.example.com", nil, true, http.StatusForbidden},
+		{"session from another site", "https://evil.example.com", map[string]string{csrfHeader: csrfToken(cookie.Value)}, true, http.StatusForbidden},
+		{"api token", "", map[string]string{"Authorization": "Bearer " + token}, false, http.StatusOK},
+		{"api token from another site", "https://evil.example.com", map[string]string{"Authorization": "Bearer " + token}, false, http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			before := called
+			r := httptest.NewRequest("POST", "https://copypaste.example.com/clipboard/new", nil)
+			if tt.origin != "" {
+				r.Header.Set("Origin", tt.origin)
+			}
+			for k, v := range tt.header {
+				r.Header.Set(k, v)
+			}
+			if tt.cookie {
+				r.AddCookie(cookie)
+			}
+			rec := httptest.NewRecorder()
+			mux.ServeHTTP(rec, r)
+			if rec.Code != tt.status {
+				t.Fatalf("status %d, want %d", rec.Code, tt.status)
+			}
+			if ran := called > before; ran != (tt.status == http.StatusOK) {
+				t.Errorf("the handler ran: %v", ran)
+			}
+		})
+	}
+}
@@ -2,8 +2,12 @@ package main
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"strings"
+	"time"
 
+	"github.com/go-webauthn/webauthn/webauthn"
 	"github.com/google/uuid"
 	"github.com/jackc/pgx/v5"
 	"github.com/jackc/pgx/v5/pgxpool"
@@ -13,41 +17,438 @@ type clipboard struct {
 	Text     string `db:"clip_text"`
 	Username string
 	Id       uuid.UUID
+	SpaceId  *uuid.UUID `db:"space_id"` // nil for personal clips
 }
 
 type file struct {
 	Filename string
 	Username string
 	Id       uuid.UUID
+	Folder   *uuid.UUID
+	SpaceId  *uuid.UUID `db:"space_id"` // nil for personal files
 }
 
-type user struct {
+// fileVersion is a single upload of a file. Its id is also the name of the blob inside filedir
+type fileVersion struct {
+	Id        uuid.UUID
+	FileId    uuid.UUID `db:"file_id"`
+	Version   int32
+	Size      int64
+	CreatedAt time.Time `db:"created_at"`
+	Checksum  *string   // hex encoded sha256 of the blob, nil until the blob has been written
+
+	ScanStatus string  `db:"scan_status"`
+	ScanReason *string `db:"scan_reason"`
+
+	UploadLinkId *uuid.UUID `db:"upload_link_id"` // the upload link of a guest upload
+}
+
+// listedFile is a file together with the scan result of its latest version
+type listedFile struct {
+	file
+	ScanStatus string  `db:"scan_status"`
+	ScanReason *string `db:"scan_reason"`
+}
+
+// blobRef links a file version to the directory of its owner, it is used to check the storage.
+// For the files of a space UserId is the id of the space, which names its directory
+type blobRef struct {
+	Id         uuid.UUID
+	UserId     uuid.UUID `db:"user_id"`
+	CreatedAt  time.Time `db:"created_at"`
+	Checksum   *string
+	ScanStatus string `db:"scan_status"`
+}
+
+const (
+	scanPending  = "pending"
+	scanClean    = "clean"
+	scanInfected = "infected"
+	scanError    = "error"   // the scanner refused the blob too many times, it stays in quarantine
+	scanCorrupt  = "corrupt" // the blob doesn't match the checksum, set by fsck
+)
+
+type folder struct {
+	Name     string
 	Username string
-	Password string
 	Id       uuid.UUID
+	Parent   *uuid.UUID
+}
+
+// folderOption is a folder identified by its full path, used to pick a destination when moving
+type folderOption struct {
+	Id   uuid.UUID
+	Path string
+}
+
+var ErrInvalidMove = errors.New("the destination folder is not valid")
+
+// shareLink gives access to a clip or a file without logging in
+type shareLink struct {
+	Id        uuid.UUID
+	Token     string
+	Username  string
+	ClipId    *uuid.UUID `db:"clip_id"`
+	FileId    *uuid.UUID `db:"file_id"`
+	Password  *string    // hashed, nil when the link is not protected
+	ExpiresAt *time.Time `db:"expires_at"`
+	MaxUses   *int32     `db:"max_uses"`
+	Uses      int32
+	CreatedAt time.Time  `db:"created_at"`
+	RevokedAt *time.Time `db:"revoked_at"`
+}
+
+// listedShareLink is a share link with the name of the shared item and the number of recorded accesses
+type listedShareLink struct {
+	shareLink
+	Item     string
+	Accesses int64
+}
+
+type shareAccess struct {
+	Id         uuid.UUID
+	LinkId     uuid.UUID `db:"link_id"`
+	AccessedAt time.Time `db:"accessed_at"`
+	Ip         string
+	UserAgent  string `db:"user_agent"`
+	Outcome    string
+}
+
+// secret is a one-time clip, it is deleted when it's read
+type secret struct {
+	Id        uuid.UUID
+	TokenHash string `db:"token_hash"`
+	Username  string
+	Label     string
+	Text      string    `db:"secret_text"`
+	CreatedAt time.Time `db:"created_at"`
+	ExpiresAt time.Time `db:"expires_at"`
+}
+
+// storedSession is a login saved in the database, with the device it comes from
+type storedSession struct {
+	Id         uuid.UUID
+	TokenHash  string `db:"token_hash"`
+	Username   string
+	CreatedAt  time.Time `db:"created_at"`
+	LastSeenAt time.Time `db:"last_seen_at"`
+	ExpiresAt  time.Time `db:"expires_at"`
+	UserAgent  string    `db:"user_agent"`
+	Ip         string
+}
+
+// totpSecret is the second factor of a user, Secret is encrypted
+type totpSecret struct {
+	Username    string
+	Secret      string
+	ConfirmedAt *time.Time `db:"confirmed_at"` // nil until the user has entered a first code
+	LastStep    int64      `db:"last_step"`
+	CreatedAt   time.Time  `db:"created_at"`
+}
+
+// loginChallenge is a login that checked the password and waits for the second factor
+type loginChallenge struct {
+	TokenHash string `db:"token_hash"`
+	Username  string
+	Remember  bool
+	Attempts  int32
+	ExpiresAt time.Time `db:"expires_at"`
+}
+
+// uploadLink lets people without an account upload files into a folder of a user
+type uploadLink struct {
+	Id        uuid.UUID
+	Token     string
+	Username  string
+	Label     string
+	Folder    *uuid.UUID // nil for the root folder
+	Password  *string    // hashed, nil when the link is not protected
+	ExpiresAt *time.Time `db:"expires_at"`
+	MaxFiles  *int32     `db:"max_files"`
+	MaxSize   *int64     `db:"max_size"` // bytes, for every file
+	Uploads   int32
+	CreatedAt time.Time  `db:"created_at"`
+	RevokedAt *time.Time `db:"revoked_at"`
+}
+
+// listedUploadLink is an upload link with the name of its folder
+type listedUploadLink struct {
+	uploadLink
+	FolderName *string `db:"folder_name"`
+}
+
+// grant gives another user access to a clip or a file
+type grant struct {
+	Id        uuid.UUID
+	Owner     string
+	Grantee   string
+	ClipId    *uuid.UUID `db:"clip_id"`
+	FileId    *uuid.UUID `db:"file_id"`
+	CanWrite  bool       `db:"can_write"`
+	CreatedAt time.Time  `db:"created_at"`
+}
+
+// sharedClip is a clip that the user can access, either as the owner or through a grant
+type sharedClip struct {
+	clipboard
+	CanWrite bool `db:"can_write"`
+}
+
+type sharedFile struct {
+	listedFile
+	CanWrite bool `db:"can_write"`
+}
+
+// space is a clipboard and a file area shared by a group of users
+type space struct {
+	Id        uuid.UUID
+	Name      string
+	CreatedAt time.Time `db:"created_at"`
+}
+
+// memberSpace is a space together with the role of the user in it
+type memberSpace struct {
+	space
+	Role string
+}
+
+type spaceMember struct {
+	SpaceId  uuid.UUID `db:"space_id"`
+	Username string
+	Role     string
+	JoinedAt time.Time `db:"joined_at"`
+}
+
+const (
+	roleOwner  = "owner"
+	roleEditor = "editor"
+	roleViewer = "viewer"
+)
+
+var ErrLastOwner = errors.New("a space needs at least one owner")
+
+type user struct {
+	Username    string
+	Password    string
+	Id          uuid.UUID
+	Email       *string // where password reset links are sent, nil if the user has not set one
+	Role        string  // "user" or "admin"
+	Disabled    bool
+	LastLoginAt *time.Time
+}
+
+// adminUser is a row of the user list of the admin console
+type adminUser struct {
+	Username    string
+	Id          uuid.UUID
+	Role        string
+	Disabled    bool
+	LastLoginAt *time.Time
+	Storage     int64 // the size of the versions of the files of the user, without spaces
+	Sessions    int64
+}
+
+// passkey is a WebAuthn credential of a user, Id is the id of the credential
+type passkey struct {
+	Id         []byte
+	Username   string
+	Name       string
+	Credential webauthn.Credential
+	CreatedAt  time.Time  `db:"created_at"`
+	LastUsedAt *time.Time `db:"last_used_at"`
+}
+
+// passkeyChallenge is the state of a WebAuthn registration or login between its two requests
+type passkeyChallenge struct {
+	Id        uuid.UUID
+	SessionId *uuid.UUID `db:"session_id"`
+	Data      webauthn.SessionData
+	ExpiresAt time.Time `db:"expires_at"`
+}
+
+// apiToken is a bearer token that lets scripts use the routes allowed by its scopes
+type apiToken struct {
+	Id         uuid.UUID
+	TokenHash  string `db:"token_hash"`
+	Username   string
+	Name       string
+	Scopes     []string
+	CreatedAt  time.Time  `db:"created_at"`
+	ExpiresAt  *time.Time `db:"expires_at"`
+	LastUsedAt *time.Time `db:"last_used_at"`
+}
+
+// oidcLogin is a login sent to the identity provider, the state is stored as its sha256 hash
+type oidcLogin struct {
+	StateHash string `db:"state_hash"`
+	Verifier  string // PKCE code verifier
+	Nonce     string
+	Remember  bool
+	ExpiresAt time.Time `db:"expires_at"`
+}
+
+// invite lets one person sign up when registration is invite-only, the code is stored as its sha256 hash
+type invite struct {
+	Id        uuid.UUID
+	CodeHash  string     `db:"code_hash"`
+	CreatedBy string     `db:"created_by"`
+	CreatedAt time.Time  `db:"created_at"`
+	ExpiresAt time.Time  `db:"expires_at"`
+	UsedBy    *string    `db:"used_by"`
+	UsedAt    *time.Time `db:"used_at"`
 }
 
 type dbData interface {
 	// TODO: put named arguments
-	allClips(*pgxpool.Pool) ([]clipboard, error)
+	allClips(db *pgxpool.Pool, user string) ([]clipboard, error)
 	insertClip(*pgxpool.Pool, string, string) error
 	deleteClips(*pgxpool.Pool, string, ...string) error
 	deleteAllClips(*pgxpool.Pool, string) error
+	userClip(db *pgxpool.Pool, user string, id string) (clipboard, error)
+	updateClip(db *pgxpool.Pool, id string, text string) error
+
+	insertFile(db *pgxpool.Pool, user string, filename string, folder string, size int64, scanStatus string, uploadLink *uuid.UUID) (string, string, error)
+	insertGuestFile(db *pgxpool.Pool, user string, filename string, folder string, size int64, scanStatus string, uploadLink uuid.UUID) (string, string, string, error)
+	allFiles(db *pgxpool.Pool, user string, folder string) ([]listedFile, error)
+	userFile(db *pgxpool.Pool, user string, id string) (file, error)
+	moveFile(db *pgxpool.Pool, user string, id string, folder string) (file, error)
+	deleteFiles(db *pgxpool.Pool, user string, ids ...string) ([]file, []string, error)
 
-	insertFile(db *pgxpool.Pool, user string, filename string) (string, error)
-	allFiles(db *pgxpool.Pool, user string) ([]file, error)
-	fileName(db *pgxpool.Pool, user string, id string) (string, error)
-	deleteFiles(db *pgxpool.Pool, user string, ids ...string) error
+	fileVersions(db *pgxpool.Pool, user string, fileId string) ([]fileVersion, error)
+	fileVersion(db *pgxpool.Pool, user string, fileId string, versionId string) (fileVersion, error)
+	insertVersion(db *pgxpool.Pool, user string, fileId string, versionId string, size int64, checksum *string, scanStatus string) error
+	setChecksum(db *pgxpool.Pool, versionId string, checksum string) error
+	allBlobs(db *pgxpool.Pool) ([]blobRef, error)
+	pendingScans(db *pgxpool.Pool, olderThan time.Time) ([]blobRef, error)
+	setScanResult(db *pgxpool.Pool, versionId string, status string, reason string) (file, error)
+	scanFailed(db *pgxpool.Pool, versionId string) (int, error)
+	deleteVersions(db *pgxpool.Pool, ids ...string) error
+	emptyFiles(db *pgxpool.Pool) ([]string, error)
+	deleteEmptyFiles(db *pgxpool.Pool) ([]string, error)
 
+	insertFolder(db *pgxpool.Pool, user string, name string, parent string) (string, error)
+	folder(db *pgxpool.Pool, user string, id string) (folder, error)
+	subFolders(db *pgxpool.Pool, user string, parent string) ([]folder, error)
+	folderPath(db *pgxpool.Pool, user string, id string) ([]folder, error)
+	allFolders(db *pgxpool.Pool, user string) ([]folderOption, error)
+	renameFolder(db *pgxpool.Pool, user string, id string, name string) error
+	moveFolder(db *pgxpool.Pool, user string, id string, parent string) error
+	deleteFolder(db *pgxpool.Pool, user string, id string) ([]string, error)
+
+	insertShareLink(db *pgxpool.Pool, link shareLink) error
+	userShareLinks(db *pgxpool.Pool, user string) ([]listedShareLink, error)
+	shareLink(db *pgxpool.Pool, token string) (shareLink, error)
+	userShareLink(db *pgxpool.Pool, user string, id string) (shareLink, error)
+	consumeShareLink(db *pgxpool.Pool, token string) (shareLink, error)
+	revokeShareLink(db *pgxpool.Pool, user string, id string) error
+	insertShareAccess(db *pgxpool.Pool, linkId uuid.UUID, ip string, userAgent string, outcome string) error
+	shareAccesses(db *pgxpool.Pool, user string, linkId string) ([]shareAccess, error)
+
+	insertUploadLink(db *pgxpool.Pool, link uploadLink) error
+	userUploadLinks(db *pgxpool.Pool, user string) ([]listedUploadLink, error)
+	userUploadLink(db *pgxpool.Pool, user string, id string) (uploadLink, error)
+	uploadLink(db *pgxpool.Pool, token string) (uploadLink, error)
+	consumeUploadLink(db *pgxpool.Pool, token string) (uploadLink, error)
+	revokeUploadLink(db *pgxpool.Pool, user string, id string) error
+
+	insertSecret(db *pgxpool.Pool, sec secret) error
+	userSecrets(db *pgxpool.Pool, user string) ([]secret, error)
+	secretExists(db *pgxpool.Pool, tokenHash string) (bool, error)
+	readSecret(db *pgxpool.Pool, tokenHash string) (secret, error)
+	deleteSecret(db *pgxpool.Pool, user string, id string) error
+	deleteExpiredSecrets(db *pgxpool.Pool) error
+
+	insertFetchCode(db *pgxpool.Pool, user string, clipId string, code string, expiresAt time.Time) error
+	fetchClip(db *pgxpool.Pool, code string) (clipboard, error)
+	deleteFetchCode(db *pgxpool.Pool, user string, clipId string) error
+	deleteExpiredFetchCodes(db *pgxpool.Pool) error
+
+	insertGrant(db *pgxpool.Pool, g grant) error
+	itemGrants(db *pgxpool.Pool, owner string, clipId string, fileId string) ([]grant, error)
+	grantees(db *pgxpool.Pool, clipId string, fileId string) ([]string, error)
+	deleteGrant(db *pgxpool.Pool, owner string, id string) (grant, error)
+	sharedClips(db *pgxpool.Pool, user string) ([]sharedClip, error)
+	sharedFiles(db *pgxpool.Pool, user string) ([]sharedFile, error)
+	clipAccess(db *pgxpool.Pool, user string, id string) (sharedClip, error)
+	fileAccess(db *pgxpool.Pool, user string, id string) (sharedFile, error)
+
+	insertSpace(db *pgxpool.Pool, name string, owner string) (string, error)
+	allSpaces(db *pgxpool.Pool) ([]space, error)
+	userSpaces(db *pgxpool.Pool, user string) ([]memberSpace, error)
+	userSpace(db *pgxpool.Pool, user string, spaceId string) (memberSpace, error)
+	deleteSpace(db *pgxpool.Pool, spaceId string) ([]string, error)
+	spaceMembers(db *pgxpool.Pool, spaceId string) ([]spaceMember, error)
+	setSpaceMember(db *pgxpool.Pool, spaceId string, user string, role string) error
+	removeSpaceMember(db *pgxpool.Pool, spaceId string, user string) error
+	memberClip(db *pgxpool.Pool, user string, id string) (clipboard, error)
+	memberFile(db *pgxpool.Pool, user string, id string) (file, error)
+	spaceClips(db *pgxpool.Pool, spaceId string) ([]clipboard, error)
+	insertSpaceClip(db *pgxpool.Pool, spaceId string, user string, text string) error
+	deleteSpaceClip(db *pgxpool.Pool, spaceId string, id string) error
+	spaceFiles(db *pgxpool.Pool, spaceId string) ([]listedFile, error)
+	insertSpaceFile(db *pgxpool.Pool, spaceId string, user string, filename string, size int64, scanStatus string) (string, string, error)
+	spaceFile(db *pgxpool.Pool, spaceId string, fileId string) (file, fileVersion, error)
+	deleteSpaceFile(db *pgxpool.Pool, spaceId string, fileId string) ([]string, error)
+
+	insertSession(db *pgxpool.Pool, sess storedSession) error
+	touchSession(db *pgxpool.Pool, tokenHash string, ip string) (storedSession, error)
+	deleteSession(db *pgxpool.Pool, tokenHash string) error
+	userSessions(db *pgxpool.Pool, user string) ([]storedSession, error)
+	deleteUserSession(db *pgxpool.Pool, user string, id string) error
+	deleteOtherSessions(db *pgxpool.Pool, user string, keepId string) error
+	deleteExpiredSessions(db *pgxpool.Pool) error
+
+	setTotpSecret(db *pgxpool.Pool, user string, secret string) error
+	totpSecret(db *pgxpool.Pool, user string) (totpSecret, error)
+	useTotpStep(db *pgxpool.Pool, user string, step int64) (bool, error)
+	confirmTotp(db *pgxpool.Pool, user string, codeHashes []string) error
+	replaceRecoveryCodes(db *pgxpool.Pool, user string, codeHashes []string) error
+	useRecoveryCode(db *pgxpool.Pool, user string, codeHash string) (bool, error)
+	deleteTotp(db *pgxpool.Pool, user string) error
+	insertLoginChallenge(db *pgxpool.Pool, c loginChallenge) error
+	attemptLoginChallenge(db *pgxpool.Pool, tokenHash string, maxAttempts int) (loginChallenge, error)
+	deleteLoginChallenge(db *pgxpool.Pool, tokenHash string) error
+	insertPasskey(db *pgxpool.Pool, p passkey) error
+	userPasskeys(db *pgxpool.Pool, user string) ([]passkey, error)
+	passkey(db *pgxpool.Pool, id []byte) (passkey, error)
+	usePasskey(db *pgxpool.Pool, id []byte, cred webauthn.Credential) error
+	deletePasskey(db *pgxpool.Pool, user string, id []byte) error
+	insertPasskeyChallenge(db *pgxpool.Pool, c passkeyChallenge) error
+	takePasskeyChallenge(db *pgxpool.Pool, id string, sessionId *uuid.UUID) (passkeyChallenge, error)
+	insertApiToken(db *pgxpool.Pool, t apiToken) error
+	userApiTokens(db *pgxpool.Pool, user string) ([]apiToken, error)
+	useApiToken(db *pgxpool.Pool, tokenHash string) (apiToken, error)
+	deleteApiToken(db *pgxpool.Pool, user string, id string) error
+
+	allUsers(db *pgxpool.Pool) ([]user, error)
 	userExists(db *pgxpool.Pool, user string) (user, error)
 	insertUser(db *pgxpool.Pool, user string, password string) error
-	deleteUser(db *pgxpool.Pool, user string) error
+	insertInvitedUser(db *pgxpool.Pool, user string, password string, codeHash string) error
+	insertInvite(db *pgxpool.Pool, i invite) error
+	userInvites(db *pgxpool.Pool, user string) ([]invite, error)
+	deleteInvite(db *pgxpool.Pool, user string, id string) error
+	updatePassword(db *pgxpool.Pool, user string, password string) error
+	rehashPassword(db *pgxpool.Pool, user string, oldHash string, newHash string) error
+	setEmail(db *pgxpool.Pool, user string, email *string) error
+	insertPasswordReset(db *pgxpool.Pool, user string, tokenHash string, expiresAt time.Time) error
+	passwordReset(db *pgxpool.Pool, tokenHash string) (string, error)
+	resetPassword(db *pgxpool.Pool, tokenHash string, password string) (string, error)
+	insertOidcLogin(db *pgxpool.Pool, l oidcLogin) error
+	takeOidcLogin(db *pgxpool.Pool, stateHash string) (oidcLogin, error)
+	oidcUser(db *pgxpool.Pool, issuer string, subject string) (user, error)
+	provisionOidcUser(db *pgxpool.Pool, username string, issuer string, subject string) (user, error)
+	deleteUser(db *pgxpool.Pool, user string) (map[string][]string, error)
+	userById(db *pgxpool.Pool, id string) (user, error)
+	adminUsers(db *pgxpool.Pool) ([]adminUser, error)
+	setRole(db *pgxpool.Pool, user string, role string) error
+	setDisabled(db *pgxpool.Pool, user string, disabled bool) error
+	deleteUserSessions(db *pgxpool.Pool, user string) error
 }
 
 type defaultDbData struct{}
 
-func (defaultDbData) allClips(db *pgxpool.Pool) ([]clipboard, error) {
-	rows, err := db.Query(context.Background(), "SELECT * FROM clipboard")
+func (defaultDbData) allClips(db *pgxpool.Pool, user string) ([]clipboard, error) {
+	rows, err := db.Query(context.Background(), "SELECT * FROM clipboard WHERE username=$1 AND space_id IS NULL", user)
 	if err != nil {
 		return []clipboard{}, err
 	}
@@ -74,7 +475,7 @@ func (defaultDbData) deleteClips(db *pgxpool.Pool, user string, ids ...string) e
 	}
 
 	idSet := strings.Join(ids, ",")
-	query := "DELETE FROM clipboard WHERE username=$1 AND id IN ($2)"
+	query := "DELETE FROM clipboard WHERE username=$1 AND space_id IS NULL AND id IN ($2)"
 	if _, err := db.Exec(context.Background(), query, user, idSet); err != nil {
 		return err
 	}
@@ -82,97 +483,1829 @@ func (defaultDbData) deleteClips(db *pgxpool.Pool, user string, ids ...string) e
 }
 
 func (defaultDbData) deleteAllClips(db *pgxpool.Pool, user string) error {
-	query := "DELETE FROM clipboard WHERE username=$1"
+	query := "DELETE FROM clipboard WHERE username=$1 AND space_id IS NULL"
 	if _, err := db.Exec(context.Background(), query, user); err != nil {
 		return err
 	}
 	return nil
 }
 
-func (defaultDbData) insertFile(db *pgxpool.Pool, user string, filename string) (string, error) {
-	// INFO: The db simply stores the reference to a file, so there's no need to update when an existing name is inserted
-	id := uuid.New()
-	query := "INSERT INTO files (filename, username, id) VALUES ($1, $2, $3) ON CONFLICT DO NOTHING"
-	if _, err := db.Exec(context.Background(), query, filename, user, id); err != nil {
-		return "", err
+// userClip returns a personal clip of user
+func (defaultDbData) userClip(db *pgxpool.Pool, user string, id string) (clipboard, error) {
+	rows, err := db.Query(context.Background(), "SELECT * FROM clipboard WHERE username=$1 AND id=$2 AND space_id IS NULL", user, id)
+	if err != nil {
+		return clipboard{}, err
 	}
+	return pgx.CollectExactlyOneRow(rows, pgx.RowToStructByName[clipboard])
+}
 
-	s := ""
-	query = "SELECT id FROM files WHERE username=$1 AND filename=$2"
-	row := db.QueryRow(context.Background(), query, user, filename)
-	if err := row.Scan(&s); err != nil {
-		return "", err
+func (defaultDbData) updateClip(db *pgxpool.Pool, id string, text string) error {
+	if _, err := db.Exec(context.Background(), "UPDATE clipboard SET clip_text=$2 WHERE id=$1", id, text); err != nil {
+		return err
+	}
+	return nil
+}
+
+// insertFile adds a new version to the file called filename in folder, creating the file if needed.
+// uploadLink is the link the upload comes from, nil for the uploads of user
+func (defaultDbData) insertFile(db *pgxpool.Pool, user string, filename string, folder string, size int64, scanStatus string, uploadLink *uuid.UUID) (string, string, error) {
+	ctx := context.Background()
+	tx, err := db.Begin(ctx)
+	if err != nil {
+		return "", "", err
+	}
+	defer tx.Rollback(ctx)
+
+	// The no-op update locks the existing row, so concurrent uploads get consecutive versions
+	fileId := ""
+	query := `INSERT INTO files (filename, username, id, folder) VALUES ($1, $2, $3, $4)
+		ON CONFLICT (username, folder, filename) WHERE space_id IS NULL DO UPDATE SET filename=EXCLUDED.filename
+		RETURNING id::text`
+	row := tx.QueryRow(ctx, query, filename, user, uuid.New(), nullableId(folder))
+	if err := row.Scan(&fileId); err != nil {
+		return "", "", err
+	}
+
+	versionId := uuid.New()
+	query = `INSERT INTO file_versions (id, file_id, version, size, scan_status, upload_link_id)
+		SELECT $1, $2, COALESCE(MAX(version), 0)+1, $3, $4, $5 FROM file_versions WHERE file_id=$2`
+	if _, err := tx.Exec(ctx, query, versionId, fileId, size, scanStatus, uploadLink); err != nil {
+		return "", "", err
+	}
+
+	return fileId, versionId.String(), tx.Commit(ctx)
+}
+
+// insertGuestFile creates a new file like insertFile, but it never adds a version to an existing one:
+// when the name is taken it's numbered as "name (1).ext". It also returns the name that was used
+func (defaultDbData) insertGuestFile(db *pgxpool.Pool, user string, filename string, folder string, size int64, scanStatus string, uploadLink uuid.UUID) (string, string, string, error) {
+	ctx := context.Background()
+	tx, err := db.Begin(ctx)
+	if err != nil {
+		return "", "", "", err
+	}
+	defer tx.Rollback(ctx)
+
+	fileId, name := "", filename
+	query := `INSERT INTO files (filename, username, id, folder) VALUES ($1, $2, $3, $4)
+		ON CONFLICT (username, folder, filename) WHERE space_id IS NULL DO NOTHING
+		RETURNING id::text`
+	for n := 1; fileId == ""; n++ {
+		if n > maxNumberedNames {
+			return "", "", "", fmt.Errorf("no free name for %q", filename)
+		}
+		err := tx.QueryRow(ctx, query, name, user, uuid.New(), nullableId(folder)).Scan(&fileId)
+		if errors.Is(err, pgx.ErrNoRows) {
+			name = numberedName(filename, n)
+		} else if err != nil {
+			return "", "", "", err
+		}
+	}
+
+	versionId := uuid.New()
+	query = "INSERT INTO file_versions (id, file_id, version, size, scan_status, upload_link_id) VALUES ($1, $2, 1, $3, $4, $5)"
+	if _, err := tx.Exec(ctx, query, versionId, fileId, size, scanStatus, uploadLink); err != nil {
+		return "", "", "", err
 	}
-	return s, nil
+	return fileId, versionId.String(), name, tx.Commit(ctx)
 }
 
-func (defaultDbData) allFiles(db *pgxpool.Pool, user string) ([]file, error) {
-	rows, err := db.Query(context.Background(), "SELECT * FROM files WHERE username=$1", user)
+// allFiles returns the files stored directly inside folder. An empty folder means the root
+func (defaultDbData) allFiles(db *pgxpool.Pool, user string, folder string) ([]listedFile, error) {
+	query := `SELECT f.*, lv.scan_status, lv.scan_reason FROM files f
+		JOIN LATERAL (
+			SELECT scan_status, scan_reason FROM file_versions WHERE file_id=f.id ORDER BY version DESC LIMIT 1
+		) lv ON true
+		WHERE f.username=$1 AND f.space_id IS NULL AND f.folder IS NOT DISTINCT FROM $2`
+	rows, err := db.Query(context.Background(), query, user, nullableId(folder))
 	if err != nil {
 		return nil, err
 	}
 
-	files, err := pgx.CollectRows(rows, pgx.RowToStructByName[file])
+	files, err := pgx.CollectRows(rows, pgx.RowToStructByName[listedFile])
 	return files, err
 }
 
-func (defaultDbData) fileName(db *pgxpool.Pool, user string, id string) (string, error) {
-	query := "SELECT (filename) FROM files WHERE username=$1 AND id=$2"
-	row := db.QueryRow(context.Background(), query, user, id)
-	var fname string
-	if err := row.Scan(&fname); err != nil {
-		return "", err
+func (defaultDbData) userFile(db *pgxpool.Pool, user string, id string) (file, error) {
+	rows, err := db.Query(context.Background(), "SELECT * FROM files WHERE username=$1 AND id=$2 AND space_id IS NULL", user, id)
+	if err != nil {
+		return file{}, err
+	}
+	return pgx.CollectExactlyOneRow(rows, pgx.RowToStructByName[file])
+}
+
+// fileVersions returns every version of a file, starting from the latest
+func (defaultDbData) fileVersions(db *pgxpool.Pool, user string, fileId string) ([]fileVersion, error) {
+	query := `SELECT v.id, v.file_id, v.version, v.size, v.created_at, v.checksum, v.scan_status, v.scan_reason, v.upload_link_id
+		FROM file_versions v JOIN files f ON v.file_id=f.id
+		WHERE f.username=$1 AND f.id=$2 AND f.space_id IS NULL ORDER BY v.version DESC`
+	rows, err := db.Query(context.Background(), query, user, fileId)
+	if err != nil {
+		return nil, err
+	}
+	return pgx.CollectRows(rows, pgx.RowToStructByName[fileVersion])
+}
+
+// fileVersion returns the requested version of a file. An empty versionId means the latest clean one
+func (defaultDbData) fileVersion(db *pgxpool.Pool, user string, fileId string, versionId string) (fileVersion, error) {
+	query := `SELECT v.id, v.file_id, v.version, v.size, v.created_at, v.checksum, v.scan_status, v.scan_reason, v.upload_link_id
+		FROM file_versions v JOIN files f ON v.file_id=f.id
+		WHERE f.username=$1 AND f.id=$2 AND f.space_id IS NULL AND ($3::uuid IS NULL AND v.scan_status='clean' OR v.id=$3)
+		ORDER BY v.version DESC LIMIT 1`
+	rows, err := db.Query(context.Background(), query, user, fileId, nullableId(versionId))
+	if err != nil {
+		return fileVersion{}, err
+	}
+	return pgx.CollectExactlyOneRow(rows, pgx.RowToStructByName[fileVersion])
+}
+
+// insertVersion adds an already written blob as the latest version of a file
+func (defaultDbData) insertVersion(db *pgxpool.Pool, user string, fileId string, versionId string, size int64, checksum *string, scanStatus string) error {
+	ctx := context.Background()
+	tx, err := db.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	// Locking the file gives concurrent uploads consecutive versions
+	query := "SELECT id FROM files WHERE username=$1 AND id=$2 AND space_id IS NULL FOR UPDATE"
+	if _, err := tx.Exec(ctx, query, user, fileId); err != nil {
+		return err
+	}
+	query = `INSERT INTO file_versions (id, file_id, version, size, checksum, scan_status)
+		SELECT $3, $2, COALESCE(MAX(v.version), 0)+1, $4, $5, $6
+		FROM files f LEFT JOIN file_versions v ON v.file_id=f.id
+		WHERE f.username=$1 AND f.id=$2 AND f.space_id IS NULL
+		GROUP BY f.id`
+	tag, err := tx.Exec(ctx, query, user, fileId, versionId, size, checksum, scanStatus)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return pgx.ErrNoRows
+	}
+	return tx.Commit(ctx)
+}
+
+func (defaultDbData) setChecksum(db *pgxpool.Pool, versionId string, checksum string) error {
+	query := "UPDATE file_versions SET checksum=$2 WHERE id=$1"
+	if _, err := db.Exec(context.Background(), query, versionId, checksum); err != nil {
+		return err
+	}
+	return nil
+}
+
+// allBlobs returns a reference to every version of every file
+func (defaultDbData) allBlobs(db *pgxpool.Pool) ([]blobRef, error) {
+	query := `SELECT v.id, COALESCE(f.space_id, u.id) AS user_id, v.created_at, v.checksum, v.scan_status
+		FROM file_versions v
+		JOIN files f ON v.file_id=f.id
+		LEFT JOIN users u ON f.username=u.username`
+	rows, err := db.Query(context.Background(), query)
+	if err != nil {
+		return nil, err
+	}
+	return pgx.CollectRows(rows, pgx.RowToStructByName[blobRef])
+}
+
+// pendingScans returns the versions uploaded before olderThan that have not been scanned yet
+func (defaultDbData) pendingScans(db *pgxpool.Pool, olderThan time.Time) ([]blobRef, error) {
+	query := `SELECT v.id, COALESCE(f.space_id, u.id) AS user_id, v.created_at, v.checksum, v.scan_status
+		FROM file_versions v
+		JOIN files f ON v.file_id=f.id
+		LEFT JOIN users u ON f.username=u.username
+		WHERE v.scan_status='pending' AND v.created_at < $1`
+	rows, err := db.Query(context.Background(), query, olderThan)
+	if err != nil {
+		return nil, err
 	}
-	return fname, nil
+	return pgx.CollectRows(rows, pgx.RowToStructByName[blobRef])
 }
 
-// deleteFiles deletes file entries based on received ids
-// and returns the set of filenames that need to be deleted from the system
-func (defaultDbData) deleteFiles(db *pgxpool.Pool, username string, ids ...string) error {
+// setScanResult records the outcome of a scan and returns the file the version belongs to
+func (defaultDbData) setScanResult(db *pgxpool.Pool, versionId string, status string, reason string) (file, error) {
+	query := `UPDATE file_versions v SET scan_status=$2, scan_reason=$3
+		FROM files f WHERE v.id=$1 AND f.id=v.file_id
+		RETURNING f.filename, COALESCE(f.username, '') AS username, f.id, f.folder, f.space_id`
+	var r *string
+	if reason != "" {
+		r = &reason
+	}
+	rows, err := db.Query(context.Background(), query, versionId, status, r)
+	if err != nil {
+		return file{}, err
+	}
+	return pgx.CollectExactlyOneRow(rows, pgx.RowToStructByName[file])
+}
+
+// scanFailed counts a failed scan of a pending version and returns the number of failures
+func (defaultDbData) scanFailed(db *pgxpool.Pool, versionId string) (int, error) {
+	query := `UPDATE file_versions SET scan_attempts=scan_attempts+1
+		WHERE id=$1 AND scan_status='pending' RETURNING scan_attempts`
+	var attempts int
+	err := db.QueryRow(context.Background(), query, versionId).Scan(&attempts)
+	return attempts, err
+}
+
+func (defaultDbData) deleteVersions(db *pgxpool.Pool, ids ...string) error {
 	if len(ids) == 0 {
 		return nil
 	}
-	idSet := strings.Join(ids, ",")
-
-	query := "DELETE FROM files WHERE username=$1 AND id IN ($2)"
-	if _, err := db.Exec(context.Background(), query, username, idSet); err != nil {
+	if _, err := db.Exec(context.Background(), "DELETE FROM file_versions WHERE id=ANY($1)", ids); err != nil {
 		return err
 	}
 	return nil
 }
 
-func (defaultDbData) userExists(db *pgxpool.Pool, username string) (user, error) {
-	rows, err := db.Query(context.Background(), "SELECT * FROM users WHERE username=$1", username)
+// emptyFiles returns the ids of the files that have no versions left
+func (defaultDbData) emptyFiles(db *pgxpool.Pool) ([]string, error) {
+	query := `SELECT f.id::text FROM files f
+		WHERE NOT EXISTS (SELECT 1 FROM file_versions v WHERE v.file_id=f.id)`
+	rows, err := db.Query(context.Background(), query)
 	if err != nil {
-		return user{}, err
+		return nil, err
 	}
-	u, err := pgx.CollectExactlyOneRow(rows, pgx.RowToStructByName[user])
+	return pgx.CollectRows(rows, pgx.RowTo[string])
+}
+
+// deleteEmptyFiles removes the files that have no versions left and returns their ids
+func (defaultDbData) deleteEmptyFiles(db *pgxpool.Pool) ([]string, error) {
+	query := `DELETE FROM files f
+		WHERE NOT EXISTS (SELECT 1 FROM file_versions v WHERE v.file_id=f.id)
+		RETURNING f.id::text`
+	rows, err := db.Query(context.Background(), query)
 	if err != nil {
-		return user{}, err
+		return nil, err
 	}
+	return pgx.CollectRows(rows, pgx.RowTo[string])
+}
 
-	return u, nil
+// moveFile puts the file inside folder and returns the file as it was before the move
+func (defaultDbData) moveFile(db *pgxpool.Pool, user string, id string, folder string) (file, error) {
+	query := `UPDATE files AS f SET folder=$3
+		FROM (SELECT id, folder FROM files WHERE id=$2 AND username=$1 AND space_id IS NULL FOR UPDATE) AS old
+		WHERE f.id=old.id
+		AND ($3::uuid IS NULL OR EXISTS (SELECT 1 FROM folders WHERE id=$3 AND username=$1))
+		RETURNING f.filename, f.username, f.id, old.folder, f.space_id`
+	rows, err := db.Query(context.Background(), query, user, id, nullableId(folder))
+	if err != nil {
+		return file{}, err
+	}
+	f, err := pgx.CollectExactlyOneRow(rows, pgx.RowToStructByName[file])
+	if errors.Is(err, pgx.ErrNoRows) {
+		return file{}, ErrInvalidMove
+	}
+	return f, err
 }
 
-// insertUser first hashes the password and then creates a new user using the hashed password
-func (defaultDbData) insertUser(db *pgxpool.Pool, username string, password string) error {
+// deleteFiles deletes file entries based on received ids.
+// It returns the deleted files and the ids of their versions, whose blobs need to be deleted from the system
+func (defaultDbData) deleteFiles(db *pgxpool.Pool, username string, ids ...string) ([]file, []string, error) {
+	if len(ids) == 0 {
+		return nil, nil, nil
+	}
+
+	ctx := context.Background()
+	tx, err := db.Begin(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer tx.Rollback(ctx)
+
+	query := `SELECT v.id::text FROM file_versions v JOIN files f ON v.file_id=f.id
+		WHERE f.username=$1 AND f.id=ANY($2) AND f.space_id IS NULL FOR UPDATE OF f`
+	rows, err := tx.Query(ctx, query, username, ids)
+	if err != nil {
+		return nil, nil, err
+	}
+	blobs, err := pgx.CollectRows(rows, pgx.RowTo[string])
+	if err != nil {
+		return nil, nil, err
+	}
+
+	query = "DELETE FROM files WHERE username=$1 AND id=ANY($2) AND space_id IS NULL RETURNING *"
+	rows, err = tx.Query(ctx, query, username, ids)
+	if err != nil {
+		return nil, nil, err
+	}
+	files, err := pgx.CollectRows(rows, pgx.RowToStructByName[file])
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return files, blobs, tx.Commit(ctx)
+}
+
+func (defaultDbData) insertFolder(db *pgxpool.Pool, user string, name string, parent string) (string, error) {
 	id := uuid.New()
-	pw, err := hashPassword(password)
+	query := `INSERT INTO folders (id, name, parent, username)
+		SELECT $1, $2, $3, $4
+		WHERE $3::uuid IS NULL OR EXISTS (SELECT 1 FROM folders WHERE id=$3 AND username=$4)`
+	tag, err := db.Exec(context.Background(), query, id, name, nullableId(parent), user)
 	if err != nil {
-		return err
+		return "", err
+	}
+	if tag.RowsAffected() == 0 {
+		return "", ErrInvalidMove
 	}
+	return id.String(), nil
+}
 
-	query := "INSERT INTO users (id, username, password) VALUES ($1, $2, $3)"
-	if _, err := db.Exec(context.Background(), query, id, username, pw); err != nil {
+func (defaultDbData) folder(db *pgxpool.Pool, user string, id string) (folder, error) {
+	rows, err := db.Query(context.Background(), "SELECT * FROM folders WHERE username=$1 AND id=$2", user, id)
+	if err != nil {
+		return folder{}, err
+	}
+	return pgx.CollectExactlyOneRow(rows, pgx.RowToStructByName[folder])
+}
+
+// subFolders returns the folders directly inside parent. An empty parent means the root
+func (defaultDbData) subFolders(db *pgxpool.Pool, user string, parent string) ([]folder, error) {
+	query := "SELECT * FROM folders WHERE username=$1 AND parent IS NOT DISTINCT FROM $2 ORDER BY name"
+	rows, err := db.Query(context.Background(), query, user, nullableId(parent))
+	if err != nil {
+		return nil, err
+	}
+	return pgx.CollectRows(rows, pgx.RowToStructByName[folder])
+}
+
+// folderPath returns the chain of folders going from the root to the folder with the given id
+func (defaultDbData) folderPath(db *pgxpool.Pool, user string, id string) ([]folder, error) {
+	if id == "" {
+		return []folder{}, nil
+	}
+
+	query := `WITH RECURSIVE chain AS (
+			SELECT id, name, parent, username, 0 AS depth FROM folders WHERE id=$2 AND username=$1
+			UNION ALL
+			SELECT f.id, f.name, f.parent, f.username, chain.depth+1 FROM folders f JOIN chain ON f.id=chain.parent
+		)
+		SELECT name, username, id, parent FROM chain ORDER BY depth DESC`
+	rows, err := db.Query(context.Background(), query, user, id)
+	if err != nil {
+		return nil, err
+	}
+	return pgx.CollectRows(rows, pgx.RowToStructByName[folder])
+}
+
+func (defaultDbData) allFolders(db *pgxpool.Pool, user string) ([]folderOption, error) {
+	query := `WITH RECURSIVE tree AS (
+			SELECT id, name::text AS path FROM folders WHERE username=$1 AND parent IS NULL
+			UNION ALL
+			SELECT f.id, tree.path || '/' || f.name FROM folders f JOIN tree ON f.parent=tree.id
+		)
+		SELECT id, path FROM tree ORDER BY path`
+	rows, err := db.Query(context.Background(), query, user)
+	if err != nil {
+		return nil, err
+	}
+	return pgx.CollectRows(rows, pgx.RowToStructByName[folderOption])
+}
+
+func (defaultDbData) renameFolder(db *pgxpool.Pool, user string, id string, name string) error {
+	query := "UPDATE folders SET name=$3 WHERE username=$1 AND id=$2"
+	tag, err := db.Exec(context.Background(), query, user, id, name)
+	if err != nil {
 		return err
 	}
+	if tag.RowsAffected() == 0 {
+		return pgx.ErrNoRows
+	}
+	return nil
+}
 
+// moveFolder changes the parent of a folder.
+// If parent is the folder itself or one of its descendants ErrInvalidMove will be returned
+func (defaultDbData) moveFolder(db *pgxpool.Pool, user string, id string, parent string) error {
+	query := `WITH RECURSIVE sub AS (
+			SELECT id FROM folders WHERE id=$2
+			UNION ALL
+			SELECT f.id FROM folders f JOIN sub ON f.parent=sub.id
+		)
+		UPDATE folders SET parent=$3 WHERE username=$1 AND id=$2
+		AND ($3::uuid IS NULL OR (
+			$3 NOT IN (SELECT id FROM sub)
+			AND EXISTS (SELECT 1 FROM folders WHERE id=$3 AND username=$1)
+		))`
+	tag, err := db.Exec(context.Background(), query, user, id, nullableId(parent))
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return ErrInvalidMove
+	}
 	return nil
 }
 
-func (defaultDbData) deleteUser(db *pgxpool.Pool, username string) error {
-	if _, err := db.Exec(context.Background(), "DELETE FROM users WHERE username=$1", username); err != nil {
+// deleteFolder removes a folder with all of its content
+// and returns the ids of the file versions whose blobs need to be deleted from the system
+func (defaultDbData) deleteFolder(db *pgxpool.Pool, user string, id string) ([]string, error) {
+	ctx := context.Background()
+	tx, err := db.Begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback(ctx)
+
+	query := `WITH RECURSIVE sub AS (
+			SELECT id FROM folders WHERE id=$2 AND username=$1
+			UNION ALL
+			SELECT f.id FROM folders f JOIN sub ON f.parent=sub.id
+		)
+		SELECT v.id::text FROM file_versions v JOIN files f ON v.file_id=f.id
+		WHERE f.folder IN (SELECT id FROM sub) FOR UPDATE OF f`
+	rows, err := tx.Query(ctx, query, user, id)
+	if err != nil {
+		return nil, err
+	}
+	ids, err := pgx.CollectRows(rows, pgx.RowTo[string])
+	if err != nil {
+		return nil, err
+	}
+
+	// Subfolders, files and versions are removed by ON DELETE CASCADE
+	tag, err := tx.Exec(ctx, "DELETE FROM folders WHERE username=$1 AND id=$2", user, id)
+	if err != nil {
+		return nil, err
+	}
+	if tag.RowsAffected() == 0 {
+		return nil, pgx.ErrNoRows
+	}
+
+	return ids, tx.Commit(ctx)
+}
+
+// insertShareLink stores a new link, after checking that the shared item belongs to the user
+func (defaultDbData) insertShareLink(db *pgxpool.Pool, link shareLink) error {
+	query := `INSERT INTO share_links (id, token, username, clip_id, file_id, password, expires_at, max_uses)
+		SELECT $1, $2, $3, $4, $5, $6, $7, $8
+		WHERE EXISTS (SELECT 1 FROM clipboard WHERE id=$4 AND username=$3 AND space_id IS NULL)
+		OR EXISTS (SELECT 1 FROM files WHERE id=$5 AND username=$3 AND space_id IS NULL)`
+	tag, err := db.Exec(context.Background(), query,
+		link.Id, link.Token, link.Username, link.ClipId, link.FileId, link.Password, link.ExpiresAt, link.MaxUses)
+	if err != nil {
 		return err
 	}
+	if tag.RowsAffected() == 0 {
+		return pgx.ErrNoRows
+	}
 	return nil
 }
+
+// userShareLinks returns the links of a user that have not been revoked, starting from the newest
+func (defaultDbData) userShareLinks(db *pgxpool.Pool, user string) ([]listedShareLink, error) {
+	query := `SELECT l.*, COALESCE(c.clip_text, f.filename) AS item,
+			(SELECT COUNT(*) FROM share_accesses a WHERE a.link_id=l.id) AS accesses
+		FROM share_links l
+		LEFT JOIN clipboard c ON c.id=l.clip_id
+		LEFT JOIN files f ON f.id=l.file_id
+		WHERE l.username=$1 AND l.revoked_at IS NULL
+		ORDER BY l.created_at DESC`
+	rows, err := db.Query(context.Background(), query, user)
+	if err != nil {
+		return nil, err
+	}
+	return pgx.CollectRows(rows, pgx.RowToStructByName[listedShareLink])
+}
+
+func (defaultDbData) shareLink(db *pgxpool.Pool, token string) (shareLink, error) {
+	rows, err := db.Query(context.Background(), "SELECT * FROM share_links WHERE token=$1", token)
+	if err != nil {
+		return shareLink{}, err
+	}
+	return pgx.CollectExactlyOneRow(rows, pgx.RowToStructByName[shareLink])
+}
+
+func (defaultDbData) userShareLink(db *pgxpool.Pool, user string, id string) (shareLink, error) {
+	rows, err := db.Query(context.Background(), "SELECT * FROM share_links WHERE username=$1 AND id=$2", user, id)
+	if err != nil {
+		return shareLink{}, err
+	}
+	return pgx.CollectExactlyOneRow(rows, pgx.RowToStructByName[shareLink])
+}
+
+// consumeShareLink counts a use of the link.
+// If the link is revoked, expired or has no uses left pgx.ErrNoRows is returned
+func (defaultDbData) consumeShareLink(db *pgxpool.Pool, token string) (shareLink, error) {
+	query := `UPDATE share_links SET uses=uses+1
+		WHERE token=$1 AND revoked_at IS NULL
+		AND (expires_at IS NULL OR expires_at > now())
+		AND (max_uses IS NULL OR uses < max_uses)
+		RETURNING *`
+	rows, err := db.Query(context.Background(), query, token)
+	if err != nil {
+		return shareLink{}, err
+	}
+	return pgx.CollectExactlyOneRow(rows, pgx.RowToStructByName[shareLink])
+}
+
+func (defaultDbData) revokeShareLink(db *pgxpool.Pool, user string, id string) error {
+	query := "UPDATE share_links SET revoked_at=now() WHERE username=$1 AND id=$2 AND revoked_at IS NULL"
+	tag, err := db.Exec(context.Background(), query, user, id)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return pgx.ErrNoRows
+	}
+	return nil
+}
+
+func (defaultDbData) insertShareAccess(db *pgxpool.Pool, linkId uuid.UUID, ip string, userAgent string, outcome string) error {
+	query := "INSERT INTO share_accesses (id, link_id, ip, user_agent, outcome) VALUES ($1, $2, $3, $4, $5)"
+	if _, err := db.Exec(context.Background(), query, uuid.New(), linkId, ip, userAgent, outcome); err != nil {
+		return err
+	}
+	return nil
+}
+
+// shareAccesses returns the accesses to one of the user's links, starting from the newest
+func (defaultDbData) shareAccesses(db *pgxpool.Pool, user string, linkId string) ([]shareAccess, error) {
+	query := `SELECT a.* FROM share_accesses a JOIN share_links l ON a.link_id=l.id
+		WHERE l.username=$1 AND l.id=$2
+		ORDER BY a.accessed_at DESC`
+	rows, err := db.Query(context.Background(), query, user, linkId)
+	if err != nil {
+		return nil, err
+	}
+	return pgx.CollectRows(rows, pgx.RowToStructByName[shareAccess])
+}
+
+// insertUploadLink adds a link into a folder of its user.
+// If the folder doesn't belong to the user pgx.ErrNoRows is returned
+func (defaultDbData) insertUploadLink(db *pgxpool.Pool, link uploadLink) error {
+	query := `INSERT INTO upload_links (id, token, username, label, folder, password, expires_at, max_files, max_size)
+		SELECT $1, $2, $3, $4, $5, $6, $7, $8, $9
+		WHERE $5::uuid IS NULL OR EXISTS (SELECT 1 FROM folders WHERE id=$5 AND username=$3)`
+	tag, err := db.Exec(context.Background(), query, link.Id, link.Token, link.Username, link.Label,
+		link.Folder, link.Password, link.ExpiresAt, link.MaxFiles, link.MaxSize)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return pgx.ErrNoRows
+	}
+	return nil
+}
+
+// userUploadLinks returns the upload links of a user that have not been revoked, starting from the newest
+func (defaultDbData) userUploadLinks(db *pgxpool.Pool, user string) ([]listedUploadLink, error) {
+	query := `SELECT l.*, f.name AS folder_name FROM upload_links l
+		LEFT JOIN folders f ON f.id=l.folder
+		WHERE l.username=$1 AND l.revoked_at IS NULL
+		ORDER BY l.created_at DESC`
+	rows, err := db.Query(context.Background(), query, user)
+	if err != nil {
+		return nil, err
+	}
+	return pgx.CollectRows(rows, pgx.RowToStructByName[listedUploadLink])
+}
+
+func (defaultDbData) userUploadLink(db *pgxpool.Pool, user string, id string) (uploadLink, error) {
+	rows, err := db.Query(context.Background(), "SELECT * FROM upload_links WHERE username=$1 AND id=$2", user, id)
+	if err != nil {
+		return uploadLink{}, err
+	}
+	return pgx.CollectExactlyOneRow(rows, pgx.RowToStructByName[uploadLink])
+}
+
+func (defaultDbData) uploadLink(db *pgxpool.Pool, token string) (uploadLink, error) {
+	rows, err := db.Query(context.Background(), "SELECT * FROM upload_links WHERE token=$1", token)
+	if err != nil {
+		return uploadLink{}, err
+	}
+	return pgx.CollectExactlyOneRow(rows, pgx.RowToStructByName[uploadLink])
+}
+
+// consumeUploadLink counts one more file uploaded through the link.
+// If the link can't take more files pgx.ErrNoRows is returned
+func (defaultDbData) consumeUploadLink(db *pgxpool.Pool, token string) (uploadLink, error) {
+	query := `UPDATE upload_links SET uploads=uploads+1
+		WHERE token=$1 AND revoked_at IS NULL
+		AND (expires_at IS NULL OR expires_at > now())
+		AND (max_files IS NULL OR uploads < max_files)
+		RETURNING *`
+	rows, err := db.Query(context.Background(), query, token)
+	if err != nil {
+		return uploadLink{}, err
+	}
+	return pgx.CollectExactlyOneRow(rows, pgx.RowToStructByName[uploadLink])
+}
+
+func (defaultDbData) revokeUploadLink(db *pgxpool.Pool, user string, id string) error {
+	query := "UPDATE upload_links SET revoked_at=now() WHERE username=$1 AND id=$2 AND revoked_at IS NULL"
+	tag, err := db.Exec(context.Background(), query, user, id)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return pgx.ErrNoRows
+	}
+	return nil
+}
+
+func (defaultDbData) insertSecret(db *pgxpool.Pool, sec secret) error {
+	query := `INSERT INTO secrets (id, token_hash, username, label, secret_text, expires_at)
+		VALUES ($1, $2, $3, $4, $5, $6)`
+	_, err := db.Exec(context.Background(), query, sec.Id, sec.TokenHash, sec.Username, sec.Label, sec.Text, sec.ExpiresAt)
+	return err
+}
+
+// userSecrets returns the secrets of a user that have not been read yet, without their text
+func (defaultDbData) userSecrets(db *pgxpool.Pool, user string) ([]secret, error) {
+	query := `SELECT id, token_hash, username, label, '' AS secret_text, created_at, expires_at
+		FROM secrets WHERE username=$1 AND expires_at > now() ORDER BY created_at DESC`
+	rows, err := db.Query(context.Background(), query, user)
+	if err != nil {
+		return nil, err
+	}
+	return pgx.CollectRows(rows, pgx.RowToStructByName[secret])
+}
+
+func (defaultDbData) secretExists(db *pgxpool.Pool, tokenHash string) (bool, error) {
+	query := "SELECT EXISTS (SELECT 1 FROM secrets WHERE token_hash=$1 AND expires_at > now())"
+	var ok bool
+	err := db.QueryRow(context.Background(), query, tokenHash).Scan(&ok)
+	return ok, err
+}
+
+// readSecret deletes the secret and returns it, so that it can be read only once.
+// If it doesn't exist or it has expired pgx.ErrNoRows is returned
+func (defaultDbData) readSecret(db *pgxpool.Pool, tokenHash string) (secret, error) {
+	query := "DELETE FROM secrets WHERE token_hash=$1 AND expires_at > now() RETURNING *"
+	rows, err := db.Query(context.Background(), query, tokenHash)
+	if err != nil {
+		return secret{}, err
+	}
+	return pgx.CollectExactlyOneRow(rows, pgx.RowToStructByName[secret])
+}
+
+func (defaultDbData) deleteSecret(db *pgxpool.Pool, user string, id string) error {
+	if _, err := db.Exec(context.Background(), "DELETE FROM secrets WHERE username=$1 AND id=$2", user, id); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (defaultDbData) deleteExpiredSecrets(db *pgxpool.Pool) error {
+	if _, err := db.Exec(context.Background(), "DELETE FROM secrets WHERE expires_at <= now()"); err != nil {
+		return err
+	}
+	return nil
+}
+
+// insertFetchCode gives a personal clip of user a new code, replacing the previous one.
+// If the clip doesn't belong to user pgx.ErrNoRows is returned
+func (defaultDbData) insertFetchCode(db *pgxpool.Pool, user string, clipId string, code string, expiresAt time.Time) error {
+	// An expired code that has not been cleaned yet can be given out again
+	if _, err := db.Exec(context.Background(), "DELETE FROM fetch_codes WHERE code=$1 AND expires_at <= now()", code); err != nil {
+		return err
+	}
+
+	query := `INSERT INTO fetch_codes (code, clip_id, username, expires_at)
+		SELECT $1, id, username, $4 FROM clipboard WHERE id=$2 AND username=$3 AND space_id IS NULL
+		ON CONFLICT (clip_id) DO UPDATE SET code=EXCLUDED.code, created_at=now(), expires_at=EXCLUDED.expires_at`
+	tag, err := db.Exec(context.Background(), query, code, clipId, user, expiresAt)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return pgx.ErrNoRows
+	}
+	return nil
+}
+
+// fetchClip deletes the code and returns its clip, so that it can be fetched only once.
+// If the code doesn't exist or it has expired pgx.ErrNoRows is returned
+func (defaultDbData) fetchClip(db *pgxpool.Pool, code string) (clipboard, error) {
+	query := `DELETE FROM fetch_codes fc USING clipboard c
+		WHERE fc.code=$1 AND fc.expires_at > now() AND c.id=fc.clip_id
+		RETURNING c.*`
+	rows, err := db.Query(context.Background(), query, code)
+	if err != nil {
+		return clipboard{}, err
+	}
+	return pgx.CollectExactlyOneRow(rows, pgx.RowToStructByName[clipboard])
+}
+
+func (defaultDbData) deleteFetchCode(db *pgxpool.Pool, user string, clipId string) error {
+	if _, err := db.Exec(context.Background(), "DELETE FROM fetch_codes WHERE username=$1 AND clip_id=$2", user, clipId); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (defaultDbData) deleteExpiredFetchCodes(db *pgxpool.Pool) error {
+	if _, err := db.Exec(context.Background(), "DELETE FROM fetch_codes WHERE expires_at <= now()"); err != nil {
+		return err
+	}
+	return nil
+}
+
+// insertGrant shares an item of the owner with the grantee, or updates the permission of an existing grant.
+// If the item doesn't belong to the owner or the grantee doesn't exist pgx.ErrNoRows is returned
+func (defaultDbData) insertGrant(db *pgxpool.Pool, g grant) error {
+	query := `INSERT INTO grants (id, owner, grantee, clip_id, file_id, can_write)
+		SELECT $1::uuid, $2::varchar, $3::varchar, $4::uuid, $5::uuid, $6::boolean
+		WHERE $3 <> $2 AND EXISTS (SELECT 1 FROM users WHERE username=$3)
+		AND (EXISTS (SELECT 1 FROM clipboard WHERE id=$4 AND username=$2 AND space_id IS NULL)
+			OR EXISTS (SELECT 1 FROM files WHERE id=$5 AND username=$2 AND space_id IS NULL))
+		ON CONFLICT (grantee, clip_id, file_id) DO UPDATE SET can_write=EXCLUDED.can_write`
+	tag, err := db.Exec(context.Background(), query, g.Id, g.Owner, g.Grantee, g.ClipId, g.FileId, g.CanWrite)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return pgx.ErrNoRows
+	}
+	return nil
+}
+
+// itemGrants returns the grants of one of the owner's clips or files
+func (defaultDbData) itemGrants(db *pgxpool.Pool, owner string, clipId string, fileId string) ([]grant, error) {
+	query := `SELECT * FROM grants WHERE owner=$1
+		AND clip_id IS NOT DISTINCT FROM $2 AND file_id IS NOT DISTINCT FROM $3
+		ORDER BY grantee`
+	rows, err := db.Query(context.Background(), query, owner, nullableId(clipId), nullableId(fileId))
+	if err != nil {
+		return nil, err
+	}
+	return pgx.CollectRows(rows, pgx.RowToStructByName[grant])
+}
+
+// grantees returns the users that can access a clip or a file through a grant
+func (defaultDbData) grantees(db *pgxpool.Pool, clipId string, fileId string) ([]string, error) {
+	query := `SELECT grantee FROM grants
+		WHERE clip_id IS NOT DISTINCT FROM $1 AND file_id IS NOT DISTINCT FROM $2`
+	rows, err := db.Query(context.Background(), query, nullableId(clipId), nullableId(fileId))
+	if err != nil {
+		return nil, err
+	}
+	return pgx.CollectRows(rows, pgx.RowTo[string])
+}
+
+func (defaultDbData) deleteGrant(db *pgxpool.Pool, owner string, id string) (grant, error) {
+	rows, err := db.Query(context.Background(), "DELETE FROM grants WHERE owner=$1 AND id=$2 RETURNING *", owner, id)
+	if err != nil {
+		return grant{}, err
+	}
+	return pgx.CollectExactlyOneRow(rows, pgx.RowToStructByName[grant])
+}
+
+// sharedClips returns the clips that other users shared with user
+func (defaultDbData) sharedClips(db *pgxpool.Pool, user string) ([]sharedClip, error) {
+	query := `SELECT c.*, g.can_write FROM grants g JOIN clipboard c ON c.id=g.clip_id
+		WHERE g.grantee=$1 ORDER BY g.created_at DESC`
+	rows, err := db.Query(context.Background(), query, user)
+	if err != nil {
+		return nil, err
+	}
+	return pgx.CollectRows(rows, pgx.RowToStructByName[sharedClip])
+}
+
+// sharedFiles returns the files that other users shared with user
+func (defaultDbData) sharedFiles(db *pgxpool.Pool, user string) ([]sharedFile, error) {
+	query := `SELECT f.*, lv.scan_status, lv.scan_reason, g.can_write
+		FROM grants g JOIN files f ON f.id=g.file_id
+		JOIN LATERAL (
+			SELECT scan_status, scan_reason FROM file_versions WHERE file_id=f.id ORDER BY version DESC LIMIT 1
+		) lv ON true
+		WHERE g.grantee=$1 ORDER BY g.created_at DESC`
+	rows, err := db.Query(context.Background(), query, user)
+	if err != nil {
+		return nil, err
+	}
+	return pgx.CollectRows(rows, pgx.RowToStructByName[sharedFile])
+}
+
+// clipAccess returns a clip if user owns it or it has been shared with them.
+// Owners can always write
+func (defaultDbData) clipAccess(db *pgxpool.Pool, user string, id string) (sharedClip, error) {
+	query := `SELECT c.*, (c.username=$1 OR COALESCE(g.can_write, false)) AS can_write
+		FROM clipboard c LEFT JOIN grants g ON g.clip_id=c.id AND g.grantee=$1
+		WHERE c.id=$2 AND c.space_id IS NULL AND (c.username=$1 OR g.id IS NOT NULL)`
+	rows, err := db.Query(context.Background(), query, user, id)
+	if err != nil {
+		return sharedClip{}, err
+	}
+	return pgx.CollectExactlyOneRow(rows, pgx.RowToStructByName[sharedClip])
+}
+
+// fileAccess returns a file if user owns it or it has been shared with them.
+// Owners can always write
+func (defaultDbData) fileAccess(db *pgxpool.Pool, user string, id string) (sharedFile, error) {
+	query := `SELECT f.*, lv.scan_status, lv.scan_reason, (f.username=$1 OR COALESCE(g.can_write, false)) AS can_write
+		FROM files f LEFT JOIN grants g ON g.file_id=f.id AND g.grantee=$1
+		JOIN LATERAL (
+			SELECT scan_status, scan_reason FROM file_versions WHERE file_id=f.id ORDER BY version DESC LIMIT 1
+		) lv ON true
+		WHERE f.id=$2 AND f.space_id IS NULL AND (f.username=$1 OR g.id IS NOT NULL)`
+	rows, err := db.Query(context.Background(), query, user, id)
+	if err != nil {
+		return sharedFile{}, err
+	}
+	return pgx.CollectExactlyOneRow(rows, pgx.RowToStructByName[sharedFile])
+}
+
+// insertSpace creates a space with owner as its first member
+func (defaultDbData) insertSpace(db *pgxpool.Pool, name string, owner string) (string, error) {
+	ctx := context.Background()
+	tx, err := db.Begin(ctx)
+	if err != nil {
+		return "", err
+	}
+	defer tx.Rollback(ctx)
+
+	id := uuid.New()
+	if _, err := tx.Exec(ctx, "INSERT INTO spaces (id, name) VALUES ($1, $2)", id, name); err != nil {
+		return "", err
+	}
+	query := "INSERT INTO space_members (space_id, username, role) VALUES ($1, $2, $3)"
+	if _, err := tx.Exec(ctx, query, id, owner, roleOwner); err != nil {
+		return "", err
+	}
+
+	return id.String(), tx.Commit(ctx)
+}
+
+func (defaultDbData) allSpaces(db *pgxpool.Pool) ([]space, error) {
+	rows, err := db.Query(context.Background(), "SELECT * FROM spaces")
+	if err != nil {
+		return nil, err
+	}
+	return pgx.CollectRows(rows, pgx.RowToStructByName[space])
+}
+
+// userSpaces returns the spaces user is a member of
+func (defaultDbData) userSpaces(db *pgxpool.Pool, user string) ([]memberSpace, error) {
+	query := `SELECT s.*, m.role FROM spaces s JOIN space_members m ON m.space_id=s.id
+		WHERE m.username=$1 ORDER BY s.name`
+	rows, err := db.Query(context.Background(), query, user)
+	if err != nil {
+		return nil, err
+	}
+	return pgx.CollectRows(rows, pgx.RowToStructByName[memberSpace])
+}
+
+// userSpace returns a space with the role of user. If user is not a member pgx.ErrNoRows is returned
+func (defaultDbData) userSpace(db *pgxpool.Pool, user string, spaceId string) (memberSpace, error) {
+	query := `SELECT s.*, m.role FROM spaces s JOIN space_members m ON m.space_id=s.id
+		WHERE m.username=$1 AND s.id=$2`
+	rows, err := db.Query(context.Background(), query, user, spaceId)
+	if err != nil {
+		return memberSpace{}, err
+	}
+	return pgx.CollectExactlyOneRow(rows, pgx.RowToStructByName[memberSpace])
+}
+
+// deleteSpace removes a space with all of its content
+// and returns the ids of the file versions whose blobs need to be deleted from the system
+func (defaultDbData) deleteSpace(db *pgxpool.Pool, spaceId string) ([]string, error) {
+	ctx := context.Background()
+	tx, err := db.Begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback(ctx)
+
+	ids, err := deleteSpaceTx(ctx, tx, spaceId)
+	if err != nil {
+		return nil, err
+	}
+	return ids, tx.Commit(ctx)
+}
+
+func deleteSpaceTx(ctx context.Context, tx pgx.Tx, spaceId string) ([]string, error) {
+	query := `SELECT v.id::text FROM file_versions v JOIN files f ON v.file_id=f.id
+		WHERE f.space_id=$1 FOR UPDATE OF f`
+	rows, err := tx.Query(ctx, query, spaceId)
+	if err != nil {
+		return nil, err
+	}
+	ids, err := pgx.CollectRows(rows, pgx.RowTo[string])
+	if err != nil {
+		return nil, err
+	}
+
+	// Members, clips, files and versions are removed by ON DELETE CASCADE
+	tag, err := tx.Exec(ctx, "DELETE FROM spaces WHERE id=$1", spaceId)
+	if err != nil {
+		return nil, err
+	}
+	if tag.RowsAffected() == 0 {
+		return nil, pgx.ErrNoRows
+	}
+	return ids, nil
+}
+
+func (defaultDbData) spaceMembers(db *pgxpool.Pool, spaceId string) ([]spaceMember, error) {
+	query := "SELECT * FROM space_members WHERE space_id=$1 ORDER BY role, username"
+	rows, err := db.Query(context.Background(), query, spaceId)
+	if err != nil {
+		return nil, err
+	}
+	return pgx.CollectRows(rows, pgx.RowToStructByName[spaceMember])
+}
+
+// setSpaceMember adds user to a space or changes their role.
+// If the user doesn't exist pgx.ErrNoRows is returned, if it would leave the space without owners ErrLastOwner
+func (defaultDbData) setSpaceMember(db *pgxpool.Pool, spaceId string, user string, role string) error {
+	ctx := context.Background()
+	tx, err := db.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	if role != roleOwner {
+		if err := checkLastOwner(ctx, tx, spaceId, user); err != nil {
+			return err
+		}
+	}
+
+	query := `INSERT INTO space_members (space_id, username, role)
+		SELECT $1, username, $3 FROM users WHERE username=$2
+		ON CONFLICT (space_id, username) DO UPDATE SET role=EXCLUDED.role`
+	tag, err := tx.Exec(ctx, query, spaceId, user, role)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return pgx.ErrNoRows
+	}
+
+	return tx.Commit(ctx)
+}
+
+// removeSpaceMember removes user from a space, unless they are its last owner
+func (defaultDbData) removeSpaceMember(db *pgxpool.Pool, spaceId string, user string) error {
+	ctx := context.Background()
+	tx, err := db.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	if err := checkLastOwner(ctx, tx, spaceId, user); err != nil {
+		return err
+	}
+	tag, err := tx.Exec(ctx, "DELETE FROM space_members WHERE space_id=$1 AND username=$2", spaceId, user)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return pgx.ErrNoRows
+	}
+
+	return tx.Commit(ctx)
+}
+
+// checkLastOwner returns ErrLastOwner if user is the only owner of the space.
+// The owners are locked until the end of tx, so concurrent changes can't remove all of them
+func checkLastOwner(ctx context.Context, tx pgx.Tx, spaceId string, user string) error {
+	query := "SELECT username FROM space_members WHERE space_id=$1 AND role='owner' FOR UPDATE"
+	rows, err := tx.Query(ctx, query, spaceId)
+	if err != nil {
+		return err
+	}
+	owners, err := pgx.CollectRows(rows, pgx.RowTo[string])
+	if err != nil {
+		return err
+	}
+	if len(owners) == 1 && owners[0] == user {
+		return ErrLastOwner
+	}
+	return nil
+}
+
+// The clips and files of a space keep no user once the user who created them has been deleted,
+// Username is empty for them
+const (
+	spaceClipColumns = "c.id, c.clip_text, COALESCE(c.username, '') AS username, c.space_id"
+	spaceFileColumns = "f.id, f.filename, COALESCE(f.username, '') AS username, f.folder, f.space_id"
+)
+
+// memberClip returns a clip of one of the spaces user is a member of
+func (defaultDbData) memberClip(db *pgxpool.Pool, user string, id string) (clipboard, error) {
+	query := `SELECT ` + spaceClipColumns + ` FROM clipboard c JOIN space_members m ON m.space_id=c.space_id
+		WHERE m.username=$1 AND c.id=$2`
+	rows, err := db.Query(context.Background(), query, user, id)
+	if err != nil {
+		return clipboard{}, err
+	}
+	return pgx.CollectExactlyOneRow(rows, pgx.RowToStructByName[clipboard])
+}
+
+// memberFile returns a file of one of the spaces user is a member of
+func (defaultDbData) memberFile(db *pgxpool.Pool, user string, id string) (file, error) {
+	query := `SELECT ` + spaceFileColumns + ` FROM files f JOIN space_members m ON m.space_id=f.space_id
+		WHERE m.username=$1 AND f.id=$2`
+	rows, err := db.Query(context.Background(), query, user, id)
+	if err != nil {
+		return file{}, err
+	}
+	return pgx.CollectExactlyOneRow(rows, pgx.RowToStructByName[file])
+}
+
+func (defaultDbData) spaceClips(db *pgxpool.Pool, spaceId string) ([]clipboard, error) {
+	rows, err := db.Query(context.Background(), "SELECT "+spaceClipColumns+" FROM clipboard c WHERE c.space_id=$1", spaceId)
+	if err != nil {
+		return nil, err
+	}
+	return pgx.CollectRows(rows, pgx.RowToStructByName[clipboard])
+}
+
+func (defaultDbData) insertSpaceClip(db *pgxpool.Pool, spaceId string, user string, text string) error {
+	query := "INSERT INTO clipboard (clip_text, username, id, space_id) VALUES ($1, $2, $3, $4)"
+	if _, err := db.Exec(context.Background(), query, text, user, uuid.New(), spaceId); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (defaultDbData) deleteSpaceClip(db *pgxpool.Pool, spaceId string, id string) error {
+	query := "DELETE FROM clipboard WHERE space_id=$1 AND id=$2"
+	if _, err := db.Exec(context.Background(), query, spaceId, id); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (defaultDbData) spaceFiles(db *pgxpool.Pool, spaceId string) ([]listedFile, error) {
+	query := `SELECT ` + spaceFileColumns + `, lv.scan_status, lv.scan_reason FROM files f
+		JOIN LATERAL (
+			SELECT scan_status, scan_reason FROM file_versions WHERE file_id=f.id ORDER BY version DESC LIMIT 1
+		) lv ON true
+		WHERE f.space_id=$1 ORDER BY f.filename`
+	rows, err := db.Query(context.Background(), query, spaceId)
+	if err != nil {
+		return nil, err
+	}
+	return pgx.CollectRows(rows, pgx.RowToStructByName[listedFile])
+}
+
+// insertSpaceFile works like insertFile, for the files of a space
+func (defaultDbData) insertSpaceFile(db *pgxpool.Pool, spaceId string, user string, filename string, size int64, scanStatus string) (string, string, error) {
+	ctx := context.Background()
+	tx, err := db.Begin(ctx)
+	if err != nil {
+		return "", "", err
+	}
+	defer tx.Rollback(ctx)
+
+	fileId := ""
+	query := `INSERT INTO files (filename, username, id, space_id) VALUES ($1, $2, $3, $4)
+		ON CONFLICT (space_id, filename) WHERE space_id IS NOT NULL DO UPDATE SET filename=EXCLUDED.filename
+		RETURNING id::text`
+	row := tx.QueryRow(ctx, query, filename, user, uuid.New(), spaceId)
+	if err := row.Scan(&fileId); err != nil {
+		return "", "", err
+	}
+
+	versionId := uuid.New()
+	query = `INSERT INTO file_versions (id, file_id, version, size, scan_status)
+		SELECT $1, $2, COALESCE(MAX(version), 0)+1, $3, $4 FROM file_versions WHERE file_id=$2`
+	if _, err := tx.Exec(ctx, query, versionId, fileId, size, scanStatus); err != nil {
+		return "", "", err
+	}
+
+	return fileId, versionId.String(), tx.Commit(ctx)
+}
+
+// spaceFile returns a file of the space with its latest clean version, the one that can be downloaded
+func (defaultDbData) spaceFile(db *pgxpool.Pool, spaceId string, fileId string) (file, fileVersion, error) {
+	query := "SELECT " + spaceFileColumns + " FROM files f WHERE f.space_id=$1 AND f.id=$2"
+	rows, err := db.Query(context.Background(), query, spaceId, fileId)
+	if err != nil {
+		return file{}, fileVersion{}, err
+	}
+	f, err := pgx.CollectExactlyOneRow(rows, pgx.RowToStructByName[file])
+	if err != nil {
+		return file{}, fileVersion{}, err
+	}
+
+	query = `SELECT id, file_id, version, size, created_at, checksum, scan_status, scan_reason, upload_link_id
+		FROM file_versions WHERE file_id=$1 AND scan_status='clean' ORDER BY version DESC LIMIT 1`
+	rows, err = db.Query(context.Background(), query, fileId)
+	if err != nil {
+		return file{}, fileVersion{}, err
+	}
+	v, err := pgx.CollectExactlyOneRow(rows, pgx.RowToStructByName[fileVersion])
+	return f, v, err
+}
+
+// deleteSpaceFile deletes a file of the space and returns the ids of its versions
+func (defaultDbData) deleteSpaceFile(db *pgxpool.Pool, spaceId string, fileId string) ([]string, error) {
+	ctx := context.Background()
+	tx, err := db.Begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback(ctx)
+
+	query := `SELECT v.id::text FROM file_versions v JOIN files f ON v.file_id=f.id
+		WHERE f.space_id=$1 AND f.id=$2 FOR UPDATE OF f`
+	rows, err := tx.Query(ctx, query, spaceId, fileId)
+	if err != nil {
+		return nil, err
+	}
+	blobs, err := pgx.CollectRows(rows, pgx.RowTo[string])
+	if err != nil {
+		return nil, err
+	}
+
+	tag, err := tx.Exec(ctx, "DELETE FROM files WHERE space_id=$1 AND id=$2", spaceId, fileId)
+	if err != nil {
+		return nil, err
+	}
+	if tag.RowsAffected() == 0 {
+		return nil, pgx.ErrNoRows
+	}
+
+	return blobs, tx.Commit(ctx)
+}
+
+// insertSession stores a new session, it's also the last login of its user
+func (defaultDbData) insertSession(db *pgxpool.Pool, sess storedSession) error {
+	query := `WITH s AS (
+			INSERT INTO sessions (id, token_hash, username, expires_at, user_agent, ip)
+			VALUES ($1, $2, $3, $4, $5, $6) RETURNING username
+		)
+		UPDATE users SET last_login_at=now() WHERE username IN (SELECT username FROM s)`
+	_, err := db.Exec(context.Background(), query, sess.Id, sess.TokenHash, sess.Username, sess.ExpiresAt, sess.UserAgent, sess.Ip)
+	return err
+}
+
+// touchSession records that a session has been used from ip and returns it.
+// If the session doesn't exist or it has expired pgx.ErrNoRows is returned
+func (defaultDbData) touchSession(db *pgxpool.Pool, tokenHash string, ip string) (storedSession, error) {
+	query := `UPDATE sessions SET last_seen_at=now(), ip=$2
+		WHERE token_hash=$1 AND expires_at > now() RETURNING *`
+	rows, err := db.Query(context.Background(), query, tokenHash, ip)
+	if err != nil {
+		return storedSession{}, err
+	}
+	return pgx.CollectExactlyOneRow(rows, pgx.RowToStructByName[storedSession])
+}
+
+func (defaultDbData) deleteSession(db *pgxpool.Pool, tokenHash string) error {
+	if _, err := db.Exec(context.Background(), "DELETE FROM sessions WHERE token_hash=$1", tokenHash); err != nil {
+		return err
+	}
+	return nil
+}
+
+// userSessions returns the sessions of a user that have not expired, the most recently used first
+func (defaultDbData) userSessions(db *pgxpool.Pool, user string) ([]storedSession, error) {
+	query := "SELECT * FROM sessions WHERE username=$1 AND expires_at > now() ORDER BY last_seen_at DESC"
+	rows, err := db.Query(context.Background(), query, user)
+	if err != nil {
+		return nil, err
+	}
+	return pgx.CollectRows(rows, pgx.RowToStructByName[storedSession])
+}
+
+// deleteUserSession deletes a session of user. If it doesn't exist pgx.ErrNoRows is returned
+func (defaultDbData) deleteUserSession(db *pgxpool.Pool, user string, id string) error {
+	tag, err := db.Exec(context.Background(), "DELETE FROM sessions WHERE username=$1 AND id=$2", user, id)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return pgx.ErrNoRows
+	}
+	return nil
+}
+
+func (defaultDbData) deleteOtherSessions(db *pgxpool.Pool, user string, keepId string) error {
+	if _, err := db.Exec(context.Background(), "DELETE FROM sessions WHERE username=$1 AND id<>$2", user, keepId); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (defaultDbData) deleteExpiredSessions(db *pgxpool.Pool) error {
+	if _, err := db.Exec(context.Background(), "DELETE FROM sessions WHERE expires_at <= now()"); err != nil {
+		return err
+	}
+	return nil
+}
+
+// setTotpSecret starts the enrollment of user with a new secret.
+// If the user has already confirmed a secret pgx.ErrNoRows is returned
+func (defaultDbData) setTotpSecret(db *pgxpool.Pool, user string, secret string) error {
+	query := `INSERT INTO totp (username, secret) VALUES ($1, $2)
+		ON CONFLICT (username) DO UPDATE SET secret=EXCLUDED.secret, last_step=0, created_at=now()
+		WHERE totp.confirmed_at IS NULL`
+	tag, err := db.Exec(context.Background(), query, user, secret)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return pgx.ErrNoRows
+	}
+	return nil
+}
+
+func (defaultDbData) totpSecret(db *pgxpool.Pool, user string) (totpSecret, error) {
+	rows, err := db.Query(context.Background(), "SELECT * FROM totp WHERE username=$1", user)
+	if err != nil {
+		return totpSecret{}, err
+	}
+	return pgx.CollectExactlyOneRow(rows, pgx.RowToStructByName[totpSecret])
+}
+
+// useTotpStep records that the code of a time step has been used.
+// It returns false if a code of the same or of a later step has already been used
+func (defaultDbData) useTotpStep(db *pgxpool.Pool, user string, step int64) (bool, error) {
+	tag, err := db.Exec(context.Background(), "UPDATE totp SET last_step=$2 WHERE username=$1 AND last_step < $2", user, step)
+	if err != nil {
+		return false, err
+	}
+	return tag.RowsAffected() == 1, nil
+}
+
+// confirmTotp enables the second factor of user, with a new set of recovery codes.
+// If it's already enabled pgx.ErrNoRows is returned
+func (defaultDbData) confirmTotp(db *pgxpool.Pool, user string, codeHashes []string) error {
+	ctx := context.Background()
+	tx, err := db.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	tag, err := tx.Exec(ctx, "UPDATE totp SET confirmed_at=now() WHERE username=$1 AND confirmed_at IS NULL", user)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return pgx.ErrNoRows
+	}
+	if err := insertRecoveryCodes(ctx, tx, user, codeHashes); err != nil {
+		return err
+	}
+	return tx.Commit(ctx)
+}
+
+// replaceRecoveryCodes invalidates the recovery codes of user and stores new ones
+func (defaultDbData) replaceRecoveryCodes(db *pgxpool.Pool, user string, codeHashes []string) error {
+	ctx := context.Background()
+	tx, err := db.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	if err := insertRecoveryCodes(ctx, tx, user, codeHashes); err != nil {
+		return err
+	}
+	return tx.Commit(ctx)
+}
+
+func insertRecoveryCodes(ctx context.Context, tx pgx.Tx, user string, codeHashes []string) error {
+	if _, err := tx.Exec(ctx, "DELETE FROM recovery_codes WHERE username=$1", user); err != nil {
+		return err
+	}
+	for _, h := range codeHashes {
+		query := "INSERT INTO recovery_codes (id, username, code_hash) VALUES ($1, $2, $3)"
+		if _, err := tx.Exec(ctx, query, uuid.New(), user, h); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// useRecoveryCode marks a recovery code as used, it returns false if it doesn't exist or it was already used
+func (defaultDbData) useRecoveryCode(db *pgxpool.Pool, user string, codeHash string) (bool, error) {
+	query := "UPDATE recovery_codes SET used_at=now() WHERE username=$1 AND code_hash=$2 AND used_at IS NULL"
+	tag, err := db.Exec(context.Background(), query, user, codeHash)
+	if err != nil {
+		return false, err
+	}
+	return tag.RowsAffected() == 1, nil
+}
+
+// deleteTotp disables the second factor of user and deletes the recovery codes
+func (defaultDbData) deleteTotp(db *pgxpool.Pool, user string) error {
+	ctx := context.Background()
+	tx, err := db.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	if _, err := tx.Exec(ctx, "DELETE FROM totp WHERE username=$1", user); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(ctx, "DELETE FROM recovery_codes WHERE username=$1", user); err != nil {
+		return err
+	}
+	return tx.Commit(ctx)
+}
+
+// insertLoginChallenge stores a new challenge and deletes the expired ones
+func (defaultDbData) insertLoginChallenge(db *pgxpool.Pool, c loginChallenge) error {
+	if _, err := db.Exec(context.Background(), "DELETE FROM login_challenges WHERE expires_at <= now()"); err != nil {
+		return err
+	}
+	query := "INSERT INTO login_challenges (token_hash, username, remember, expires_at) VALUES ($1, $2, $3, $4)"
+	_, err := db.Exec(context.Background(), query, c.TokenHash, c.Username, c.Remember, c.ExpiresAt)
+	return err
+}
+
+// attemptLoginChallenge counts an attempt to answer a challenge and returns it.
+// If it doesn't exist, it has expired or it has run out of attempts pgx.ErrNoRows is returned
+func (defaultDbData) attemptLoginChallenge(db *pgxpool.Pool, tokenHash string, maxAttempts int) (loginChallenge, error) {
+	query := `UPDATE login_challenges SET attempts=attempts+1
+		WHERE token_hash=$1 AND expires_at > now() AND attempts < $2 RETURNING *`
+	rows, err := db.Query(context.Background(), query, tokenHash, maxAttempts)
+	if err != nil {
+		return loginChallenge{}, err
+	}
+	return pgx.CollectExactlyOneRow(rows, pgx.RowToStructByName[loginChallenge])
+}
+
+func (defaultDbData) deleteLoginChallenge(db *pgxpool.Pool, tokenHash string) error {
+	if _, err := db.Exec(context.Background(), "DELETE FROM login_challenges WHERE token_hash=$1", tokenHash); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (defaultDbData) insertPasskey(db *pgxpool.Pool, p passkey) error {
+	query := "INSERT INTO passkeys (id, username, name, credential) VALUES ($1, $2, $3, $4)"
+	_, err := db.Exec(context.Background(), query, p.Id, p.Username, p.Name, p.Credential)
+	return err
+}
+
+func (defaultDbData) userPasskeys(db *pgxpool.Pool, user string) ([]passkey, error) {
+	rows, err := db.Query(context.Background(), "SELECT * FROM passkeys WHERE username=$1 ORDER BY created_at", user)
+	if err != nil {
+		return nil, err
+	}
+	return pgx.CollectRows(rows, pgx.RowToStructByName[passkey])
+}
+
+func (defaultDbData) passkey(db *pgxpool.Pool, id []byte) (passkey, error) {
+	rows, err := db.Query(context.Background(), "SELECT * FROM passkeys WHERE id=$1", id)
+	if err != nil {
+		return passkey{}, err
+	}
+	return pgx.CollectExactlyOneRow(rows, pgx.RowToStructByName[passkey])
+}
+
+// usePasskey saves the credential after a login, its sign counter has changed
+func (defaultDbData) usePasskey(db *pgxpool.Pool, id []byte, cred webauthn.Credential) error {
+	_, err := db.Exec(context.Background(), "UPDATE passkeys SET credential=$2, last_used_at=now() WHERE id=$1", id, cred)
+	return err
+}
+
+// deletePasskey deletes a passkey of user. If it doesn't exist pgx.ErrNoRows is returned
+func (defaultDbData) deletePasskey(db *pgxpool.Pool, user string, id []byte) error {
+	tag, err := db.Exec(context.Background(), "DELETE FROM passkeys WHERE username=$1 AND id=$2", user, id)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return pgx.ErrNoRows
+	}
+	return nil
+}
+
+func (defaultDbData) insertPasskeyChallenge(db *pgxpool.Pool, c passkeyChallenge) error {
+	if _, err := db.Exec(context.Background(), "DELETE FROM passkey_challenges WHERE expires_at <= now()"); err != nil {
+		return err
+	}
+	query := "INSERT INTO passkey_challenges (id, session_id, data, expires_at) VALUES ($1, $2, $3, $4)"
+	_, err := db.Exec(context.Background(), query, c.Id, c.SessionId, c.Data, c.ExpiresAt)
+	return err
+}
+
+// takePasskeyChallenge deletes a challenge and returns it, so it can be answered only once.
+// sessionId must be the one that started the challenge, nil for logins.
+// If it doesn't exist or it has expired pgx.ErrNoRows is returned
+func (defaultDbData) takePasskeyChallenge(db *pgxpool.Pool, id string, sessionId *uuid.UUID) (passkeyChallenge, error) {
+	query := `DELETE FROM passkey_challenges
+		WHERE id=$1 AND session_id IS NOT DISTINCT FROM $2 AND expires_at > now() RETURNING *`
+	rows, err := db.Query(context.Background(), query, id, sessionId)
+	if err != nil {
+		return passkeyChallenge{}, err
+	}
+	return pgx.CollectExactlyOneRow(rows, pgx.RowToStructByName[passkeyChallenge])
+}
+
+func (defaultDbData) insertApiToken(db *pgxpool.Pool, t apiToken) error {
+	query := `INSERT INTO api_tokens (id, token_hash, username, name, scopes, expires_at)
+		VALUES ($1, $2, $3, $4, $5, $6)`
+	_, err := db.Exec(context.Background(), query, t.Id, t.TokenHash, t.Username, t.Name, t.Scopes, t.ExpiresAt)
+	return err
+}
+
+func (defaultDbData) userApiTokens(db *pgxpool.Pool, user string) ([]apiToken, error) {
+	rows, err := db.Query(context.Background(), "SELECT * FROM api_tokens WHERE username=$1 ORDER BY created_at", user)
+	if err != nil {
+		return nil, err
+	}
+	return pgx.CollectRows(rows, pgx.RowToStructByName[apiToken])
+}
+
+// useApiToken records the use of a token and returns it.
+// If it doesn't exist or it has expired pgx.ErrNoRows is returned
+func (defaultDbData) useApiToken(db *pgxpool.Pool, tokenHash string) (apiToken, error) {
+	query := `UPDATE api_tokens SET last_used_at=now()
+		WHERE token_hash=$1 AND (expires_at IS NULL OR expires_at > now()) RETURNING *`
+	rows, err := db.Query(context.Background(), query, tokenHash)
+	if err != nil {
+		return apiToken{}, err
+	}
+	return pgx.CollectExactlyOneRow(rows, pgx.RowToStructByName[apiToken])
+}
+
+// deleteApiToken revokes a token of user. If it doesn't exist pgx.ErrNoRows is returned
+func (defaultDbData) deleteApiToken(db *pgxpool.Pool, user string, id string) error {
+	tag, err := db.Exec(context.Background(), "DELETE FROM api_tokens WHERE username=$1 AND id=$2", user, id)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return pgx.ErrNoRows
+	}
+	return nil
+}
+
+func (defaultDbData) allUsers(db *pgxpool.Pool) ([]user, error) {
+	rows, err := db.Query(context.Background(), "SELECT * FROM users")
+	if err != nil {
+		return nil, err
+	}
+	return pgx.CollectRows(rows, pgx.RowToStructByName[user])
+}
+
+func (defaultDbData) userExists(db *pgxpool.Pool, username string) (user, error) {
+	rows, err := db.Query(context.Background(), "SELECT * FROM users WHERE username=$1", username)
+	if err != nil {
+		return user{}, err
+	}
+	u, err := pgx.CollectExactlyOneRow(rows, pgx.RowToStructByName[user])
+	if err != nil {
+		return user{}, err
+	}
+
+	return u, nil
+}
+
+// insertUser first hashes the password and then creates a new user using the hashed password
+func (defaultDbData) insertUser(db *pgxpool.Pool, username string, password string) error {
+	id := uuid.New()
+	pw, err := hashPassword(password)
+	if err != nil {
+		return err
+	}
+
+	query := "INSERT INTO users (id, username, password) VALUES ($1, $2, $3)"
+	if _, err := db.Exec(context.Background(), query, id, username, pw); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// insertInvitedUser creates a user like insertUser and uses up the invite with codeHash.
+// If the invite doesn't exist, it has been used or it has expired pgx.ErrNoRows is returned
+func (defaultDbData) insertInvitedUser(db *pgxpool.Pool, username string, password string, codeHash string) error {
+	pw, err := hashPassword(password)
+	if err != nil {
+		return err
+	}
+
+	ctx := context.Background()
+	tx, err := db.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	// The invite is checked first, so people without one can't find out which usernames are taken
+	var id uuid.UUID
+	query := "UPDATE invites SET used_at=now() WHERE code_hash=$1 AND used_at IS NULL AND expires_at > now() RETURNING id"
+	if err := tx.QueryRow(ctx, query, codeHash).Scan(&id); err != nil {
+		return err
+	}
+	query = "INSERT INTO users (id, username, password) VALUES ($1, $2, $3)"
+	if _, err := tx.Exec(ctx, query, uuid.New(), username, pw); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(ctx, "UPDATE invites SET used_by=$2 WHERE id=$1", id, username); err != nil {
+		return err
+	}
+	return tx.Commit(ctx)
+}
+
+// insertInvite stores a new invite, the expired ones that were never used are removed
+func (defaultDbData) insertInvite(db *pgxpool.Pool, i invite) error {
+	if _, err := db.Exec(context.Background(), "DELETE FROM invites WHERE used_at IS NULL AND expires_at <= now()"); err != nil {
+		return err
+	}
+	query := "INSERT INTO invites (id, code_hash, created_by, expires_at) VALUES ($1, $2, $3, $4)"
+	_, err := db.Exec(context.Background(), query, i.Id, i.CodeHash, i.CreatedBy, i.ExpiresAt)
+	return err
+}
+
+func (defaultDbData) userInvites(db *pgxpool.Pool, user string) ([]invite, error) {
+	rows, err := db.Query(context.Background(), "SELECT * FROM invites WHERE created_by=$1 ORDER BY created_at", user)
+	if err != nil {
+		return nil, err
+	}
+	return pgx.CollectRows(rows, pgx.RowToStructByName[invite])
+}
+
+// deleteInvite removes an invite of user. If it doesn't exist pgx.ErrNoRows is returned
+func (defaultDbData) deleteInvite(db *pgxpool.Pool, user string, id string) error {
+	tag, err := db.Exec(context.Background(), "DELETE FROM invites WHERE created_by=$1 AND id=$2", user, id)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return pgx.ErrNoRows
+	}
+	return nil
+}
+
+// rehashPassword replaces the hash of the password of user with a stronger one.
+// Nothing changes if the password has been changed in the meantime
+func (defaultDbData) rehashPassword(db *pgxpool.Pool, username string, oldHash string, newHash string) error {
+	query := "UPDATE users SET password=$3 WHERE username=$1 AND password=$2"
+	_, err := db.Exec(context.Background(), query, username, oldHash, newHash)
+	return err
+}
+
+// updatePassword hashes the new password of user and stores it.
+// The reset links of the user stop working
+func (defaultDbData) updatePassword(db *pgxpool.Pool, username string, password string) error {
+	pw, err := hashPassword(password)
+	if err != nil {
+		return err
+	}
+
+	ctx := context.Background()
+	tx, err := db.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	tag, err := tx.Exec(ctx, "UPDATE users SET password=$2 WHERE username=$1", username, pw)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return pgx.ErrNoRows
+	}
+	if _, err := tx.Exec(ctx, "DELETE FROM password_resets WHERE username=$1", username); err != nil {
+		return err
+	}
+	return tx.Commit(ctx)
+}
+
+func (defaultDbData) setEmail(db *pgxpool.Pool, username string, email *string) error {
+	if _, err := db.Exec(context.Background(), "UPDATE users SET email=$2 WHERE username=$1", username, email); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (defaultDbData) insertPasswordReset(db *pgxpool.Pool, username string, tokenHash string, expiresAt time.Time) error {
+	if _, err := db.Exec(context.Background(), "DELETE FROM password_resets WHERE expires_at <= now()"); err != nil {
+		return err
+	}
+	query := "INSERT INTO password_resets (token_hash, username, expires_at) VALUES ($1, $2, $3)"
+	_, err := db.Exec(context.Background(), query, tokenHash, username, expiresAt)
+	return err
+}
+
+// passwordReset returns the user of a reset link. If it doesn't exist or it has expired pgx.ErrNoRows is returned
+func (defaultDbData) passwordReset(db *pgxpool.Pool, tokenHash string) (string, error) {
+	var username string
+	query := "SELECT username FROM password_resets WHERE token_hash=$1 AND expires_at > now()"
+	err := db.QueryRow(context.Background(), query, tokenHash).Scan(&username)
+	return username, err
+}
+
+// resetPassword uses a reset link to set the password of its user, and returns the user.
+// Every reset link of the user stops working. If the link doesn't exist or it has expired
+// pgx.ErrNoRows is returned
+func (defaultDbData) resetPassword(db *pgxpool.Pool, tokenHash string, password string) (string, error) {
+	pw, err := hashPassword(password)
+	if err != nil {
+		return "", err
+	}
+
+	ctx := context.Background()
+	tx, err := db.Begin(ctx)
+	if err != nil {
+		return "", err
+	}
+	defer tx.Rollback(ctx)
+
+	var username string
+	query := "DELETE FROM password_resets WHERE token_hash=$1 AND expires_at > now() RETURNING username"
+	if err := tx.QueryRow(ctx, query, tokenHash).Scan(&username); err != nil {
+		return "", err
+	}
+	if _, err := tx.Exec(ctx, "UPDATE users SET password=$2 WHERE username=$1", username, pw); err != nil {
+		return "", err
+	}
+	if _, err := tx.Exec(ctx, "DELETE FROM password_resets WHERE username=$1", username); err != nil {
+		return "", err
+	}
+	return username, tx.Commit(ctx)
+}
+
+func (defaultDbData) insertOidcLogin(db *pgxpool.Pool, l oidcLogin) error {
+	if _, err := db.Exec(context.Background(), "DELETE FROM oidc_logins WHERE expires_at <= now()"); err != nil {
+		return err
+	}
+	query := "INSERT INTO oidc_logins (state_hash, verifier, nonce, remember, expires_at) VALUES ($1, $2, $3, $4, $5)"
+	_, err := db.Exec(context.Background(), query, l.StateHash, l.Verifier, l.Nonce, l.Remember, l.ExpiresAt)
+	return err
+}
+
+// takeOidcLogin deletes a pending login and returns it, so a callback can be used only once.
+// If it doesn't exist or it has expired pgx.ErrNoRows is returned
+func (defaultDbData) takeOidcLogin(db *pgxpool.Pool, stateHash string) (oidcLogin, error) {
+	query := "DELETE FROM oidc_logins WHERE state_hash=$1 AND expires_at > now() RETURNING *"
+	rows, err := db.Query(context.Background(), query, stateHash)
+	if err != nil {
+		return oidcLogin{}, err
+	}
+	return pgx.CollectExactlyOneRow(rows, pgx.RowToStructByName[oidcLogin])
+}
+
+// oidcUser returns the user linked to an identity. If there is none pgx.ErrNoRows is returned
+func (defaultDbData) oidcUser(db *pgxpool.Pool, issuer string, subject string) (user, error) {
+	query := `SELECT u.* FROM oidc_identities i JOIN users u ON u.username=i.username
+		WHERE i.issuer=$1 AND i.subject=$2`
+	rows, err := db.Query(context.Background(), query, issuer, subject)
+	if err != nil {
+		return user{}, err
+	}
+	return pgx.CollectExactlyOneRow(rows, pgx.RowToStructByName[user])
+}
+
+// provisionOidcUser creates the user of an identity on its first login. The password is random,
+// the user logs in through the identity provider. If the username is taken the error has code 23505
+func (defaultDbData) provisionOidcUser(db *pgxpool.Pool, username string, issuer string, subject string) (user, error) {
+	random, err := newLinkToken()
+	if err != nil {
+		return user{}, err
+	}
+	pw, err := hashPassword(random)
+	if err != nil {
+		return user{}, err
+	}
+	u := user{Username: username, Password: pw, Id: uuid.New(), Role: "user"}
+
+	ctx := context.Background()
+	tx, err := db.Begin(ctx)
+	if err != nil {
+		return user{}, err
+	}
+	defer tx.Rollback(ctx)
+
+	if _, err := tx.Exec(ctx, "INSERT INTO users (id, username, password) VALUES ($1, $2, $3)", u.Id, u.Username, u.Password); err != nil {
+		return user{}, err
+	}
+	query := "INSERT INTO oidc_identities (issuer, subject, username) VALUES ($1, $2, $3)"
+	if _, err := tx.Exec(ctx, query, issuer, subject, username); err != nil {
+		return user{}, err
+	}
+	return u, tx.Commit(ctx)
+}
+
+// deleteUser deletes the user with its personal clips and files, the ones it created in spaces stay in the spaces.
+// The spaces it was the last owner of go to their oldest member, the ones left without members are deleted:
+// it returns the ids of their file versions, by space, whose blobs need to be deleted from the system
+func (defaultDbData) deleteUser(db *pgxpool.Pool, username string) (map[string][]string, error) {
+	ctx := context.Background()
+	tx, err := db.Begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback(ctx)
+
+	rows, err := tx.Query(ctx, "SELECT space_id::text FROM space_members WHERE username=$1 AND role='owner'", username)
+	if err != nil {
+		return nil, err
+	}
+	owned, err := pgx.CollectRows(rows, pgx.RowTo[string])
+	if err != nil {
+		return nil, err
+	}
+	deleted := map[string][]string{}
+	for _, spaceId := range owned {
+		if err := checkLastOwner(ctx, tx, spaceId, username); !errors.Is(err, ErrLastOwner) {
+			if err != nil {
+				return nil, err
+			}
+			continue
+		}
+		// Editors before viewers, members added together have the same joined_at
+		query := `UPDATE space_members SET role='owner' WHERE space_id=$1 AND username=(
+			SELECT username FROM space_members WHERE space_id=$1 AND username<>$2
+			ORDER BY joined_at, role='viewer', username LIMIT 1 FOR UPDATE)`
+		tag, err := tx.Exec(ctx, query, spaceId, username)
+		if err != nil {
+			return nil, err
+		}
+		if tag.RowsAffected() == 0 {
+			if deleted[spaceId], err = deleteSpaceTx(ctx, tx, spaceId); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	for _, query := range []string{
+		"UPDATE clipboard SET username=NULL WHERE username=$1 AND space_id IS NOT NULL",
+		"UPDATE files SET username=NULL WHERE username=$1 AND space_id IS NOT NULL",
+		"DELETE FROM users WHERE username=$1",
+	} {
+		if _, err := tx.Exec(ctx, query, username); err != nil {
+			return nil, err
+		}
+	}
+	return deleted, tx.Commit(ctx)
+}
+
+func (defaultDbData) userById(db *pgxpool.Pool, id string) (user, error) {
+	rows, err := db.Query(context.Background(), "SELECT * FROM users WHERE id=$1", id)
+	if err != nil {
+		return user{}, err
+	}
+	return pgx.CollectExactlyOneRow(rows, pgx.RowToStructByName[user])
+}
+
+// adminUsers lists every user with the storage used and the open sessions
+func (defaultDbData) adminUsers(db *pgxpool.Pool) ([]adminUser, error) {
+	query := `SELECT u.username, u.id, u.role, u.disabled, u.last_login_at,
+			COALESCE((SELECT sum(v.size) FROM files f JOIN file_versions v ON v.file_id=f.id
+				WHERE f.username=u.username AND f.space_id IS NULL), 0)::BIGINT AS storage,
+			(SELECT count(*) FROM sessions s WHERE s.username=u.username AND s.expires_at > now()) AS sessions
+		FROM users u ORDER BY u.username`
+	rows, err := db.Query(context.Background(), query)
+	if err != nil {
+		return nil, err
+	}
+	return pgx.CollectRows(rows, pgx.RowToStructByName[adminUser])
+}
+
+func (defaultDbData) setRole(db *pgxpool.Pool, username string, role string) error {
+	tag, err := db.Exec(context.Background(), "UPDATE users SET role=$2 WHERE username=$1", username, role)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return pgx.ErrNoRows
+	}
+	return nil
+}
+
+// setDisabled disables or enables the account of user. Disabling it deletes its sessions
+func (defaultDbData) setDisabled(db *pgxpool.Pool, username string, disabled bool) error {
+	ctx := context.Background()
+	tx, err := db.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	tag, err := tx.Exec(ctx, "UPDATE users SET disabled=$2 WHERE username=$1", username, disabled)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return pgx.ErrNoRows
+	}
+	if disabled {
+		if _, err := tx.Exec(ctx, "DELETE FROM sessions WHERE username=$1", username); err != nil {
+			return err
+		}
+	}
+	return tx.Commit(ctx)
+}
+
+func (defaultDbData) deleteUserSessions(db *pgxpool.Pool, username string) error {
+	if _, err := db.Exec(context.Background(), "DELETE FROM sessions WHERE username=$1", username); err != nil {
+		return err
+	}
+	return nil
+}
+
+// nullableId maps the empty id, used for the root folder, to NULL
+func nullableId(id string) any {
+	if id == "" {
+		return nil
+	}
+	return id
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// The spaces of a deleted last owner go to their oldest member or are deleted when nobody is left
+func TestDeleteUserSpaces(t *testing.T) {
+	pool := testPool(t)
+	ctx := context.Background()
+	if _, err := pool.Exec(ctx, mig); err != nil {
+		t.Fatal(err)
+	}
+	exec := func(query string, args ...any) {
+		t.Helper()
+		if _, err := pool.Exec(ctx, query, args...); err != nil {
+			t.Fatalf("%s: %v", query, err)
+		}
+	}
+	for _, name := range []string{"alice", "bob", "carol"} {
+		exec("INSERT INTO users (id, username, password) VALUES ($1, $2, '')", uuid.New(), name)
+	}
+	shared, alone := uuid.New(), uuid.New()
+	exec("INSERT INTO spaces (id, name) VALUES ($1, 'shared'), ($2, 'alone')", shared, alone)
+	joined := time.Now().Add(-time.Hour)
+	exec(`INSERT INTO space_members (space_id, username, role, joined_at) VALUES
+		($1, 'alice', 'owner', $2), ($1, 'bob', 'viewer', $3), ($1, 'carol', 'editor', $4), ($5, 'alice', 'owner', $2)`,
+		shared, joined, joined.Add(time.Minute), joined.Add(2*time.Minute), alone)
+	file, version := uuid.New(), uuid.New()
+	exec("INSERT INTO files (id, filename, username, space_id) VALUES ($1, 'a.txt', 'alice', $2)", file, alone)
+	exec("INSERT INTO file_versions (id, file_id, version, size) VALUES ($1, $2, 1, 5)", version, file)
+
+	deleted, err := defaultDbData{}.deleteUser(pool, "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(deleted) != 1 || len(deleted[alone.String()]) != 1 || deleted[alone.String()][0] != version.String() {
+		t.Errorf("deleted %v, want the space alone with its version", deleted)
+	}
+	var role string
+	if err := pool.QueryRow(ctx, "SELECT role FROM space_members WHERE space_id=$1 AND username='bob'", shared).Scan(&role); err != nil || role != roleOwner {
+		t.Errorf("the oldest member is %q: %v", role, err)
+	}
+	var spaces int
+	pool.QueryRow(ctx, "SELECT count(*) FROM spaces").Scan(&spaces)
+	if spaces != 1 {
+		t.Errorf("%d spaces left", spaces)
+	}
+}
+
+// Concurrent uploads to the same file get consecutive versions
+func TestInsertVersionConcurrent(t *testing.T) {
+	pool := testPool(t)
+	ctx := context.Background()
+	if _, err := pool.Exec(ctx, mig); err != nil {
+		t.Fatal(err)
+	}
+	file := uuid.New()
+	if _, err := pool.Exec(ctx, "INSERT INTO users (id, username, password) VALUES ($1, 'alice', '')", uuid.New()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := pool.Exec(ctx, "INSERT INTO files (id, filename, username) VALUES ($1, 'a.txt', 'alice')", file); err != nil {
+		t.Fatal(err)
+	}
+
+	const uploads = 10
+	errs := make(chan error, uploads)
+	for i := 0; i < uploads; i++ {
+		go func() {
+			errs <- defaultDbData{}.insertVersion(pool, "alice", file.String(), uuid.NewString(), 5, nil, scanClean)
+		}()
+	}
+	for i := 0; i < uploads; i++ {
+		if err := <-errs; err != nil {
+			t.Error(err)
+		}
+	}
+	var count, last int
+	pool.QueryRow(ctx, "SELECT count(*), max(version) FROM file_versions WHERE file_id=$1", file).Scan(&count, &last)
+	if count != uploads || last != uploads {
+		t.Errorf("%d versions up to %d, want %d", count, last, uploads)
+	}
+}
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// Content types that a browser can execute, they are never displayed inline
+var activeContentTypes = map[string]bool{
+	"text/html":              true,
+	"application/xhtml+xml":  true,
+	"image/svg+xml":          true,
+	"text/xml":               true,
+	"application/xml":        true,
+	"text/xsl":               true,
+	"text/javascript":        true,
+	"application/javascript": true,
+	"application/pdf":        true,
+}
+
+var downloadTokenExpir = 5 * time.Minute
+
+// downloadKey signs the links to DOWNLOAD_ORIGIN, set by NewEnv
+var downloadKey []byte
+
+// newDownloadKey derives the key of the download links from SECRET_KEY, so the links keep working
+// after a restart and on every instance. It's nil when DOWNLOAD_ORIGIN is not set
+func newDownloadKey() ([]byte, error) {
+	if os.Getenv("DOWNLOAD_ORIGIN") == "" {
+		return nil, nil
+	}
+	k := os.Getenv("SECRET_KEY")
+	if k == "" {
+		return nil, errors.New("DOWNLOAD_ORIGIN needs SECRET_KEY to sign the download links")
+	}
+	mac := hmac.New(sha256.New, []byte(k))
+	mac.Write([]byte("download"))
+	return mac.Sum(nil), nil
+}
+
+// downloadOrigin returns the origin configured to serve uploaded content, if any
+func downloadOrigin() (*url.URL, bool) {
+	origin := os.Getenv("DOWNLOAD_ORIGIN")
+	if origin == "" {
+		return nil, false
+	}
+	u, err := url.Parse(origin)
+	if err != nil || u.Host == "" {
+		log.Printf("err: invalid DOWNLOAD_ORIGIN %q\n", origin)
+		return nil, false
+	}
+	return u, true
+}
+
+// serveBlob sends the blob at pth as the file called filename.
+// Content that can be rendered as an active document is always sent as an attachment
+func serveBlob(w HTMLWriter, r *http.Request, pth string, filename string) {
+	f, err := os.Open(pth)
+	if err != nil {
+		log.Printf("err: %v\n", err)
+		w.Status = http.StatusNotFound
+		w.WriteHeader()
+		return
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		log.Printf("err: %v\n", err)
+		w.Status = http.StatusInternalServerError
+		w.WriteHeader()
+		return
+	}
+
+	ctype, err := contentType(f, filename)
+	if err != nil {
+		log.Printf("err: %v\n", err)
+		w.Status = http.StatusInternalServerError
+		w.WriteHeader()
+		return
+	}
+	disposition := "inline"
+	if isActiveContent(ctype) {
+		disposition = "attachment"
+	}
+
+	h := w.Writer.Header()
+	h.Set("Content-Type", ctype)
+	h.Set("Content-Disposition", contentDisposition(disposition, filename))
+	h.Set("X-Content-Type-Options", "nosniff")
+	h.Set("Content-Security-Policy", "default-src 'none'; style-src 'unsafe-inline'; sandbox")
+	http.ServeContent(w.Writer, r, "", info.ModTime(), f)
+}
+
+// contentType guesses the type from the extension of filename and falls back to sniffing the content
+func contentType(f io.ReadSeeker, filename string) (string, error) {
+	if ctype := mime.TypeByExtension(path.Ext(filename)); ctype != "" {
+		return ctype, nil
+	}
+
+	buf := make([]byte, 512)
+	n, err := io.ReadFull(f, buf)
+	if err != nil && !errors.Is(err, io.EOF) && !errors.Is(err, io.ErrUnexpectedEOF) {
+		return "", err
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return "", err
+	}
+	return http.DetectContentType(buf[:n]), nil
+}
+
+func isActiveContent(ctype string) bool {
+	media, _, err := mime.ParseMediaType(ctype)
+	if err != nil {
+		return true
+	}
+	return activeContentTypes[media] || strings.HasSuffix(media, "+xml")
+}
+
+// contentDisposition encodes filename following RFC 6266: an ASCII fallback in filename
+// and the full name, percent encoded as described in RFC 5987, in filename*
+func contentDisposition(disposition string, filename string) string {
+	fallback := strings.Map(func(r rune) rune {
+		if r > unicode.MaxASCII || unicode.IsControl(r) || r == '"' || r == '\\' {
+			return '_'
+		}
+		return r
+	}, filename)
+
+	var enc strings.Builder
+	for _, b := range []byte(filename) {
+		if isAttrChar(b) {
+			enc.WriteByte(b)
+		} else {
+			fmt.Fprintf(&enc, "%%%02X", b)
+		}
+	}
+
+	return fmt.Sprintf(`%s; filename="%s"; filename*=UTF-8''%s`, disposition, fallback, enc.String())
+}
+
+// isAttrChar reports whether b is an attr-char as defined by RFC 5987
+func isAttrChar(b byte) bool {
+	switch {
+	case 'a' <= b && b <= 'z', 'A' <= b && b <= 'Z', '0' <= b && b <= '9':
+		return true
+	}
+	return strings.IndexByte("!#$&+-.^_`|~", b) >= 0
+}
+
+// downloadToken signs the blob of a user's file version so it can be served by the download origin
+func downloadToken(userId string, versionId string, filename string) string {
+	exp := strconv.FormatInt(time.Now().Add(downloadTokenExpir).Unix(), 10)
+	payload := strings.Join([]string{userId, versionId, exp, filename}, "/")
+
+	enc := base64.RawURLEncoding.EncodeToString([]byte(payload))
+	return enc + "." + base64.RawURLEncoding.EncodeToString(signDownload(enc))
+}
+
+// parseDownloadToken verifies a token made by downloadToken and returns its content
+func parseDownloadToken(token string) (userId string, versionId string, filename string, err error) {
+	enc, sig, found := strings.Cut(token, ".")
+	if !found {
+		return "", "", "", errors.New("malformed download token")
+	}
+	rawSig, err := base64.RawURLEncoding.DecodeString(sig)
+	if err != nil {
+		return "", "", "", err
+	}
+	if !hmac.Equal(rawSig, signDownload(enc)) {
+		return "", "", "", errors.New("invalid download token signature")
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(enc)
+	if err != nil {
+		return "", "", "", err
+	}
+	parts := strings.SplitN(string(payload), "/", 4)
+	if len(parts) != 4 {
+		return "", "", "", errors.New("malformed download token")
+	}
+	exp, err := strconv.ParseInt(parts[2], 10, 64)
+	if err != nil {
+		return "", "", "", err
+	}
+	if time.Now().Unix() > exp {
+		return "", "", "", errors.New("download token expired")
+	}
+
+	return parts[0], parts[1], parts[3], nil
+}
+
+func signDownload(payload string) []byte {
+	mac := hmac.New(sha256.New, downloadKey)
+	mac.Write([]byte(payload))
+	return mac.Sum(nil)
+}
+
+// downloadFromOrigin serves the blobs signed by downloadToken.
+// It only answers on the host of DOWNLOAD_ORIGIN, so uploaded content never runs on the main origin
+func downloadFromOrigin(w HTMLWriter, r *http.Request) {
+	origin, ok := downloadOrigin()
+	if !ok || r.Host != origin.Host {
+		w.Status = http.StatusNotFound
+		w.WriteHeader()
+		return
+	}
+
+	userId, versionId, filename, err := parseDownloadToken(r.PathValue("token"))
+	if err != nil {
+		log.Printf("err: %v\n", err)
+		w.Status = http.StatusForbidden
+		w.WriteHeader()
+		return
+	}
+
+	serveBlob(w, r, path.Join("./filedir", userId, versionId), filename)
+}
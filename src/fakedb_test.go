@@ -0,0 +1,791 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/go-webauthn/webauthn/webauthn"
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// fakeDb keeps in memory the rows the tests use, like the tables of the same names.
+// The methods it doesn't implement panic with their name, see unimplementedDb
+type fakeDb struct {
+	unimplementedDb
+	sync.Mutex // reset links are sent from goroutines
+
+	users      map[string]user
+	sessions   []storedSession
+	loggedOut  []string // the users whose sessions were all deleted
+	rehashed   int      // the hashes upgraded by rehashPassword
+	passkeys   map[string]passkey
+	challenges map[string]passkeyChallenge
+	tokens     map[string]apiToken // by hash
+	resets     map[string]string   // token hash to username
+	oidcLogins map[string]oidcLogin
+	identities map[string]string // issuer and subject to username
+	totp       map[string]totpSecret
+	recovery   map[string]bool // username and code hash, true once used
+
+	// The outcome of the scans by version id
+	scanStatus   map[string]string
+	scanReason   map[string]string
+	scanAttempts map[string]int
+
+	spaces []space
+	blobs  map[string]blobRef // versions by id
+	fileOf map[string]string  // the file of every version, by version id
+	files  map[string]bool    // file ids
+}
+
+func newFakeDb(users ...user) *fakeDb {
+	d := &fakeDb{
+		users:        map[string]user{},
+		passkeys:     map[string]passkey{},
+		challenges:   map[string]passkeyChallenge{},
+		tokens:       map[string]apiToken{},
+		resets:       map[string]string{},
+		oidcLogins:   map[string]oidcLogin{},
+		identities:   map[string]string{},
+		totp:         map[string]totpSecret{},
+		recovery:     map[string]bool{},
+		scanStatus:   map[string]string{},
+		scanReason:   map[string]string{},
+		scanAttempts: map[string]int{},
+		blobs:        map[string]blobRef{},
+		fileOf:       map[string]string{},
+		files:        map[string]bool{},
+	}
+	for _, u := range users {
+		d.users[u.Username] = u
+	}
+	return d
+}
+
+// USERS AND SESSIONS //
+
+func (d *fakeDb) allUsers(*pgxpool.Pool) ([]user, error) {
+	d.Lock()
+	defer d.Unlock()
+	var list []user
+	for _, u := range d.users {
+		list = append(list, u)
+	}
+	return list, nil
+}
+
+func (d *fakeDb) allSpaces(*pgxpool.Pool) ([]space, error) {
+	return d.spaces, nil
+}
+
+func (d *fakeDb) userExists(_ *pgxpool.Pool, username string) (user, error) {
+	d.Lock()
+	defer d.Unlock()
+	if u, ok := d.users[username]; ok {
+		return u, nil
+	}
+	return user{}, pgx.ErrNoRows
+}
+
+func (d *fakeDb) insertSession(_ *pgxpool.Pool, sess storedSession) error {
+	d.Lock()
+	defer d.Unlock()
+	d.sessions = append(d.sessions, sess)
+	return nil
+}
+
+func (d *fakeDb) deleteUserSessions(_ *pgxpool.Pool, username string) error {
+	d.Lock()
+	defer d.Unlock()
+	d.loggedOut = append(d.loggedOut, username)
+	return nil
+}
+
+func (d *fakeDb) rehashPassword(_ *pgxpool.Pool, username string, oldHash string, newHash string) error {
+	d.Lock()
+	defer d.Unlock()
+	u, ok := d.users[username]
+	if !ok || u.Password != oldHash {
+		return pgx.ErrNoRows // the password changed in the meantime
+	}
+	u.Password = newHash
+	d.users[username] = u
+	d.rehashed++
+	return nil
+}
+
+func (d *fakeDb) useApiToken(_ *pgxpool.Pool, tokenHash string) (apiToken, error) {
+	d.Lock()
+	defer d.Unlock()
+	if t, ok := d.tokens[tokenHash]; ok {
+		return t, nil
+	}
+	return apiToken{}, pgx.ErrNoRows
+}
+
+// PASSWORD RESETS //
+
+func (d *fakeDb) insertPasswordReset(_ *pgxpool.Pool, username string, tokenHash string, _ time.Time) error {
+	d.Lock()
+	defer d.Unlock()
+	d.resets[tokenHash] = username
+	return nil
+}
+
+func (d *fakeDb) passwordReset(_ *pgxpool.Pool, tokenHash string) (string, error) {
+	d.Lock()
+	defer d.Unlock()
+	username, ok := d.resets[tokenHash]
+	if !ok {
+		return "", pgx.ErrNoRows
+	}
+	return username, nil
+}
+
+func (d *fakeDb) resetPassword(_ *pgxpool.Pool, tokenHash string, password string) (string, error) {
+	pw, err := hashPassword(password)
+	if err != nil {
+		return "", err
+	}
+	d.Lock()
+	defer d.Unlock()
+	username, ok := d.resets[tokenHash]
+	if !ok {
+		return "", pgx.ErrNoRows
+	}
+	delete(d.resets, tokenHash)
+	u := d.users[username]
+	u.Password = pw
+	d.users[username] = u
+	return username, nil
+}
+
+// PASSKEYS //
+
+func (d *fakeDb) insertPasskey(_ *pgxpool.Pool, p passkey) error {
+	d.Lock()
+	defer d.Unlock()
+	d.passkeys[string(p.Id)] = p
+	return nil
+}
+
+func (d *fakeDb) userPasskeys(_ *pgxpool.Pool, username string) ([]passkey, error) {
+	d.Lock()
+	defer d.Unlock()
+	var list []passkey
+	for _, p := range d.passkeys {
+		if p.Username == username {
+			list = append(list, p)
+		}
+	}
+	return list, nil
+}
+
+func (d *fakeDb) passkey(_ *pgxpool.Pool, id []byte) (passkey, error) {
+	d.Lock()
+	defer d.Unlock()
+	if p, ok := d.passkeys[string(id)]; ok {
+		return p, nil
+	}
+	return passkey{}, pgx.ErrNoRows
+}
+
+func (d *fakeDb) usePasskey(_ *pgxpool.Pool, id []byte, cred webauthn.Credential) error {
+	d.Lock()
+	defer d.Unlock()
+	p := d.passkeys[string(id)]
+	p.Credential = cred
+	d.passkeys[string(id)] = p
+	return nil
+}
+
+func (d *fakeDb) insertPasskeyChallenge(_ *pgxpool.Pool, c passkeyChallenge) error {
+	d.Lock()
+	defer d.Unlock()
+	d.challenges[c.Id.String()] = c
+	return nil
+}
+
+func (d *fakeDb) takePasskeyChallenge(_ *pgxpool.Pool, id string, sessionId *uuid.UUID) (passkeyChallenge, error) {
+	d.Lock()
+	defer d.Unlock()
+	c, ok := d.challenges[id]
+	if !ok || (c.SessionId == nil) != (sessionId == nil) || sessionId != nil && *c.SessionId != *sessionId {
+		return passkeyChallenge{}, pgx.ErrNoRows
+	}
+	delete(d.challenges, id)
+	return c, nil
+}
+
+// SINGLE SIGN-ON //
+
+func (d *fakeDb) insertOidcLogin(_ *pgxpool.Pool, l oidcLogin) error {
+	d.Lock()
+	defer d.Unlock()
+	d.oidcLogins[l.StateHash] = l
+	return nil
+}
+
+func (d *fakeDb) takeOidcLogin(_ *pgxpool.Pool, stateHash string) (oidcLogin, error) {
+	d.Lock()
+	defer d.Unlock()
+	l, ok := d.oidcLogins[stateHash]
+	if !ok || !l.ExpiresAt.After(time.Now()) {
+		return oidcLogin{}, pgx.ErrNoRows
+	}
+	delete(d.oidcLogins, stateHash)
+	return l, nil
+}
+
+func (d *fakeDb) oidcUser(_ *pgxpool.Pool, issuer string, subject string) (user, error) {
+	d.Lock()
+	defer d.Unlock()
+	username, ok := d.identities[issuer+" "+subject]
+	if !ok {
+		return user{}, pgx.ErrNoRows
+	}
+	return d.users[username], nil
+}
+
+func (d *fakeDb) provisionOidcUser(_ *pgxpool.Pool, username string, issuer string, subject string) (user, error) {
+	d.Lock()
+	defer d.Unlock()
+	if _, ok := d.users[username]; ok {
+		return user{}, &pgconn.PgError{Code: "23505"}
+	}
+	u := user{Username: username, Id: uuid.New()}
+	d.users[username] = u
+	d.identities[issuer+" "+subject] = username
+	return u, nil
+}
+
+// SECOND FACTOR //
+
+func (d *fakeDb) totpSecret(_ *pgxpool.Pool, user string) (totpSecret, error) {
+	d.Lock()
+	defer d.Unlock()
+	if s, ok := d.totp[user]; ok {
+		return s, nil
+	}
+	return totpSecret{}, pgx.ErrNoRows
+}
+
+func (d *fakeDb) useTotpStep(_ *pgxpool.Pool, user string, step int64) (bool, error) {
+	d.Lock()
+	defer d.Unlock()
+	s, ok := d.totp[user]
+	if !ok || s.LastStep >= step {
+		return false, nil
+	}
+	s.LastStep = step
+	d.totp[user] = s
+	return true, nil
+}
+
+func (d *fakeDb) useRecoveryCode(_ *pgxpool.Pool, user string, codeHash string) (bool, error) {
+	d.Lock()
+	defer d.Unlock()
+	used, ok := d.recovery[user+" "+codeHash]
+	if !ok || used {
+		return false, nil
+	}
+	d.recovery[user+" "+codeHash] = true
+	return true, nil
+}
+
+// SCANS //
+
+func (d *fakeDb) scanFailed(_ *pgxpool.Pool, versionId string) (int, error) {
+	d.Lock()
+	defer d.Unlock()
+	d.scanAttempts[versionId]++
+	return d.scanAttempts[versionId], nil
+}
+
+func (d *fakeDb) setScanResult(_ *pgxpool.Pool, versionId string, status string, reason string) (file, error) {
+	d.Lock()
+	defer d.Unlock()
+	d.scanStatus[versionId] = status
+	d.scanReason[versionId] = reason
+	if b, ok := d.blobs[versionId]; ok {
+		b.ScanStatus = status
+		d.blobs[versionId] = b
+	}
+	return file{Filename: "a.txt", Username: "alice", Id: uuid.New()}, nil
+}
+
+func (d *fakeDb) grantees(*pgxpool.Pool, string, string) ([]string, error) {
+	return nil, nil
+}
+
+// VERSIONS //
+
+// addVersion stores a version of fileId, creating the file if needed
+func (d *fakeDb) addVersion(fileId string, b blobRef) {
+	d.Lock()
+	defer d.Unlock()
+	d.files[fileId] = true
+	d.blobs[b.Id.String()] = b
+	d.fileOf[b.Id.String()] = fileId
+}
+
+func (d *fakeDb) allBlobs(*pgxpool.Pool) ([]blobRef, error) {
+	d.Lock()
+	defer d.Unlock()
+	var list []blobRef
+	for _, b := range d.blobs {
+		list = append(list, b)
+	}
+	return list, nil
+}
+
+func (d *fakeDb) setChecksum(_ *pgxpool.Pool, versionId string, checksum string) error {
+	d.Lock()
+	defer d.Unlock()
+	if b, ok := d.blobs[versionId]; ok {
+		b.Checksum = &checksum
+		d.blobs[versionId] = b
+	}
+	return nil
+}
+
+func (d *fakeDb) deleteVersions(_ *pgxpool.Pool, ids ...string) error {
+	d.Lock()
+	defer d.Unlock()
+	for _, id := range ids {
+		delete(d.blobs, id)
+		delete(d.fileOf, id)
+	}
+	return nil
+}
+
+func (d *fakeDb) emptyFiles(*pgxpool.Pool) ([]string, error) {
+	d.Lock()
+	defer d.Unlock()
+	return d.emptyFileIds(), nil
+}
+
+func (d *fakeDb) deleteEmptyFiles(*pgxpool.Pool) ([]string, error) {
+	d.Lock()
+	defer d.Unlock()
+	ids := d.emptyFileIds()
+	for _, id := range ids {
+		delete(d.files, id)
+	}
+	return ids, nil
+}
+
+func (d *fakeDb) emptyFileIds() []string {
+	used := map[string]bool{}
+	for _, f := range d.fileOf {
+		used[f] = true
+	}
+	var ids []string
+	for f := range d.files {
+		if !used[f] {
+			ids = append(ids, f)
+		}
+	}
+	return ids
+}
+
+// unimplementedDb implements dbData with methods that panic with their name, so a test that reaches
+// a query fakeDb doesn't keep fails on it instead of on a nil interface
+type unimplementedDb struct{}
+
+func (unimplementedDb) allClips(*pgxpool.Pool, string) ([]clipboard, error) {
+	panic("fakeDb: allClips is not implemented")
+}
+func (unimplementedDb) insertClip(*pgxpool.Pool, string, string) error {
+	panic("fakeDb: insertClip is not implemented")
+}
+func (unimplementedDb) deleteClips(*pgxpool.Pool, string, ...string) error {
+	panic("fakeDb: deleteClips is not implemented")
+}
+func (unimplementedDb) deleteAllClips(*pgxpool.Pool, string) error {
+	panic("fakeDb: deleteAllClips is not implemented")
+}
+func (unimplementedDb) userClip(*pgxpool.Pool, string, string) (clipboard, error) {
+	panic("fakeDb: userClip is not implemented")
+}
+func (unimplementedDb) updateClip(*pgxpool.Pool, string, string) error {
+	panic("fakeDb: updateClip is not implemented")
+}
+func (unimplementedDb) insertFile(*pgxpool.Pool, string, string, string, int64, string, *uuid.UUID) (string, string, error) {
+	panic("fakeDb: insertFile is not implemented")
+}
+func (unimplementedDb) insertGuestFile(*pgxpool.Pool, string, string, string, int64, string, uuid.UUID) (string, string, string, error) {
+	panic("fakeDb: insertGuestFile is not implemented")
+}
+func (unimplementedDb) allFiles(*pgxpool.Pool, string, string) ([]listedFile, error) {
+	panic("fakeDb: allFiles is not implemented")
+}
+func (unimplementedDb) userFile(*pgxpool.Pool, string, string) (file, error) {
+	panic("fakeDb: userFile is not implemented")
+}
+func (unimplementedDb) moveFile(*pgxpool.Pool, string, string, string) (file, error) {
+	panic("fakeDb: moveFile is not implemented")
+}
+func (unimplementedDb) deleteFiles(*pgxpool.Pool, string, ...string) ([]file, []string, error) {
+	panic("fakeDb: deleteFiles is not implemented")
+}
+func (unimplementedDb) fileVersions(*pgxpool.Pool, string, string) ([]fileVersion, error) {
+	panic("fakeDb: fileVersions is not implemented")
+}
+func (unimplementedDb) fileVersion(*pgxpool.Pool, string, string, string) (fileVersion, error) {
+	panic("fakeDb: fileVersion is not implemented")
+}
+func (unimplementedDb) insertVersion(*pgxpool.Pool, string, string, string, int64, *string, string) error {
+	panic("fakeDb: insertVersion is not implemented")
+}
+func (unimplementedDb) setChecksum(*pgxpool.Pool, string, string) error {
+	panic("fakeDb: setChecksum is not implemented")
+}
+func (unimplementedDb) allBlobs(*pgxpool.Pool) ([]blobRef, error) {
+	panic("fakeDb: allBlobs is not implemented")
+}
+func (unimplementedDb) pendingScans(*pgxpool.Pool, time.Time) ([]blobRef, error) {
+	panic("fakeDb: pendingScans is not implemented")
+}
+func (unimplementedDb) setScanResult(*pgxpool.Pool, string, string, string) (file, error) {
+	panic("fakeDb: setScanResult is not implemented")
+}
+func (unimplementedDb) scanFailed(*pgxpool.Pool, string) (int, error) {
+	panic("fakeDb: scanFailed is not implemented")
+}
+func (unimplementedDb) deleteVersions(*pgxpool.Pool, ...string) error {
+	panic("fakeDb: deleteVersions is not implemented")
+}
+func (unimplementedDb) emptyFiles(*pgxpool.Pool) ([]string, error) {
+	panic("fakeDb: emptyFiles is not implemented")
+}
+func (unimplementedDb) deleteEmptyFiles(*pgxpool.Pool) ([]string, error) {
+	panic("fakeDb: deleteEmptyFiles is not implemented")
+}
+func (unimplementedDb) insertFolder(*pgxpool.Pool, string, string, string) (string, error) {
+	panic("fakeDb: insertFolder is not implemented")
+}
+func (unimplementedDb) folder(*pgxpool.Pool, string, string) (folder, error) {
+	panic("fakeDb: folder is not implemented")
+}
+func (unimplementedDb) subFolders(*pgxpool.Pool, string, string) ([]folder, error) {
+	panic("fakeDb: subFolders is not implemented")
+}
+func (unimplementedDb) folderPath(*pgxpool.Pool, string, string) ([]folder, error) {
+	panic("fakeDb: folderPath is not implemented")
+}
+func (unimplementedDb) allFolders(*pgxpool.Pool, string) ([]folderOption, error) {
+	panic("fakeDb: allFolders is not implemented")
+}
+func (unimplementedDb) renameFolder(*pgxpool.Pool, string, string, string) error {
+	panic("fakeDb: renameFolder is not implemented")
+}
+func (unimplementedDb) moveFolder(*pgxpool.Pool, string, string, string) error {
+	panic("fakeDb: moveFolder is not implemented")
+}
+func (unimplementedDb) deleteFolder(*pgxpool.Pool, string, string) ([]string, error) {
+	panic("fakeDb: deleteFolder is not implemented")
+}
+func (unimplementedDb) insertShareLink(*pgxpool.Pool, shareLink) error {
+	panic("fakeDb: insertShareLink is not implemented")
+}
+func (unimplementedDb) userShareLinks(*pgxpool.Pool, string) ([]listedShareLink, error) {
+	panic("fakeDb: userShareLinks is not implemented")
+}
+func (unimplementedDb) shareLink(*pgxpool.Pool, string) (shareLink, error) {
+	panic("fakeDb: shareLink is not implemented")
+}
+func (unimplementedDb) userShareLink(*pgxpool.Pool, string, string) (shareLink, error) {
+	panic("fakeDb: userShareLink is not implemented")
+}
+func (unimplementedDb) consumeShareLink(*pgxpool.Pool, string) (shareLink, error) {
+	panic("fakeDb: consumeShareLink is not implemented")
+}
+func (unimplementedDb) revokeShareLink(*pgxpool.Pool, string, string) error {
+	panic("fakeDb: revokeShareLink is not implemented")
+}
+func (unimplementedDb) insertShareAccess(*pgxpool.Pool, uuid.UUID, string, string, string) error {
+	panic("fakeDb: insertShareAccess is not implemented")
+}
+func (unimplementedDb) shareAccesses(*pgxpool.Pool, string, string) ([]shareAccess, error) {
+	panic("fakeDb: shareAccesses is not implemented")
+}
+func (unimplementedDb) insertUploadLink(*pgxpool.Pool, uploadLink) error {
+	panic("fakeDb: insertUploadLink is not implemented")
+}
+func (unimplementedDb) userUploadLinks(*pgxpool.Pool, string) ([]listedUploadLink, error) {
+	panic("fakeDb: userUploadLinks is not implemented")
+}
+func (unimplementedDb) userUploadLink(*pgxpool.Pool, string, string) (uploadLink, error) {
+	panic("fakeDb: userUploadLink is not implemented")
+}
+func (unimplementedDb) uploadLink(*pgxpool.Pool, string) (uploadLink, error) {
+	panic("fakeDb: uploadLink is not implemented")
+}
+func (unimplementedDb) consumeUploadLink(*pgxpool.Pool, string) (uploadLink, error) {
+	panic("fakeDb: consumeUploadLink is not implemented")
+}
+func (unimplementedDb) revokeUploadLink(*pgxpool.Pool, string, string) error {
+	panic("fakeDb: revokeUploadLink is not implemented")
+}
+func (unimplementedDb) insertSecret(*pgxpool.Pool, secret) error {
+	panic("fakeDb: insertSecret is not implemented")
+}
+func (unimplementedDb) userSecrets(*pgxpool.Pool, string) ([]secret, error) {
+	panic("fakeDb: userSecrets is not implemented")
+}
+func (unimplementedDb) secretExists(*pgxpool.Pool, string) (bool, error) {
+	panic("fakeDb: secretExists is not implemented")
+}
+func (unimplementedDb) readSecret(*pgxpool.Pool, string) (secret, error) {
+	panic("fakeDb: readSecret is not implemented")
+}
+func (unimplementedDb) deleteSecret(*pgxpool.Pool, string, string) error {
+	panic("fakeDb: deleteSecret is not implemented")
+}
+func (unimplementedDb) deleteExpiredSecrets(*pgxpool.Pool) error {
+	panic("fakeDb: deleteExpiredSecrets is not implemented")
+}
+func (unimplementedDb) insertFetchCode(*pgxpool.Pool, string, string, string, time.Time) error {
+	panic("fakeDb: insertFetchCode is not implemented")
+}
+func (unimplementedDb) fetchClip(*pgxpool.Pool, string) (clipboard, error) {
+	panic("fakeDb: fetchClip is not implemented")
+}
+func (unimplementedDb) deleteFetchCode(*pgxpool.Pool, string, string) error {
+	panic("fakeDb: deleteFetchCode is not implemented")
+}
+func (unimplementedDb) deleteExpiredFetchCodes(*pgxpool.Pool) error {
+	panic("fakeDb: deleteExpiredFetchCodes is not implemented")
+}
+func (unimplementedDb) insertGrant(*pgxpool.Pool, grant) error {
+	panic("fakeDb: insertGrant is not implemented")
+}
+func (unimplementedDb) itemGrants(*pgxpool.Pool, string, string, string) ([]grant, error) {
+	panic("fakeDb: itemGrants is not implemented")
+}
+func (unimplementedDb) grantees(*pgxpool.Pool, string, string) ([]string, error) {
+	panic("fakeDb: grantees is not implemented")
+}
+func (unimplementedDb) deleteGrant(*pgxpool.Pool, string, string) (grant, error) {
+	panic("fakeDb: deleteGrant is not implemented")
+}
+func (unimplementedDb) sharedClips(*pgxpool.Pool, string) ([]sharedClip, error) {
+	panic("fakeDb: sharedClips is not implemented")
+}
+func (unimplementedDb) sharedFiles(*pgxpool.Pool, string) ([]sharedFile, error) {
+	panic("fakeDb: sharedFiles is not implemented")
+}
+func (unimplementedDb) clipAccess(*pgxpool.Pool, string, string) (sharedClip, error) {
+	panic("fakeDb: clipAccess is not implemented")
+}
+func (unimplementedDb) fileAccess(*pgxpool.Pool, string, string) (sharedFile, error) {
+	panic("fakeDb: fileAccess is not implemented")
+}
+func (unimplementedDb) insertSpace(*pgxpool.Pool, string, string) (string, error) {
+	panic("fakeDb: insertSpace is not implemented")
+}
+func (unimplementedDb) allSpaces(*pgxpool.Pool) ([]space, error) {
+	panic("fakeDb: allSpaces is not implemented")
+}
+func (unimplementedDb) userSpaces(*pgxpool.Pool, string) ([]memberSpace, error) {
+	panic("fakeDb: userSpaces is not implemented")
+}
+func (unimplementedDb) userSpace(*pgxpool.Pool, string, string) (memberSpace, error) {
+	panic("fakeDb: userSpace is not implemented")
+}
+func (unimplementedDb) deleteSpace(*pgxpool.Pool, string) ([]string, error) {
+	panic("fakeDb: deleteSpace is not implemented")
+}
+func (unimplementedDb) spaceMembers(*pgxpool.Pool, string) ([]spaceMember, error) {
+	panic("fakeDb: spaceMembers is not implemented")
+}
+func (unimplementedDb) setSpaceMember(*pgxpool.Pool, string, string, string) error {
+	panic("fakeDb: setSpaceMember is not implemented")
+}
+func (unimplementedDb) removeSpaceMember(*pgxpool.Pool, string, string) error {
+	panic("fakeDb: removeSpaceMember is not implemented")
+}
+func (unimplementedDb) memberClip(*pgxpool.Pool, string, string) (clipboard, error) {
+	panic("fakeDb: memberClip is not implemented")
+}
+func (unimplementedDb) memberFile(*pgxpool.Pool, string, string) (file, error) {
+	panic("fakeDb: memberFile is not implemented")
+}
+func (unimplementedDb) spaceClips(*pgxpool.Pool, string) ([]clipboard, error) {
+	panic("fakeDb: spaceClips is not implemented")
+}
+func (unimplementedDb) insertSpaceClip(*pgxpool.Pool, string, string, string) error {
+	panic("fakeDb: insertSpaceClip is not implemented")
+}
+func (unimplementedDb) deleteSpaceClip(*pgxpool.Pool, string, string) error {
+	panic("fakeDb: deleteSpaceClip is not implemented")
+}
+func (unimplementedDb) spaceFiles(*pgxpool.Pool, string) ([]listedFile, error) {
+	panic("fakeDb: spaceFiles is not implemented")
+}
+func (unimplementedDb) insertSpaceFile(*pgxpool.Pool, string, string, string, int64, string) (string, string, error) {
+	panic("fakeDb: insertSpaceFile is not implemented")
+}
+func (unimplementedDb) spaceFile(*pgxpool.Pool, string, string) (file, fileVersion, error) {
+	panic("fakeDb: spaceFile is not implemented")
+}
+func (unimplementedDb) deleteSpaceFile(*pgxpool.Pool, string, string) ([]string, error) {
+	panic("fakeDb: deleteSpaceFile is not implemented")
+}
+func (unimplementedDb) insertSession(*pgxpool.Pool, storedSession) error {
+	panic("fakeDb: insertSession is not implemented")
+}
+func (unimplementedDb) touchSession(*pgxpool.Pool, string, string) (storedSession, error) {
+	panic("fakeDb: touchSession is not implemented")
+}
+func (unimplementedDb) deleteSession(*pgxpool.Pool, string) error {
+	panic("fakeDb: deleteSession is not implemented")
+}
+func (unimplementedDb) userSessions(*pgxpool.Pool, string) ([]storedSession, error) {
+	panic("fakeDb: userSessions is not implemented")
+}
+func (unimplementedDb) deleteUserSession(*pgxpool.Pool, string, string) error {
+	panic("fakeDb: deleteUserSession is not implemented")
+}
+func (unimplementedDb) deleteOtherSessions(*pgxpool.Pool, string, string) error {
+	panic("fakeDb: deleteOtherSessions is not implemented")
+}
+func (unimplementedDb) deleteExpiredSessions(*pgxpool.Pool) error {
+	panic("fakeDb: deleteExpiredSessions is not implemented")
+}
+func (unimplementedDb) setTotpSecret(*pgxpool.Pool, string, string) error {
+	panic("fakeDb: setTotpSecret is not implemented")
+}
+func (unimplementedDb) totpSecret(*pgxpool.Pool, string) (totpSecret, error) {
+	panic("fakeDb: totpSecret is not implemented")
+}
+func (unimplementedDb) useTotpStep(*pgxpool.Pool, string, int64) (bool, error) {
+	panic("fakeDb: useTotpStep is not implemented")
+}
+func (unimplementedDb) confirmTotp(*pgxpool.Pool, string, []string) error {
+	panic("fakeDb: confirmTotp is not implemented")
+}
+func (unimplementedDb) replaceRecoveryCodes(*pgxpool.Pool, string, []string) error {
+	panic("fakeDb: replaceRecoveryCodes is not implemented")
+}
+func (unimplementedDb) useRecoveryCode(*pgxpool.Pool, string, string) (bool, error) {
+	panic("fakeDb: useRecoveryCode is not implemented")
+}
+func (unimplementedDb) deleteTotp(*pgxpool.Pool, string) error {
+	panic("fakeDb: deleteTotp is not implemented")
+}
+func (unimplementedDb) insertLoginChallenge(*pgxpool.Pool, loginChallenge) error {
+	panic("fakeDb: insertLoginChallenge is not implemented")
+}
+func (unimplementedDb) attemptLoginChallenge(*pgxpool.Pool, string, int) (loginChallenge, error) {
+	panic("fakeDb: attemptLoginChallenge is not implemented")
+}
+func (unimplementedDb) deleteLoginChallenge(*pgxpool.Pool, string) error {
+	panic("fakeDb: deleteLoginChallenge is not implemented")
+}
+func (unimplementedDb) insertPasskey(*pgxpool.Pool, passkey) error {
+	panic("fakeDb: insertPasskey is not implemented")
+}
+func (unimplementedDb) userPasskeys(*pgxpool.Pool, string) ([]passkey, error) {
+	panic("fakeDb: userPasskeys is not implemented")
+}
+func (unimplementedDb) passkey(*pgxpool.Pool, []byte) (passkey, error) {
+	panic("fakeDb: passkey is not implemented")
+}
+func (unimplementedDb) usePasskey(*pgxpool.Pool, []byte, webauthn.Credential) error {
+	panic("fakeDb: usePasskey is not implemented")
+}
+func (unimplementedDb) deletePasskey(*pgxpool.Pool, string, []byte) error {
+	panic("fakeDb: deletePasskey is not implemented")
+}
+func (unimplementedDb) insertPasskeyChallenge(*pgxpool.Pool, passkeyChallenge) error {
+	panic("fakeDb: insertPasskeyChallenge is not implemented")
+}
+func (unimplementedDb) takePasskeyChallenge(*pgxpool.Pool, string, *uuid.UUID) (passkeyChallenge, error) {
+	panic("fakeDb: takePasskeyChallenge is not implemented")
+}
+func (unimplementedDb) insertApiToken(*pgxpool.Pool, apiToken) error {
+	panic("fakeDb: insertApiToken is not implemented")
+}
+func (unimplementedDb) userApiTokens(*pgxpool.Pool, string) ([]apiToken, error) {
+	panic("fakeDb: userApiTokens is not implemented")
+}
+func (unimplementedDb) useApiToken(*pgxpool.Pool, string) (apiToken, error) {
+	panic("fakeDb: useApiToken is not implemented")
+}
+func (unimplementedDb) deleteApiToken(*pgxpool.Pool, string, string) error {
+	panic("fakeDb: deleteApiToken is not implemented")
+}
+func (unimplementedDb) allUsers(*pgxpool.Pool) ([]user, error) {
+	panic("fakeDb: allUsers is not implemented")
+}
+func (unimplementedDb) userExists(*pgxpool.Pool, string) (user, error) {
+	panic("fakeDb: userExists is not implemented")
+}
+func (unimplementedDb) insertUser(*pgxpool.Pool, string, string) error {
+	panic("fakeDb: insertUser is not implemented")
+}
+func (unimplementedDb) insertInvitedUser(*pgxpool.Pool, string, string, string) error {
+	panic("fakeDb: insertInvitedUser is not implemented")
+}
+func (unimplementedDb) insertInvite(*pgxpool.Pool, invite) error {
+	panic("fakeDb: insertInvite is not implemented")
+}
+func (unimplementedDb) userInvites(*pgxpool.Pool, string) ([]invite, error) {
+	panic("fakeDb: userInvites is not implemented")
+}
+func (unimplementedDb) deleteInvite(*pgxpool.Pool, string, string) error {
+	panic("fakeDb: deleteInvite is not implemented")
+}
+func (unimplementedDb) updatePassword(*pgxpool.Pool, string, string) error {
+	panic("fakeDb: updatePassword is not implemented")
+}
+func (unimplementedDb) rehashPassword(*pgxpool.Pool, string, string, string) error {
+	panic("fakeDb: rehashPassword is not implemented")
+}
+func (unimplementedDb) setEmail(*pgxpool.Pool, string, *string) error {
+	panic("fakeDb: setEmail is not implemented")
+}
+func (unimplementedDb) insertPasswordReset(*pgxpool.Pool, string, string, time.Time) error {
+	panic("fakeDb: insertPasswordReset is not implemented")
+}
+func (unimplementedDb) passwordReset(*pgxpool.Pool, string) (string, error) {
+	panic("fakeDb: passwordReset is not implemented")
+}
+func (unimplementedDb) resetPassword(*pgxpool.Pool, string, string) (string, error) {
+	panic("fakeDb: resetPassword is not implemented")
+}
+func (unimplementedDb) insertOidcLogin(*pgxpool.Pool, oidcLogin) error {
+	panic("fakeDb: insertOidcLogin is not implemented")
+}
+func (unimplementedDb) takeOidcLogin(*pgxpool.Pool, string) (oidcLogin, error) {
+	panic("fakeDb: takeOidcLogin is not implemented")
+}
+func (unimplementedDb) oidcUser(*pgxpool.Pool, string, string) (user, error) {
+	panic("fakeDb: oidcUser is not implemented")
+}
+func (unimplementedDb) provisionOidcUser(*pgxpool.Pool, string, string, string) (user, error) {
+	panic("fakeDb: provisionOidcUser is not implemented")
+}
+func (unimplementedDb) deleteUser(*pgxpool.Pool, string) (map[string][]string, error) {
+	panic("fakeDb: deleteUser is not implemented")
+}
+func (unimplementedDb) userById(*pgxpool.Pool, string) (user, error) {
+	panic("fakeDb: userById is not implemented")
+}
+func (unimplementedDb) adminUsers(*pgxpool.Pool) ([]adminUser, error) {
+	panic("fakeDb: adminUsers is not implemented")
+}
+func (unimplementedDb) setRole(*pgxpool.Pool, string, string) error {
+	panic("fakeDb: setRole is not implemented")
+}
+func (unimplementedDb) setDisabled(*pgxpool.Pool, string, bool) error {
+	panic("fakeDb: setDisabled is not implemented")
+}
+func (unimplementedDb) deleteUserSessions(*pgxpool.Pool, string) error {
+	panic("fakeDb: deleteUserSessions is not implemented")
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"net/http"
+	"path"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+// Fetch codes are short enough to be typed, so they live only for a few minutes, work once
+// and every lookup is rate limited per client, IPv6 clients per /64 network. The failed lookups
+// of the whole instance have a budget too, against guesses spread over many networks: when it's
+// spent nobody can fetch for a while, which is better than a guessed clip
+const fetchCodeExpir = 10 * time.Minute
+
+var fetchCodeRe = regexp.MustCompile(`^[a-z]+-[a-z]+-[0-9]{2}$`)
+
+// codeWords has 256 entries, a code like tiger-maple-42 is one of about 5.9 million
+var codeWords = [...]string{
+	"acorn", "agate", "alder", "algae", "amber", "anchor", "angel", "antler", "apple",
+	"apricot", "arrow", "aspen", "aster", "atlas", "badger", "bamboo", "banjo", "barley", "basil",
+	"bat", "bay", "beach", "beacon", "bean", "bear", "beaver", "bee", "beetle", "bell", "berry",
+	"birch", "biscuit", "bison", "blossom", "boar", "bobcat", "bog", "boulder", "bramble", "breeze",
+	"bronze", "brook", "buffalo", "bunny", "butter", "cabin", "cactus", "camel", "canary", "candle",
+	"canoe", "canyon", "cardinal", "carrot", "castle", "cedar", "cello", "cherry", "chestnut",
+	"cliff", "clover", "cobalt", "cobra", "cocoa", "comet", "copper", "coral", "cougar", "cove",
+	"coyote", "crab", "crane", "creek", "cricket", "crow", "crystal", "cypress", "daisy", "delta",
+	"desert", "dingo", "dolphin", "dove", "dragon", "drum", "dune", "eagle", "elk", "elm", "ember",
+	"falcon", "fern", "ferret", "fig", "finch", "fjord", "flint", "forest", "fox", "frog", "garnet",
+	"gazelle", "gecko", "geyser", "ginger", "glacier", "goat", "goose", "granite", "grape", "grove",
+	"gull", "harbor", "hare", "harvest", "hawk", "hazel", "heron", "hickory", "hill", "holly",
+	"honey", "hornet", "husky", "ibis", "iris", "island", "ivy", "jackal", "jade", "jaguar", "jasper",
+	"juniper", "kelp", "kestrel", "kite", "koala", "lagoon", "lake", "lantern", "lark", "laurel",
+	"lava", "lemon", "lemur", "leopard", "lily", "lime", "linden", "lion", "llama", "lotus", "lynx",
+	"magpie", "mango", "mantis", "maple", "marble", "marsh", "meadow", "melon", "mesa", "meteor",
+	"mink", "mint", "mole", "moose", "moss", "moth", "mule", "nectar", "newt", "nova", "nutmeg",
+	"oak", "oasis", "ocean", "olive", "onyx", "orange", "orbit", "orca", "orchid", "osprey", "otter",
+	"owl", "panda", "panther", "parrot", "peach", "pear", "pebble", "pecan", "pelican", "pepper",
+	"perch", "pine", "plum", "pond", "poppy", "prairie", "prism", "puma", "quail", "quartz", "rabbit",
+	"raven", "reef", "ridge", "river", "robin", "rocket", "rose", "ruby", "saddle", "sage", "salmon",
+	"sapphire", "seal", "sequoia", "shark", "shell", "silver", "spark", "sparrow", "spruce", "squid",
+	"stork", "stream", "summit", "swan", "tangerine", "tapir", "thistle", "thrush", "thunder",
+	"tiger", "timber", "toad", "topaz", "tulip", "tundra", "turtle", "valley", "velvet", "violet",
+	"viper", "walnut", "walrus", "wasp", "willow", "wolf", "wombat", "wren", "yak", "zebra",
+}
+
+// newFetchCode returns two random words and a number between 10 and 99
+func newFetchCode() (string, error) {
+	parts := make([]string, 3)
+	for i, n := range []int64{int64(len(codeWords)), int64(len(codeWords)), 90} {
+		v, err := rand.Int(rand.Reader, big.NewInt(n))
+		if err != nil {
+			return "", err
+		}
+		if i < 2 {
+			parts[i] = codeWords[v.Int64()]
+		} else {
+			parts[i] = fmt.Sprint(v.Int64() + 10)
+		}
+	}
+	return strings.Join(parts, "-"), nil
+}
+
+func (env *Env) fetchCodesCleanRoutine() {
+	go func() {
+		for {
+			if err := env.dataManager.deleteExpiredFetchCodes(env.db); err != nil {
+				log.Printf("err: %v\n", err)
+			}
+			time.Sleep(fetchCodeExpir)
+		}
+	}()
+}
+
+// POST //
+
+// postFetchCode makes a clip fetchable through a new code, the previous code of the clip stops working
+func (env *Env) postFetchCode(w HTMLWriter, r *http.Request, s session) {
+	clipId := r.PathValue("clipId")
+	expiresAt := time.Now().Add(fetchCodeExpir)
+
+	var code string
+	var err error
+	for range 5 { // A code that is already in use is replaced by a new one
+		code, err = newFetchCode()
+		if err != nil {
+			break
+		}
+		err = env.dataManager.insertFetchCode(env.db, s.user.Username, clipId, code, expiresAt)
+		var pgErr *pgconn.PgError
+		if !errors.As(err, &pgErr) || pgErr.Code != "23505" {
+			break
+		}
+	}
+	if err != nil {
+		log.Printf("err: %v\n", err)
+		w.Status = folderErrStatus(err)
+		w.WriteHeader()
+		return
+	}
+
+	obj := map[string]any{
+		"ClipId":    clipId,
+		"Code":      code,
+		"URL":       publicURL(r, path.Join("/c", code)),
+		"ExpiresAt": expiresAt,
+	}
+	sendTemplate(w, obj, "fetchcode", "./html/fetchcode.html")
+}
+
+// DELETE //
+
+func (env *Env) deleteFetchCode(w HTMLWriter, r *http.Request, s session) {
+	if err := env.dataManager.deleteFetchCode(env.db, s.user.Username, r.PathValue("clipId")); err != nil {
+		log.Printf("err: %v\n", err)
+		w.Status = http.StatusInternalServerError
+		w.WriteHeader()
+	}
+}
+
+// PUBLIC //
+
+// viewFetch sends the clip right away to command line clients like curl.
+// Browsers get a button first, like one-time secrets, so link previews don't use the code
+func (env *Env) viewFetch(w HTMLWriter, r *http.Request) {
+	if !wantsHTML(r) {
+		env.fetch(w, r)
+		return
+	}
+
+	secretHeaders(w)
+	if !env.allowPublic(w, r) {
+		return
+	}
+	sendFetchPage(w, map[string]any{"Code": normalizeCode(r.PathValue("code"))})
+}
+
+// fetch returns the clip of the code and deletes the code
+func (env *Env) fetch(w HTMLWriter, r *http.Request) {
+	secretHeaders(w)
+	if !env.fetchLimiter.allow(clientNetwork(r)) || env.fetchFailures.spent("") {
+		w.Status = http.StatusTooManyRequests
+		sendFetchResult(w, r, "Too many attempts, try again later")
+		return
+	}
+
+	code := normalizeCode(r.PathValue("code"))
+	clip := clipboard{}
+	err := pgx.ErrNoRows
+	if fetchCodeRe.MatchString(code) {
+		clip, err = env.dataManager.fetchClip(env.db, code)
+	}
+	if err != nil {
+		if !errors.Is(err, pgx.ErrNoRows) {
+			log.Printf("err: %v\n", err)
+		} else if env.fetchFailures.allow(""); env.fetchFailures.spent("") {
+			log.Printf("fetch: too many failed lookups, refusing lookups for a while, the last from %s\n", clientIP(r))
+		}
+		w.Status = http.StatusNotFound
+		sendFetchResult(w, r, "This code does not exist, has expired or has already been used")
+		return
+	}
+
+	if wantsHTML(r) {
+		sendFetchPage(w, map[string]any{"Text": clip.Text})
+		return
+	}
+	w.Writer.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Writer.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader()
+	w.Writer.Write([]byte(clip.Text))
+}
+
+// sendFetchResult sends a message as a page to browsers and as a line of text to the other clients
+func sendFetchResult(w HTMLWriter, r *http.Request, msg string) {
+	if wantsHTML(r) {
+		w.WriteHeader()
+		sendFetchPage(w, map[string]any{"Message": msg})
+		return
+	}
+	w.Writer.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.WriteHeader()
+	fmt.Fprintln(w.Writer, msg)
+}
+
+func sendFetchPage(w HTMLWriter, obj any) {
+	w.HTMX = true // Public pages never use the index template
+	sendTemplate(w, obj, "login_base", "./html/login_base.html", "./html/fetch.html")
+}
+
+// normalizeCode accepts codes typed with capitals or spaces instead of dashes
+func normalizeCode(code string) string {
+	return strings.Join(strings.Fields(strings.ReplaceAll(strings.ToLower(code), "-", " ")), "-")
+}
+
+func wantsHTML(r *http.Request) bool {
+	return strings.Contains(r.Header.Get("Accept"), "text/html")
+}
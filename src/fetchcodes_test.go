@@ -0,0 +1,59 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestClientNetwork(t *testing.T) {
+	tests := []struct {
+		remote string
+		key    string
+	}{
+		{"192.0.2.1:1234", "192.0.2.1"},
+		{"[::ffff:192.0.2.1]:1234", "192.0.2.1"},
+		{"[2001:db8:1:2:3:4:5:6]:1234", "2001:db8:1:2::/64"},
+		{"[2001:db8:1:2:ffff::1]:1234", "2001:db8:1:2::/64"},
+		{"[fe80::1%eth0]:1234", "fe80::/64"},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest("GET", "/c/code", nil)
+		r.RemoteAddr = tt.remote
+		if got := clientNetwork(r); got != tt.key {
+			t.Errorf("%s: got %q, want %q", tt.remote, got, tt.key)
+		}
+	}
+}
+
+// The failed lookups of all the clients share a budget, each client has a limit of its own
+func TestFetchBudget(t *testing.T) {
+	env := &Env{fetchLimiter: newMemoryLimiter(0, 2), fetchFailures: newMemoryLimiter(0, 3)}
+	lookup := func(remote string) int {
+		r := httptest.NewRequest("GET", "/c/not-a-code", nil)
+		r.SetPathValue("code", "not-a-code")
+		r.RemoteAddr = remote
+		rec := httptest.NewRecorder()
+		env.fetch(HTMLWriter{Writer: rec, Status: http.StatusOK}, r)
+		return rec.Code
+	}
+
+	// Two addresses of the same /64 network
+	lookup("[2001:db8::1]:1234")
+	if code := lookup("[2001:db8::2]:1234"); code != http.StatusNotFound {
+		t.Fatalf("second lookup of the network: %d", code)
+	}
+	if code := lookup("[2001:db8::3]:1234"); code != http.StatusTooManyRequests {
+		t.Errorf("third lookup of the network: %d", code)
+	}
+
+	if code := lookup("192.0.2.1:1234"); code != http.StatusNotFound {
+		t.Fatalf("lookup of another client: %d", code)
+	}
+	for i := 2; i < 5; i++ {
+		if code := lookup(fmt.Sprintf("192.0.2.%d:1234", i)); code != http.StatusTooManyRequests {
+			t.Errorf("lookup %d after the budget was spent: %d", i, code)
+		}
+	}
+}
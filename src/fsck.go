@@ -0,0 +1,277 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path"
+	"time"
+)
+
+// Blobs and versions younger than fsckGrace may still be uploading, so they are not checked yet
+var fsckGrace = 10 * time.Minute
+
+// fsckReport lists the inconsistencies between the files table and filedir
+type fsckReport struct {
+	OrphanBlobs      []string // blobs without a version row
+	OrphanDirs       []string // entries of filedir that don't belong to any user or space
+	MissingDirs      []string // users and spaces without a directory
+	DanglingVersions []string // version rows without a blob
+	EmptyFiles       []string // file rows without versions
+	Mismatches       []string // blobs that don't match the checksum of their version
+	MissingChecksums []string // versions uploaded before checksums were recorded
+	Repaired         bool
+}
+
+func (r fsckReport) problems() int {
+	return len(r.OrphanBlobs) + len(r.OrphanDirs) + len(r.MissingDirs) + len(r.DanglingVersions) +
+		len(r.EmptyFiles) + len(r.Mismatches) + len(r.MissingChecksums)
+}
+
+func (r fsckReport) write(w io.Writer) {
+	sections := []struct {
+		title string
+		items []string
+	}{
+		{"orphaned blobs", r.OrphanBlobs},
+		{"orphaned directories", r.OrphanDirs},
+		{"missing directories", r.MissingDirs},
+		{"versions without blob", r.DanglingVersions},
+		{"files without versions", r.EmptyFiles},
+		{"checksum mismatches", r.Mismatches},
+		{"missing checksums", r.MissingChecksums},
+	}
+	for _, sec := range sections {
+		fmt.Fprintf(w, "%s: %d\n", sec.title, len(sec.items))
+		for _, it := range sec.items {
+			fmt.Fprintf(w, "  %s\n", it)
+		}
+	}
+
+	switch {
+	case r.problems() == 0:
+		fmt.Fprintln(w, "storage is consistent")
+	case r.Repaired:
+		fmt.Fprintln(w, "all the problems have been repaired")
+	default:
+		fmt.Fprintln(w, "run with repair to fix the problems")
+	}
+}
+
+// fsck compares the files table with the content of filedir.
+// If repair is true, rows without blobs and blobs without rows are deleted,
+// corrupted versions are moved to quarantine, missing checksums are recorded and missing directories are created
+func (env *Env) fsck(repair bool) (fsckReport, error) {
+	report := fsckReport{Repaired: repair}
+
+	users, err := env.dataManager.allUsers(env.db)
+	if err != nil {
+		return report, err
+	}
+	spaces, err := env.spaceIds()
+	if err != nil {
+		return report, err
+	}
+	blobs, err := env.dataManager.allBlobs(env.db)
+	if err != nil {
+		return report, err
+	}
+
+	// Every user and every space has a directory
+	dirIds := spaces
+	for _, u := range users {
+		dirIds = append(dirIds, u.Id.String())
+	}
+	userDirs := map[string]bool{}
+	for _, id := range dirIds {
+		userDirs[id] = true
+	}
+	// Versions that are not clean are kept in quarantine
+	userDirs["quarantine"] = true
+	known := map[string]blobRef{}
+	for _, b := range blobs {
+		known[blobName(b)] = b
+	}
+
+	// Directories and blobs that are not referenced by the database
+	entries, err := os.ReadDir("./filedir")
+	if err != nil {
+		return report, err
+	}
+	found := map[string]bool{}
+	unknown := map[string]string{} // blobs that are not where their version is expected, by version id
+	for _, e := range entries {
+		if !e.IsDir() || !userDirs[e.Name()] {
+			info, err := e.Info()
+			if err != nil {
+				return report, err
+			}
+			// A user or a space may have been created after they were loaded
+			if time.Since(info.ModTime()) >= fsckGrace {
+				report.OrphanDirs = append(report.OrphanDirs, e.Name())
+			}
+			continue
+		}
+		found[e.Name()] = true
+
+		blobEntries, err := os.ReadDir(path.Join("./filedir", e.Name()))
+		if err != nil {
+			return report, err
+		}
+		for _, be := range blobEntries {
+			name := path.Join(e.Name(), be.Name())
+			if _, ok := known[name]; !ok {
+				unknown[be.Name()] = name
+			}
+		}
+	}
+	for _, id := range dirIds {
+		if !found[id] {
+			report.MissingDirs = append(report.MissingDirs, id)
+		}
+	}
+
+	// Versions uploaded or scanned while filedir was read are in the database by now,
+	// a blob that has a version row is not orphaned even if a scan has moved it
+	if len(unknown) > 0 {
+		current, err := env.dataManager.allBlobs(env.db)
+		if err != nil {
+			return report, err
+		}
+		for _, b := range current {
+			delete(unknown, b.Id.String())
+		}
+	}
+	for _, name := range unknown {
+		info, err := os.Stat(path.Join("./filedir", name))
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		} else if err != nil {
+			return report, err
+		}
+		// Restoring a version copies the blob before the row is inserted,
+		// without a row the age of the blob is all there is to go by
+		if time.Since(info.ModTime()) >= fsckGrace {
+			report.OrphanBlobs = append(report.OrphanBlobs, name)
+		}
+	}
+
+	// Versions whose blob is missing or corrupted
+	checksums := map[string]string{}
+	for name, b := range known {
+		if time.Since(b.CreatedAt) < fsckGrace {
+			continue
+		}
+		sum, err := blobChecksum(path.Join("./filedir", name))
+		if errors.Is(err, os.ErrNotExist) && b.ScanStatus == scanPending {
+			// The scan may have finished after the versions were loaded
+			name = path.Join(b.UserId.String(), b.Id.String())
+			sum, err = blobChecksum(path.Join("./filedir", name))
+		}
+		if errors.Is(err, os.ErrNotExist) {
+			report.DanglingVersions = append(report.DanglingVersions, b.Id.String())
+			continue
+		} else if err != nil {
+			return report, err
+		}
+
+		if b.Checksum == nil {
+			report.MissingChecksums = append(report.MissingChecksums, b.Id.String())
+			checksums[b.Id.String()] = sum
+		} else if *b.Checksum != sum && b.ScanStatus != scanCorrupt {
+			report.Mismatches = append(report.Mismatches, name)
+		}
+	}
+
+	report.EmptyFiles, err = env.dataManager.emptyFiles(env.db)
+	if err != nil {
+		return report, err
+	}
+
+	if !repair {
+		return report, nil
+	}
+	return report, env.repairStorage(report, checksums)
+}
+
+// blobName is the path of the blob of a version inside filedir
+func blobName(b blobRef) string {
+	if b.ScanStatus == scanClean {
+		return path.Join(b.UserId.String(), b.Id.String())
+	}
+	return path.Join("quarantine", b.Id.String())
+}
+
+func (env *Env) repairStorage(report fsckReport, checksums map[string]string) error {
+	if err := env.dataManager.deleteVersions(env.db, report.DanglingVersions...); err != nil {
+		return err
+	}
+	for _, name := range report.OrphanBlobs {
+		if err := os.Remove(path.Join("./filedir", name)); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+
+	// Corrupted versions are kept, so the content can still be recovered by hand,
+	// but they can't be downloaded or restored anymore
+	if len(report.Mismatches) > 0 {
+		if err := os.MkdirAll(path.Join("./filedir", "quarantine"), 0750); err != nil {
+			return err
+		}
+	}
+	for _, name := range report.Mismatches {
+		id := path.Base(name)
+		if err := os.Rename(path.Join("./filedir", name), quarantinePath(id)); err != nil {
+			return err
+		}
+		if _, err := env.dataManager.setScanResult(env.db, id, scanCorrupt, "checksum mismatch"); err != nil {
+			return err
+		}
+		log.Printf("log: moved version %s to quarantine, it doesn't match its checksum\n", id)
+	}
+
+	// Removing versions can leave files empty, so this is done after
+	ids, err := env.dataManager.deleteEmptyFiles(env.db)
+	if err != nil {
+		return err
+	}
+	for _, id := range ids {
+		log.Printf("log: removed file %s, it had no versions left\n", id)
+	}
+
+	for _, dir := range report.OrphanDirs {
+		if err := os.RemoveAll(path.Join("./filedir", dir)); err != nil {
+			return err
+		}
+	}
+	for _, dir := range report.MissingDirs {
+		if err := os.Mkdir(path.Join("./filedir", dir), 0750); err != nil && !errors.Is(err, os.ErrExist) {
+			return err
+		}
+	}
+	for id, sum := range checksums {
+		if err := env.dataManager.setChecksum(env.db, id, sum); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func blobChecksum(pth string) (string, error) {
+	f, err := os.Open(pth)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	hash := sha256.New()
+	if _, err := io.Copy(hash, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
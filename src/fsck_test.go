@@ -0,0 +1,162 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"os"
+	"path"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// fsckStorage is the storage of alice with one problem of each kind, and the same problems
+// younger than fsckGrace that must be left alone
+type fsckStorage struct {
+	db     *fakeDb
+	userId uuid.UUID
+
+	clean, dangling, corrupt, unsummed, young string // version ids
+	orphan, youngOrphan, danglingFile         string
+}
+
+func newFsckStorage(t *testing.T) fsckStorage {
+	t.Helper()
+	chdir(t, t.TempDir())
+	alice := user{Username: "alice", Id: uuid.New()}
+	st := fsckStorage{db: newFakeDb(alice), userId: alice.Id}
+	dir := path.Join("./filedir", alice.Id.String())
+	if err := os.MkdirAll(dir, 0750); err != nil {
+		t.Fatal(err)
+	}
+
+	old := time.Now().Add(-time.Hour)
+	blob := func(name string, content string, mtime time.Time) {
+		t.Helper()
+		pth := path.Join(dir, name)
+		if err := os.WriteFile(pth, []byte(content), 0640); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(pth, mtime, mtime); err != nil {
+			t.Fatal(err)
+		}
+	}
+	version := func(fileId string, content string, sum bool, created time.Time) string {
+		b := blobRef{Id: uuid.New(), UserId: alice.Id, CreatedAt: created, ScanStatus: scanClean}
+		if sum {
+			hash := sha256.Sum256([]byte(content))
+			s := hex.EncodeToString(hash[:])
+			b.Checksum = &s
+		}
+		st.db.addVersion(fileId, b)
+		return b.Id.String()
+	}
+
+	st.clean = version("notes", "hello", true, old)
+	blob(st.clean, "hello", old)
+	st.corrupt = version("notes", "hello", true, old)
+	blob(st.corrupt, "bit rot", old)
+	st.unsummed = version("notes", "hello", false, old)
+	blob(st.unsummed, "hello", old)
+
+	// The only version of its file has lost its blob
+	st.danglingFile = "lost"
+	st.dangling = version(st.danglingFile, "hello", true, old)
+
+	st.orphan = uuid.NewString()
+	blob(st.orphan, "hello", old)
+
+	// Still uploading: the row without its blob and a blob without its row
+	st.young = version("notes", "hello", true, time.Now())
+	st.youngOrphan = uuid.NewString()
+	blob(st.youngOrphan, "hello", time.Now())
+	return st
+}
+
+func (st fsckStorage) blob(id string) string {
+	return path.Join(st.userId.String(), id)
+}
+
+func TestFsckReport(t *testing.T) {
+	st := newFsckStorage(t)
+	env := &Env{dataManager: st.db}
+
+	report, err := env.fsck(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(report.OrphanBlobs, []string{st.blob(st.orphan)}) {
+		t.Errorf("orphaned blobs %v", report.OrphanBlobs)
+	}
+	if !slices.Equal(report.DanglingVersions, []string{st.dangling}) {
+		t.Errorf("versions without blob %v", report.DanglingVersions)
+	}
+	if !slices.Equal(report.Mismatches, []string{st.blob(st.corrupt)}) {
+		t.Errorf("checksum mismatches %v", report.Mismatches)
+	}
+	if !slices.Equal(report.MissingChecksums, []string{st.unsummed}) {
+		t.Errorf("missing checksums %v", report.MissingChecksums)
+	}
+	if report.problems() != 4 {
+		t.Errorf("%d problems, want 4: %+v", report.problems(), report)
+	}
+
+	// Nothing is changed without repair
+	if _, err := os.Stat(path.Join("./filedir", st.blob(st.orphan))); err != nil {
+		t.Errorf("the orphaned blob: %v", err)
+	}
+	if _, ok := st.db.blobs[st.dangling]; !ok {
+		t.Error("the version without blob was deleted")
+	}
+}
+
+func TestFsckRepair(t *testing.T) {
+	st := newFsckStorage(t)
+	env := &Env{dataManager: st.db}
+
+	if _, err := env.fsck(true); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := os.Stat(path.Join("./filedir", st.blob(st.orphan))); !os.IsNotExist(err) {
+		t.Errorf("the orphaned blob is still there: %v", err)
+	}
+	if _, ok := st.db.blobs[st.dangling]; ok {
+		t.Error("the version without blob is still there")
+	}
+	if st.db.files[st.danglingFile] {
+		t.Error("the file left without versions is still there")
+	}
+
+	if _, err := os.Stat(quarantinePath(st.corrupt)); err != nil {
+		t.Errorf("the corrupted blob is not in quarantine: %v", err)
+	}
+	if st.db.blobs[st.corrupt].ScanStatus != scanCorrupt {
+		t.Errorf("the corrupted version is %q", st.db.blobs[st.corrupt].ScanStatus)
+	}
+	if sum := st.db.blobs[st.unsummed].Checksum; sum == nil || *sum != *st.db.blobs[st.clean].Checksum {
+		t.Errorf("the missing checksum was recorded as %v", sum)
+	}
+
+	// The blob and the version that may still be uploading are kept
+	if _, err := os.Stat(path.Join("./filedir", st.blob(st.youngOrphan))); err != nil {
+		t.Errorf("the recent blob without row: %v", err)
+	}
+	if _, ok := st.db.blobs[st.young]; !ok {
+		t.Error("the recent version without blob was deleted")
+	}
+	if _, err := os.Stat(path.Join("./filedir", st.blob(st.clean))); err != nil {
+		t.Errorf("the clean blob: %v", err)
+	}
+
+	// The storage is consistent after the repair
+	report, err := env.fsck(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.problems() != 0 {
+		t.Errorf("problems left after the repair: %+v", report)
+	}
+}
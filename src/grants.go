@@ -0,0 +1,221 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+)
+
+// GET //
+
+// getGrants shows who an item is shared with, for the owner of the item
+func (env *Env) getGrants(w HTMLWriter, r *http.Request, s session) {
+	env.sendGrants(w, s, r.URL.Query().Get("clip"), r.URL.Query().Get("file"), "")
+}
+
+// POST //
+
+func (env *Env) postGrant(w HTMLWriter, r *http.Request, s session) {
+	if err := r.ParseForm(); err != nil {
+		w.Status = http.StatusBadRequest
+		w.WriteHeader()
+		log.Printf("err: %v\n", err)
+		return
+	}
+	form := r.PostForm
+
+	g := grant{
+		Id:       uuid.New(),
+		Owner:    s.user.Username,
+		Grantee:  strings.TrimSpace(form.Get("username")),
+		CanWrite: form.Get("write") != "",
+	}
+	if id, err := uuid.Parse(form.Get("clip")); err == nil {
+		g.ClipId = &id
+	} else if id, err := uuid.Parse(form.Get("file")); err == nil {
+		g.FileId = &id
+	} else {
+		w.Status = http.StatusBadRequest
+		w.WriteHeader()
+		return
+	}
+	clipId, fileId := idString(g.ClipId), idString(g.FileId)
+
+	msg := ""
+	if err := env.dataManager.insertGrant(env.db, g); err != nil {
+		if !errors.Is(err, pgx.ErrNoRows) {
+			log.Printf("err: %v\n", err)
+			w.Status = http.StatusInternalServerError
+			w.WriteHeader()
+			return
+		}
+		msg = "There is no other user called " + g.Grantee
+	} else {
+		env.publishShared(g.Grantee, clipId, fileId)
+	}
+
+	env.sendGrants(w, s, clipId, fileId, msg)
+}
+
+// editClip replaces the text of a clip, for its owner and the users that can write it
+func (env *Env) editClip(w HTMLWriter, r *http.Request, s session) {
+	text := r.Header.Get("HX-Prompt")
+	if text == "" {
+		w.Status = http.StatusBadRequest
+		w.WriteHeader()
+		return
+	}
+
+	clip, err := env.dataManager.clipAccess(env.db, s.user.Username, r.PathValue("clipId"))
+	if err != nil {
+		log.Printf("err: %v\n", err)
+		w.Status = folderErrStatus(err)
+		w.WriteHeader()
+		return
+	}
+	if !clip.CanWrite {
+		w.Status = http.StatusForbidden
+		w.WriteHeader()
+		return
+	}
+
+	if err := env.dataManager.updateClip(env.db, clip.Id.String(), text); err != nil {
+		log.Printf("err: %v\n", err)
+		w.Status = http.StatusInternalServerError
+		w.WriteHeader()
+		return
+	}
+
+	env.clipBroker.Publish(userChannel(clip.Username), "")
+	env.publishGrantees(clip.Id.String(), "")
+}
+
+// uploadVersion adds a new version to a file, for its owner and the users that can write it.
+// The blob is stored with the other versions, in the directory of the owner
+func (env *Env) uploadVersion(w HTMLWriter, r *http.Request, s session) {
+	f, err := env.dataManager.fileAccess(env.db, s.user.Username, r.PathValue("fileId"))
+	if err != nil {
+		log.Printf("err: %v\n", err)
+		w.Status = folderErrStatus(err)
+		w.WriteHeader()
+		return
+	}
+	if !f.CanWrite {
+		w.Status = http.StatusForbidden
+		w.WriteHeader()
+		return
+	}
+	owner, err := env.dataManager.userExists(env.db, f.Username)
+	if err != nil {
+		log.Printf("err: %v\n", err)
+		w.Status = http.StatusInternalServerError
+		w.WriteHeader()
+		return
+	}
+
+	upload, header, err := r.FormFile("file")
+	if err != nil {
+		log.Printf("err: %v\n", err)
+		w.Status = http.StatusBadRequest
+		w.WriteHeader()
+		return
+	}
+	defer upload.Close()
+	if err := env.checkUploadSize(header.Size); err != nil {
+		w.Status = http.StatusRequestEntityTooLarge
+		w.WriteHeader()
+		return
+	}
+
+	status, version := env.uploadStatus(), uuid.NewString()
+	if err := env.dataManager.insertVersion(env.db, owner.Username, f.Id.String(), version, header.Size, nil, status); err != nil {
+		log.Printf("err: %v\n", err)
+		w.Status = http.StatusInternalServerError
+		w.WriteHeader()
+		return
+	}
+	if err := env.storeBlob(upload, owner.Id, version, status); err != nil {
+		log.Printf("err: %v\n", err)
+		w.Status = http.StatusInternalServerError
+		w.WriteHeader()
+		return
+	}
+
+	env.fileBroker.Publish(userChannel(owner.Username), folderEvent(idString(f.Folder)))
+	env.publishGrantees("", f.Id.String())
+}
+
+// DELETE //
+
+func (env *Env) deleteGrant(w HTMLWriter, r *http.Request, s session) {
+	g, err := env.dataManager.deleteGrant(env.db, s.user.Username, r.PathValue("grantId"))
+	if err != nil {
+		log.Printf("err: %v\n", err)
+		w.Status = folderErrStatus(err)
+		w.WriteHeader()
+		return
+	}
+
+	env.publishShared(g.Grantee, idString(g.ClipId), idString(g.FileId))
+	env.sendGrants(w, s, idString(g.ClipId), idString(g.FileId), "")
+}
+
+func (env *Env) sendGrants(w HTMLWriter, s session, clipId string, fileId string, msg string) {
+	var err error
+	var name string
+	if clipId != "" {
+		var clip clipboard
+		clip, err = env.dataManager.userClip(env.db, s.user.Username, clipId)
+		name = clip.Text
+	} else {
+		var f file
+		f, err = env.dataManager.userFile(env.db, s.user.Username, fileId)
+		name = f.Filename
+	}
+	var grants []grant
+	if err == nil {
+		grants, err = env.dataManager.itemGrants(env.db, s.user.Username, clipId, fileId)
+	}
+	if err != nil {
+		log.Printf("err: %v\n", err)
+		w.Status = folderErrStatus(err)
+		w.WriteHeader()
+		return
+	}
+
+	obj := map[string]any{
+		"ClipId":  clipId,
+		"FileId":  fileId,
+		"Name":    name,
+		"Grants":  grants,
+		"Message": msg,
+	}
+	sendTemplate(w, obj, "grants", "./html/grants.html")
+}
+
+// publishGrantees tells the users an item is shared with that it changed
+func (env *Env) publishGrantees(clipId string, fileId string) {
+	users, err := env.dataManager.grantees(env.db, clipId, fileId)
+	if err != nil {
+		log.Printf("err: %v\n", err)
+		return
+	}
+	for _, u := range users {
+		env.publishShared(u, clipId, fileId)
+	}
+}
+
+// publishShared updates the "shared with me" section of user.
+// Shared files are listed in the root folder
+func (env *Env) publishShared(user string, clipId string, fileId string) {
+	if clipId != "" {
+		env.clipBroker.Publish(userChannel(user), "")
+	}
+	if fileId != "" {
+		env.fileBroker.Publish(userChannel(user), folderEvent(""))
+	}
+}
@@ -1,8 +1,13 @@
 package main
 
 import (
+	"crypto/subtle"
+	"errors"
 	"fmt"
+	"log"
 	"net/http"
+	"os"
+	"strings"
 	"time"
 )
 
@@ -12,45 +17,128 @@ func handlerWrapper(h func(HTMLWriter, *http.Request, session)) http.HandlerFunc
 
 		ws := HTMLWriter{Writer: w, Status: 200, HTMX: isHTMX(r)}
 
-		if s, ex := sessions.session(r); !ex {
+		if token, found := bearerToken(r); found {
+			if s, err := sessions.tokenSession(r, token); err != nil {
+				ws.Status = apiErrStatus(err)
+				if ws.Status == http.StatusUnauthorized {
+					w.Header().Set("WWW-Authenticate", "Bearer")
+				}
+				ws.WriteHeader()
+				if ws.Status == http.StatusInternalServerError {
+					log.Printf("err: %v\n", err)
+				} else {
+					fmt.Fprintln(w, err) // Tell the script why the token was refused
+				}
+			} else {
+				ws.HTMX = true // Scripts get the fragments, never the whole page
+				h(ws, r, s)
+			}
+		} else if username, found := sessions.proxyUser(r); found {
+			if s, cookie, err := sessions.proxySession(r, username); err != nil {
+				ws.Status = http.StatusInternalServerError
+				if errors.Is(err, ErrProxyUsername) || errors.Is(err, ErrUserDisabled) || errors.Is(err, ErrRegistrationClosed) {
+					ws.Status = http.StatusForbidden
+				} else {
+					log.Printf("err: %v\n", err)
+				}
+				ws.WriteHeader()
+			} else {
+				if cookie != nil {
+					http.SetCookie(w, cookie)
+				}
+				ws.HTMX = isHTMX(r)
+				ws.CSRF = csrfToken(s.cookie.Value)
+				if !notLogin(r) {
+					sendRedirect(&ws, r, "/") // The proxy has already logged the user in
+				} else if allowCsrf(ws, r, s.cookie.Value) {
+					h(ws, r, s)
+				}
+			}
+		} else if s, ex := sessions.session(r); !ex {
 			w.Header().Set("HX-Retarget", "body")
 			if r.URL.Path == "/login" || r.URL.Path == "/register" {
 				ws.HTMX = isHTMX(r)
-				h(ws, r, s)
+				if allowCsrf(ws, r, "") {
+					h(ws, r, s)
+				}
 			} else {
 				getLogin(ws, r, s)
 			}
 		} else {
-			s.revitalize()
 			ws.HTMX = isHTMX(r)
-			h(ws, r, s)
+			ws.CSRF = csrfToken(s.cookie.Value)
+			if allowCsrf(ws, r, s.cookie.Value) {
+				h(ws, r, s)
+			}
+		}
+
+		logRequest(r, ws, start)
+	}
+}
+
+// publicWrapper is used by the routes that don't need a session
+func publicWrapper(h func(HTMLWriter, *http.Request)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+
+		ws := HTMLWriter{Writer: w, Status: 200, HTMX: isHTMX(r)}
+		if allowCsrf(ws, r, "") {
+			h(ws, r)
 		}
 
-		timeStamp := time.Now()
-		latency := timeStamp.Sub(start)
-
-		path := r.URL.Path
-		statusColor := statusCodeColor(ws.Status)
-		methodColor := methodColor(r.Method)
-		htmxColor := htmxColor(ws.HTMX)
-		resetColor := reset
-
-		clientIP := r.RemoteAddr
-		method := r.Method
-		statusCode := ws.Status
-
-		fmt.Printf("%v |%s %3d %s| %13v | %15s |%s %-7s %s|%s HTMX %s|\n%s\n",
-			timeStamp.Format("2006/01/02 - 15:04:05"),
-			statusColor, statusCode, resetColor,
-			latency,
-			clientIP,
-			methodColor, method, resetColor,
-			htmxColor, resetColor,
-			path,
-		)
+		logRequest(r, ws, start)
 	}
 }
 
+// operatorWrapper protects the routes meant for the operator of the instance.
+// They are disabled unless OPERATOR_TOKEN is set, and the token must be sent as a bearer token
+func operatorWrapper(h func(HTMLWriter, *http.Request)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+
+		ws := HTMLWriter{Writer: w, Status: 200, HTMX: isHTMX(r)}
+
+		token := os.Getenv("OPERATOR_TOKEN")
+		auth, found := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if token == "" {
+			ws.Status = http.StatusNotFound
+			ws.WriteHeader()
+		} else if !found || subtle.ConstantTimeCompare([]byte(auth), []byte(token)) != 1 {
+			ws.Status = http.StatusUnauthorized
+			ws.WriteHeader()
+		} else {
+			h(ws, r)
+		}
+
+		logRequest(r, ws, start)
+	}
+}
+
+func logRequest(r *http.Request, ws HTMLWriter, start time.Time) {
+	timeStamp := time.Now()
+	latency := timeStamp.Sub(start)
+
+	path := r.URL.Path
+	statusColor := statusCodeColor(ws.Status)
+	methodColor := methodColor(r.Method)
+	htmxColor := htmxColor(ws.HTMX)
+	resetColor := reset
+
+	clientIP := r.RemoteAddr
+	method := r.Method
+	statusCode := ws.Status
+
+	fmt.Printf("%v |%s %3d %s| %13v | %15s |%s %-7s %s|%s HTMX %s|\n%s\n",
+		timeStamp.Format("2006/01/02 - 15:04:05"),
+		statusColor, statusCode, resetColor,
+		latency,
+		clientIP,
+		methodColor, method, resetColor,
+		htmxColor, resetColor,
+		path,
+	)
+}
+
 func notLogin(r *http.Request) bool {
 	return (r.URL.Path != "/login" && r.URL.Path != "/register")
 }
@@ -1,14 +1,19 @@
 package main
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"io"
 	"log"
+	"mime/multipart"
 	"net/http"
 	"os"
 	"path"
+	"strings"
 
+	"github.com/google/uuid"
 	"github.com/jackc/pgx/v5"
 	"github.com/jackc/pgx/v5/pgconn"
 )
@@ -22,6 +27,11 @@ func (env *Env) mainPage(w HTMLWriter, r *http.Request, _ session) {
 
 func logout(w HTMLWriter, r *http.Request, s session) {
 	sessions.remove(s)
+	// The proxy would log the user in again, its own logout ends the login there
+	if sessions.proxy != nil && sessions.proxy.logoutURL != "" {
+		sendRedirect(&w, r, sessions.proxy.logoutURL)
+		return
+	}
 	sendTemplate(w, "Logged out successfully!", "login_base", "./html/login_base.html", "./html/login.html")
 }
 
@@ -32,21 +42,22 @@ func getLogin(w HTMLWriter, r *http.Request, _ session) {
 	sendTemplate(w, "", "login_base", "./html/login_base.html", "./html/login.html")
 }
 
-func getRegister(w HTMLWriter, r *http.Request, _ session) {
-	w.HTMX = true // Login does not need index template even if the request is not from HTMX
-	sendTemplate(w, "", "login_base", "./html/login_base.html", "./html/register.html")
-}
-
 func (env *Env) getClips(w HTMLWriter, r *http.Request, s session) {
-	clips, err := env.dataManager.allClips(env.db)
+	clips, err := env.dataManager.allClips(env.db, s.user.Username)
 	if err != nil {
 		log.Printf("err: %v\n", err)
 		clips = make([]clipboard, 0)
 	}
+	shared, err := env.dataManager.sharedClips(env.db, s.user.Username)
+	if err != nil {
+		log.Printf("err: %v\n", err)
+		shared = make([]sharedClip, 0)
+	}
 
 	obj := map[string]any{
 		"UserId": s.user.Id.String(),
 		"Clip":   clips,
+		"Shared": shared,
 	}
 	sendTemplate(w, obj, "cliplist", "./html/cliplist.html")
 }
@@ -55,25 +66,74 @@ func (env *Env) newClip(w HTMLWriter, r *http.Request, _ session) {
 	sendTemplate(w, "", "newclip", "./html/newclip.html")
 }
 
-func (env *Env) getFiles(w HTMLWriter, _ *http.Request, s session) {
-	files, err := env.dataManager.allFiles(env.db, s.user.Username)
+func (env *Env) getFiles(w HTMLWriter, r *http.Request, s session) {
+	folderId := r.URL.Query().Get("folder")
+
+	path, err := env.dataManager.folderPath(env.db, s.user.Username, folderId)
+	if err == nil && folderId != "" && len(path) == 0 {
+		err = pgx.ErrNoRows
+	}
 	if err != nil {
 		log.Printf("err: %v\n", err)
+		if errors.Is(err, pgx.ErrNoRows) {
+			w.Status = http.StatusNotFound
+		} else {
+			w.Status = http.StatusInternalServerError
+		}
+		w.WriteHeader()
 		return
 	}
 
+	files, err := env.dataManager.allFiles(env.db, s.user.Username, folderId)
+	if err != nil {
+		log.Printf("err: %v\n", err)
+		return
+	}
+	folders, err := env.dataManager.subFolders(env.db, s.user.Username, folderId)
+	if err != nil {
+		log.Printf("err: %v\n", err)
+		return
+	}
+	destinations, err := env.dataManager.allFolders(env.db, s.user.Username)
+	if err != nil {
+		log.Printf("err: %v\n", err)
+		return
+	}
+	// Files shared by other users are listed in the root folder
+	shared := make([]sharedFile, 0)
+	if folderId == "" {
+		if shared, err = env.dataManager.sharedFiles(env.db, s.user.Username); err != nil {
+			log.Printf("err: %v\n", err)
+			return
+		}
+	}
+
 	obj := map[string]any{
-		"UserId": s.user.Id.String(),
-		"Files":  files,
+		"UserId":       s.user.Id.String(),
+		"Files":        files,
+		"Folders":      folders,
+		"FolderId":     folderId,
+		"FolderEvent":  folderEvent(folderId),
+		"Path":         path,
+		"Destinations": destinations,
+		"Shared":       shared,
 	}
 	sendTemplate(w, obj, "files", "./html/files.html")
 }
 
 func (env *Env) sendFile(w HTMLWriter, r *http.Request, s session) {
 	fileId := r.PathValue("fileId")
-	pth := path.Join("./filedir", s.user.Id.String(), fileId)
 
-	fileName, err := env.dataManager.fileName(env.db, s.user.Username, fileId)
+	// Files shared with the user are read from the directory of their owner
+	f, err := env.dataManager.fileAccess(env.db, s.user.Username, fileId)
+	owner := s.user
+	if err == nil && f.Username != s.user.Username {
+		owner, err = env.dataManager.userExists(env.db, f.Username)
+	}
+	var version fileVersion
+	if err == nil {
+		version, err = env.dataManager.fileVersion(env.db, owner.Username, fileId, r.URL.Query().Get("version"))
+	}
 	if err != nil {
 		log.Printf("err: %v\n", err)
 		if errors.Is(err, pgx.ErrNoRows) {
@@ -86,24 +146,167 @@ func (env *Env) sendFile(w HTMLWriter, r *http.Request, s session) {
 		return
 	}
 
-	w.Writer.Header().Set("Content-Disposition", "filename="+fileName)
-	http.ServeFile(w.Writer, r, pth)
+	if version.ScanStatus != scanClean {
+		w.Status = http.StatusForbidden
+		w.WriteHeader()
+		return
+	}
+
+	if origin, ok := downloadOrigin(); ok {
+		token := downloadToken(owner.Id.String(), version.Id.String(), f.Filename)
+		http.Redirect(w.Writer, r, origin.JoinPath("dl", token).String(), http.StatusSeeOther)
+		return
+	}
+
+	pth := path.Join("./filedir", owner.Id.String(), version.Id.String())
+	serveBlob(w, r, pth, f.Filename)
+}
+
+func (env *Env) getVersions(w HTMLWriter, r *http.Request, s session) {
+	fileId := r.PathValue("fileId")
+
+	f, err := env.dataManager.userFile(env.db, s.user.Username, fileId)
+	var versions []fileVersion
+	if err == nil {
+		versions, err = env.dataManager.fileVersions(env.db, s.user.Username, fileId)
+	}
+	if err != nil {
+		log.Printf("err: %v\n", err)
+		if errors.Is(err, pgx.ErrNoRows) {
+			w.Status = http.StatusNotFound
+		} else {
+			w.Status = http.StatusInternalServerError
+		}
+		w.WriteHeader()
+		return
+	}
+
+	obj := map[string]any{
+		"File":     f,
+		"FolderId": idString(f.Folder),
+		"Versions": versions,
+	}
+	sendTemplate(w, obj, "versions", "./html/versions.html")
 }
 
-func getUser(w HTMLWriter, _ *http.Request, s session) {
-	sendTemplate(w, s.user, "user", "./html/user.html")
+// Clips up to qrMaxText bytes are encoded in the QR code, longer ones are linked
+const qrMaxText = 500
+
+func (env *Env) clipQR(w HTMLWriter, r *http.Request, s session) {
+	clip, err := env.readableClip(s.user.Username, r.PathValue("clipId"))
+	if err != nil {
+		log.Printf("err: %v\n", err)
+		w.Status = folderErrStatus(err)
+		w.WriteHeader()
+		return
+	}
+
+	if len(clip.Text) <= qrMaxText {
+		sendQR(w, r, clip.Text)
+		return
+	}
+	sendQR(w, r, publicURL(r, path.Join("/clipboard", clip.Id.String(), "text")))
+}
+
+// clipText sends the text of a clip as plain text, it's the target of the QR codes of long clips
+func (env *Env) clipText(w HTMLWriter, r *http.Request, s session) {
+	clip, err := env.readableClip(s.user.Username, r.PathValue("clipId"))
+	if err != nil {
+		log.Printf("err: %v\n", err)
+		w.Status = folderErrStatus(err)
+		w.WriteHeader()
+		return
+	}
+
+	w.Writer.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Writer.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader()
+	w.Writer.Write([]byte(clip.Text))
+}
+
+// fileQR encodes the download URL of a file
+func (env *Env) fileQR(w HTMLWriter, r *http.Request, s session) {
+	fileId := r.PathValue("fileId")
+
+	pth := ""
+	if f, err := env.dataManager.fileAccess(env.db, s.user.Username, fileId); err == nil {
+		pth = path.Join("/file/download", f.Id.String())
+	} else if f, err := env.dataManager.memberFile(env.db, s.user.Username, fileId); err == nil {
+		pth = path.Join("/space", f.SpaceId.String(), "file", f.Id.String())
+	} else {
+		log.Printf("err: %v\n", err)
+		w.Status = folderErrStatus(err)
+		w.WriteHeader()
+		return
+	}
+	sendQR(w, r, publicURL(r, pth))
+}
+
+// device is a session in the list of the devices of a user
+type device struct {
+	storedSession
+	Current bool
+}
+
+func (env *Env) getUser(w HTMLWriter, _ *http.Request, s session) {
+	sendTemplate(w, env.userPage(s), "user", "./html/user.html")
+}
+
+// userPage collects the account settings of the user page
+func (env *Env) userPage(s session) map[string]any {
+	stored, err := env.dataManager.userSessions(env.db, s.user.Username)
+	if err != nil {
+		log.Printf("err: %v\n", err)
+	}
+	devices := make([]device, len(stored))
+	for i, sess := range stored {
+		devices[i] = device{sess, sess.Id == s.id}
+	}
+	passkeys, err := env.dataManager.userPasskeys(env.db, s.user.Username)
+	if err != nil {
+		log.Printf("err: %v\n", err)
+	}
+	tokens, err := env.dataManager.userApiTokens(env.db, s.user.Username)
+	if err != nil {
+		log.Printf("err: %v\n", err)
+	}
+	var invites []invite
+	if env.registration == registrationInvite {
+		if invites, err = env.dataManager.userInvites(env.db, s.user.Username); err != nil {
+			log.Printf("err: %v\n", err)
+		}
+	}
+
+	return map[string]any{
+		"User":       s.user,
+		"Devices":    devices,
+		"TOTP":       env.totpState(s.user.Username),
+		"Passkeys":   passkeys,
+		"Tokens":     tokens,
+		"ApiScopes":  apiScopes,
+		"InviteMode": env.registration == registrationInvite,
+		"Invites":    invites,
+	}
 }
 
 // POST //
 
 func (env *Env) postLogin(w HTMLWriter, r *http.Request, _ session) {
-	cookie, err := env.checkUser(r)
+	username := r.PostFormValue("username")
+	if !env.allowLogin(w, r, username, "./html/login.html") {
+		return
+	}
+
+	u, rem, err := env.checkUser(r)
 	if err != nil {
 		var e *ErrWrongPassword
-		if errors.Is(err, pgx.ErrNoRows) {
-			sendTemplate(w, "This user doesn't exists, create a new one?", "login_base", "./html/login.html", "./html/login_base.html")
-		} else if errors.As(err, &e) {
-			sendTemplate(w, "The password is not correct", "login_base", "./html/login.html", "./html/login_base.html")
+		if errors.Is(err, pgx.ErrNoRows) || errors.As(err, &e) {
+			// The same answer for both, so it doesn't tell which users exist
+			env.loginFailed(r, username)
+			sendTemplate(w, "The username or the password is not correct", "login_base", "./html/login.html", "./html/login_base.html")
+		} else if errors.Is(err, ErrUserDisabled) {
+			// Only shown after the password has been checked
+			sendTemplate(w, "This account has been disabled", "login_base", "./html/login.html", "./html/login_base.html")
 		} else {
 			log.Printf("err: %v\n", err)
 			w.Status = http.StatusInternalServerError
@@ -113,18 +316,52 @@ func (env *Env) postLogin(w HTMLWriter, r *http.Request, _ session) {
 		return
 	}
 
-	http.SetCookie(w.Writer, cookie)
-	w.Writer.Header().Add("HX-Push-Url", "/")
-	w.WriteHeader()
-	sendTemplate(w, "", "index", "./html/index.html")
+	// Users with a second factor get a session only after entering a code
+	if env.totpEnabled(u.Username) {
+		env.sendLoginChallenge(w, u, rem)
+		return
+	}
+
+	env.loginSucceeded(r, u.Username)
+	cookie, err := env.startSession(r, u, rem)
+	if err != nil {
+		log.Printf("err: %v\n", err)
+		w.Status = http.StatusInternalServerError
+		w.WriteHeader()
+		sendTemplate(w, err.Error(), "login_base", "./html/login.html", "./html/login_base.html")
+		return
+	}
+	sendLoggedIn(w, cookie)
 }
 
 func (env *Env) postRegister(w HTMLWriter, r *http.Request, _ session) {
+	if !env.allowLogin(w, r, "", "./html/register.html") {
+		return
+	}
+
 	cookie, err := env.registerUser(r)
 	if err != nil {
+		switch {
+		case errors.Is(err, ErrRegistrationClosed):
+			sendTemplate(w, env.registerForm(r, ""), "login_base", "./html/register.html", "./html/login_base.html")
+			return
+		case errors.Is(err, ErrUsername):
+			sendTemplate(w, env.registerForm(r, "Usernames have at most 25 letters, digits, dots, dashes, underscores or @ and start with a letter or a digit"), "login_base", "./html/register.html", "./html/login_base.html")
+			return
+		case errors.Is(err, pgx.ErrNoRows):
+			// Wrong codes count as failures like wrong passwords
+			log.Printf("login: sign-up with an invalid invite from %s\n", clientIP(r))
+			env.clientFailed(r)
+			sendTemplate(w, env.registerForm(r, "The invite code is not valid, it has already been used or it has expired"), "login_base", "./html/register.html", "./html/login_base.html")
+			return
+		}
+
 		var pgErr *pgconn.PgError
 		if errors.As(err, &pgErr) {
 			if pgErr.Code == "23505" {
+				// Taken usernames count as failures, so they can't be enumerated quickly
+				log.Printf("login: sign-up with the taken username %q from %s\n", r.PostForm.Get("username"), clientIP(r))
+				env.clientFailed(r)
 				sendTemplate(
 					w,
 					"Username already taken, please login",
@@ -138,11 +375,17 @@ func (env *Env) postRegister(w HTMLWriter, r *http.Request, _ session) {
 		log.Printf("err: %v\n", err)
 		w.Status = http.StatusInternalServerError
 		w.WriteHeader()
-		sendTemplate(w, err.Error(), "login_base", "./html/register.html", "./html/login_base.html")
+		sendTemplate(w, env.registerForm(r, err.Error()), "login_base", "./html/register.html", "./html/login_base.html")
 		return
 	}
 
+	sendLoggedIn(w, cookie)
+}
+
+// sendLoggedIn sets the cookie of a new session and sends the main page
+func sendLoggedIn(w HTMLWriter, cookie *http.Cookie) {
 	http.SetCookie(w.Writer, cookie)
+	w.CSRF = csrfToken(cookie.Value)
 	w.Writer.Header().Add("HX-Push-Url", "/")
 	w.WriteHeader()
 	sendTemplate(w, "", "index", "./html/index.html")
@@ -159,7 +402,7 @@ func (env *Env) postClip(w HTMLWriter, r *http.Request, s session) {
 		log.Printf("err: %v\n", err)
 	}
 
-	env.clipBroker.Publish(s.user.Username, 1)
+	env.clipBroker.Publish(userChannel(s.user.Username), "")
 }
 
 func (env *Env) postFile(w HTMLWriter, r *http.Request, s session) {
@@ -169,60 +412,247 @@ func (env *Env) postFile(w HTMLWriter, r *http.Request, s session) {
 	}
 	fileMap := r.MultipartForm.File
 
+	folderId := r.FormValue("folder")
+	if folderId != "" {
+		if _, err := env.dataManager.folder(env.db, s.user.Username, folderId); err != nil {
+			log.Printf("err: %v\n", err)
+			w.Status = http.StatusNotFound
+			w.WriteHeader()
+			return
+		}
+	}
+
 	for _, files := range fileMap {
 		for _, f := range files {
-			file, err := f.Open()
-			if err != nil {
+			if _, err := env.saveUpload(s.user, f, folderId, nil); err != nil {
 				log.Printf("err: %v\n", err)
-				continue
+				if errors.Is(err, ErrScanTooLarge) {
+					w.Status = http.StatusRequestEntityTooLarge
+				}
 			}
-			defer file.Close()
+		}
+	}
+	if w.Status != http.StatusOK {
+		w.WriteHeader()
+	}
 
-			fname, err := env.dataManager.insertFile(env.db, s.user.Username, f.Filename)
-			if err != nil {
-				log.Printf("err: %v\n", err)
-				continue
-			}
-			pth := path.Join("./filedir", s.user.Id.String(), fname)
-			local, err := os.Create(pth)
-			if err != nil {
-				log.Printf("err: %v\n", err)
-				continue
-			}
-			defer local.Close()
+	env.fileBroker.Publish(userChannel(s.user.Username), folderEvent(folderId))
+}
 
-			if _, err = io.Copy(local, file); err != nil {
-				log.Printf("err: %v\n", err)
-			}
+// saveUpload stores an uploaded file in folderId of owner and returns its name. uploadLink is the
+// link the file comes from, nil when the owner uploads it. Guests never add versions to the files
+// of the owner, their files are renamed instead. The caller publishes the change to the owner
+func (env *Env) saveUpload(owner user, f *multipart.FileHeader, folderId string, uploadLink *uuid.UUID) (string, error) {
+	if err := env.checkUploadSize(f.Size); err != nil {
+		return "", err
+	}
+	file, err := f.Open()
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	status := env.uploadStatus()
+	name := f.Filename
+	var fileId, version string
+	if uploadLink != nil {
+		fileId, version, name, err = env.dataManager.insertGuestFile(env.db, owner.Username, f.Filename, folderId, f.Size, status, *uploadLink)
+	} else {
+		fileId, version, err = env.dataManager.insertFile(env.db, owner.Username, f.Filename, folderId, f.Size, status, nil)
+	}
+	if err != nil {
+		return "", err
+	}
+	err = env.storeBlob(file, owner.Id, version, status)
+	// Uploading a file with the same name adds a version, which users it's shared with can see
+	env.publishGrantees("", fileId)
+	return name, err
+}
+
+// restoreVersion makes a copy of an older version the latest one, so that the history is preserved
+func (env *Env) restoreVersion(w HTMLWriter, r *http.Request, s session) {
+	fileId := r.PathValue("fileId")
+
+	f, err := env.dataManager.userFile(env.db, s.user.Username, fileId)
+	var old fileVersion
+	if err == nil {
+		old, err = env.dataManager.fileVersion(env.db, s.user.Username, fileId, r.PathValue("versionId"))
+	}
+	if err != nil {
+		log.Printf("err: %v\n", err)
+		if errors.Is(err, pgx.ErrNoRows) {
+			w.Status = http.StatusNotFound
+		} else {
+			w.Status = http.StatusInternalServerError
+		}
+		w.WriteHeader()
+		return
+	}
+	if old.ScanStatus != scanClean {
+		w.Status = http.StatusBadRequest
+		w.WriteHeader()
+		return
+	}
+
+	dir := path.Join("./filedir", s.user.Id.String())
+	newId := uuid.NewString()
+	if err := copyBlob(path.Join(dir, old.Id.String()), path.Join(dir, newId)); err != nil {
+		log.Printf("err: %v\n", err)
+		w.Status = http.StatusInternalServerError
+		w.WriteHeader()
+		return
+	}
+	if err := env.dataManager.insertVersion(env.db, s.user.Username, fileId, newId, old.Size, old.Checksum, scanClean); err != nil {
+		log.Printf("err: %v\n", err)
+		if err := os.Remove(path.Join(dir, newId)); err != nil {
+			log.Printf("err: %v\n", err)
 		}
+		w.Status = http.StatusInternalServerError
+		w.WriteHeader()
+		return
+	}
+
+	env.fileBroker.Publish(userChannel(s.user.Username), folderEvent(idString(f.Folder)))
+	env.getVersions(w, r, s)
+}
+
+func (env *Env) postFolder(w HTMLWriter, r *http.Request, s session) {
+	if err := r.ParseForm(); err != nil {
+		w.Status = http.StatusBadRequest
+		w.WriteHeader()
+		log.Printf("err: %v\n", err)
+		return
+	}
+	name := strings.TrimSpace(r.PostForm.Get("name"))
+	parent := r.PostForm.Get("parent")
+	if name == "" {
+		w.Status = http.StatusBadRequest
+		w.WriteHeader()
+		return
+	}
+
+	if _, err := env.dataManager.insertFolder(env.db, s.user.Username, name, parent); err != nil {
+		log.Printf("err: %v\n", err)
+		w.Status = folderErrStatus(err)
+		w.WriteHeader()
+		return
+	}
+
+	env.fileBroker.Publish(userChannel(s.user.Username), folderEvent(parent))
+}
+
+func (env *Env) renameFolder(w HTMLWriter, r *http.Request, s session) {
+	folderId := r.PathValue("folderId")
+	name := strings.TrimSpace(r.Header.Get("HX-Prompt"))
+	if name == "" {
+		w.Status = http.StatusBadRequest
+		w.WriteHeader()
+		return
+	}
+
+	fold, err := env.dataManager.folder(env.db, s.user.Username, folderId)
+	if err == nil {
+		err = env.dataManager.renameFolder(env.db, s.user.Username, folderId, name)
+	}
+	if err != nil {
+		log.Printf("err: %v\n", err)
+		w.Status = folderErrStatus(err)
+		w.WriteHeader()
+		return
+	}
+
+	// The folder is listed in its parent and its name is shown in its own breadcrumb
+	env.fileBroker.Publish(userChannel(s.user.Username), folderEvent(idString(fold.Parent)))
+	env.fileBroker.Publish(userChannel(s.user.Username), folderEvent(folderId))
+}
+
+func (env *Env) moveFolder(w HTMLWriter, r *http.Request, s session) {
+	folderId := r.PathValue("folderId")
+	if err := r.ParseForm(); err != nil {
+		w.Status = http.StatusBadRequest
+		w.WriteHeader()
+		log.Printf("err: %v\n", err)
+		return
+	}
+	dest := r.PostForm.Get("folder")
+
+	fold, err := env.dataManager.folder(env.db, s.user.Username, folderId)
+	if err == nil {
+		err = env.dataManager.moveFolder(env.db, s.user.Username, folderId, dest)
+	}
+	if err != nil {
+		log.Printf("err: %v\n", err)
+		w.Status = folderErrStatus(err)
+		w.WriteHeader()
+		return
 	}
 
-	env.fileBroker.Publish(s.user.Username, 1)
+	env.fileBroker.Publish(userChannel(s.user.Username), folderEvent(idString(fold.Parent)))
+	env.fileBroker.Publish(userChannel(s.user.Username), folderEvent(dest))
+	env.fileBroker.Publish(userChannel(s.user.Username), folderEvent(folderId))
+}
+
+func (env *Env) moveFile(w HTMLWriter, r *http.Request, s session) {
+	fileId := r.PathValue("fileId")
+	if err := r.ParseForm(); err != nil {
+		w.Status = http.StatusBadRequest
+		w.WriteHeader()
+		log.Printf("err: %v\n", err)
+		return
+	}
+	dest := r.PostForm.Get("folder")
+
+	old, err := env.dataManager.moveFile(env.db, s.user.Username, fileId, dest)
+	if err != nil {
+		log.Printf("err: %v\n", err)
+		w.Status = folderErrStatus(err)
+		w.WriteHeader()
+		return
+	}
+
+	env.fileBroker.Publish(userChannel(s.user.Username), folderEvent(idString(old.Folder)))
+	env.fileBroker.Publish(userChannel(s.user.Username), folderEvent(dest))
 }
 
 // DELETE //
 
 func (env *Env) deleteClip(w HTMLWriter, r *http.Request, s session) {
 	ids := r.URL.Query()["id"]
+	notify := env.itemsGrantees(true, ids...)
 
 	if err := env.dataManager.deleteClips(env.db, s.user.Username, ids...); err != nil {
 		log.Printf("err: %v\n", err)
 		w.Status = http.StatusInternalServerError
 	}
 
-	env.clipBroker.Publish(s.user.Username, 1)
+	env.clipBroker.Publish(userChannel(s.user.Username), "")
+	for _, u := range notify {
+		env.clipBroker.Publish(userChannel(u), "")
+	}
 	w.Status = http.StatusNoContent
 	w.WriteHeader()
 	sendTemplate(w, "", "nil", "./html/index.html")
 }
 
 func (env *Env) deleteAllClips(w HTMLWriter, r *http.Request, s session) {
+	var notify []string
+	if clips, err := env.dataManager.allClips(env.db, s.user.Username); err == nil {
+		ids := make([]string, len(clips))
+		for i, c := range clips {
+			ids[i] = c.Id.String()
+		}
+		notify = env.itemsGrantees(true, ids...)
+	}
+
 	if err := env.dataManager.deleteAllClips(env.db, s.user.Username); err != nil {
 		log.Printf("err: %v\n", err)
 		w.Status = http.StatusInternalServerError
 	}
 
-	env.clipBroker.Publish(s.user.Username, 1)
+	env.clipBroker.Publish(userChannel(s.user.Username), "")
+	for _, u := range notify {
+		env.clipBroker.Publish(userChannel(u), "")
+	}
 	w.Status = http.StatusNoContent
 	w.WriteHeader()
 	sendTemplate(w, "", "nil", "./html/index.html")
@@ -230,27 +660,65 @@ func (env *Env) deleteAllClips(w HTMLWriter, r *http.Request, s session) {
 
 func (env *Env) deleteFile(w HTMLWriter, r *http.Request, s session) {
 	ids := r.URL.Query()["id"]
+	notify := env.itemsGrantees(false, ids...)
 
-	err := env.dataManager.deleteFiles(env.db, s.user.Username, ids...)
+	deleted, blobs, err := env.dataManager.deleteFiles(env.db, s.user.Username, ids...)
 	if err != nil {
 		log.Printf("err: %v\n", err)
 		w.Status = http.StatusInternalServerError
-	} else {
-		for _, fname := range ids {
-			pth := path.Join("./filedir", s.user.Id.String(), fname)
-			if err := os.Remove(pth); err != nil {
-				log.Printf("err: %v\n", err)
-				continue
-			}
+	}
+
+	for _, blob := range blobs {
+		if err := removeBlob(s.user.Id.String(), blob); err != nil {
+			log.Printf("err: %v\n", err)
 		}
 	}
 
-	env.fileBroker.Publish(s.user.Username, 1)
+	affected := map[string]bool{}
+	for _, f := range deleted {
+		affected[folderEvent(idString(f.Folder))] = true
+	}
+
+	for folder := range affected {
+		env.fileBroker.Publish(userChannel(s.user.Username), folder)
+	}
+	for _, u := range notify {
+		env.fileBroker.Publish(userChannel(u), folderEvent(""))
+	}
 	w.Status = http.StatusNoContent
 	w.WriteHeader()
 	sendTemplate(w, "", "nil", "./html/index.html")
 }
 
+func (env *Env) deleteFolder(w HTMLWriter, r *http.Request, s session) {
+	folderId := r.PathValue("folderId")
+
+	fold, err := env.dataManager.folder(env.db, s.user.Username, folderId)
+	if err != nil {
+		log.Printf("err: %v\n", err)
+		w.Status = folderErrStatus(err)
+		w.WriteHeader()
+		return
+	}
+	ids, err := env.dataManager.deleteFolder(env.db, s.user.Username, folderId)
+	if err != nil {
+		log.Printf("err: %v\n", err)
+		w.Status = folderErrStatus(err)
+		w.WriteHeader()
+		return
+	}
+
+	for _, id := range ids {
+		if err := removeBlob(s.user.Id.String(), id); err != nil {
+			log.Printf("err: %v\n", err)
+		}
+	}
+
+	env.fileBroker.Publish(userChannel(s.user.Username), folderEvent(idString(fold.Parent)))
+	w.Status = http.StatusNoContent
+	w.WriteHeader()
+}
+
 func (env *Env) deleteUser(w HTMLWriter, r *http.Request, s session) {
 	if s.user.Id.String() != r.PathValue("id") {
 		w.Status = http.StatusUnauthorized
@@ -258,21 +726,60 @@ func (env *Env) deleteUser(w HTMLWriter, r *http.Request, s session) {
 		sendTemplate(w, "", "index", "./html/index.html")
 		return
 	}
-	if err := env.dataManager.deleteUser(env.db, s.user.Username); err != nil {
+	if err := env.purgeUser(s.user); err != nil {
+		log.Printf("err: %v\n", err)
 		w.Status = http.StatusInternalServerError
 		w.WriteHeader()
 		sendTemplate(w, "", "index", "./html/index.html")
 		return
 	}
 
-	// ISSUE: This is bad. Probably better to group sessions by user too
-	for _, sess := range sessions.m {
-		if sess.user.Username == s.user.Username {
-			sessions.remove(s)
-		}
+	sendTemplate(w, env.registerForm(r, ""), "login_base", "./html/register.html", "./html/login_base.html")
+}
+
+// logoutDevice ends one of the sessions of the user. Ending the current one is a logout
+func (env *Env) logoutDevice(w HTMLWriter, r *http.Request, s session) {
+	id := r.PathValue("sessionId")
+	if id == s.id.String() {
+		w.Writer.Header().Set("HX-Retarget", "body")
+		logout(w, r, s)
+		return
 	}
 
-	sendTemplate(w, "", "login_base", "./html/register.html", "./html/login_base.html")
+	if err := sessions.removeId(s.user.Username, id); err != nil {
+		log.Printf("err: %v\n", err)
+		w.Status = folderErrStatus(err)
+		w.WriteHeader()
+		return
+	}
+	env.getUser(w, r, s)
+}
+
+// logoutOthers ends every session of the user except the current one
+func (env *Env) logoutOthers(w HTMLWriter, r *http.Request, s session) {
+	if err := sessions.removeOthers(s); err != nil {
+		log.Printf("err: %v\n", err)
+		w.Status = http.StatusInternalServerError
+		w.WriteHeader()
+		return
+	}
+	env.getUser(w, r, s)
+}
+
+// OPERATOR //
+
+// operatorFsck reports the inconsistencies of the storage. POST requests also repair them
+func (env *Env) operatorFsck(w HTMLWriter, r *http.Request) {
+	report, err := env.fsck(r.Method == http.MethodPost)
+	if err != nil {
+		log.Printf("err: %v\n", err)
+		w.Status = http.StatusInternalServerError
+		w.WriteHeader()
+		return
+	}
+
+	w.Writer.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	report.write(w.Writer)
 }
 
 // SSE //
@@ -283,20 +790,27 @@ func (env *Env) clipUpdate(w HTMLWriter, r *http.Request, s session) {
 	writer.Header().Set("Cache-Control", "no-cache")
 	writer.Header().Set("Connection", "keep-alive")
 
-	env.clipBroker.Subscribe <- s
+	sub := newSubscription(userChannel(s.user.Username))
+	env.clipBroker.Subscribe <- sub
 	done := r.Context().Done()
 
 	rc := http.NewResponseController(writer)
 	for {
 		select {
 		case <-done:
-			env.clipBroker.Unsubscribe <- s
+			env.clipBroker.Unsubscribe <- sub
 			return
-		case _, open := <-s.clipEvtCh:
-			if !open {
-				return
+		case <-s.done:
+			// The session ended, unsubscribe before the stream stops reading
+			env.clipBroker.Unsubscribe <- sub
+			return
+		case evt := <-sub.ch:
+			// Events with a scope carry a notification instead of a clipboard change
+			name := "update-clipboard"
+			if evt.Scope != "" {
+				name = evt.Scope
 			}
-			if _, err := fmt.Fprintf(writer, "event: %s-update-clipboard\ndata:\n\n", s.user.Id); err != nil {
+			if _, err := fmt.Fprintf(writer, "event: %s-%s\ndata: %s\n\n", s.user.Id, name, evt.Data); err != nil {
 				log.Printf("err: %v", err)
 				continue
 			}
@@ -315,20 +829,21 @@ func (env *Env) fileUpdate(w HTMLWriter, r *http.Request, s session) {
 	writer.Header().Set("Cache-Control", "no-cache")
 	writer.Header().Set("Connection", "keep-alive")
 
-	env.fileBroker.Subscribe <- s
+	sub := newSubscription(userChannel(s.user.Username))
+	env.fileBroker.Subscribe <- sub
 	done := r.Context().Done()
 
 	rc := http.NewResponseController(writer)
 	for {
 		select {
 		case <-done:
-			env.fileBroker.Unsubscribe <- s
+			env.fileBroker.Unsubscribe <- sub
 			return
-		case _, open := <-s.clipEvtCh:
-			if !open {
-				return
-			}
-			if _, err := fmt.Fprintf(writer, "event: %s-update-file\ndata:\n\n", s.user.Id); err != nil {
+		case <-s.done:
+			env.fileBroker.Unsubscribe <- sub
+			return
+		case evt := <-sub.ch:
+			if _, err := fmt.Fprintf(writer, "event: %s-update-file-%s\ndata:\n\n", s.user.Id, evt.Scope); err != nil {
 				log.Printf("err: %v", err)
 				continue
 			}
@@ -340,3 +855,138 @@ func (env *Env) fileUpdate(w HTMLWriter, r *http.Request, s session) {
 		}
 	}
 }
+
+// folderEvent returns the name used to identify the folder in file events
+func folderEvent(folderId string) string {
+	if folderId == "" {
+		return "root"
+	}
+	return folderId
+}
+
+func idString(id *uuid.UUID) string {
+	if id == nil {
+		return ""
+	}
+	return id.String()
+}
+
+// removeBlob deletes the blob of a version, wherever it is stored.
+// dirId is the id of the user or space that owns the version
+func removeBlob(dirId string, versionId string) error {
+	for _, pth := range []string{path.Join("./filedir", dirId, versionId), quarantinePath(versionId)} {
+		if err := os.Remove(pth); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+	return nil
+}
+
+// readableClip returns a clip that user owns, that has been shared with them or that is in one of their spaces
+func (env *Env) readableClip(user string, id string) (clipboard, error) {
+	clip, err := env.dataManager.clipAccess(env.db, user, id)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return env.dataManager.memberClip(env.db, user, id)
+	}
+	return clip.clipboard, err
+}
+
+// itemsGrantees returns the users that the clips or files are shared with, without duplicates
+func (env *Env) itemsGrantees(clips bool, ids ...string) []string {
+	seen := map[string]bool{}
+	users := make([]string, 0)
+	for _, id := range ids {
+		clipId, fileId := id, ""
+		if !clips {
+			clipId, fileId = "", id
+		}
+		grantees, err := env.dataManager.grantees(env.db, clipId, fileId)
+		if err != nil {
+			log.Printf("err: %v\n", err)
+			continue
+		}
+		for _, u := range grantees {
+			if !seen[u] {
+				seen[u] = true
+				users = append(users, u)
+			}
+		}
+	}
+	return users
+}
+
+// uploadStatus is the scan status of new uploads
+func (env *Env) uploadStatus() string {
+	if env.scanner != nil {
+		return scanPending
+	}
+	return scanClean
+}
+
+// checkUploadSize refuses the files that are larger than the scanner accepts, they could never be scanned
+func (env *Env) checkUploadSize(size int64) error {
+	if env.scanner != nil && env.scanMaxSize > 0 && size > env.scanMaxSize {
+		return ErrScanTooLarge
+	}
+	return nil
+}
+
+// storeBlob writes the content of a new version in dirId, the directory of a user or a space,
+// and records its checksum. When a scanner is configured the blob waits in quarantine until it is found clean
+func (env *Env) storeBlob(src io.Reader, dirId uuid.UUID, versionId string, status string) error {
+	pth := path.Join("./filedir", dirId.String(), versionId)
+	if status == scanPending {
+		pth = quarantinePath(versionId)
+	}
+	local, err := os.Create(pth)
+	if err != nil {
+		return err
+	}
+	defer local.Close()
+
+	hash := sha256.New()
+	if _, err = io.Copy(io.MultiWriter(local, hash), src); err != nil {
+		return err
+	}
+	if err := env.dataManager.setChecksum(env.db, versionId, hex.EncodeToString(hash.Sum(nil))); err != nil {
+		return err
+	}
+
+	if status == scanPending {
+		go env.scans.push(blobRef{Id: uuid.MustParse(versionId), UserId: dirId})
+	}
+	return nil
+}
+
+// copyBlob copies the blob at src into a new file at dst
+func copyBlob(src string, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+func folderErrStatus(err error) int {
+	var pgErr *pgconn.PgError
+	switch {
+	case errors.Is(err, pgx.ErrNoRows):
+		return http.StatusNotFound
+	case errors.Is(err, ErrInvalidMove):
+		return http.StatusBadRequest
+	case errors.As(err, &pgErr) && pgErr.Code == "23505":
+		return http.StatusConflict
+	default:
+		return http.StatusInternalServerError
+	}
+}
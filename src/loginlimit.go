@@ -0,0 +1,93 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// allowLogin applies the rate limit of login and sign-up attempts and the lockouts of the client
+// and of username, an empty username checks only the client.
+// If it returns false the response has already been sent, with the form in page
+func (env *Env) allowLogin(w HTMLWriter, r *http.Request, username string, page string) bool {
+	ip := clientIP(r)
+	wait := env.loginClientLockout.blocked(ip)
+	if username != "" {
+		wait = max(wait, env.accountWait(r, username))
+	}
+
+	msg := ""
+	if wait > 0 {
+		w.Writer.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+		msg = "Too many failed attempts, try again in " + waitText(wait)
+		log.Printf("login: %q from %s refused, locked out for %v\n", username, ip, wait.Round(time.Second))
+	} else if !env.loginLimiter.allow(ip) {
+		msg = "Too many attempts, try again later"
+		log.Printf("login: %q from %s refused, rate limited\n", username, ip)
+	} else {
+		return true
+	}
+
+	// HTMX doesn't swap error responses, its requests get the message as a normal page
+	if !isHTMX(r) {
+		w.Status = http.StatusTooManyRequests
+	}
+	w.WriteHeader()
+	w.HTMX = true // Login pages never use the index template
+	var obj any = msg
+	if page == "./html/register.html" {
+		obj = env.registerForm(r, msg)
+	}
+	sendTemplate(w, obj, "login_base", "./html/login_base.html", page)
+	return false
+}
+
+// accountKey is the key of the lockout of username. It's per client, so others can't lock
+// the owner out of the account by failing on purpose
+func accountKey(r *http.Request, username string) string {
+	return username + " " + clientIP(r)
+}
+
+// accountWait returns how long the client must wait before trying username again, because of
+// its own failures or of the failures from all the clients
+func (env *Env) accountWait(r *http.Request, username string) time.Duration {
+	return max(env.loginUserLockout.blocked(accountKey(r, username)), env.loginAccountLockout.blocked(username))
+}
+
+// loginFailed records a wrong password or code for username
+func (env *Env) loginFailed(r *http.Request, username string) {
+	ip := clientIP(r)
+	log.Printf("login: failed attempt for %q from %s\n", username, ip)
+	env.clientFailed(r)
+	if wait := env.loginUserLockout.fail(accountKey(r, username)); wait > 0 {
+		log.Printf("login: user %q locked out for %v from %s\n", username, wait, ip)
+	}
+	if wait := env.loginAccountLockout.fail(username); wait > 0 {
+		log.Printf("login: user %q locked out for %v from every client, too many failures from several addresses\n", username, wait)
+	}
+}
+
+// clientFailed records a failed attempt of the client, also used for sign-ups with a taken username
+func (env *Env) clientFailed(r *http.Request) {
+	ip := clientIP(r)
+	if wait := env.loginClientLockout.fail(ip); wait > 0 {
+		log.Printf("login: client %s locked out for %v\n", ip, wait)
+	}
+}
+
+// loginSucceeded forgets the failures of username from the client. The failures of the client
+// are kept, so an attacker with an account can't use it to reset them, and so are the failures
+// of the account from all the clients, a distributed guess can't be reset by the owner logging in
+func (env *Env) loginSucceeded(r *http.Request, username string) {
+	env.loginUserLockout.reset(accountKey(r, username))
+}
+
+func waitText(d time.Duration) string {
+	if d < time.Minute {
+		return fmt.Sprintf("%d seconds", int(math.Ceil(d.Seconds())))
+	}
+	return fmt.Sprintf("%d minutes", int(math.Ceil(d.Minutes())))
+}
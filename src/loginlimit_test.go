@@ -0,0 +1,41 @@
+package main
+
+import (
+	"fmt"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// Guesses spread over many addresses lock the account for every client once they add up
+func TestAccountLockout(t *testing.T) {
+	env := &Env{
+		loginClientLockout:  newMemoryLockout(20, 30*time.Second, 15*time.Minute),
+		loginUserLockout:    newMemoryLockout(5, 30*time.Second, 15*time.Minute),
+		loginAccountLockout: newMemoryLockout(50, time.Minute, time.Hour),
+	}
+	for i := 0; i < 50; i++ {
+		r := httptest.NewRequest("POST", "/login", nil)
+		r.RemoteAddr = fmt.Sprintf("192.0.2.%d:1234", i)
+		env.loginFailed(r, "alice")
+	}
+
+	r := httptest.NewRequest("POST", "/login", nil)
+	r.RemoteAddr = "198.51.100.1:1234"
+	if wait := env.accountWait(r, "alice"); wait != 0 {
+		t.Fatalf("locked out after 50 failures: %v", wait)
+	}
+	env.loginFailed(r, "alice")
+	if wait := env.accountWait(r, "alice"); wait < 59*time.Second || wait > time.Minute {
+		t.Errorf("a new client waits %v, want a minute", wait)
+	}
+	if wait := env.accountWait(r, "bob"); wait != 0 {
+		t.Errorf("other accounts wait %v", wait)
+	}
+
+	// The owner logging in doesn't lift the lock of the account
+	env.loginSucceeded(r, "alice")
+	if wait := env.accountWait(r, "alice"); wait == 0 {
+		t.Error("a successful login reset the failures of every client")
+	}
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"fmt"
+	"mime"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"strings"
+	"time"
+)
+
+// mailer delivers the emails of the instance, only password reset links for now
+type mailer interface {
+	send(to string, subject string, body string) error
+}
+
+// smtpMailer sends mail through an SMTP relay, with STARTTLS when the relay supports it
+type smtpMailer struct {
+	addr string
+	from string
+	auth smtp.Auth // nil when the relay doesn't need a login
+}
+
+func newSmtpMailer(addr string, from string, username string, password string) smtpMailer {
+	var auth smtp.Auth
+	if username != "" {
+		host, _, _ := net.SplitHostPort(addr)
+		auth = smtp.PlainAuth("", username, password, host)
+	}
+	return smtpMailer{addr, from, auth}
+}
+
+func (m smtpMailer) send(to string, subject string, body string) error {
+	// The addresses come from the configuration and from validated user input,
+	// line breaks are removed anyway so they can't add headers
+	clean := strings.NewReplacer("\r", "", "\n", "")
+	to, from := clean.Replace(to), clean.Replace(m.from)
+
+	var msg strings.Builder
+	fmt.Fprintf(&msg, "From: %s\r\n", from)
+	fmt.Fprintf(&msg, "To: %s\r\n", to)
+	fmt.Fprintf(&msg, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", subject))
+	fmt.Fprintf(&msg, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	msg.WriteString("MIME-Version: 1.0\r\n")
+	msg.WriteString("Content-Type: text/plain; charset=utf-8\r\n")
+	msg.WriteString("Content-Transfer-Encoding: 8bit\r\n\r\n")
+	msg.WriteString(strings.ReplaceAll(body, "\n", "\r\n"))
+
+	// SMTP_FROM can include a display name, the envelope needs only the address
+	envelope := from
+	if a, err := mail.ParseAddress(from); err == nil {
+		envelope = a.Address
+	}
+	return smtp.SendMail(m.addr, m.auth, envelope, []string{to}, []byte(msg.String()))
+}
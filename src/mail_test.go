@@ -0,0 +1,307 @@
+package main
+
+import (
+	"encoding/base64"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/mail"
+	"net/textproto"
+	"net/url"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// smtpMessage is a mail received by fakeSmtp, with its envelope
+type smtpMessage struct {
+	auth string // the decoded AUTH PLAIN response, empty without a login
+	from string
+	to   []string
+	data []byte
+}
+
+// fakeSmtp is a relay that accepts every mail, without STARTTLS, and sends it to the channel
+func fakeSmtp(t *testing.T) (string, <-chan smtpMessage) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	received := make(chan smtpMessage, 4)
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go serveSmtp(textproto.NewConn(conn), received)
+		}
+	}()
+	return ln.Addr().String(), received
+}
+
+func serveSmtp(c *textproto.Conn, received chan<- smtpMessage) {
+	defer c.Close()
+	var msg smtpMessage
+	c.PrintfLine("220 localhost ESMTP")
+	for {
+		line, err := c.ReadLine()
+		if err != nil {
+			return
+		}
+		cmd, arg, _ := strings.Cut(line, " ")
+		switch strings.ToUpper(cmd) {
+		case "EHLO":
+			c.PrintfLine("250-localhost")
+			c.PrintfLine("250-8BITMIME")
+			c.PrintfLine("250 AUTH PLAIN")
+		case "HELO", "RSET", "NOOP":
+			c.PrintfLine("250 OK")
+		case "AUTH":
+			mech, resp, _ := strings.Cut(arg, " ")
+			dec, err := base64.StdEncoding.DecodeString(resp)
+			if mech != "PLAIN" || err != nil {
+				c.PrintfLine("504 5.5.4 Unrecognized authentication type")
+				continue
+			}
+			msg.auth = string(dec)
+			c.PrintfLine("235 2.7.0 Authentication successful")
+		case "MAIL":
+			addr, _, _ := strings.Cut(strings.TrimPrefix(arg, "FROM:<"), ">")
+			msg.from = addr
+			c.PrintfLine("250 OK")
+		case "RCPT":
+			addr, _, _ := strings.Cut(strings.TrimPrefix(arg, "TO:<"), ">")
+			msg.to = append(msg.to, addr)
+			c.PrintfLine("250 OK")
+		case "DATA":
+			c.PrintfLine("354 End data with <CR><LF>.<CR><LF>")
+			data, err := io.ReadAll(c.DotReader())
+			if err != nil {
+				return
+			}
+			// DotReader turns the line endings into LF, put the CRLF of the wire back
+			msg.data = []byte(strings.ReplaceAll(string(data), "\n", "\r\n"))
+			c.PrintfLine("250 OK")
+			received <- msg
+			msg = smtpMessage{auth: msg.auth}
+		case "QUIT":
+			c.PrintfLine("221 Bye")
+			return
+		default:
+			c.PrintfLine("502 5.5.2 Command not recognized")
+		}
+	}
+}
+
+func receiveMail(t *testing.T, received <-chan smtpMessage) smtpMessage {
+	t.Helper()
+	select {
+	case msg := <-received:
+		return msg
+	case <-time.After(5 * time.Second):
+		t.Fatal("no mail was received")
+		return smtpMessage{}
+	}
+}
+
+func TestSmtpMailerSend(t *testing.T) {
+	addr, received := fakeSmtp(t)
+	m := newSmtpMailer(addr, "CopyPaste <noreply@example.com>", "", "")
+	if err := m.send("alice@example.com", "Réinitialiser le mot de passe", "first line\nsecond line\n"); err != nil {
+		t.Fatal(err)
+	}
+
+	msg := receiveMail(t, received)
+	if msg.auth != "" {
+		t.Errorf("logged in as %q without a username", msg.auth)
+	}
+	if msg.from != "noreply@example.com" {
+		t.Errorf("envelope from %q, want only the address of SMTP_FROM", msg.from)
+	}
+	if len(msg.to) != 1 || msg.to[0] != "alice@example.com" {
+		t.Errorf("envelope to %v", msg.to)
+	}
+
+	parsed, err := mail.ReadMessage(strings.NewReader(string(msg.data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if from := parsed.Header.Get("From"); from != "CopyPaste <noreply@example.com>" {
+		t.Errorf("From %q", from)
+	}
+	subject, err := new(mime.WordDecoder).DecodeHeader(parsed.Header.Get("Subject"))
+	if err != nil || subject != "Réinitialiser le mot de passe" {
+		t.Errorf("Subject %q: %v", subject, err)
+	}
+	if _, err := parsed.Header.Date(); err != nil {
+		t.Errorf("Date: %v", err)
+	}
+	body, _ := io.ReadAll(parsed.Body)
+	if string(body) != "first line\r\nsecond line\r\n" {
+		t.Errorf("body %q, want CRLF line endings", body)
+	}
+}
+
+func TestSmtpMailerHeaderInjection(t *testing.T) {
+	addr, received := fakeSmtp(t)
+	m := newSmtpMailer(addr, "noreply@example.com\r\nBcc: eve@example.com", "", "")
+	if err := m.send("alice@example.com\r\nBcc: eve@example.com", "Subject\r\nBcc: eve@example.com", "body"); err != nil {
+		t.Fatal(err)
+	}
+
+	msg := receiveMail(t, received)
+	parsed, err := mail.ReadMessage(strings.NewReader(string(msg.data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bcc := parsed.Header.Get("Bcc"); bcc != "" {
+		t.Errorf("a Bcc header was added: %q", bcc)
+	}
+	for _, to := range msg.to {
+		if to == "eve@example.com" {
+			t.Error("eve@example.com is a recipient")
+		}
+	}
+}
+
+func TestSmtpMailerAuth(t *testing.T) {
+	addr, received := fakeSmtp(t)
+	m := newSmtpMailer(addr, "noreply@example.com", "mailer", "secret")
+	if err := m.send("alice@example.com", "Subject", "body"); err != nil {
+		t.Fatal(err)
+	}
+	if msg := receiveMail(t, received); msg.auth != "\x00mailer\x00secret" {
+		t.Errorf("AUTH PLAIN %q", msg.auth)
+	}
+}
+
+var resetLinkRe = regexp.MustCompile(`https?://\S+/reset/(\S+)`)
+
+func TestPasswordResetByEmail(t *testing.T) {
+	root, err := filepath.Abs("..")
+	if err != nil {
+		t.Fatal(err)
+	}
+	email := "alice@example.com"
+	db := newFakeDb(user{Username: "alice", Id: uuid.New(), Email: &email}, user{Username: "bob", Id: uuid.New()})
+	useSessions(t, db)
+	chdir(t, root) // The pages are rendered from ./html
+
+	// A device of alice is logged in, the reset ends its session
+	sessions.Lock()
+	sessions.put("device", session{id: uuid.New(), user: db.users["alice"], done: make(chan struct{})})
+	sessions.Unlock()
+
+	addr, received := fakeSmtp(t)
+	env := &Env{
+		dataManager:  db,
+		mailer:       newSmtpMailer(addr, "CopyPaste <noreply@example.com>", "", ""),
+		resetURL:     "https://copypaste.example.com/reset",
+		linkLimiter:  newMemoryLimiter(100, 100),
+		resetLimiter: newMemoryLimiter(1.0/60, 3),
+	}
+
+	// Users without an address and unknown users get no mail
+	env.sendResetLink("bob", "https://copypaste.example.com/reset")
+	env.sendResetLink("carol", "https://copypaste.example.com/reset")
+	select {
+	case msg := <-received:
+		t.Fatalf("a mail was sent to %v", msg.to)
+	default:
+	}
+
+	// The request is sent with the host of an attacker, the link must stay on PUBLIC_URL
+	form := url.Values{"username": {"alice"}}
+	r := httptest.NewRequest("POST", "https://evil.example/forgot", strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	rec := httptest.NewRecorder()
+	env.requestReset(HTMLWriter{Writer: rec, Status: http.StatusOK}, r)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status %d", rec.Code)
+	}
+
+	msg := receiveMail(t, received)
+	if len(msg.to) != 1 || msg.to[0] != email {
+		t.Fatalf("sent to %v, want %s", msg.to, email)
+	}
+	match := resetLinkRe.FindStringSubmatch(string(msg.data))
+	if match == nil {
+		t.Fatalf("no reset link in %q", msg.data)
+	}
+	if !strings.HasPrefix(match[0], "https://copypaste.example.com/reset/") {
+		t.Errorf("the link %q is not on the instance", match[0])
+	}
+	token := match[1]
+
+	reset := func(password string, confirm string) *httptest.ResponseRecorder {
+		form := url.Values{"password": {password}, "confirm": {confirm}}
+		r := httptest.NewRequest("POST", "/reset/"+token, strings.NewReader(form.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		r.SetPathValue("token", token)
+		rec := httptest.NewRecorder()
+		env.postReset(HTMLWriter{Writer: rec, Status: http.StatusOK}, r)
+		return rec
+	}
+
+	if reset("new password", "other password"); db.users["alice"].Password != "" {
+		t.Fatal("the password changed without a matching confirmation")
+	}
+	if rec := reset("new password", "new password"); rec.Code != http.StatusOK {
+		t.Fatalf("status %d", rec.Code)
+	}
+	if ok, err := hashCompare("new password", db.users["alice"].Password); !ok {
+		t.Errorf("the password of alice is not the new one: %v", err)
+	}
+	if len(db.loggedOut) != 1 || db.loggedOut[0] != "alice" {
+		t.Errorf("sessions deleted for %v, want alice", db.loggedOut)
+	}
+	if _, ok := sessions.m["device"]; ok {
+		t.Error("the cached session of alice survived the reset")
+	}
+
+	if rec := reset("another password", "another password"); rec.Code != http.StatusNotFound {
+		t.Errorf("the link was used twice: status %d", rec.Code)
+	}
+}
+
+func TestPasswordResetLimit(t *testing.T) {
+	root, err := filepath.Abs("..")
+	if err != nil {
+		t.Fatal(err)
+	}
+	email := "alice@example.com"
+	db := newFakeDb(user{Username: "alice", Id: uuid.New(), Email: &email})
+	chdir(t, root)
+
+	addr, received := fakeSmtp(t)
+	env := &Env{
+		dataManager:  db,
+		mailer:       newSmtpMailer(addr, "noreply@example.com", "", ""),
+		resetURL:     "https://copypaste.example.com/reset",
+		linkLimiter:  newMemoryLimiter(100, 100),
+		resetLimiter: newMemoryLimiter(1.0/3600, 2),
+	}
+	for range 4 {
+		r := httptest.NewRequest("POST", "/forgot", strings.NewReader("username=alice"))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		env.requestReset(HTMLWriter{Writer: httptest.NewRecorder(), Status: http.StatusOK}, r)
+	}
+
+	receiveMail(t, received)
+	receiveMail(t, received)
+	select {
+	case <-received:
+		t.Error("more reset mails than the limit were sent")
+	case <-time.After(200 * time.Millisecond):
+	}
+}
@@ -3,10 +3,14 @@ package main
 import (
 	"context"
 	_ "embed"
+	"errors"
+	"flag"
 	"fmt"
 	"log"
 	"net/http"
+	"net/url"
 	"os"
+	"time"
 
 	"github.com/jackc/pgx/v5/pgxpool"
 )
@@ -19,6 +23,32 @@ type Env struct {
 	dataManager dbData
 	clipBroker  EventBroker
 	fileBroker  EventBroker
+	spaceBroker EventBroker
+	scanner     fileScanner // nil when uploads are not scanned
+	scans       *scanQueue
+	scanMaxSize int64 // the largest upload the scanner accepts, in bytes, 0 without a scanner
+	linkLimiter rateLimiter
+
+	guestUploadMax int64 // the largest body of a guest upload, in bytes
+
+	fetchLimiter  rateLimiter // lookups of fetch codes per client
+	fetchFailures budget      // failed lookups of fetch codes on the whole instance
+
+	// Login and sign-up attempts per client, failed logins per client and per account and client
+	loginLimiter       rateLimiter
+	loginClientLockout lockout
+	loginUserLockout   lockout
+	// The failures of an account from all the clients, against guesses spread over many addresses
+	loginAccountLockout lockout
+
+	mailer       mailer      // nil when reset links can't be sent by email
+	resetURL     string      // the page of the links sent by email, under PUBLIC_URL
+	resetLimiter rateLimiter // reset emails per user
+
+	oidc  *oidcProvider // nil when single sign-on is not configured
+	proxy *proxyAuth    // nil when the users are not authenticated by a reverse proxy
+
+	registration string // who can sign up: registrationOpen, registrationInvite or registrationClosed
 }
 
 func NewEnv() (*Env, error) {
@@ -43,8 +73,132 @@ func NewEnv() (*Env, error) {
 	clipbrk.Init()
 	filebrk := NewEventBroker()
 	filebrk.Init()
+	spacebrk := NewEventBroker()
+	spacebrk.Init()
+
+	var scanner fileScanner
+	var scanMaxMB uint64
+	if addr := os.Getenv("CLAMD_ADDR"); addr != "" {
+		scanner = newClamdScanner(addr)
+		// clamd refuses the streams longer than its StreamMaxLength, 100 MB by default
+		if scanMaxMB, err = envUint("CLAMD_MAX_MB", 32, 100); err != nil {
+			return nil, err
+		} else if scanMaxMB == 0 {
+			return nil, errors.New("CLAMD_MAX_MB must be at least 1")
+		}
+	}
+
+	if trustedProxies, err = newTrustedProxies(); err != nil {
+		return nil, err
+	}
+	if hashPolicy, err = newHashPolicy(); err != nil {
+		return nil, err
+	}
+	if downloadKey, err = newDownloadKey(); err != nil {
+		return nil, err
+	}
+	registration, err := newRegistrationMode()
+	if err != nil {
+		return nil, err
+	}
+	provider, err := newOidcProvider(registration)
+	if err != nil {
+		return nil, err
+	}
+	proxy, err := newProxyAuth(registration)
+	if err != nil {
+		return nil, err
+	}
+	guestMB, err := envUint("GUEST_UPLOAD_MAX_MB", 32, 1024)
+	if err != nil {
+		return nil, err
+	} else if guestMB == 0 {
+		return nil, errors.New("GUEST_UPLOAD_MAX_MB must be at least 1")
+	}
+
+	var mail mailer
+	var resetURL string
+	if addr := os.Getenv("SMTP_ADDR"); addr != "" {
+		// Anybody can set the Host of a request, the links sent by email only come from PUBLIC_URL
+		base, err := url.Parse(os.Getenv("PUBLIC_URL"))
+		if err != nil || base.Scheme == "" || base.Host == "" {
+			return nil, errors.New("SMTP_ADDR needs PUBLIC_URL, the links of the reset emails are built from it")
+		}
+		mail = newSmtpMailer(addr, os.Getenv("SMTP_FROM"), os.Getenv("SMTP_USER"), os.Getenv("SMTP_PASSWORD"))
+		resetURL = base.JoinPath("/reset").String()
+	}
+
+	return &Env{
+		db:          pool,
+		dataManager: defaultDbData{},
+		clipBroker:  clipbrk,
+		fileBroker:  filebrk,
+		spaceBroker: spacebrk,
+		scanner:     scanner,
+		scans:       newScanQueue(),
+		scanMaxSize: int64(scanMaxMB) << 20,
+		linkLimiter: newMemoryLimiter(0.5, 10),
+
+		guestUploadMax: int64(guestMB) << 20,
+
+		fetchLimiter:  newMemoryLimiter(1.0/60, 5),
+		fetchFailures: newMemoryLimiter(0.5, 300),
+
+		// Clients can fail more often than accounts, many users can share an address
+		loginLimiter:        newMemoryLimiter(1.0/6, 10),
+		loginClientLockout:  newMemoryLockout(20, 30*time.Second, 15*time.Minute),
+		loginUserLockout:    newMemoryLockout(5, 30*time.Second, 15*time.Minute),
+		loginAccountLockout: newMemoryLockout(50, time.Minute, time.Hour),
+
+		mailer:       mail,
+		resetURL:     resetURL,
+		resetLimiter: newMemoryLimiter(1.0/600, 3),
+
+		oidc:  provider,
+		proxy: proxy,
+
+		registration: registration,
+	}, nil
+}
+
+// runCommand executes the subcommand in args, it returns false if args don't contain one
+func runCommand(env *Env, args []string) (bool, int) {
+	if len(args) == 0 {
+		return false, 0
+	}
+
+	switch args[0] {
+	case "fsck":
+		fs := flag.NewFlagSet("fsck", flag.ExitOnError)
+		repair := fs.Bool("repair", false, "fix the problems that are found")
+		fs.Parse(args[1:])
+
+		report, err := env.fsck(*repair)
+		if err != nil {
+			log.Printf("err: %v\n", err)
+			return true, 2
+		}
+		report.write(os.Stdout)
+		if report.problems() > 0 && !report.Repaired {
+			return true, 1
+		}
+		return true, 0
+	case "reset-password":
+		fs := flag.NewFlagSet("reset-password", flag.ExitOnError)
+		expir := fs.Duration("expires", 24*time.Hour, "how long the link can be used")
+		fs.Parse(args[1:])
+
+		return true, env.resetCommand(fs.Args(), *expir)
+	case "admin":
+		fs := flag.NewFlagSet("admin", flag.ExitOnError)
+		revoke := fs.Bool("revoke", false, "make the user a normal user again")
+		fs.Parse(args[1:])
 
-	return &Env{pool, defaultDbData{}, clipbrk, filebrk}, nil
+		return true, env.adminCommand(fs.Args(), *revoke)
+	default:
+		fmt.Fprintf(os.Stderr, "unknown command %q\nusage: %s [fsck [--repair] | reset-password [--expires 24h] <username> | admin [--revoke] <username>]\n", args[0], os.Args[0])
+		return true, 2
+	}
 }
 
 func main() {
@@ -56,29 +210,134 @@ func main() {
 	}
 	defer env.db.Close()
 
+	if ok, code := runCommand(env, os.Args[1:]); ok {
+		env.db.Close()
+		os.Exit(code)
+	}
+
+	sessions = newSessionMap(env.db, env.dataManager)
+	sessions.proxy = env.proxy
+	env.bootstrapAdmins()
+	env.secretsCleanRoutine()
+	env.fetchCodesCleanRoutine()
+	if env.scanner != nil {
+		if err := env.startScanner(); err != nil {
+			log.Printf("err: %v\n", err)
+			return
+		}
+	}
+
 	http.HandleFunc("/{$}", handlerWrapper(env.mainPage))
 	http.HandleFunc("/logout", handlerWrapper(logout))
 
 	http.HandleFunc("GET /login", handlerWrapper(getLogin))
-	http.HandleFunc("GET /register", handlerWrapper(getRegister))
+	http.HandleFunc("GET /register", handlerWrapper(env.getRegister))
+	http.HandleFunc("GET /login/sso", publicWrapper(env.ssoButton))
+	http.HandleFunc("GET /login/oidc", publicWrapper(env.startOidc))
+	http.HandleFunc("GET /login/oidc/callback", publicWrapper(env.oidcCallback))
 	http.HandleFunc("GET /clipboard", handlerWrapper(env.getClips))
 	http.HandleFunc("GET /clipboard/new", handlerWrapper(env.newClip))
+	http.HandleFunc("GET /clipboard/{clipId}/qr", handlerWrapper(env.clipQR))
+	http.HandleFunc("GET /clipboard/{clipId}/text", handlerWrapper(env.clipText))
 	http.HandleFunc("GET /file", handlerWrapper(env.getFiles))
 	http.HandleFunc("GET /file/download/{fileId}", handlerWrapper(env.sendFile))
-	http.HandleFunc("GET /user", handlerWrapper(getUser))
+	http.HandleFunc("GET /file/versions/{fileId}", handlerWrapper(env.getVersions))
+	http.HandleFunc("GET /file/qr/{fileId}", handlerWrapper(env.fileQR))
+	http.HandleFunc("GET /share", handlerWrapper(env.getShares))
+	http.HandleFunc("GET /share/new", handlerWrapper(env.newShare))
+	http.HandleFunc("GET /share/{linkId}/accesses", handlerWrapper(env.getShareAccesses))
+	http.HandleFunc("GET /share/{linkId}/qr", handlerWrapper(env.shareQR))
+	http.HandleFunc("GET /upload/new", handlerWrapper(env.newUpload))
+	http.HandleFunc("GET /upload/{linkId}/qr", handlerWrapper(env.uploadQR))
+	http.HandleFunc("GET /grant", handlerWrapper(env.getGrants))
+	http.HandleFunc("GET /secret", handlerWrapper(env.getSecrets))
+	http.HandleFunc("GET /secret/new", handlerWrapper(env.newSecret))
+	http.HandleFunc("GET /space", handlerWrapper(env.getSpaces))
+	http.HandleFunc("GET /space/{spaceId}", handlerWrapper(env.getSpace))
+	http.HandleFunc("GET /space/{spaceId}/file/{fileId}", handlerWrapper(env.sendSpaceFile))
+	http.HandleFunc("GET /user", handlerWrapper(env.getUser))
+	http.HandleFunc("GET /user/totp/qr", handlerWrapper(env.totpQR))
+	http.HandleFunc("GET /admin", handlerWrapper(requireAdmin(env.getAdmin)))
+	http.HandleFunc("GET /admin/user/{userId}", handlerWrapper(requireAdmin(env.getAdminUser)))
+	http.HandleFunc("GET /dl/{token}", publicWrapper(downloadFromOrigin))
+	http.HandleFunc("GET /s/{token}", publicWrapper(env.viewShare))
+	http.HandleFunc("GET /u/{token}", publicWrapper(env.viewUpload))
+	http.HandleFunc("GET /once/{token}", publicWrapper(env.viewSecret))
+	http.HandleFunc("GET /c/{code}", publicWrapper(env.viewFetch))
+	http.HandleFunc("GET /reset", publicWrapper(env.viewForgot))
+	http.HandleFunc("GET /reset/{token}", publicWrapper(env.viewReset))
 
 	http.HandleFunc("POST /login", handlerWrapper(env.postLogin))
+	http.HandleFunc("POST /login/totp", publicWrapper(env.postLoginCode))
+	http.HandleFunc("POST /login/passkey", publicWrapper(env.beginPasskeyLogin))
+	http.HandleFunc("POST /login/passkey/{challengeId}", publicWrapper(env.finishPasskeyLogin))
 	http.HandleFunc("POST /register", handlerWrapper(env.postRegister))
 	http.HandleFunc("POST /clipboard/new", handlerWrapper(env.postClip))
 	http.HandleFunc("POST /file/new", handlerWrapper(env.postFile))
+	http.HandleFunc("POST /clipboard/{clipId}/edit", handlerWrapper(env.editClip))
+	http.HandleFunc("POST /file/{fileId}/upload", handlerWrapper(env.uploadVersion))
+	http.HandleFunc("POST /file/{fileId}/move", handlerWrapper(env.moveFile))
+	http.HandleFunc("POST /file/versions/{fileId}/{versionId}/restore", handlerWrapper(env.restoreVersion))
+	http.HandleFunc("POST /folder/new", handlerWrapper(env.postFolder))
+	http.HandleFunc("POST /folder/{folderId}/rename", handlerWrapper(env.renameFolder))
+	http.HandleFunc("POST /folder/{folderId}/move", handlerWrapper(env.moveFolder))
+	http.HandleFunc("POST /share/new", handlerWrapper(env.postShare))
+	http.HandleFunc("POST /s/{token}", publicWrapper(env.openShare))
+	http.HandleFunc("POST /upload/new", handlerWrapper(env.postUpload))
+	http.HandleFunc("POST /u/{token}", publicWrapper(env.guestUpload))
+	http.HandleFunc("POST /grant/new", handlerWrapper(env.postGrant))
+	http.HandleFunc("POST /space/new", handlerWrapper(env.postSpace))
+	http.HandleFunc("POST /space/{spaceId}/clip", handlerWrapper(env.postSpaceClip))
+	http.HandleFunc("POST /space/{spaceId}/file", handlerWrapper(env.postSpaceFile))
+	http.HandleFunc("POST /space/{spaceId}/member", handlerWrapper(env.postSpaceMember))
+	http.HandleFunc("POST /secret/new", handlerWrapper(env.postSecret))
+	http.HandleFunc("POST /once/{token}", publicWrapper(env.revealSecret))
+	http.HandleFunc("POST /clipboard/{clipId}/fetch", handlerWrapper(env.postFetchCode))
+	http.HandleFunc("POST /c/{code}", publicWrapper(env.fetch))
+	http.HandleFunc("POST /user/totp", handlerWrapper(env.enrollTotp))
+	http.HandleFunc("POST /user/totp/confirm", handlerWrapper(env.confirmTotp))
+	http.HandleFunc("POST /user/totp/recovery", handlerWrapper(env.renewRecoveryCodes))
+	http.HandleFunc("POST /user/passkey/new", handlerWrapper(env.beginPasskey))
+	http.HandleFunc("POST /user/passkey/{challengeId}", handlerWrapper(env.finishPasskey))
+	http.HandleFunc("POST /user/token", handlerWrapper(env.postApiToken))
+	http.HandleFunc("POST /user/invite", handlerWrapper(env.postInvite))
+	http.HandleFunc("POST /user/password", handlerWrapper(env.changePassword))
+	http.HandleFunc("POST /user/email", handlerWrapper(env.postEmail))
+	http.HandleFunc("POST /admin/user/{userId}/role", handlerWrapper(requireAdmin(env.postUserRole)))
+	http.HandleFunc("POST /admin/user/{userId}/disable", handlerWrapper(requireAdmin(env.disableUser)))
+	http.HandleFunc("POST /admin/user/{userId}/enable", handlerWrapper(requireAdmin(env.enableUser)))
+	http.HandleFunc("POST /reset", publicWrapper(env.requestReset))
+	http.HandleFunc("POST /reset/{token}", publicWrapper(env.postReset))
 
 	http.HandleFunc("DELETE /clipboard", handlerWrapper(env.deleteClip))
 	http.HandleFunc("DELETE /clipboard/all", handlerWrapper(env.deleteAllClips))
 	http.HandleFunc("DELETE /file", handlerWrapper(env.deleteFile))
+	http.HandleFunc("DELETE /folder/{folderId}", handlerWrapper(env.deleteFolder))
+	http.HandleFunc("DELETE /share/{linkId}", handlerWrapper(env.revokeShare))
+	http.HandleFunc("DELETE /upload/{linkId}", handlerWrapper(env.revokeUpload))
+	http.HandleFunc("DELETE /grant/{grantId}", handlerWrapper(env.deleteGrant))
+	http.HandleFunc("DELETE /secret/{secretId}", handlerWrapper(env.deleteSecret))
+	http.HandleFunc("DELETE /clipboard/{clipId}/fetch", handlerWrapper(env.deleteFetchCode))
+	http.HandleFunc("DELETE /space/{spaceId}", handlerWrapper(env.deleteSpace))
+	http.HandleFunc("DELETE /space/{spaceId}/clip/{clipId}", handlerWrapper(env.deleteSpaceClip))
+	http.HandleFunc("DELETE /space/{spaceId}/file/{fileId}", handlerWrapper(env.deleteSpaceFile))
+	http.HandleFunc("DELETE /space/{spaceId}/member/{username}", handlerWrapper(env.deleteSpaceMember))
 	http.HandleFunc("DELETE /user/{id}", handlerWrapper(env.deleteUser))
+	http.HandleFunc("DELETE /user/session", handlerWrapper(env.logoutOthers))
+	http.HandleFunc("DELETE /user/session/{sessionId}", handlerWrapper(env.logoutDevice))
+	http.HandleFunc("DELETE /user/totp", handlerWrapper(env.disableTotp))
+	http.HandleFunc("DELETE /user/passkey/{passkeyId}", handlerWrapper(env.deletePasskey))
+	http.HandleFunc("DELETE /user/token/{tokenId}", handlerWrapper(env.deleteApiToken))
+	http.HandleFunc("DELETE /user/invite/{inviteId}", handlerWrapper(env.deleteInvite))
+	http.HandleFunc("DELETE /admin/user/{userId}", handlerWrapper(requireAdmin(env.adminDeleteUser)))
+	http.HandleFunc("DELETE /admin/user/{userId}/session", handlerWrapper(requireAdmin(env.logoutUser)))
+
+	http.HandleFunc("GET /operator/fsck", operatorWrapper(env.operatorFsck))
+	http.HandleFunc("POST /operator/fsck", operatorWrapper(env.operatorFsck))
 
 	http.HandleFunc("/clipboard/update", handlerWrapper(env.clipUpdate))
 	http.HandleFunc("/file/update", handlerWrapper(env.fileUpdate))
+	http.HandleFunc("/space/{spaceId}/update", handlerWrapper(env.spaceUpdate))
 
 	static := http.FileServer(http.Dir("./static"))
 	http.Handle("/", static)
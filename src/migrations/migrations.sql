@@ -25,3 +25,310 @@ CREATE TABLE IF NOT EXISTS files (
     ON DELETE CASCADE
     ON UPDATE CASCADE
 );
+
+CREATE TABLE IF NOT EXISTS folders (
+  id       UUID PRIMARY KEY,
+  name     TEXT NOT NULL,
+  parent   UUID,
+  username VARCHAR(25) NOT NULL,
+
+  CONSTRAINT fk_users
+    FOREIGN KEY (username) REFERENCES users(username)
+    ON DELETE CASCADE
+    ON UPDATE CASCADE,
+  CONSTRAINT fk_parent
+    FOREIGN KEY (parent) REFERENCES folders(id)
+    ON DELETE CASCADE,
+  CONSTRAINT unique_folder_name
+    UNIQUE NULLS NOT DISTINCT (username, parent, name)
+);
+
+ALTER TABLE files ADD COLUMN IF NOT EXISTS folder UUID
+  REFERENCES folders(id) ON DELETE CASCADE;
+
+-- File names are unique per folder of a user, see files_personal_name_idx below
+ALTER TABLE files DROP CONSTRAINT IF EXISTS files_filename_key;
+
+CREATE TABLE IF NOT EXISTS file_versions (
+  id         UUID PRIMARY KEY,
+  file_id    UUID NOT NULL,
+  version    INTEGER NOT NULL,
+  size       BIGINT NOT NULL DEFAULT 0,
+  created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+
+  CONSTRAINT fk_files
+    FOREIGN KEY (file_id) REFERENCES files(id)
+    ON DELETE CASCADE,
+  CONSTRAINT unique_file_version
+    UNIQUE (file_id, version)
+);
+
+-- Files uploaded before versioning keep their blob, named after the file id, as version 1
+INSERT INTO file_versions (id, file_id, version)
+  SELECT id, id, 1 FROM files
+  WHERE NOT EXISTS (SELECT 1 FROM file_versions v WHERE v.file_id = files.id);
+
+ALTER TABLE file_versions ADD COLUMN IF NOT EXISTS checksum TEXT;
+
+-- scan_status is one of 'pending', 'clean', 'infected', 'error' or 'corrupt'
+ALTER TABLE file_versions ADD COLUMN IF NOT EXISTS scan_status TEXT NOT NULL DEFAULT 'clean';
+ALTER TABLE file_versions ADD COLUMN IF NOT EXISTS scan_reason TEXT;
+-- The failed scans of a pending version, it's marked 'error' after a few
+ALTER TABLE file_versions ADD COLUMN IF NOT EXISTS scan_attempts INTEGER NOT NULL DEFAULT 0;
+
+CREATE TABLE IF NOT EXISTS share_links (
+  id         UUID PRIMARY KEY,
+  token      TEXT UNIQUE NOT NULL,
+  username   VARCHAR(25) NOT NULL,
+  clip_id    UUID REFERENCES clipboard(id) ON DELETE CASCADE,
+  file_id    UUID REFERENCES files(id) ON DELETE CASCADE,
+  password   TEXT,
+  expires_at TIMESTAMPTZ,
+  max_uses   INTEGER,
+  uses       INTEGER NOT NULL DEFAULT 0,
+  created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+  revoked_at TIMESTAMPTZ,
+
+  CONSTRAINT fk_users
+    FOREIGN KEY (username) REFERENCES users(username)
+    ON DELETE CASCADE
+    ON UPDATE CASCADE,
+  CONSTRAINT one_item
+    CHECK ((clip_id IS NULL) <> (file_id IS NULL))
+);
+
+-- outcome is one of 'view', 'open', 'wrong-password' or 'unavailable'
+CREATE TABLE IF NOT EXISTS share_accesses (
+  id          UUID PRIMARY KEY,
+  link_id     UUID NOT NULL REFERENCES share_links(id) ON DELETE CASCADE,
+  accessed_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+  ip          TEXT NOT NULL,
+  user_agent  TEXT NOT NULL,
+  outcome     TEXT NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS secrets (
+  id          UUID PRIMARY KEY,
+  token_hash  TEXT UNIQUE NOT NULL,
+  username    VARCHAR(25) NOT NULL,
+  label       TEXT NOT NULL DEFAULT '',
+  secret_text TEXT NOT NULL,
+  created_at  TIMESTAMPTZ NOT NULL DEFAULT now(),
+  expires_at  TIMESTAMPTZ NOT NULL,
+
+  CONSTRAINT fk_users
+    FOREIGN KEY (username) REFERENCES users(username)
+    ON DELETE CASCADE
+    ON UPDATE CASCADE
+);
+
+CREATE TABLE IF NOT EXISTS grants (
+  id         UUID PRIMARY KEY,
+  owner      VARCHAR(25) NOT NULL REFERENCES users(username) ON DELETE CASCADE ON UPDATE CASCADE,
+  grantee    VARCHAR(25) NOT NULL REFERENCES users(username) ON DELETE CASCADE ON UPDATE CASCADE,
+  clip_id    UUID REFERENCES clipboard(id) ON DELETE CASCADE,
+  file_id    UUID REFERENCES files(id) ON DELETE CASCADE,
+  can_write  BOOLEAN NOT NULL DEFAULT false,
+  created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+
+  CONSTRAINT one_item
+    CHECK ((clip_id IS NULL) <> (file_id IS NULL))
+);
+CREATE UNIQUE INDEX IF NOT EXISTS grants_item_idx
+  ON grants (grantee, clip_id, file_id) NULLS NOT DISTINCT;
+
+CREATE TABLE IF NOT EXISTS spaces (
+  id         UUID PRIMARY KEY,
+  name       TEXT NOT NULL,
+  created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+-- role is one of 'owner', 'editor' or 'viewer'
+CREATE TABLE IF NOT EXISTS space_members (
+  space_id UUID NOT NULL REFERENCES spaces(id) ON DELETE CASCADE,
+  username VARCHAR(25) NOT NULL REFERENCES users(username) ON DELETE CASCADE ON UPDATE CASCADE,
+  role     TEXT NOT NULL,
+
+  PRIMARY KEY (space_id, username),
+  CONSTRAINT valid_role
+    CHECK (role IN ('owner', 'editor', 'viewer'))
+);
+CREATE INDEX IF NOT EXISTS space_members_user_idx ON space_members (username);
+-- The oldest member becomes the owner when the last one deletes their account
+ALTER TABLE space_members ADD COLUMN IF NOT EXISTS joined_at TIMESTAMPTZ NOT NULL DEFAULT now();
+
+-- Clips and files of a space keep the user who created them in username
+ALTER TABLE clipboard ADD COLUMN IF NOT EXISTS space_id UUID
+  REFERENCES spaces(id) ON DELETE CASCADE;
+ALTER TABLE files ADD COLUMN IF NOT EXISTS space_id UUID
+  REFERENCES spaces(id) ON DELETE CASCADE;
+
+-- Personal files are unique inside the folders of their user, files of a space inside the space.
+-- files_user_name_idx was the index of personal files before spaces, it can't hold the files of spaces
+DROP INDEX IF EXISTS files_user_name_idx;
+CREATE UNIQUE INDEX IF NOT EXISTS files_personal_name_idx
+  ON files (username, folder, filename) NULLS NOT DISTINCT WHERE space_id IS NULL;
+CREATE UNIQUE INDEX IF NOT EXISTS files_space_name_idx
+  ON files (space_id, filename) WHERE space_id IS NOT NULL;
+
+-- A clip can have one fetch code at a time, it is deleted when the clip is fetched
+CREATE TABLE IF NOT EXISTS fetch_codes (
+  code       TEXT PRIMARY KEY,
+  clip_id    UUID UNIQUE NOT NULL REFERENCES clipboard(id) ON DELETE CASCADE,
+  username   VARCHAR(25) NOT NULL REFERENCES users(username) ON DELETE CASCADE ON UPDATE CASCADE,
+  created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+  expires_at TIMESTAMPTZ NOT NULL
+);
+
+-- Upload links let people without an account add files to the folder of a user.
+-- max_size is the size limit of every file, in bytes
+CREATE TABLE IF NOT EXISTS upload_links (
+  id         UUID PRIMARY KEY,
+  token      TEXT UNIQUE NOT NULL,
+  username   VARCHAR(25) NOT NULL REFERENCES users(username) ON DELETE CASCADE ON UPDATE CASCADE,
+  label      TEXT NOT NULL DEFAULT '',
+  folder     UUID REFERENCES folders(id) ON DELETE SET NULL,
+  password   TEXT,
+  expires_at TIMESTAMPTZ,
+  max_files  INTEGER,
+  max_size   BIGINT,
+  uploads    INTEGER NOT NULL DEFAULT 0,
+  created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+  revoked_at TIMESTAMPTZ
+);
+
+-- The upload link a version comes from, NULL for the uploads of users
+ALTER TABLE file_versions ADD COLUMN IF NOT EXISTS upload_link_id UUID
+  REFERENCES upload_links(id) ON DELETE SET NULL;
+
+-- Logins, the cookie is only stored as its sha256 hash
+CREATE TABLE IF NOT EXISTS sessions (
+  id           UUID PRIMARY KEY,
+  token_hash   TEXT UNIQUE NOT NULL,
+  username     VARCHAR(25) NOT NULL REFERENCES users(username) ON DELETE CASCADE ON UPDATE CASCADE,
+  created_at   TIMESTAMPTZ NOT NULL DEFAULT now(),
+  last_seen_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+  expires_at   TIMESTAMPTZ NOT NULL,
+  user_agent   TEXT NOT NULL DEFAULT '',
+  ip           TEXT NOT NULL DEFAULT ''
+);
+CREATE INDEX IF NOT EXISTS sessions_user_idx ON sessions (username);
+
+-- TOTP second factor. secret is encrypted with SECRET_KEY, confirmed_at is NULL until the user
+-- has entered a first code. last_step is the last time step used, codes can't be replayed
+CREATE TABLE IF NOT EXISTS totp (
+  username     VARCHAR(25) PRIMARY KEY REFERENCES users(username) ON DELETE CASCADE ON UPDATE CASCADE,
+  secret       TEXT NOT NULL,
+  confirmed_at TIMESTAMPTZ,
+  last_step    BIGINT NOT NULL DEFAULT 0,
+  created_at   TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+CREATE TABLE IF NOT EXISTS recovery_codes (
+  id        UUID PRIMARY KEY,
+  username  VARCHAR(25) NOT NULL REFERENCES users(username) ON DELETE CASCADE ON UPDATE CASCADE,
+  code_hash TEXT NOT NULL,
+  used_at   TIMESTAMPTZ,
+
+  UNIQUE (username, code_hash)
+);
+
+-- A login that checked the password and waits for the second factor
+CREATE TABLE IF NOT EXISTS login_challenges (
+  token_hash TEXT PRIMARY KEY,
+  username   VARCHAR(25) NOT NULL REFERENCES users(username) ON DELETE CASCADE ON UPDATE CASCADE,
+  remember   BOOLEAN NOT NULL DEFAULT false,
+  attempts   INTEGER NOT NULL DEFAULT 0,
+  expires_at TIMESTAMPTZ NOT NULL
+);
+
+-- WebAuthn credentials. credential holds the public key and the sign counter as JSON
+CREATE TABLE IF NOT EXISTS passkeys (
+  id           BYTEA PRIMARY KEY,
+  username     VARCHAR(25) NOT NULL REFERENCES users(username) ON DELETE CASCADE ON UPDATE CASCADE,
+  name         TEXT NOT NULL,
+  credential   JSONB NOT NULL,
+  created_at   TIMESTAMPTZ NOT NULL DEFAULT now(),
+  last_used_at TIMESTAMPTZ
+);
+CREATE INDEX IF NOT EXISTS passkeys_user_idx ON passkeys (username);
+
+-- A WebAuthn ceremony in progress. Registrations belong to the session that started them,
+-- logins have no session
+CREATE TABLE IF NOT EXISTS passkey_challenges (
+  id         UUID PRIMARY KEY,
+  session_id UUID REFERENCES sessions(id) ON DELETE CASCADE,
+  data       JSONB NOT NULL,
+  expires_at TIMESTAMPTZ NOT NULL
+);
+
+-- Personal bearer tokens for scripts, only the sha256 hash of the token is stored
+CREATE TABLE IF NOT EXISTS api_tokens (
+  id           UUID PRIMARY KEY,
+  token_hash   TEXT UNIQUE NOT NULL,
+  username     VARCHAR(25) NOT NULL REFERENCES users(username) ON DELETE CASCADE ON UPDATE CASCADE,
+  name         TEXT NOT NULL,
+  scopes       TEXT[] NOT NULL,
+  created_at   TIMESTAMPTZ NOT NULL DEFAULT now(),
+  expires_at   TIMESTAMPTZ,
+  last_used_at TIMESTAMPTZ
+);
+CREATE INDEX IF NOT EXISTS api_tokens_user_idx ON api_tokens (username);
+
+-- Where self-service password reset links are sent, optional
+ALTER TABLE users ADD COLUMN IF NOT EXISTS email TEXT;
+
+-- Single-use password reset links, from the reset-password command or sent by email
+CREATE TABLE IF NOT EXISTS password_resets (
+  token_hash TEXT PRIMARY KEY,
+  username   VARCHAR(25) NOT NULL REFERENCES users(username) ON DELETE CASCADE ON UPDATE CASCADE,
+  created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+  expires_at TIMESTAMPTZ NOT NULL
+);
+
+-- An OIDC login waiting for the callback of the identity provider
+CREATE TABLE IF NOT EXISTS oidc_logins (
+  state_hash TEXT PRIMARY KEY,
+  verifier   TEXT NOT NULL,
+  nonce      TEXT NOT NULL,
+  remember   BOOLEAN NOT NULL DEFAULT false,
+  expires_at TIMESTAMPTZ NOT NULL
+);
+
+-- The account of the identity provider behind a user, by the issuer and the subject of its ID tokens
+CREATE TABLE IF NOT EXISTS oidc_identities (
+  issuer     TEXT NOT NULL,
+  subject    TEXT NOT NULL,
+  username   VARCHAR(25) NOT NULL REFERENCES users(username) ON DELETE CASCADE ON UPDATE CASCADE,
+  created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+
+  PRIMARY KEY (issuer, subject)
+);
+
+-- role is 'user' or 'admin'. Disabled users can't log in, their data is kept
+ALTER TABLE users ADD COLUMN IF NOT EXISTS role TEXT NOT NULL DEFAULT 'user';
+ALTER TABLE users ADD COLUMN IF NOT EXISTS disabled BOOLEAN NOT NULL DEFAULT false;
+ALTER TABLE users ADD COLUMN IF NOT EXISTS last_login_at TIMESTAMPTZ;
+ALTER TABLE users DROP CONSTRAINT IF EXISTS valid_user_role;
+ALTER TABLE users ADD CONSTRAINT valid_user_role CHECK (role IN ('user', 'admin'));
+
+-- Single-use codes that let people sign up when REGISTRATION_MODE is invite
+CREATE TABLE IF NOT EXISTS invites (
+  id         UUID PRIMARY KEY,
+  code_hash  TEXT NOT NULL UNIQUE,
+  created_by VARCHAR(25) NOT NULL REFERENCES users(username) ON DELETE CASCADE ON UPDATE CASCADE,
+  created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+  expires_at TIMESTAMPTZ NOT NULL,
+  used_by    VARCHAR(25) REFERENCES users(username) ON DELETE SET NULL ON UPDATE CASCADE,
+  used_at    TIMESTAMPTZ
+);
+CREATE INDEX IF NOT EXISTS invites_created_by_idx ON invites (created_by);
+
+-- Clips and files of a space stay in the space when the user who created them is deleted,
+-- username is set to NULL for them. Personal ones are still deleted with their user
+ALTER TABLE clipboard ALTER COLUMN username DROP NOT NULL;
+ALTER TABLE files ALTER COLUMN username DROP NOT NULL;
+ALTER TABLE clipboard DROP CONSTRAINT IF EXISTS personal_owner;
+ALTER TABLE clipboard ADD CONSTRAINT personal_owner CHECK (space_id IS NOT NULL OR username IS NOT NULL);
+ALTER TABLE files DROP CONSTRAINT IF EXISTS personal_owner;
+ALTER TABLE files ADD CONSTRAINT personal_owner CHECK (space_id IS NOT NULL OR username IS NOT NULL);
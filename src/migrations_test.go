@@ -0,0 +1,83 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// testPool connects to the database in TEST_DATABASE_URL, in a schema of its own that is dropped
+// after the test. Tests that need PostgreSQL are skipped when the variable is not set
+func testPool(t *testing.T) *pgxpool.Pool {
+	t.Helper()
+	url := os.Getenv("TEST_DATABASE_URL")
+	if url == "" {
+		t.Skip("TEST_DATABASE_URL is not set")
+	}
+	ctx := context.Background()
+	schema := fmt.Sprintf("test_%d", time.Now().UnixNano())
+
+	admin, err := pgxpool.New(ctx, url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(admin.Close)
+	if _, err := admin.Exec(ctx, "CREATE SCHEMA "+schema); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { admin.Exec(ctx, "DROP SCHEMA "+schema+" CASCADE") })
+
+	cfg, err := pgxpool.ParseConfig(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.ConnConfig.RuntimeParams["search_path"] = schema
+	pool, err := pgxpool.NewWithConfig(ctx, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(pool.Close)
+	return pool
+}
+
+// The migrations run at every start, they must succeed again on the data they allow
+func TestMigrationsRerun(t *testing.T) {
+	pool := testPool(t)
+	ctx := context.Background()
+	if _, err := pool.Exec(ctx, mig); err != nil {
+		t.Fatalf("first run: %v", err)
+	}
+
+	alice := uuid.New()
+	spaces := []uuid.UUID{uuid.New(), uuid.New()}
+	exec := func(query string, args ...any) {
+		t.Helper()
+		if _, err := pool.Exec(ctx, query, args...); err != nil {
+			t.Fatalf("%s: %v", query, err)
+		}
+	}
+	exec("INSERT INTO users (id, username, password) VALUES ($1, 'alice', '')", alice)
+	exec("INSERT INTO files (id, filename, username) VALUES ($1, 'notes.txt', 'alice')", uuid.New())
+	for _, s := range spaces {
+		exec("INSERT INTO spaces (id, name) VALUES ($1, 'space')", s)
+		// The same name in the root of alice and in two spaces, created by alice
+		exec("INSERT INTO files (id, filename, username, space_id) VALUES ($1, 'notes.txt', 'alice', $2)", uuid.New(), s)
+		// Files of a deleted user
+		exec("INSERT INTO files (id, filename, username, space_id) VALUES ($1, 'old.txt', NULL, $2)", uuid.New(), s)
+	}
+
+	if _, err := pool.Exec(ctx, mig); err != nil {
+		t.Fatalf("second run: %v", err)
+	}
+	if _, err := pool.Exec(ctx, "INSERT INTO files (id, filename, username) VALUES ($1, 'notes.txt', 'alice')", uuid.New()); err == nil {
+		t.Error("two personal files with the same name in the same folder")
+	}
+	if _, err := pool.Exec(ctx, "INSERT INTO files (id, filename, username, space_id) VALUES ($1, 'notes.txt', NULL, $2)", uuid.New(), spaces[0]); err == nil {
+		t.Error("two files with the same name in a space")
+	}
+}
@@ -0,0 +1,337 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/coreos/go-oidc/v3/oidc"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"golang.org/x/oauth2"
+)
+
+const (
+	oidcStateCookie = "OIDC-State"
+	oidcLoginExpir  = 10 * time.Minute
+	oidcTimeout     = 10 * time.Second
+)
+
+var ErrOidcGroup = errors.New("the user is not in an allowed group")
+
+// oidcProvider is the identity provider configured with the OIDC_ variables.
+// Its discovery document is fetched on the first login, so the instance starts even if the provider is down
+type oidcProvider struct {
+	issuer        string
+	clientID      string
+	clientSecret  string // empty for public clients, PKCE protects the code
+	redirectURL   string // empty to use PUBLIC_URL or the host of the request
+	scopes        []string
+	usernameClaim string
+	groupsClaim   string
+	allowedGroups []string // empty lets every user of the provider in
+	autoCreate    bool     // users without an account get one on the first login
+
+	client *http.Client
+	sync.Mutex
+	provider *oidc.Provider
+}
+
+// newOidcProvider reads the configuration, it returns nil if single sign-on is not configured
+func newOidcProvider(registration string) (*oidcProvider, error) {
+	issuer := os.Getenv("OIDC_ISSUER")
+	if issuer == "" {
+		return nil, nil
+	}
+	create, err := autoCreate("OIDC_AUTO_CREATE", registration)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &oidcProvider{
+		issuer:        issuer,
+		clientID:      os.Getenv("OIDC_CLIENT_ID"),
+		clientSecret:  os.Getenv("OIDC_CLIENT_SECRET"),
+		redirectURL:   os.Getenv("OIDC_REDIRECT_URL"),
+		scopes:        []string{oidc.ScopeOpenID, "profile", "email"},
+		usernameClaim: "preferred_username",
+		groupsClaim:   "groups",
+		autoCreate:    create,
+		client:        &http.Client{Timeout: oidcTimeout},
+	}
+	if v := os.Getenv("OIDC_SCOPES"); v != "" {
+		p.scopes = append([]string{oidc.ScopeOpenID}, strings.Fields(v)...)
+	}
+	if v := os.Getenv("OIDC_USERNAME_CLAIM"); v != "" {
+		p.usernameClaim = v
+	}
+	if v := os.Getenv("OIDC_GROUPS_CLAIM"); v != "" {
+		p.groupsClaim = v
+	}
+	for _, g := range strings.Split(os.Getenv("OIDC_ALLOWED_GROUPS"), ",") {
+		if g = strings.TrimSpace(g); g != "" {
+			p.allowedGroups = append(p.allowedGroups, g)
+		}
+	}
+	return p, nil
+}
+
+func (p *oidcProvider) context() context.Context {
+	return oidc.ClientContext(context.Background(), p.client)
+}
+
+// config discovers the provider and returns the OAuth2 configuration for the request
+func (p *oidcProvider) config(r *http.Request) (*oidc.Provider, oauth2.Config, error) {
+	p.Lock()
+	defer p.Unlock()
+	if p.provider == nil {
+		provider, err := oidc.NewProvider(p.context(), p.issuer)
+		if err != nil {
+			return nil, oauth2.Config{}, err
+		}
+		p.provider = provider
+	}
+
+	redirect := p.redirectURL
+	if redirect == "" {
+		redirect = publicURL(r, "/login/oidc/callback")
+	}
+	return p.provider, oauth2.Config{
+		ClientID:     p.clientID,
+		ClientSecret: p.clientSecret,
+		Endpoint:     p.provider.Endpoint(),
+		RedirectURL:  redirect,
+		Scopes:       p.scopes,
+	}, nil
+}
+
+// identity checks the groups in claims and returns the username mapped from them
+func (p *oidcProvider) identity(claims map[string]any) (string, error) {
+	if len(p.allowedGroups) > 0 {
+		var groups []string
+		switch v := claims[p.groupsClaim].(type) {
+		case string:
+			groups = []string{v}
+		case []any:
+			for _, g := range v {
+				if s, ok := g.(string); ok {
+					groups = append(groups, s)
+				}
+			}
+		}
+		if !slices.ContainsFunc(groups, func(g string) bool { return slices.Contains(p.allowedGroups, g) }) {
+			return "", ErrOidcGroup
+		}
+	}
+
+	username, _ := claims[p.usernameClaim].(string)
+	username = strings.TrimSpace(username)
+	if username == "" || utf8.RuneCountInString(username) > 25 {
+		return "", fmt.Errorf("the claim %q is not a valid username: %q", p.usernameClaim, username)
+	}
+	return username, nil
+}
+
+// PUBLIC //
+
+// ssoButton is loaded by the login page, it's empty when single sign-on is not configured
+func (env *Env) ssoButton(w HTMLWriter, r *http.Request) {
+	if env.oidc == nil {
+		return
+	}
+	w.HTMX = true
+	sendTemplate(w, nil, "sso", "./html/sso.html")
+}
+
+// startOidc sends the browser to the identity provider
+func (env *Env) startOidc(w HTMLWriter, r *http.Request) {
+	if env.oidc == nil {
+		w.Status = http.StatusNotFound
+		w.WriteHeader()
+		return
+	}
+	if !env.allowPublic(w, r) {
+		return
+	}
+
+	_, cfg, err := env.oidc.config(r)
+	if err != nil {
+		log.Printf("err: %v\n", err)
+		w.Status = http.StatusBadGateway
+		w.WriteHeader()
+		sendOidcError(w, "The identity provider can't be reached, try again later")
+		return
+	}
+
+	state, err := newLinkToken()
+	var nonce string
+	if err == nil {
+		nonce, err = newLinkToken()
+	}
+	login := oidcLogin{
+		Verifier:  oauth2.GenerateVerifier(),
+		Nonce:     nonce,
+		Remember:  r.URL.Query().Get("remember") == "on",
+		ExpiresAt: time.Now().Add(oidcLoginExpir),
+	}
+	login.StateHash = hashToken(state)
+	if err == nil {
+		err = env.dataManager.insertOidcLogin(env.db, login)
+	}
+	if err != nil {
+		log.Printf("err: %v\n", err)
+		w.Status = http.StatusInternalServerError
+		w.WriteHeader()
+		return
+	}
+
+	// The cookie binds the callback to this browser, so nobody can log someone else into their account
+	http.SetCookie(w.Writer, &http.Cookie{
+		Name:     oidcStateCookie,
+		Value:    state,
+		Path:     "/login/oidc",
+		MaxAge:   int(oidcLoginExpir.Seconds()),
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteLaxMode, // The callback is a navigation from the provider
+	})
+	authURL := cfg.AuthCodeURL(state, oidc.Nonce(nonce), oauth2.S256ChallengeOption(login.Verifier))
+	w.Status = http.StatusSeeOther
+	http.Redirect(w.Writer, r, authURL, w.Status)
+}
+
+// oidcCallback verifies the ID token of the provider and logs in its user, creating it on the first login
+func (env *Env) oidcCallback(w HTMLWriter, r *http.Request) {
+	if env.oidc == nil {
+		w.Status = http.StatusNotFound
+		w.WriteHeader()
+		return
+	}
+	if !env.allowPublic(w, r) {
+		return
+	}
+	query := r.URL.Query()
+	http.SetCookie(w.Writer, &http.Cookie{Name: oidcStateCookie, Path: "/login/oidc", MaxAge: -1})
+
+	if e := query.Get("error"); e != "" {
+		log.Printf("err: identity provider: %s %s\n", e, query.Get("error_description"))
+		sendOidcError(w, "The identity provider refused the login")
+		return
+	}
+	state := query.Get("state")
+	cookie, err := r.Cookie(oidcStateCookie)
+	if err != nil || state == "" || subtle.ConstantTimeCompare([]byte(cookie.Value), []byte(state)) != 1 {
+		w.Status = http.StatusBadRequest
+		w.WriteHeader()
+		sendOidcError(w, "The login has expired or it was started in another browser, please try again")
+		return
+	}
+	login, err := env.dataManager.takeOidcLogin(env.db, hashToken(state))
+	if err != nil {
+		if !errors.Is(err, pgx.ErrNoRows) {
+			log.Printf("err: %v\n", err)
+		}
+		w.Status = http.StatusBadRequest
+		w.WriteHeader()
+		sendOidcError(w, "The login has expired, please try again")
+		return
+	}
+
+	u, err := env.oidcUser(r, query.Get("code"), login)
+	if err != nil {
+		log.Printf("err: %v\n", err)
+		w.Status = http.StatusForbidden
+		msg := "The login could not be verified"
+		var pgErr *pgconn.PgError
+		switch {
+		case errors.Is(err, ErrOidcGroup):
+			msg = "Your account is not allowed to use this instance"
+		case errors.Is(err, ErrRegistrationClosed):
+			msg = "There is no account for you on this instance, ask the administrator"
+		case errors.Is(err, ErrUsername):
+			msg = "Your username can't be used on this instance, ask the administrator"
+		case errors.As(err, &pgErr) && pgErr.Code == "23505":
+			w.Status = http.StatusConflict
+			msg = "A local user with your username already exists, ask the administrator"
+		}
+		w.WriteHeader()
+		sendOidcError(w, msg)
+		return
+	}
+
+	remember := ""
+	if login.Remember {
+		remember = "on"
+	}
+	cookieSession, err := env.startSession(r, u, remember)
+	if err != nil {
+		log.Printf("err: %v\n", err)
+		w.Status = http.StatusInternalServerError
+		w.WriteHeader()
+		sendOidcError(w, "The login could not be completed")
+		return
+	}
+	http.SetCookie(w.Writer, cookieSession)
+	w.Status = http.StatusSeeOther
+	http.Redirect(w.Writer, r, "/", w.Status)
+}
+
+// oidcUser redeems the code and returns the user of the ID token
+func (env *Env) oidcUser(r *http.Request, code string, login oidcLogin) (user, error) {
+	provider, cfg, err := env.oidc.config(r)
+	if err != nil {
+		return user{}, err
+	}
+	ctx := env.oidc.context()
+
+	tok, err := cfg.Exchange(ctx, code, oauth2.VerifierOption(login.Verifier))
+	if err != nil {
+		return user{}, err
+	}
+	raw, ok := tok.Extra("id_token").(string)
+	if !ok {
+		return user{}, errors.New("the token response has no id_token")
+	}
+	idToken, err := provider.Verifier(&oidc.Config{ClientID: env.oidc.clientID}).Verify(ctx, raw)
+	if err != nil {
+		return user{}, err
+	}
+	if subtle.ConstantTimeCompare([]byte(idToken.Nonce), []byte(login.Nonce)) != 1 {
+		return user{}, errors.New("the nonce of the ID token does not match")
+	}
+
+	var claims map[string]any
+	if err := idToken.Claims(&claims); err != nil {
+		return user{}, err
+	}
+	username, err := env.oidc.identity(claims)
+	if err != nil {
+		return user{}, err
+	}
+
+	u, err := env.dataManager.oidcUser(env.db, idToken.Issuer, idToken.Subject)
+	if errors.Is(err, pgx.ErrNoRows) {
+		if !env.oidc.autoCreate {
+			return user{}, fmt.Errorf("%s of %s: %w", idToken.Subject, idToken.Issuer, ErrRegistrationClosed)
+		}
+		if err := checkUsername(username); err != nil {
+			return user{}, fmt.Errorf("the claim %q can't be a new username: %w", env.oidc.usernameClaim, err)
+		}
+		u, err = env.dataManager.provisionOidcUser(env.db, username, idToken.Issuer, idToken.Subject)
+	}
+	return u, err
+}
+
+func sendOidcError(w HTMLWriter, msg string) {
+	w.HTMX = true // Login does not need index template even if the request is not from HTMX
+	sendTemplate(w, msg, "login_base", "./html/login_base.html", "./html/login.html")
+}
@@ -0,0 +1,358 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/json"
+	"maps"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-jose/go-jose/v4"
+	"github.com/google/uuid"
+)
+
+const (
+	oidcClientID     = "copypaste"
+	oidcClientSecret = "client-secret"
+)
+
+// mockIdp is an OpenID provider with discovery, keys and a token endpoint that checks PKCE.
+// The authorization endpoint is played by authorize, without a browser
+type mockIdp struct {
+	*httptest.Server
+	key     *rsa.PrivateKey // publishes its public key
+	signKey *rsa.PrivateKey // signs the ID tokens, key unless a test forges them
+
+	sync.Mutex
+	codes map[string]idpGrant
+}
+
+// idpGrant is an authorization code waiting to be redeemed
+type idpGrant struct {
+	challenge string
+	redirect  string
+	claims    map[string]any
+}
+
+func newMockIdp(t *testing.T) *mockIdp {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	idp := &mockIdp{key: key, signKey: key, codes: map[string]idpGrant{}}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]any{
+			"issuer":                                idp.URL,
+			"authorization_endpoint":                idp.URL + "/authorize",
+			"token_endpoint":                        idp.URL + "/token",
+			"jwks_uri":                              idp.URL + "/jwks",
+			"id_token_signing_alg_values_supported": []string{"RS256"},
+		})
+	})
+	mux.HandleFunc("GET /jwks", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(jose.JSONWebKeySet{Keys: []jose.JSONWebKey{
+			{Key: &idp.key.PublicKey, KeyID: "test", Algorithm: "RS256", Use: "sig"},
+		}})
+	})
+	mux.HandleFunc("POST /token", idp.token)
+	idp.Server = httptest.NewServer(mux)
+	t.Cleanup(idp.Close)
+	return idp
+}
+
+// authorize logs in at the provider through the URL of startOidc and returns the code and state of the callback.
+// The nonce of the request is added to claims unless they set it
+func (idp *mockIdp) authorize(t *testing.T, authURL string, claims map[string]any) (string, string) {
+	t.Helper()
+	u, err := url.Parse(authURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	q := u.Query()
+	if u.Path != "/authorize" || q.Get("client_id") != oidcClientID || q.Get("response_type") != "code" {
+		t.Fatalf("authorization request %s", authURL)
+	}
+	if q.Get("code_challenge_method") != "S256" || q.Get("code_challenge") == "" {
+		t.Fatalf("authorization request without PKCE: %s", authURL)
+	}
+
+	now := time.Now()
+	all := map[string]any{
+		"iss":   idp.URL,
+		"aud":   oidcClientID,
+		"sub":   "subject-1",
+		"nonce": q.Get("nonce"),
+		"iat":   now.Unix(),
+		"exp":   now.Add(time.Hour).Unix(),
+	}
+	maps.Copy(all, claims)
+
+	code := uuid.NewString()
+	idp.Lock()
+	idp.codes[code] = idpGrant{challenge: q.Get("code_challenge"), redirect: q.Get("redirect_uri"), claims: all}
+	idp.Unlock()
+	return code, q.Get("state")
+}
+
+func (idp *mockIdp) token(w http.ResponseWriter, r *http.Request) {
+	r.ParseForm()
+	id, secret, ok := r.BasicAuth()
+	if !ok {
+		id, secret = r.PostForm.Get("client_id"), r.PostForm.Get("client_secret")
+	}
+
+	idp.Lock()
+	grant, found := idp.codes[r.PostForm.Get("code")]
+	delete(idp.codes, r.PostForm.Get("code"))
+	idp.Unlock()
+
+	sum := sha256.Sum256([]byte(r.PostForm.Get("code_verifier")))
+	if id != oidcClientID || secret != oidcClientSecret || !found ||
+		r.PostForm.Get("grant_type") != "authorization_code" ||
+		r.PostForm.Get("redirect_uri") != grant.redirect || b64.EncodeToString(sum[:]) != grant.challenge {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(`{"error":"invalid_grant"}`))
+		return
+	}
+
+	opts := (&jose.SignerOptions{}).WithType("JWT").WithHeader("kid", "test")
+	signer, err := jose.NewSigner(jose.SigningKey{Algorithm: jose.RS256, Key: idp.signKey}, opts)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	payload, _ := json.Marshal(grant.claims)
+	jws, err := signer.Sign(payload)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	idToken, _ := jws.CompactSerialize()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{
+		"access_token": "access token",
+		"token_type":   "Bearer",
+		"expires_in":   3600,
+		"id_token":     idToken,
+	})
+}
+
+// newOidcEnv configures single sign-on with idp, the OIDC_ variables are set by the caller
+func newOidcEnv(t *testing.T, idp *mockIdp, registration string) (*Env, *fakeDb) {
+	t.Helper()
+	root, err := filepath.Abs("..")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("OIDC_ISSUER", idp.URL)
+	t.Setenv("OIDC_CLIENT_ID", oidcClientID)
+	t.Setenv("OIDC_CLIENT_SECRET", oidcClientSecret)
+	provider, err := newOidcProvider(registration)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	db := newFakeDb()
+	useSessions(t, db)
+	// The error pages are rendered from ./html
+	if err := os.Symlink(filepath.Join(root, "html"), "html"); err != nil {
+		t.Fatal(err)
+	}
+	return &Env{dataManager: db, oidc: provider, linkLimiter: newMemoryLimiter(100, 100)}, db
+}
+
+// oidcStart begins a login and returns the URL of the provider and the state cookie
+func oidcStart(t *testing.T, env *Env) (string, *http.Cookie) {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	env.startOidc(HTMLWriter{Writer: rec, Status: http.StatusOK}, httptest.NewRequest("GET", "https://copypaste.example.com/login/oidc", nil))
+	if rec.Code != http.StatusSeeOther {
+		t.Fatalf("start: status %d", rec.Code)
+	}
+	for _, c := range rec.Result().Cookies() {
+		if c.Name == oidcStateCookie {
+			return rec.Header().Get("Location"), c
+		}
+	}
+	t.Fatal("start: no state cookie")
+	return "", nil
+}
+
+func finishOidc(env *Env, code string, state string, cookie *http.Cookie) *httptest.ResponseRecorder {
+	q := url.Values{"code": {code}, "state": {state}}
+	r := httptest.NewRequest("GET", "https://copypaste.example.com/login/oidc/callback?"+q.Encode(), nil)
+	if cookie != nil {
+		r.AddCookie(cookie)
+	}
+	rec := httptest.NewRecorder()
+	env.oidcCallback(HTMLWriter{Writer: rec, Status: http.StatusOK}, r)
+	return rec
+}
+
+// oidcLoginAs runs a whole login where the provider vouches for claims
+func oidcLoginAs(t *testing.T, env *Env, idp *mockIdp, claims map[string]any) int {
+	t.Helper()
+	authURL, cookie := oidcStart(t, env)
+	code, state := idp.authorize(t, authURL, claims)
+	return finishOidc(env, code, state, cookie).Code
+}
+
+func TestOidcLogin(t *testing.T) {
+	idp := newMockIdp(t)
+	env, db := newOidcEnv(t, idp, registrationOpen)
+
+	if status := oidcLoginAs(t, env, idp, map[string]any{"preferred_username": "alice"}); status != http.StatusSeeOther {
+		t.Fatalf("first login: status %d", status)
+	}
+	alice, ok := db.users["alice"]
+	if !ok || db.identities[idp.URL+" subject-1"] != "alice" {
+		t.Fatalf("alice was not provisioned: %v", db.identities)
+	}
+	if _, err := os.Stat(filepath.Join("filedir", alice.Id.String())); err != nil {
+		t.Errorf("no file directory: %v", err)
+	}
+
+	// The identity stays linked to alice even if the provider renames the user
+	if status := oidcLoginAs(t, env, idp, map[string]any{"preferred_username": "alice2"}); status != http.StatusSeeOther {
+		t.Fatalf("second login: status %d", status)
+	}
+	if len(db.users) != 1 || len(db.sessions) != 2 || db.sessions[1].Username != "alice" {
+		t.Errorf("users %v, sessions %+v", db.users, db.sessions)
+	}
+}
+
+func TestOidcLoginRefused(t *testing.T) {
+	tests := []struct {
+		name         string
+		registration string
+		groups       string // OIDC_ALLOWED_GROUPS
+		claims       map[string]any
+		status       int
+	}{
+		{"registration closed", registrationClosed, "", map[string]any{"preferred_username": "alice"}, http.StatusForbidden},
+		{"invalid username", registrationOpen, "", map[string]any{"preferred_username": "alice/../bob"}, http.StatusForbidden},
+		{"no username", registrationOpen, "", map[string]any{}, http.StatusForbidden},
+		{"local user", registrationOpen, "", map[string]any{"preferred_username": "bob"}, http.StatusConflict},
+		{"other nonce", registrationOpen, "", map[string]any{"preferred_username": "alice", "nonce": "other"}, http.StatusForbidden},
+		{"other audience", registrationOpen, "", map[string]any{"preferred_username": "alice", "aud": "other"}, http.StatusForbidden},
+		{"other issuer", registrationOpen, "", map[string]any{"preferred_username": "alice", "iss": "https://idp.example.com"}, http.StatusForbidden},
+		{"expired", registrationOpen, "", map[string]any{"preferred_username": "alice", "exp": time.Now().Add(-time.Hour).Unix()}, http.StatusForbidden},
+		{"not in group", registrationOpen, "admins, staff", map[string]any{"preferred_username": "alice", "groups": []string{"users"}}, http.StatusForbidden},
+		{"no groups", registrationOpen, "admins", map[string]any{"preferred_username": "alice"}, http.StatusForbidden},
+		{"in group", registrationOpen, "admins, staff", map[string]any{"preferred_username": "alice", "groups": []string{"users", "staff"}}, http.StatusSeeOther},
+		{"single group", registrationOpen, "admins", map[string]any{"preferred_username": "alice", "groups": "admins"}, http.StatusSeeOther},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			idp := newMockIdp(t)
+			t.Setenv("OIDC_ALLOWED_GROUPS", tt.groups)
+			env, db := newOidcEnv(t, idp, tt.registration)
+			db.users["bob"] = user{Username: "bob", Id: uuid.New()}
+
+			if status := oidcLoginAs(t, env, idp, tt.claims); status != tt.status {
+				t.Fatalf("status %d, want %d", status, tt.status)
+			}
+			if created := len(db.users) > 1; created != (tt.status == http.StatusSeeOther) {
+				t.Errorf("users %v", db.users)
+			}
+		})
+	}
+}
+
+// OIDC_AUTO_CREATE overrides the registration mode
+func TestOidcAutoCreate(t *testing.T) {
+	tests := []struct {
+		value        string
+		registration string
+		status       int
+	}{
+		{"", registrationInvite, http.StatusForbidden},
+		{"true", registrationClosed, http.StatusSeeOther},
+		{"false", registrationOpen, http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		t.Run(tt.value+" "+tt.registration, func(t *testing.T) {
+			idp := newMockIdp(t)
+			t.Setenv("OIDC_AUTO_CREATE", tt.value)
+			env, _ := newOidcEnv(t, idp, tt.registration)
+			if status := oidcLoginAs(t, env, idp, map[string]any{"preferred_username": "alice"}); status != tt.status {
+				t.Errorf("status %d, want %d", status, tt.status)
+			}
+		})
+	}
+
+	t.Setenv("OIDC_ISSUER", "https://idp.example.com")
+	t.Setenv("OIDC_AUTO_CREATE", "sometimes")
+	if _, err := newOidcProvider(registrationOpen); err == nil {
+		t.Error("an invalid OIDC_AUTO_CREATE is accepted")
+	}
+}
+
+func TestOidcForgedToken(t *testing.T) {
+	idp := newMockIdp(t)
+	env, db := newOidcEnv(t, idp, registrationOpen)
+	other, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	idp.signKey = other
+
+	if status := oidcLoginAs(t, env, idp, map[string]any{"preferred_username": "alice"}); status != http.StatusForbidden {
+		t.Errorf("status %d", status)
+	}
+	if len(db.users) != 0 {
+		t.Errorf("users %v", db.users)
+	}
+}
+
+func TestOidcCallbackState(t *testing.T) {
+	idp := newMockIdp(t)
+	env, db := newOidcEnv(t, idp, registrationOpen)
+	claims := map[string]any{"preferred_username": "alice"}
+
+	// The callback must come back to the browser that started the login
+	authURL, _ := oidcStart(t, env)
+	code, state := idp.authorize(t, authURL, claims)
+	if rec := finishOidc(env, code, state, nil); rec.Code != http.StatusBadRequest {
+		t.Errorf("without the cookie: status %d", rec.Code)
+	}
+	_, otherCookie := oidcStart(t, env)
+	if rec := finishOidc(env, code, state, otherCookie); rec.Code != http.StatusBadRequest {
+		t.Errorf("with the cookie of another login: status %d", rec.Code)
+	}
+
+	// A login can be completed only once
+	authURL, cookie := oidcStart(t, env)
+	code, state = idp.authorize(t, authURL, claims)
+	if rec := finishOidc(env, code, state, cookie); rec.Code != http.StatusSeeOther {
+		t.Fatalf("status %d", rec.Code)
+	}
+	code, _ = idp.authorize(t, authURL, claims)
+	if rec := finishOidc(env, code, state, cookie); rec.Code != http.StatusBadRequest {
+		t.Errorf("replayed state: status %d", rec.Code)
+	}
+	if len(db.sessions) != 1 {
+		t.Errorf("%d sessions, want 1", len(db.sessions))
+	}
+
+	// The error of the provider is shown without redeeming anything
+	r := httptest.NewRequest("GET", "https://copypaste.example.com/login/oidc/callback?error=access_denied", nil)
+	rec := httptest.NewRecorder()
+	env.oidcCallback(HTMLWriter{Writer: rec, Status: http.StatusOK}, r)
+	if rec.Code != http.StatusOK || len(db.sessions) != 1 {
+		t.Errorf("refused by the provider: status %d", rec.Code)
+	}
+}
@@ -0,0 +1,290 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/go-webauthn/webauthn/protocol"
+	"github.com/go-webauthn/webauthn/webauthn"
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+)
+
+const (
+	passkeyTimeout = 5 * time.Minute
+	passkeyNameLen = 64
+)
+
+// passkeyUser adapts a user and its passkeys to the interface of the WebAuthn library.
+// The user handle stored by authenticators is the id of the user, not the username
+type passkeyUser struct {
+	user
+	passkeys []passkey
+}
+
+func (u passkeyUser) WebAuthnID() []byte {
+	return u.Id[:]
+}
+
+func (u passkeyUser) WebAuthnName() string {
+	return u.Username
+}
+
+func (u passkeyUser) WebAuthnDisplayName() string {
+	return u.Username
+}
+
+func (u passkeyUser) WebAuthnIcon() string {
+	return ""
+}
+
+func (u passkeyUser) WebAuthnCredentials() []webauthn.Credential {
+	creds := make([]webauthn.Credential, len(u.passkeys))
+	for i, p := range u.passkeys {
+		creds[i] = p.Credential
+	}
+	return creds
+}
+
+// EncodedId is the id of the passkey as it appears in URLs
+func (p passkey) EncodedId() string {
+	return base64.RawURLEncoding.EncodeToString(p.Id)
+}
+
+// webAuthn configures the relying party for the origin the instance is reachable at
+func webAuthn(r *http.Request) (*webauthn.WebAuthn, error) {
+	u, err := url.Parse(publicURL(r, "/"))
+	if err != nil {
+		return nil, err
+	}
+	timeout := webauthn.TimeoutConfig{Enforce: true, Timeout: passkeyTimeout, TimeoutUVD: passkeyTimeout}
+	return webauthn.New(&webauthn.Config{
+		RPID:          u.Hostname(),
+		RPDisplayName: "CopyPaste",
+		RPOrigins:     []string{u.Scheme + "://" + u.Host},
+		Timeouts:      webauthn.TimeoutsConfig{Login: timeout, Registration: timeout},
+	})
+}
+
+func (env *Env) passkeyUser(u user) (passkeyUser, error) {
+	passkeys, err := env.dataManager.userPasskeys(env.db, u.Username)
+	return passkeyUser{u, passkeys}, err
+}
+
+// POST //
+
+// beginPasskey sends the options of navigator.credentials.create to register a new passkey
+func (env *Env) beginPasskey(w HTMLWriter, r *http.Request, s session) {
+	wa, err := webAuthn(r)
+	var pu passkeyUser
+	if err == nil {
+		pu, err = env.passkeyUser(s.user)
+	}
+	if err != nil {
+		log.Printf("err: %v\n", err)
+		w.Status = http.StatusInternalServerError
+		w.WriteHeader()
+		return
+	}
+
+	exclude := make([]protocol.CredentialDescriptor, len(pu.passkeys))
+	for i, p := range pu.passkeys {
+		exclude[i] = p.Credential.Descriptor()
+	}
+	// Discoverable credentials let the user log in without typing the username
+	creation, data, err := wa.BeginRegistration(pu,
+		webauthn.WithExclusions(exclude),
+		webauthn.WithResidentKeyRequirement(protocol.ResidentKeyRequirementRequired),
+	)
+	if err != nil {
+		log.Printf("err: %v\n", err)
+		w.Status = http.StatusInternalServerError
+		w.WriteHeader()
+		return
+	}
+	env.sendPasskeyChallenge(w, &s.id, data, creation)
+}
+
+// finishPasskey verifies the new credential and stores it
+func (env *Env) finishPasskey(w HTMLWriter, r *http.Request, s session) {
+	c, err := env.dataManager.takePasskeyChallenge(env.db, r.PathValue("challengeId"), &s.id)
+	if err != nil {
+		log.Printf("err: %v\n", err)
+		w.Status = folderErrStatus(err)
+		w.WriteHeader()
+		return
+	}
+
+	wa, err := webAuthn(r)
+	var pu passkeyUser
+	if err == nil {
+		pu, err = env.passkeyUser(s.user)
+	}
+	if err != nil {
+		log.Printf("err: %v\n", err)
+		w.Status = http.StatusInternalServerError
+		w.WriteHeader()
+		return
+	}
+
+	cred, err := wa.FinishRegistration(pu, c.Data, r)
+	if err != nil {
+		log.Printf("err: %v\n", err)
+		w.Status = http.StatusBadRequest
+		w.WriteHeader()
+		return
+	}
+
+	name := strings.TrimSpace(r.URL.Query().Get("name"))
+	if name == "" {
+		name = "Passkey"
+	}
+	if len([]rune(name)) > passkeyNameLen {
+		name = string([]rune(name)[:passkeyNameLen])
+	}
+	p := passkey{Id: cred.ID, Username: s.user.Username, Name: name, Credential: *cred}
+	if err := env.dataManager.insertPasskey(env.db, p); err != nil {
+		log.Printf("err: %v\n", err)
+		w.Status = folderErrStatus(err)
+		w.WriteHeader()
+		return
+	}
+	w.Status = http.StatusCreated
+	w.WriteHeader()
+}
+
+// DELETE //
+
+func (env *Env) deletePasskey(w HTMLWriter, r *http.Request, s session) {
+	id, err := base64.RawURLEncoding.DecodeString(r.PathValue("passkeyId"))
+	if err == nil {
+		err = env.dataManager.deletePasskey(env.db, s.user.Username, id)
+	} else {
+		err = pgx.ErrNoRows
+	}
+	if err != nil {
+		log.Printf("err: %v\n", err)
+		w.Status = folderErrStatus(err)
+		w.WriteHeader()
+		return
+	}
+	env.getUser(w, r, s)
+}
+
+// LOGIN //
+
+// beginPasskeyLogin sends the options of navigator.credentials.get.
+// Any passkey can answer, the user is known from the credential
+func (env *Env) beginPasskeyLogin(w HTMLWriter, r *http.Request) {
+	if !env.allowPublic(w, r) {
+		return
+	}
+
+	wa, err := webAuthn(r)
+	if err != nil {
+		log.Printf("err: %v\n", err)
+		w.Status = http.StatusInternalServerError
+		w.WriteHeader()
+		return
+	}
+	// The passkey replaces both the password and the second factor, so the authenticator must verify the user
+	assertion, data, err := wa.BeginDiscoverableLogin(webauthn.WithUserVerification(protocol.VerificationRequired))
+	if err != nil {
+		log.Printf("err: %v\n", err)
+		w.Status = http.StatusInternalServerError
+		w.WriteHeader()
+		return
+	}
+	env.sendPasskeyChallenge(w, nil, data, assertion)
+}
+
+// finishPasskeyLogin verifies the signature of the passkey and starts a session for its owner
+func (env *Env) finishPasskeyLogin(w HTMLWriter, r *http.Request) {
+	c, err := env.dataManager.takePasskeyChallenge(env.db, r.PathValue("challengeId"), nil)
+	if err != nil {
+		if !errors.Is(err, pgx.ErrNoRows) {
+			log.Printf("err: %v\n", err)
+		}
+		w.Status = http.StatusNotFound
+		w.WriteHeader()
+		return
+	}
+	wa, err := webAuthn(r)
+	if err != nil {
+		log.Printf("err: %v\n", err)
+		w.Status = http.StatusInternalServerError
+		w.WriteHeader()
+		return
+	}
+
+	var owner passkeyUser
+	findOwner := func(rawId, userHandle []byte) (webauthn.User, error) {
+		p, err := env.dataManager.passkey(env.db, rawId)
+		if err != nil {
+			return nil, err
+		}
+		u, err := env.dataManager.userExists(env.db, p.Username)
+		if err != nil {
+			return nil, err
+		}
+		owner, err = env.passkeyUser(u)
+		return owner, err
+	}
+	cred, err := wa.FinishDiscoverableLogin(findOwner, c.Data, r)
+	if err == nil && cred.Authenticator.CloneWarning {
+		err = errors.New("the sign counter of the passkey went backwards, it may have been cloned")
+	}
+	if err != nil {
+		log.Printf("err: %v\n", err)
+		w.Status = http.StatusForbidden
+		w.WriteHeader()
+		return
+	}
+
+	if err := env.dataManager.usePasskey(env.db, cred.ID, *cred); err != nil {
+		log.Printf("err: %v\n", err)
+	}
+	remember := ""
+	if r.URL.Query().Get("remember") == "on" {
+		remember = "on"
+	}
+	cookie, err := env.startSession(r, owner.user, remember)
+	if err != nil {
+		log.Printf("err: %v\n", err)
+		w.Status = http.StatusInternalServerError
+		w.WriteHeader()
+		return
+	}
+	http.SetCookie(w.Writer, cookie)
+	w.Status = http.StatusNoContent
+	w.WriteHeader()
+}
+
+// sendPasskeyChallenge stores the state of a ceremony and sends its options to the browser,
+// with the id the answer must be posted to
+func (env *Env) sendPasskeyChallenge(w HTMLWriter, sessionId *uuid.UUID, data *webauthn.SessionData, options any) {
+	c := passkeyChallenge{Id: uuid.New(), SessionId: sessionId, Data: *data, ExpiresAt: data.Expires}
+	if c.ExpiresAt.IsZero() {
+		c.ExpiresAt = time.Now().Add(passkeyTimeout)
+	}
+	if err := env.dataManager.insertPasskeyChallenge(env.db, c); err != nil {
+		log.Printf("err: %v\n", err)
+		w.Status = http.StatusInternalServerError
+		w.WriteHeader()
+		return
+	}
+
+	w.Writer.Header().Set("Content-Type", "application/json")
+	w.Writer.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader()
+	err := json.NewEncoder(w.Writer).Encode(map[string]any{"id": c.Id, "options": options})
+	if err != nil {
+		log.Printf("err: %v\n", err)
+	}
+}
@@ -0,0 +1,354 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/google/uuid"
+)
+
+const passkeyOrigin = "https://copypaste.example.com"
+
+// softAuthenticator is a platform authenticator with one ES256 credential, it answers
+// the options sent by the server like navigator.credentials does
+type softAuthenticator struct {
+	key        *ecdsa.PrivateKey
+	credId     []byte
+	userHandle []byte
+	counter    uint32
+	flags      byte // added to user present in assertions
+	origin     string
+}
+
+func newSoftAuthenticator(t *testing.T) *softAuthenticator {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	credId := make([]byte, 16)
+	rand.Read(credId)
+	return &softAuthenticator{key: key, credId: credId, flags: 0x04, origin: passkeyOrigin}
+}
+
+// A minimal CBOR encoder, enough for attestation objects and COSE keys
+func cborHead(major byte, n int) []byte {
+	switch {
+	case n < 24:
+		return []byte{major<<5 | byte(n)}
+	case n < 256:
+		return []byte{major<<5 | 24, byte(n)}
+	default:
+		return []byte{major<<5 | 25, byte(n >> 8), byte(n)}
+	}
+}
+
+func cborInt(n int) []byte {
+	if n < 0 {
+		return cborHead(1, -1-n)
+	}
+	return cborHead(0, n)
+}
+
+func cborBytes(b []byte) []byte {
+	return append(cborHead(2, len(b)), b...)
+}
+
+func cborText(s string) []byte {
+	return append(cborHead(3, len(s)), s...)
+}
+
+// coseKey is the public key in the COSE format: EC2, ES256, P-256
+func (a *softAuthenticator) coseKey() []byte {
+	x := make([]byte, 32)
+	y := make([]byte, 32)
+	a.key.X.FillBytes(x)
+	a.key.Y.FillBytes(y)
+	key := cborHead(5, 5)
+	key = append(append(key, cborInt(1)...), cborInt(2)...)
+	key = append(append(key, cborInt(3)...), cborInt(-7)...)
+	key = append(append(key, cborInt(-1)...), cborInt(1)...)
+	key = append(append(key, cborInt(-2)...), cborBytes(x)...)
+	key = append(append(key, cborInt(-3)...), cborBytes(y)...)
+	return key
+}
+
+func (a *softAuthenticator) authData(rpId string, flags byte) []byte {
+	rpHash := sha256.Sum256([]byte(rpId))
+	data := append(rpHash[:], flags)
+	return binary.BigEndian.AppendUint32(data, a.counter)
+}
+
+func (a *softAuthenticator) clientData(typ string, challenge string) []byte {
+	b, _ := json.Marshal(map[string]any{"type": typ, "challenge": challenge, "origin": a.origin, "crossOrigin": false})
+	return b
+}
+
+type passkeyOptions struct {
+	Id      string `json:"id"`
+	Options struct {
+		PublicKey struct {
+			Challenge string `json:"challenge"`
+			RpId      string `json:"rpId"`
+			Rp        struct {
+				Id string `json:"id"`
+			} `json:"rp"`
+			User struct {
+				Id string `json:"id"`
+			} `json:"user"`
+			UserVerification string `json:"userVerification"`
+		} `json:"publicKey"`
+	} `json:"options"`
+}
+
+var b64 = base64.RawURLEncoding
+
+// create answers navigator.credentials.create with a "none" attestation
+func (a *softAuthenticator) create(t *testing.T, opts passkeyOptions) []byte {
+	t.Helper()
+	pk := opts.Options.PublicKey
+	handle, err := b64.DecodeString(pk.User.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.userHandle = handle
+
+	const userPresent, userVerified, attested = 0x01, 0x04, 0x40
+	auth := a.authData(pk.Rp.Id, userPresent|userVerified|attested)
+	auth = append(auth, make([]byte, 16)...) // AAGUID
+	auth = binary.BigEndian.AppendUint16(auth, uint16(len(a.credId)))
+	auth = append(append(auth, a.credId...), a.coseKey()...)
+
+	att := cborHead(5, 3)
+	att = append(append(att, cborText("fmt")...), cborText("none")...)
+	att = append(append(att, cborText("attStmt")...), cborHead(5, 0)...)
+	att = append(append(att, cborText("authData")...), cborBytes(auth)...)
+
+	body, _ := json.Marshal(map[string]any{
+		"id":    b64.EncodeToString(a.credId),
+		"rawId": b64.EncodeToString(a.credId),
+		"type":  "public-key",
+		"response": map[string]string{
+			"clientDataJSON":    b64.EncodeToString(a.clientData("webauthn.create", pk.Challenge)),
+			"attestationObject": b64.EncodeToString(att),
+		},
+	})
+	return body
+}
+
+// get answers navigator.credentials.get with a signed assertion
+func (a *softAuthenticator) get(t *testing.T, opts passkeyOptions) []byte {
+	t.Helper()
+	pk := opts.Options.PublicKey
+	a.counter++
+	auth := a.authData(pk.RpId, 0x01|a.flags)
+	client := a.clientData("webauthn.get", pk.Challenge)
+	clientHash := sha256.Sum256(client)
+	digest := sha256.Sum256(append(append([]byte{}, auth...), clientHash[:]...))
+	sig, err := ecdsa.SignASN1(rand.Reader, a.key, digest[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	body, _ := json.Marshal(map[string]any{
+		"id":    b64.EncodeToString(a.credId),
+		"rawId": b64.EncodeToString(a.credId),
+		"type":  "public-key",
+		"response": map[string]string{
+			"clientDataJSON":    b64.EncodeToString(client),
+			"authenticatorData": b64.EncodeToString(auth),
+			"signature":         b64.EncodeToString(sig),
+			"userHandle":        b64.EncodeToString(a.userHandle),
+		},
+	})
+	return body
+}
+
+// useSessions replaces the sessions of the instance for the rest of the test.
+// Sessions need a file directory, so the test runs in an empty one
+func useSessions(t *testing.T, db dbData) {
+	t.Helper()
+	chdir(t, t.TempDir())
+	if err := os.Mkdir("filedir", 0750); err != nil {
+		t.Fatal(err)
+	}
+	old := sessions
+	sessions = &sessionMap{m: map[string]session{}, byUser: map[string]map[string]struct{}{}, dataManager: db}
+	t.Cleanup(func() { sessions = old })
+}
+
+func passkeyRequest(target string, body []byte) *http.Request {
+	r := httptest.NewRequest("POST", passkeyOrigin+target, bytes.NewReader(body))
+	r.Header.Set("Content-Type", "application/json")
+	return r
+}
+
+func readPasskeyOptions(t *testing.T, rec *httptest.ResponseRecorder) passkeyOptions {
+	t.Helper()
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status %d", rec.Code)
+	}
+	var opts passkeyOptions
+	if err := json.NewDecoder(rec.Body).Decode(&opts); err != nil {
+		t.Fatal(err)
+	}
+	return opts
+}
+
+// registerPasskey runs the registration ceremony of a for alice
+func registerPasskey(t *testing.T, env *Env, s session, a *softAuthenticator) {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	env.beginPasskey(HTMLWriter{Writer: rec, Status: http.StatusOK}, passkeyRequest("/user/passkey/new", nil), s)
+	opts := readPasskeyOptions(t, rec)
+	if opts.Options.PublicKey.Rp.Id != "copypaste.example.com" {
+		t.Fatalf("relying party %q", opts.Options.PublicKey.Rp.Id)
+	}
+
+	rec = httptest.NewRecorder()
+	r := passkeyRequest("/user/passkey/"+opts.Id+"?name=Laptop", a.create(t, opts))
+	r.SetPathValue("challengeId", opts.Id)
+	env.finishPasskey(HTMLWriter{Writer: rec, Status: http.StatusOK}, r, s)
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("registration: status %d", rec.Code)
+	}
+}
+
+// loginPasskey runs a login ceremony and returns the status of the answer
+func loginPasskey(t *testing.T, env *Env, a *softAuthenticator) int {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	env.beginPasskeyLogin(HTMLWriter{Writer: rec, Status: http.StatusOK}, passkeyRequest("/login/passkey", nil))
+	opts := readPasskeyOptions(t, rec)
+	if opts.Options.PublicKey.UserVerification != "required" {
+		t.Errorf("user verification is %q", opts.Options.PublicKey.UserVerification)
+	}
+
+	rec = httptest.NewRecorder()
+	r := passkeyRequest("/login/passkey/"+opts.Id, a.get(t, opts))
+	r.SetPathValue("challengeId", opts.Id)
+	env.finishPasskeyLogin(HTMLWriter{Writer: rec, Status: http.StatusOK}, r)
+	return rec.Code
+}
+
+func newPasskeyEnv(t *testing.T) (*Env, *fakeDb, session) {
+	t.Helper()
+	alice := user{Username: "alice", Id: uuid.New()}
+	db := newFakeDb(alice)
+	useSessions(t, db)
+	env := &Env{dataManager: db, linkLimiter: newMemoryLimiter(100, 100)}
+	return env, db, newSession(uuid.New(), alice, http.Cookie{})
+}
+
+func TestPasskeyRegistrationAndLogin(t *testing.T) {
+	env, db, s := newPasskeyEnv(t)
+	a := newSoftAuthenticator(t)
+	registerPasskey(t, env, s, a)
+
+	p, ok := db.passkeys[string(a.credId)]
+	if !ok || p.Username != "alice" || p.Name != "Laptop" {
+		t.Fatalf("stored passkey %+v", p)
+	}
+	if !bytes.Equal(a.userHandle, s.user.Id[:]) {
+		t.Error("the user handle is not the id of the user")
+	}
+
+	if status := loginPasskey(t, env, a); status != http.StatusNoContent {
+		t.Fatalf("login: status %d", status)
+	}
+	if len(db.sessions) != 1 || db.sessions[0].Username != "alice" {
+		t.Errorf("sessions %+v", db.sessions)
+	}
+	if got := db.passkeys[string(a.credId)].Credential.Authenticator.SignCount; got != a.counter {
+		t.Errorf("stored sign count %d, want %d", got, a.counter)
+	}
+	if status := loginPasskey(t, env, a); status != http.StatusNoContent {
+		t.Errorf("second login: status %d", status)
+	}
+}
+
+func TestPasskeyLoginRefused(t *testing.T) {
+	tests := []struct {
+		name   string
+		change func(a *softAuthenticator)
+	}{
+		{"without user verification", func(a *softAuthenticator) { a.flags = 0 }},
+		{"other origin", func(a *softAuthenticator) { a.origin = "https://evil.example.com" }},
+		{"cloned", func(a *softAuthenticator) { a.counter = 0 }},
+		{"other key", func(a *softAuthenticator) {
+			a.key, _ = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		}},
+		{"unknown credential", func(a *softAuthenticator) { a.credId = []byte("unknown") }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			env, db, s := newPasskeyEnv(t)
+			a := newSoftAuthenticator(t)
+			registerPasskey(t, env, s, a)
+			if status := loginPasskey(t, env, a); status != http.StatusNoContent {
+				t.Fatalf("first login: status %d", status)
+			}
+
+			tt.change(a)
+			if status := loginPasskey(t, env, a); status != http.StatusForbidden {
+				t.Errorf("status %d, want %d", status, http.StatusForbidden)
+			}
+			if len(db.sessions) != 1 {
+				t.Errorf("%d sessions were started", len(db.sessions))
+			}
+		})
+	}
+}
+
+func TestPasskeyChallengeReplay(t *testing.T) {
+	env, _, s := newPasskeyEnv(t)
+	a := newSoftAuthenticator(t)
+	registerPasskey(t, env, s, a)
+
+	rec := httptest.NewRecorder()
+	env.beginPasskeyLogin(HTMLWriter{Writer: rec, Status: http.StatusOK}, passkeyRequest("/login/passkey", nil))
+	opts := readPasskeyOptions(t, rec)
+	body := a.get(t, opts)
+
+	for i, want := range []int{http.StatusNoContent, http.StatusNotFound} {
+		rec := httptest.NewRecorder()
+		r := passkeyRequest("/login/passkey/"+opts.Id, body)
+		r.SetPathValue("challengeId", opts.Id)
+		env.finishPasskeyLogin(HTMLWriter{Writer: rec, Status: http.StatusOK}, r)
+		if rec.Code != want {
+			t.Errorf("attempt %d: status %d, want %d", i+1, rec.Code, want)
+		}
+	}
+}
+
+func TestPasskeyRegistrationOtherSession(t *testing.T) {
+	env, db, s := newPasskeyEnv(t)
+	a := newSoftAuthenticator(t)
+
+	rec := httptest.NewRecorder()
+	env.beginPasskey(HTMLWriter{Writer: rec, Status: http.StatusOK}, passkeyRequest("/user/passkey/new", nil), s)
+	opts := readPasskeyOptions(t, rec)
+
+	// The challenge belongs to the session that started the registration
+	other := newSession(uuid.New(), s.user, http.Cookie{})
+	rec = httptest.NewRecorder()
+	r := passkeyRequest("/user/passkey/"+opts.Id, a.create(t, opts))
+	r.SetPathValue("challengeId", opts.Id)
+	env.finishPasskey(HTMLWriter{Writer: rec, Status: http.StatusOK}, r, other)
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("status %d, want %d", rec.Code, http.StatusNotFound)
+	}
+	if len(db.passkeys) != 0 {
+		t.Error("the passkey was stored")
+	}
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+)
+
+var ErrHashFormat = errors.New("the password hash has an unknown format")
+
+// argon2Params is the cost of an argon2id hash
+type argon2Params struct {
+	memory  uint32 // KiB
+	time    uint32
+	threads uint8
+}
+
+// Hashes of the first versions were stored as salt$hash with these parameters
+var legacyParams = argon2Params{memory: 64 * 1024, time: 1, threads: 4}
+
+// hashPolicy is the cost of new hashes, set by NewEnv. Hashes with a lower cost are
+// replaced when their user logs in
+var hashPolicy = argon2Params{memory: 64 * 1024, time: 3, threads: 4}
+
+const (
+	saltLen = 16
+	keyLen  = 32
+)
+
+// newHashPolicy reads ARGON2_MEMORY (in KiB), ARGON2_TIME and ARGON2_THREADS, the unset ones keep the default
+func newHashPolicy() (argon2Params, error) {
+	memory, err := envUint("ARGON2_MEMORY", 32, uint64(hashPolicy.memory))
+	if err != nil {
+		return argon2Params{}, err
+	}
+	time, err := envUint("ARGON2_TIME", 32, uint64(hashPolicy.time))
+	if err != nil {
+		return argon2Params{}, err
+	}
+	threads, err := envUint("ARGON2_THREADS", 8, uint64(hashPolicy.threads))
+	if err != nil {
+		return argon2Params{}, err
+	}
+	p := argon2Params{memory: uint32(memory), time: uint32(time), threads: uint8(threads)}
+
+	// argon2 needs at least 8 KiB for every thread
+	if p.time < 1 || p.threads < 1 || p.memory < 8*uint32(p.threads) {
+		return p, fmt.Errorf("invalid argon2 parameters m=%d,t=%d,p=%d", p.memory, p.time, p.threads)
+	}
+	return p, nil
+}
+
+func envUint(name string, bits int, def uint64) (uint64, error) {
+	v := os.Getenv(name)
+	if v == "" {
+		return def, nil
+	}
+	n, err := strconv.ParseUint(v, 10, bits)
+	if err != nil {
+		return 0, fmt.Errorf("%s: %w", name, err)
+	}
+	return n, nil
+}
+
+// weaker reports whether p costs less than policy
+func (p argon2Params) weaker(policy argon2Params) bool {
+	return p.memory < policy.memory || p.time < policy.time
+}
+
+// hashPassword returns the argon2id hash of password in the PHC string format:
+// $argon2id$v=19$m=65536,t=3,p=4$salt$hash
+func hashPassword(password string) (string, error) {
+	salt := make([]byte, saltLen)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	p := hashPolicy
+	hash := argon2.IDKey([]byte(password), salt, p.time, p.memory, p.threads, keyLen)
+
+	return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s",
+		argon2.Version, p.memory, p.time, p.threads,
+		base64.RawStdEncoding.EncodeToString(salt),
+		base64.RawStdEncoding.EncodeToString(hash),
+	), nil
+}
+
+// parseHash decodes a PHC string or a legacy salt$hash
+func parseHash(encoded string) (argon2Params, []byte, []byte, error) {
+	parts := strings.Split(encoded, "$")
+	var p argon2Params
+	var encSalt, encHash string
+	switch {
+	case len(parts) == 2:
+		p, encSalt, encHash = legacyParams, parts[0], parts[1]
+	case len(parts) == 6 && parts[0] == "" && parts[1] == "argon2id":
+		var version int
+		if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+			return p, nil, nil, ErrHashFormat
+		}
+		if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &p.memory, &p.time, &p.threads); err != nil {
+			return p, nil, nil, ErrHashFormat
+		}
+		if p.time < 1 || p.threads < 1 {
+			return p, nil, nil, ErrHashFormat
+		}
+		encSalt, encHash = parts[4], parts[5]
+	default:
+		return p, nil, nil, ErrHashFormat
+	}
+
+	salt, err := base64.RawStdEncoding.DecodeString(encSalt)
+	if err != nil {
+		return p, nil, nil, err
+	}
+	hash, err := base64.RawStdEncoding.DecodeString(encHash)
+	if err != nil {
+		return p, nil, nil, err
+	}
+	if len(hash) == 0 {
+		return p, nil, nil, ErrHashFormat
+	}
+	return p, salt, hash, nil
+}
+
+// hashCompare reports whether password matches hash, in the PHC or in the legacy format
+func hashCompare(password string, hash string) (bool, error) {
+	p, salt, baseHash, err := parseHash(hash)
+	if err != nil {
+		return false, err
+	}
+	newHash := argon2.IDKey([]byte(password), salt, p.time, p.memory, p.threads, uint32(len(baseHash)))
+
+	if subtle.ConstantTimeCompare(baseHash, newHash) == 1 {
+		return true, nil
+	}
+	return false, nil
+}
+
+// needsRehash reports whether hash is in the legacy format or costs less than the policy
+func needsRehash(hash string) bool {
+	if !strings.HasPrefix(hash, "$") {
+		return true
+	}
+	p, _, _, err := parseHash(hash)
+	return err == nil && p.weaker(hashPolicy)
+}
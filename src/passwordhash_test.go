@@ -0,0 +1,198 @@
+package main
+
+import (
+	"encoding/base64"
+	"errors"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/argon2"
+)
+
+// The argon2id example of the reference implementation
+const referenceHash = "$argon2id$v=19$m=65536,t=2,p=1$c29tZXNhbHQ$CTFhFdXPJO1aFaMaO6Mm5c8y7cJHAph8ArZWb2GRPPc"
+
+// usePolicy hashes the new passwords of the test with p, the tests keep the cost low
+func usePolicy(t *testing.T, p argon2Params) {
+	t.Helper()
+	old := hashPolicy
+	hashPolicy = p
+	t.Cleanup(func() { hashPolicy = old })
+}
+
+// legacyHash returns password hashed like the first versions did
+func legacyHash(password string) string {
+	salt := []byte("0123456789abcdef")
+	p := legacyParams
+	hash := argon2.IDKey([]byte(password), salt, p.time, p.memory, p.threads, keyLen)
+	return base64.RawStdEncoding.EncodeToString(salt) + "$" + base64.RawStdEncoding.EncodeToString(hash)
+}
+
+func TestHashPassword(t *testing.T) {
+	usePolicy(t, argon2Params{memory: 64, time: 1, threads: 1})
+	hash, err := hashPassword("correct horse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !regexp.MustCompile(`^\$argon2id\$v=19\$m=64,t=1,p=1\$[A-Za-z0-9+/]{22}\$[A-Za-z0-9+/]{43}$`).MatchString(hash) {
+		t.Errorf("%q is not a PHC string of the policy", hash)
+	}
+	if ok, err := hashCompare("correct horse", hash); !ok || err != nil {
+		t.Errorf("the password doesn't match its hash: %v", err)
+	}
+	if ok, _ := hashCompare("correct horse ", hash); ok {
+		t.Error("another password matches")
+	}
+	if other, _ := hashPassword("correct horse"); other == hash {
+		t.Error("two hashes of the same password are equal, the salt is not random")
+	}
+}
+
+func TestHashCompare(t *testing.T) {
+	tests := []struct {
+		name     string
+		password string
+		hash     string
+		ok       bool
+	}{
+		{"reference", "password", referenceHash, true},
+		{"reference, wrong password", "Password", referenceHash, false},
+		{"legacy", "password", legacyHash("password"), true},
+		{"legacy, wrong password", "passwort", legacyHash("password"), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ok, err := hashCompare(tt.password, tt.hash)
+			if err != nil || ok != tt.ok {
+				t.Errorf("got %v %v, want %v", ok, err, tt.ok)
+			}
+		})
+	}
+}
+
+func TestParseHash(t *testing.T) {
+	p, salt, hash, err := parseHash(referenceHash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p != (argon2Params{memory: 65536, time: 2, threads: 1}) || string(salt) != "somesalt" || len(hash) != 32 {
+		t.Errorf("got %+v %q %d bytes", p, salt, len(hash))
+	}
+
+	malformed := []string{
+		"",
+		"password",
+		"$argon2i$v=19$m=65536,t=2,p=1$c29tZXNhbHQ$CTFhFdXPJO1aFaMaO6Mm5c8y7cJHAph8ArZWb2GRPPc",
+		"$argon2id$v=16$m=65536,t=2,p=1$c29tZXNhbHQ$CTFhFdXPJO1aFaMaO6Mm5c8y7cJHAph8ArZWb2GRPPc",
+		"$argon2id$m=65536,t=2,p=1$c29tZXNhbHQ$CTFhFdXPJO1aFaMaO6Mm5c8y7cJHAph8ArZWb2GRPPc",
+		"$argon2id$v=19$m=65536$c29tZXNhbHQ$CTFhFdXPJO1aFaMaO6Mm5c8y7cJHAph8ArZWb2GRPPc",
+		"$argon2id$v=19$m=65536,t=0,p=1$c29tZXNhbHQ$CTFhFdXPJO1aFaMaO6Mm5c8y7cJHAph8ArZWb2GRPPc",
+		"$argon2id$v=19$m=65536,t=2,p=0$c29tZXNhbHQ$CTFhFdXPJO1aFaMaO6Mm5c8y7cJHAph8ArZWb2GRPPc",
+		"$argon2id$v=19$m=65536,t=2,p=1$c29tZXNhbHQ$",
+		"$argon2id$v=19$m=65536,t=2,p=1$not base64!$CTFhFdXPJO1aFaMaO6Mm5c8y7cJHAph8ArZWb2GRPPc",
+		"c29tZXNhbHQ$",
+	}
+	for _, h := range malformed {
+		if _, _, _, err := parseHash(h); err == nil {
+			t.Errorf("%q is accepted", h)
+		}
+		if ok, _ := hashCompare("password", h); ok {
+			t.Errorf("%q matches", h)
+		}
+	}
+}
+
+func TestNeedsRehash(t *testing.T) {
+	usePolicy(t, argon2Params{memory: 65536, time: 2, threads: 4})
+	tests := []struct {
+		hash string
+		want bool
+	}{
+		{referenceHash, false}, // fewer threads cost the same
+		{"$argon2id$v=19$m=131072,t=3,p=1$c29tZXNhbHQ$CTFhFdXPJO1aFaMaO6Mm5c8y7cJHAph8ArZWb2GRPPc", false},
+		{"$argon2id$v=19$m=32768,t=2,p=1$c29tZXNhbHQ$CTFhFdXPJO1aFaMaO6Mm5c8y7cJHAph8ArZWb2GRPPc", true},
+		{"$argon2id$v=19$m=65536,t=1,p=1$c29tZXNhbHQ$CTFhFdXPJO1aFaMaO6Mm5c8y7cJHAph8ArZWb2GRPPc", true},
+		{legacyHash("password"), true},
+		{"$argon2i$v=19$m=4096,t=1,p=1$c29tZXNhbHQ$CTFhFdXPJO1aFaMaO6Mm5c8y7cJHAph8ArZWb2GRPPc", false}, // can't be verified anyway
+	}
+	for _, tt := range tests {
+		if got := needsRehash(tt.hash); got != tt.want {
+			t.Errorf("%q: got %v, want %v", tt.hash, got, tt.want)
+		}
+	}
+}
+
+func TestNewHashPolicy(t *testing.T) {
+	tests := []struct {
+		memory, time, threads string
+		want                  argon2Params
+		err                   bool
+	}{
+		{"", "", "", hashPolicy, false},
+		{"131072", "4", "2", argon2Params{memory: 131072, time: 4, threads: 2}, false},
+		{"", "5", "", argon2Params{memory: hashPolicy.memory, time: 5, threads: hashPolicy.threads}, false},
+		{"64MiB", "", "", argon2Params{}, true},
+		{"", "0", "", argon2Params{}, true},
+		{"", "", "0", argon2Params{}, true},
+		{"", "", "256", argon2Params{}, true},
+		{"", "-1", "", argon2Params{}, true},
+		{"4294967296", "", "", argon2Params{}, true},
+		{"16", "", "4", argon2Params{}, true}, // less than 8 KiB for every thread
+	}
+	for _, tt := range tests {
+		t.Setenv("ARGON2_MEMORY", tt.memory)
+		t.Setenv("ARGON2_TIME", tt.time)
+		t.Setenv("ARGON2_THREADS", tt.threads)
+		got, err := newHashPolicy()
+		if (err != nil) != tt.err {
+			t.Errorf("m=%q t=%q p=%q: %v", tt.memory, tt.time, tt.threads, err)
+		} else if !tt.err && got != tt.want {
+			t.Errorf("m=%q t=%q p=%q: got %+v, want %+v", tt.memory, tt.time, tt.threads, got, tt.want)
+		}
+	}
+}
+
+func TestCheckUserRehash(t *testing.T) {
+	policy := argon2Params{memory: 128, time: 2, threads: 1}
+	usePolicy(t, policy)
+	login := func(env *Env, password string) (user, error) {
+		form := url.Values{"username": {"alice"}, "password": {password}}
+		r := httptest.NewRequest("POST", "/login", strings.NewReader(form.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		u, _, err := env.checkUser(r)
+		return u, err
+	}
+
+	weak := "$argon2id$v=19$m=64,t=1,p=1$c29tZXNhbHQ$" +
+		base64.RawStdEncoding.EncodeToString(argon2.IDKey([]byte("password"), []byte("somesalt"), 1, 64, 1, keyLen))
+	for name, hash := range map[string]string{"legacy": legacyHash("password"), "weak": weak} {
+		t.Run(name, func(t *testing.T) {
+			db := newFakeDb(user{Username: "alice", Password: hash})
+			env := &Env{dataManager: db}
+
+			var wrong *ErrWrongPassword
+			if _, err := login(env, "wrong"); !errors.As(err, &wrong) || db.rehashed != 0 {
+				t.Fatalf("wrong password: %v, %d rehashes", err, db.rehashed)
+			}
+
+			u, err := login(env, "password")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if db.rehashed != 1 || u.Password != db.users["alice"].Password {
+				t.Fatalf("%d rehashes, the session has the hash %q", db.rehashed, u.Password)
+			}
+			if p, _, _, err := parseHash(db.users["alice"].Password); err != nil || p != policy {
+				t.Errorf("new hash %q: %v", db.users["alice"].Password, err)
+			}
+
+			// The new hash works and follows the policy, it's not upgraded again
+			if _, err := login(env, "password"); err != nil || db.rehashed != 1 {
+				t.Errorf("second login: %v, %d rehashes", err, db.rehashed)
+			}
+		})
+	}
+}
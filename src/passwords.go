@@ -0,0 +1,268 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/mail"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// Reset links sent by email expire sooner than the ones the operator hands out
+const emailResetExpir = time.Hour
+
+// issueResetLink creates a reset link for username and returns its token
+func (env *Env) issueResetLink(username string, expir time.Duration) (string, error) {
+	if _, err := env.dataManager.userExists(env.db, username); err != nil {
+		return "", err
+	}
+	token, err := newLinkToken()
+	if err != nil {
+		return "", err
+	}
+	err = env.dataManager.insertPasswordReset(env.db, username, hashToken(token), time.Now().Add(expir))
+	return token, err
+}
+
+// resetCommand prints a reset link for the user in args, for the operator to hand over
+func (env *Env) resetCommand(args []string, expir time.Duration) int {
+	if len(args) != 1 {
+		fmt.Fprintf(os.Stderr, "usage: %s reset-password [--expires 24h] <username>\n", os.Args[0])
+		return 2
+	}
+
+	token, err := env.issueResetLink(args[0], expir)
+	if errors.Is(err, pgx.ErrNoRows) {
+		fmt.Fprintf(os.Stderr, "user %q does not exist\n", args[0])
+		return 1
+	} else if err != nil {
+		log.Printf("err: %v\n", err)
+		return 2
+	}
+
+	link := "/reset/" + token
+	if base := os.Getenv("PUBLIC_URL"); base != "" {
+		link = strings.TrimSuffix(base, "/") + link
+	} else {
+		fmt.Fprintln(os.Stderr, "PUBLIC_URL is not set, prepend the address of the instance to the link")
+	}
+	fmt.Printf("%s\nThe link can be used once and expires at %s\n", link, time.Now().Add(expir).Format(time.RFC1123))
+	return 0
+}
+
+// POST //
+
+// changePassword sets a new password after checking the current one, the other sessions are logged out
+func (env *Env) changePassword(w HTMLWriter, r *http.Request, s session) {
+	if err := r.ParseForm(); err != nil {
+		w.Status = http.StatusBadRequest
+		w.WriteHeader()
+		log.Printf("err: %v\n", err)
+		return
+	}
+	form := r.PostForm
+
+	// The cached user can be older than the last change
+	u, err := env.dataManager.userExists(env.db, s.user.Username)
+	if err != nil {
+		log.Printf("err: %v\n", err)
+		w.Status = http.StatusInternalServerError
+		w.WriteHeader()
+		return
+	}
+	ok, err := hashCompare(form.Get("current"), u.Password)
+	if err != nil {
+		log.Printf("err: %v\n", err)
+	}
+
+	msg := ""
+	switch {
+	case !ok:
+		msg = "The current password is not correct"
+	case form.Get("password") == "":
+		msg = "The new password can't be empty"
+	case form.Get("password") != form.Get("confirm"):
+		msg = "The new passwords don't match"
+	}
+	if msg != "" {
+		obj := env.userPage(s)
+		obj["PasswordMessage"] = msg
+		sendTemplate(w, obj, "user", "./html/user.html")
+		return
+	}
+
+	if err := env.dataManager.updatePassword(env.db, s.user.Username, form.Get("password")); err != nil {
+		log.Printf("err: %v\n", err)
+		w.Status = http.StatusInternalServerError
+		w.WriteHeader()
+		return
+	}
+	if err := sessions.removeOthers(s); err != nil {
+		log.Printf("err: %v\n", err)
+	}
+
+	obj := env.userPage(s)
+	obj["PasswordNotice"] = "The password has been changed, your other devices have been logged out"
+	sendTemplate(w, obj, "user", "./html/user.html")
+}
+
+// postEmail sets the address that receives reset links, an empty one removes it
+func (env *Env) postEmail(w HTMLWriter, r *http.Request, s session) {
+	if err := r.ParseForm(); err != nil {
+		w.Status = http.StatusBadRequest
+		w.WriteHeader()
+		log.Printf("err: %v\n", err)
+		return
+	}
+
+	var email *string
+	if v := strings.TrimSpace(r.PostForm.Get("email")); v != "" {
+		addr, err := mail.ParseAddress(v)
+		if err != nil {
+			obj := env.userPage(s)
+			obj["EmailMessage"] = "The email address is not valid"
+			sendTemplate(w, obj, "user", "./html/user.html")
+			return
+		}
+		email = &addr.Address
+	}
+
+	if err := env.dataManager.setEmail(env.db, s.user.Username, email); err != nil {
+		log.Printf("err: %v\n", err)
+		w.Status = http.StatusInternalServerError
+		w.WriteHeader()
+		return
+	}
+	s.user.Email = email // The cached session is refreshed later
+	env.getUser(w, r, s)
+}
+
+// PUBLIC //
+
+func (env *Env) viewForgot(w HTMLWriter, r *http.Request) {
+	sendResetPage(w, map[string]any{"Forgot": true, "Email": env.mailer != nil})
+}
+
+// requestReset emails a reset link to the user, if the user has an address.
+// The answer is the same either way, so it doesn't tell which users exist
+func (env *Env) requestReset(w HTMLWriter, r *http.Request) {
+	if !env.allowPublic(w, r) {
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		w.Status = http.StatusBadRequest
+		w.WriteHeader()
+		log.Printf("err: %v\n", err)
+		return
+	}
+	if env.mailer == nil {
+		w.Status = http.StatusNotFound
+		w.WriteHeader()
+		sendResetPage(w, map[string]any{"Forgot": true})
+		return
+	}
+
+	username := strings.TrimSpace(r.PostForm.Get("username"))
+	if username != "" && env.resetLimiter.allow(username) {
+		go env.sendResetLink(username, env.resetURL)
+	}
+	sendResetPage(w, map[string]any{
+		"Notice": "If the account has an email address, a link to reset the password has been sent to it",
+	})
+}
+
+// sendResetLink runs after the response, so its duration doesn't tell whether the user exists
+func (env *Env) sendResetLink(username string, base string) {
+	u, err := env.dataManager.userExists(env.db, username)
+	if err != nil || u.Email == nil {
+		if err != nil && !errors.Is(err, pgx.ErrNoRows) {
+			log.Printf("err: %v\n", err)
+		}
+		return
+	}
+
+	token, err := env.issueResetLink(username, emailResetExpir)
+	if err != nil {
+		log.Printf("err: %v\n", err)
+		return
+	}
+	body := fmt.Sprintf("Someone asked to reset the password of %s on CopyPaste.\n\n"+
+		"Open this link within an hour to choose a new password:\n%s/%s\n\n"+
+		"If it wasn't you, ignore this email: the password has not been changed.\n",
+		username, base, token)
+	if err := env.mailer.send(*u.Email, "Reset your CopyPaste password", body); err != nil {
+		log.Printf("err: %v\n", err)
+	}
+}
+
+func (env *Env) viewReset(w HTMLWriter, r *http.Request) {
+	if !env.allowPublic(w, r) {
+		return
+	}
+	token := r.PathValue("token")
+	if _, err := env.dataManager.passwordReset(env.db, hashToken(token)); err != nil {
+		sendResetInvalid(w, err)
+		return
+	}
+	secretHeaders(w)
+	sendResetPage(w, map[string]any{"Token": token})
+}
+
+// postReset sets the new password and logs out every session of the user
+func (env *Env) postReset(w HTMLWriter, r *http.Request) {
+	if !env.allowPublic(w, r) {
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		w.Status = http.StatusBadRequest
+		w.WriteHeader()
+		log.Printf("err: %v\n", err)
+		return
+	}
+	token := r.PathValue("token")
+	secretHeaders(w)
+
+	pw := r.PostForm.Get("password")
+	if pw == "" || pw != r.PostForm.Get("confirm") {
+		sendResetPage(w, map[string]any{"Token": token, "Message": "The passwords are empty or don't match"})
+		return
+	}
+
+	username, err := env.dataManager.resetPassword(env.db, hashToken(token), pw)
+	if err != nil {
+		sendResetInvalid(w, err)
+		return
+	}
+	if err := env.dataManager.deleteUserSessions(env.db, username); err != nil {
+		log.Printf("err: %v\n", err)
+		w.Status = http.StatusInternalServerError
+		w.WriteHeader()
+		sendResetPage(w, map[string]any{"Message": "The password has been changed, but the devices could not be logged out"})
+		return
+	}
+	sessions.removeUser(username)
+
+	w.HTMX = true
+	sendTemplate(w, "The password has been changed, log in with the new one", "login_base", "./html/login_base.html", "./html/login.html")
+}
+
+func sendResetInvalid(w HTMLWriter, err error) {
+	if !errors.Is(err, pgx.ErrNoRows) {
+		log.Printf("err: %v\n", err)
+		w.Status = http.StatusInternalServerError
+	} else {
+		w.Status = http.StatusNotFound
+	}
+	w.WriteHeader()
+	sendResetPage(w, map[string]any{"Message": "This link has expired or it has already been used"})
+}
+
+func sendResetPage(w HTMLWriter, obj any) {
+	w.HTMX = true // Public pages never use the index template
+	sendTemplate(w, obj, "login_base", "./html/login_base.html", "./html/reset.html")
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"os"
+	"strings"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+var ErrProxyUsername = errors.New("the username sent by the proxy is not valid")
+
+// trustedProxies are the addresses of the reverse proxies in PROXY_AUTH_TRUSTED, set by NewEnv.
+// Only they can send the username header and the address of the client in X-Forwarded-For
+var trustedProxies []netip.Prefix
+
+// proxyAuth trusts the username that an authenticating reverse proxy, such as Authelia or
+// oauth2-proxy, puts in a header. The header is read only from the addresses of the proxy,
+// anyone else could send it
+type proxyAuth struct {
+	header     string
+	logoutURL  string // where logout sends the browser, empty to show the login page
+	autoCreate bool   // users without an account get one on the first visit
+}
+
+// newTrustedProxies reads PROXY_AUTH_TRUSTED, a comma separated list of addresses and CIDRs
+func newTrustedProxies() ([]netip.Prefix, error) {
+	var trusted []netip.Prefix
+	for _, v := range strings.Split(os.Getenv("PROXY_AUTH_TRUSTED"), ",") {
+		if v = strings.TrimSpace(v); v == "" {
+			continue
+		}
+		prefix, err := netip.ParsePrefix(v)
+		if err != nil {
+			// A single address is a prefix as long as the address
+			addr, err := netip.ParseAddr(v)
+			if err != nil {
+				return nil, fmt.Errorf("PROXY_AUTH_TRUSTED: %q is not an address or a CIDR", v)
+			}
+			prefix = netip.PrefixFrom(addr, addr.BitLen())
+		}
+		trusted = append(trusted, prefix.Masked())
+	}
+	return trusted, nil
+}
+
+// newProxyAuth reads the configuration, it returns nil if header authentication is not configured
+func newProxyAuth(registration string) (*proxyAuth, error) {
+	header := os.Getenv("PROXY_AUTH_HEADER")
+	if header == "" {
+		return nil, nil
+	}
+	if len(trustedProxies) == 0 {
+		return nil, errors.New("PROXY_AUTH_HEADER is set but PROXY_AUTH_TRUSTED is empty")
+	}
+	create, err := autoCreate("PROXY_AUTH_AUTO_CREATE", registration)
+	if err != nil {
+		return nil, err
+	}
+	return &proxyAuth{header: header, logoutURL: os.Getenv("PROXY_AUTH_LOGOUT_URL"), autoCreate: create}, nil
+}
+
+// trustedProxy reports whether host, an address without the port, is one of the trusted proxies
+func trustedProxy(host string) bool {
+	addr, err := netip.ParseAddr(host)
+	if err != nil {
+		return false
+	}
+	addr = addr.Unmap()
+	for _, prefix := range trustedProxies {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// username returns the user authenticated by the proxy, if r comes from the proxy and has the header
+func (p *proxyAuth) username(r *http.Request) (string, bool) {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil || !trustedProxy(host) {
+		return "", false
+	}
+	username := strings.TrimSpace(r.Header.Get(p.header))
+	return username, username != ""
+}
+
+// proxyUser returns the user authenticated by the reverse proxy, if there is one
+func (m *sessionMap) proxyUser(r *http.Request) (string, bool) {
+	if m.proxy == nil {
+		return "", false
+	}
+	return m.proxy.username(r)
+}
+
+// proxySession returns the session of the user authenticated by the proxy. The session in the
+// cookie is used if it belongs to the same user, otherwise a new one is started, creating the
+// user, if autoCreate allows it, and its file directory on the first visit. The cookie is nil when the session is not new
+func (m *sessionMap) proxySession(r *http.Request, username string) (session, *http.Cookie, error) {
+	if s, ex := m.session(r); ex {
+		if s.user.Username == username {
+			return s, nil, nil
+		}
+		m.remove(s) // Another user logged in at the proxy
+	}
+	u, err := m.dataManager.userExists(m.db, username)
+	if errors.Is(err, pgx.ErrNoRows) {
+		if !m.proxy.autoCreate {
+			return session{}, nil, ErrRegistrationClosed
+		}
+		if checkUsername(username) != nil {
+			return session{}, nil, ErrProxyUsername
+		}
+
+		// The password is random, the user logs in through the proxy
+		var pw string
+		pw, err = newLinkToken()
+		if err == nil {
+			err = m.dataManager.insertUser(m.db, username, pw)
+		}
+		var pgErr *pgconn.PgError
+		if err == nil || errors.As(err, &pgErr) && pgErr.Code == "23505" {
+			// A concurrent request may have created it first
+			u, err = m.dataManager.userExists(m.db, username)
+		}
+	}
+	if err != nil {
+		return session{}, nil, err
+	}
+
+	cookie, err := m.create(r, u, "")
+	if err != nil {
+		return session{}, nil, err
+	}
+	if err := userDir(u); err != nil {
+		return session{}, nil, err
+	}
+
+	m.RLock()
+	s := m.m[cookie.Value]
+	m.RUnlock()
+	return s, cookie, nil
+}
@@ -0,0 +1,513 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"net/http"
+	"strings"
+)
+
+// A QR code encoder for byte mode data at error correction level M, following ISO/IEC 18004.
+// It's small enough that pulling in a dependency is not worth it
+
+var ErrQRTooLong = errors.New("the data does not fit in a QR code")
+
+// Error correction codewords per block and number of blocks for level M, indexed by version
+var (
+	qrEccPerBlock = [41]int{-1,
+		10, 16, 26, 18, 24, 16, 18, 22, 22, 26, 30, 22, 22, 24, 24, 28, 28, 26, 26, 26,
+		26, 28, 28, 28, 28, 28, 28, 28, 28, 28, 28, 28, 28, 28, 28, 28, 28, 28, 28, 28}
+	qrEccBlocks = [41]int{-1,
+		1, 1, 1, 2, 2, 4, 4, 4, 5, 5, 5, 8, 9, 9, 10, 10, 11, 13, 14, 16,
+		17, 17, 18, 20, 21, 23, 25, 26, 28, 29, 31, 33, 35, 37, 38, 40, 43, 45, 47, 49}
+)
+
+const qrEccFormatM = 0 // the format bits of level M
+
+// qrCode holds the modules of a symbol, true is dark
+type qrCode struct {
+	size     int
+	modules  [][]bool
+	function [][]bool // modules that are part of a function pattern and can't be masked
+}
+
+// encodeQR returns the smallest QR code holding data
+func encodeQR(data []byte) (*qrCode, error) {
+	version := 0
+	for v := 1; v <= 40; v++ {
+		if qrHeaderBits(v)+8*len(data) <= 8*qrDataCodewords(v) {
+			version = v
+			break
+		}
+	}
+	if version == 0 {
+		return nil, ErrQRTooLong
+	}
+
+	// Byte mode segment, terminator and padding
+	var bits qrBits
+	bits.append(0b0100, 4)
+	bits.append(len(data), qrHeaderBits(version)-4)
+	for _, b := range data {
+		bits.append(int(b), 8)
+	}
+	capacity := 8 * qrDataCodewords(version)
+	bits.append(0, min(4, capacity-len(bits)))
+	bits.append(0, (8-len(bits)%8)%8)
+	for pad := 0xEC; len(bits) < capacity; pad ^= 0xEC ^ 0x11 {
+		bits.append(pad, 8)
+	}
+
+	codewords := make([]byte, len(bits)/8)
+	for i, b := range bits {
+		if b {
+			codewords[i/8] |= 1 << (7 - i%8)
+		}
+	}
+
+	qr := newQRCode(version)
+	qr.drawCodewords(qrAddEcc(version, codewords))
+	qr.applyBestMask()
+	return qr, nil
+}
+
+// qrHeaderBits is the length of the mode indicator and of the character count
+func qrHeaderBits(version int) int {
+	if version < 10 {
+		return 4 + 8
+	}
+	return 4 + 16
+}
+
+// qrRawModules is the number of modules that can hold data or error correction, in bits
+func qrRawModules(version int) int {
+	n := (16*version+128)*version + 64
+	if version >= 2 {
+		align := version/7 + 2
+		n -= (25*align-10)*align - 55
+		if version >= 7 {
+			n -= 36
+		}
+	}
+	return n
+}
+
+func qrDataCodewords(version int) int {
+	return qrRawModules(version)/8 - qrEccPerBlock[version]*qrEccBlocks[version]
+}
+
+// qrAddEcc splits the data in blocks, computes the error correction of each one and interleaves them
+func qrAddEcc(version int, data []byte) []byte {
+	numBlocks := qrEccBlocks[version]
+	eccLen := qrEccPerBlock[version]
+	raw := qrRawModules(version) / 8
+	numShort := numBlocks - raw%numBlocks
+	shortLen := raw / numBlocks
+
+	divisor := rsDivisor(eccLen)
+	blocks := make([][]byte, numBlocks)
+	for i, k := 0, 0; i < numBlocks; i++ {
+		n := shortLen - eccLen
+		if i >= numShort {
+			n++
+		}
+		dat := data[k : k+n]
+		k += n
+		block := append([]byte{}, dat...)
+		if i < numShort {
+			block = append(block, 0) // placeholder so that all the blocks have the same length
+		}
+		blocks[i] = append(block, rsRemainder(dat, divisor)...)
+	}
+
+	result := make([]byte, 0, raw)
+	for i := 0; i < len(blocks[0]); i++ {
+		for j, block := range blocks {
+			if i != shortLen-eccLen || j >= numShort {
+				result = append(result, block[i])
+			}
+		}
+	}
+	return result
+}
+
+// gfMul multiplies in GF(2^8) modulo x^8 + x^4 + x^3 + x^2 + 1
+func gfMul(x, y byte) byte {
+	z := 0
+	for i := 7; i >= 0; i-- {
+		z = (z << 1) ^ ((z >> 7) * 0x11D)
+		z ^= int((y>>i)&1) * int(x)
+	}
+	return byte(z)
+}
+
+// rsDivisor returns the generator polynomial of the given degree, without the leading term
+func rsDivisor(degree int) []byte {
+	result := make([]byte, degree)
+	result[degree-1] = 1
+	root := byte(1)
+	for range degree {
+		for j := range result {
+			result[j] = gfMul(result[j], root)
+			if j+1 < len(result) {
+				result[j] ^= result[j+1]
+			}
+		}
+		root = gfMul(root, 0x02)
+	}
+	return result
+}
+
+func rsRemainder(data []byte, divisor []byte) []byte {
+	result := make([]byte, len(divisor))
+	for _, b := range data {
+		factor := b ^ result[0]
+		copy(result, result[1:])
+		result[len(result)-1] = 0
+		for i, d := range divisor {
+			result[i] ^= gfMul(d, factor)
+		}
+	}
+	return result
+}
+
+type qrBits []bool
+
+func (b *qrBits) append(val int, n int) {
+	for i := n - 1; i >= 0; i-- {
+		*b = append(*b, (val>>i)&1 == 1)
+	}
+}
+
+// newQRCode draws the function patterns of a symbol of the given version
+func newQRCode(version int) *qrCode {
+	size := 4*version + 17
+	qr := &qrCode{size: size, modules: make([][]bool, size), function: make([][]bool, size)}
+	for i := range size {
+		qr.modules[i] = make([]bool, size)
+		qr.function[i] = make([]bool, size)
+	}
+
+	for i := range size {
+		qr.setFunction(6, i, i%2 == 0)
+		qr.setFunction(i, 6, i%2 == 0)
+	}
+
+	for _, c := range [][2]int{{3, 3}, {size - 4, 3}, {3, size - 4}} {
+		for dy := -4; dy <= 4; dy++ {
+			for dx := -4; dx <= 4; dx++ {
+				x, y := c[0]+dx, c[1]+dy
+				if x < 0 || x >= size || y < 0 || y >= size {
+					continue
+				}
+				dist := max(abs(dx), abs(dy))
+				qr.setFunction(x, y, dist != 2 && dist != 4)
+			}
+		}
+	}
+
+	pos := qrAlignmentPositions(version)
+	for i, x := range pos {
+		for j, y := range pos {
+			// Skip the corners with a finder pattern
+			if i == 0 && j == 0 || i == 0 && j == len(pos)-1 || i == len(pos)-1 && j == 0 {
+				continue
+			}
+			for dy := -2; dy <= 2; dy++ {
+				for dx := -2; dx <= 2; dx++ {
+					qr.setFunction(x+dx, y+dy, max(abs(dx), abs(dy)) != 1)
+				}
+			}
+		}
+	}
+
+	qr.drawFormat(0) // reserves the area, it's drawn again once the mask is chosen
+	if version >= 7 {
+		rem := version
+		for range 12 {
+			rem = (rem << 1) ^ ((rem >> 11) * 0x1F25)
+		}
+		bits := version<<12 | rem
+		for i := range 18 {
+			a, b := size-11+i%3, i/3
+			qr.setFunction(a, b, (bits>>i)&1 == 1)
+			qr.setFunction(b, a, (bits>>i)&1 == 1)
+		}
+	}
+	return qr
+}
+
+func qrAlignmentPositions(version int) []int {
+	if version == 1 {
+		return nil
+	}
+	num := version/7 + 2
+	step := (version*8 + num*3 + 5) / (num*4 - 4) * 2
+	pos := make([]int, num)
+	pos[0] = 6
+	for i, p := num-1, 4*version+17-7; i >= 1; i, p = i-1, p-step {
+		pos[i] = p
+	}
+	return pos
+}
+
+func (qr *qrCode) setFunction(x, y int, dark bool) {
+	qr.modules[y][x] = dark
+	qr.function[y][x] = true
+}
+
+// drawFormat draws both copies of the error correction level and mask
+func (qr *qrCode) drawFormat(mask int) {
+	data := qrEccFormatM<<3 | mask
+	rem := data
+	for range 10 {
+		rem = (rem << 1) ^ ((rem >> 9) * 0x537)
+	}
+	bits := (data<<10 | rem) ^ 0x5412
+	bit := func(i int) bool { return (bits>>i)&1 == 1 }
+
+	for i := 0; i <= 5; i++ {
+		qr.setFunction(8, i, bit(i))
+	}
+	qr.setFunction(8, 7, bit(6))
+	qr.setFunction(8, 8, bit(7))
+	qr.setFunction(7, 8, bit(8))
+	for i := 9; i < 15; i++ {
+		qr.setFunction(14-i, 8, bit(i))
+	}
+
+	for i := 0; i < 8; i++ {
+		qr.setFunction(qr.size-1-i, 8, bit(i))
+	}
+	for i := 8; i < 15; i++ {
+		qr.setFunction(8, qr.size-15+i, bit(i))
+	}
+	qr.setFunction(8, qr.size-8, true) // always dark
+}
+
+// drawCodewords places the bits in the zigzag order, going up and down columns of two modules
+func (qr *qrCode) drawCodewords(data []byte) {
+	i := 0
+	for right := qr.size - 1; right >= 1; right -= 2 {
+		if right == 6 {
+			right = 5 // skip the vertical timing pattern
+		}
+		for vert := range qr.size {
+			for j := range 2 {
+				x := right - j
+				y := vert
+				if (right+1)&2 == 0 {
+					y = qr.size - 1 - vert
+				}
+				if !qr.function[y][x] && i < len(data)*8 {
+					qr.modules[y][x] = (data[i>>3]>>(7-i&7))&1 == 1
+					i++
+				}
+			}
+		}
+	}
+}
+
+func qrMaskBit(mask, x, y int) bool {
+	switch mask {
+	case 0:
+		return (x+y)%2 == 0
+	case 1:
+		return y%2 == 0
+	case 2:
+		return x%3 == 0
+	case 3:
+		return (x+y)%3 == 0
+	case 4:
+		return (x/3+y/2)%2 == 0
+	case 5:
+		return x*y%2+x*y%3 == 0
+	case 6:
+		return (x*y%2+x*y%3)%2 == 0
+	default:
+		return ((x+y)%2+x*y%3)%2 == 0
+	}
+}
+
+func (qr *qrCode) applyMask(mask int) {
+	for y := range qr.size {
+		for x := range qr.size {
+			if !qr.function[y][x] && qrMaskBit(mask, x, y) {
+				qr.modules[y][x] = !qr.modules[y][x]
+			}
+		}
+	}
+}
+
+// applyBestMask tries every mask and keeps the one with the lowest penalty
+func (qr *qrCode) applyBestMask() {
+	best, bestPenalty := 0, -1
+	for mask := range 8 {
+		qr.applyMask(mask)
+		qr.drawFormat(mask)
+		if p := qr.penalty(); bestPenalty < 0 || p < bestPenalty {
+			best, bestPenalty = mask, p
+		}
+		qr.applyMask(mask) // masks are XOR, applying one again removes it
+	}
+	qr.applyMask(best)
+	qr.drawFormat(best)
+}
+
+// penalty scores the patterns that make a symbol hard to read
+func (qr *qrCode) penalty() int {
+	n := qr.size
+	at := func(x, y int, vertical bool) bool {
+		if vertical {
+			return qr.modules[x][y]
+		}
+		return qr.modules[y][x]
+	}
+
+	result := 0
+	finderLike := []bool{true, false, true, true, true, false, true}
+	for _, vertical := range []bool{false, true} {
+		for y := range n {
+			run := 1
+			for x := 1; x <= n; x++ {
+				if x < n && at(x, y, vertical) == at(x-1, y, vertical) {
+					run++
+					continue
+				}
+				if run >= 5 {
+					result += run - 2
+				}
+				run = 1
+			}
+
+			// A finder-like pattern with four light modules on either side
+			for x := 0; x+7 <= n; x++ {
+				match := true
+				for k, dark := range finderLike {
+					if at(x+k, y, vertical) != dark {
+						match = false
+						break
+					}
+				}
+				if match && (qr.lightRun(x-4, x, y, vertical) || qr.lightRun(x+7, x+11, y, vertical)) {
+					result += 40
+				}
+			}
+		}
+	}
+
+	dark := 0
+	for y := range n {
+		for x := range n {
+			if qr.modules[y][x] {
+				dark++
+			}
+			if x+1 < n && y+1 < n {
+				c := qr.modules[y][x]
+				if c == qr.modules[y][x+1] && c == qr.modules[y+1][x] && c == qr.modules[y+1][x+1] {
+					result += 3
+				}
+			}
+		}
+	}
+	total := n * n
+	result += abs(dark*20-total*10) / total * 10
+	return result
+}
+
+// lightRun reports whether the modules from x0 to x1 are light, modules outside the symbol count as light
+func (qr *qrCode) lightRun(x0, x1, y int, vertical bool) bool {
+	for x := x0; x < x1; x++ {
+		if x < 0 || x >= qr.size {
+			continue
+		}
+		if vertical && qr.modules[x][y] || !vertical && qr.modules[y][x] {
+			return false
+		}
+	}
+	return true
+}
+
+// qrQuietZone is the light border around the symbol, in modules
+const qrQuietZone = 4
+
+// svg draws the symbol as a path, one square per dark module
+func (qr *qrCode) svg() []byte {
+	full := qr.size + 2*qrQuietZone
+	var path strings.Builder
+	for y := range qr.size {
+		for x := range qr.size {
+			if qr.modules[y][x] {
+				fmt.Fprintf(&path, "M%d,%dh1v1h-1z", x+qrQuietZone, y+qrQuietZone)
+			}
+		}
+	}
+
+	var b bytes.Buffer
+	fmt.Fprintf(&b, `<svg xmlns="http://www.w3.org/2000/svg" viewBox="0 0 %d %d" shape-rendering="crispEdges">`, full, full)
+	b.WriteString(`<rect width="100%" height="100%" fill="#fff"/>`)
+	fmt.Fprintf(&b, `<path d="%s" fill="#000"/></svg>`, path.String())
+	return b.Bytes()
+}
+
+// png draws the symbol with scale pixels per module
+func (qr *qrCode) png(scale int) ([]byte, error) {
+	full := (qr.size + 2*qrQuietZone) * scale
+	img := image.NewPaletted(image.Rect(0, 0, full, full), color.Palette{color.White, color.Black})
+	for y := range qr.size {
+		for x := range qr.size {
+			if !qr.modules[y][x] {
+				continue
+			}
+			for dy := range scale {
+				for dx := range scale {
+					img.SetColorIndex((x+qrQuietZone)*scale+dx, (y+qrQuietZone)*scale+dy, 1)
+				}
+			}
+		}
+	}
+
+	var b bytes.Buffer
+	if err := png.Encode(&b, img); err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
+
+// sendQR encodes data and sends it as SVG, or as PNG if the request asks for it with ?format=png
+func sendQR(w HTMLWriter, r *http.Request, data string) {
+	qr, err := encodeQR([]byte(data))
+	if err != nil {
+		w.Status = http.StatusRequestEntityTooLarge
+		w.WriteHeader()
+		return
+	}
+
+	body, ctype := qr.svg(), "image/svg+xml"
+	if r.URL.Query().Get("format") == "png" {
+		if body, err = qr.png(8); err != nil {
+			w.Status = http.StatusInternalServerError
+			w.WriteHeader()
+			return
+		}
+		ctype = "image/png"
+	}
+
+	h := w.Writer.Header()
+	h.Set("Content-Type", ctype)
+	h.Set("Cache-Control", "private, no-store")
+	h.Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader()
+	w.Writer.Write(body)
+}
+
+func abs(x int) int {
+	if x < 0 {
+		return -x
+	}
+	return x
+}
@@ -0,0 +1,346 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"image/png"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestGfMul(t *testing.T) {
+	if got := gfMul(0x80, 0x02); got != 0x1D {
+		t.Errorf("0x80 * 2 = %#x, want the reduction 0x1d", got)
+	}
+	// 2 generates the multiplicative group, its powers go through every non-zero element
+	seen := map[byte]bool{}
+	x := byte(1)
+	for range 255 {
+		seen[x] = true
+		x = gfMul(x, 0x02)
+	}
+	if len(seen) != 255 || x != 1 {
+		t.Errorf("2 has order %d, want 255", len(seen))
+	}
+	for a := range 256 {
+		if gfMul(byte(a), 1) != byte(a) || gfMul(byte(a), 0) != 0 {
+			t.Fatalf("%#x: 1 and 0 don't behave", a)
+		}
+		for b := range 256 {
+			if gfMul(byte(a), byte(b)) != gfMul(byte(b), byte(a)) {
+				t.Fatalf("%#x * %#x is not commutative", a, b)
+			}
+		}
+	}
+}
+
+// The example of ISO/IEC 18004 annex I, "01234567" at version 1-M
+func TestRsRemainderStandardExample(t *testing.T) {
+	data := []byte{0x10, 0x20, 0x0C, 0x56, 0x61, 0x80, 0xEC, 0x11, 0xEC, 0x11, 0xEC, 0x11, 0xEC, 0x11, 0xEC, 0x11}
+	want := []byte{0xA5, 0x24, 0xD4, 0xC1, 0xED, 0x36, 0xC7, 0x87, 0x2C, 0x55}
+	if got := rsRemainder(data, rsDivisor(10)); !bytes.Equal(got, want) {
+		t.Errorf("got % X, want % X", got, want)
+	}
+}
+
+// rsSyndromesZero reports whether block, data followed by ecc codewords, is a valid codeword:
+// as a polynomial it has the powers of 2 from 0 to ecc-1 as roots
+func rsSyndromesZero(block []byte, ecc int) bool {
+	root := byte(1)
+	for range ecc {
+		var sum byte
+		for _, c := range block {
+			sum = gfMul(sum, root) ^ c
+		}
+		if sum != 0 {
+			return false
+		}
+		root = gfMul(root, 0x02)
+	}
+	return true
+}
+
+func TestRsRemainderRoots(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	for _, ecc := range []int{7, 10, 16, 18, 22, 24, 26, 28, 30} {
+		data := make([]byte, 1+rnd.Intn(100))
+		rnd.Read(data)
+		block := append(slices.Clone(data), rsRemainder(data, rsDivisor(ecc))...)
+		if !rsSyndromesZero(block, ecc) {
+			t.Errorf("%d ecc codewords: the block is not a codeword", ecc)
+		}
+		block[0] ^= 1
+		if rsSyndromesZero(block, ecc) {
+			t.Errorf("%d ecc codewords: a corrupted block passes", ecc)
+		}
+	}
+}
+
+func TestQRCapacity(t *testing.T) {
+	// Raw codewords and data codewords at level M, from the tables of the standard
+	tests := []struct{ version, raw, data int }{
+		{1, 26, 16}, {2, 44, 28}, {5, 134, 86}, {7, 196, 124}, {10, 346, 216},
+		{20, 1085, 669}, {27, 1828, 1128}, {40, 3706, 2334},
+	}
+	for _, tt := range tests {
+		if got := qrRawModules(tt.version) / 8; got != tt.raw {
+			t.Errorf("version %d: %d raw codewords, want %d", tt.version, got, tt.raw)
+		}
+		if got := qrDataCodewords(tt.version); got != tt.data {
+			t.Errorf("version %d: %d data codewords, want %d", tt.version, got, tt.data)
+		}
+	}
+}
+
+func TestQRAlignmentPositions(t *testing.T) {
+	tests := map[int][]int{
+		1:  nil,
+		2:  {6, 18},
+		7:  {6, 22, 38},
+		14: {6, 26, 46, 66},
+		32: {6, 34, 60, 86, 112, 138},
+		36: {6, 24, 50, 76, 102, 128, 154},
+		40: {6, 30, 58, 86, 114, 142, 170},
+	}
+	for version, want := range tests {
+		if got := qrAlignmentPositions(version); !slices.Equal(got, want) {
+			t.Errorf("version %d: %v, want %v", version, got, want)
+		}
+	}
+}
+
+// Format information of level M for each mask, from the table of the standard
+var qrFormatM = [8]int{
+	0b101010000010010, 0b101000100100101, 0b101111001111100, 0b101101101001011,
+	0b100010111111001, 0b100000011001110, 0b100111110010111, 0b100101010100000,
+}
+
+// qrReadFormat returns the two copies of the format information, read from bit 0
+func qrReadFormat(qr *qrCode) (int, int) {
+	var first, second []bool
+	for y := 0; y <= 8; y++ {
+		if y != 6 {
+			first = append(first, qr.modules[y][8])
+		}
+	}
+	for x := 7; x >= 0; x-- {
+		if x != 6 {
+			first = append(first, qr.modules[8][x])
+		}
+	}
+	for x := qr.size - 1; x >= qr.size-8; x-- {
+		second = append(second, qr.modules[8][x])
+	}
+	for y := qr.size - 7; y < qr.size; y++ {
+		second = append(second, qr.modules[y][8])
+	}
+
+	toInt := func(bits []bool) int {
+		n := 0
+		for i, b := range bits {
+			if b {
+				n |= 1 << i
+			}
+		}
+		return n
+	}
+	return toInt(first), toInt(second)
+}
+
+// decodeQR reads back the data of a symbol made by encodeQR, checking every error correction block
+func decodeQR(t *testing.T, qr *qrCode) []byte {
+	t.Helper()
+	version := (qr.size - 17) / 4
+
+	first, second := qrReadFormat(qr)
+	if first != second {
+		t.Fatalf("the copies of the format differ: %015b %015b", first, second)
+	}
+	mask := slices.Index(qrFormatM[:], first)
+	if mask < 0 {
+		t.Fatalf("%015b is not the format of level M", first)
+	}
+	if !qr.modules[qr.size-8][8] {
+		t.Fatal("the dark module is light")
+	}
+
+	// Read the modules in pairs of columns from the right, going up first and then alternating
+	function := newQRCode(version).function
+	var codewords []byte
+	var cur byte
+	n := 0
+	for k, right := 0, qr.size-1; right >= 1; k, right = k+1, right-2 {
+		if right == 6 {
+			right = 5
+		}
+		for i := range qr.size {
+			y := i
+			if k%2 == 0 {
+				y = qr.size - 1 - i
+			}
+			for _, x := range []int{right, right - 1} {
+				if function[y][x] {
+					continue
+				}
+				bit := qr.modules[y][x] != qrMaskBit(mask, x, y)
+				cur <<= 1
+				if bit {
+					cur |= 1
+				}
+				if n++; n%8 == 0 {
+					codewords = append(codewords, cur)
+					cur = 0
+				}
+			}
+		}
+	}
+
+	// Undo the interleaving: the data of every block, then the error correction of every block
+	numBlocks, ecc := qrEccBlocks[version], qrEccPerBlock[version]
+	numShort := numBlocks - len(codewords)%numBlocks
+	shortData := len(codewords)/numBlocks - ecc
+	blocks := make([][]byte, numBlocks)
+	k := 0
+	for i := 0; i <= shortData; i++ {
+		for j := range blocks {
+			if i < shortData || j >= numShort {
+				blocks[j] = append(blocks[j], codewords[k])
+				k++
+			}
+		}
+	}
+	for range ecc {
+		for j := range blocks {
+			blocks[j] = append(blocks[j], codewords[k])
+			k++
+		}
+	}
+	var data []byte
+	for j, block := range blocks {
+		if !rsSyndromesZero(block, ecc) {
+			t.Fatalf("block %d is not a valid codeword", j)
+		}
+		data = append(data, block[:len(block)-ecc]...)
+	}
+
+	// Byte mode header, then the content
+	var bits qrBits
+	for _, b := range data {
+		bits.append(int(b), 8)
+	}
+	read := func(n int) int {
+		v := 0
+		for _, b := range bits[:n] {
+			v <<= 1
+			if b {
+				v |= 1
+			}
+		}
+		bits = bits[n:]
+		return v
+	}
+	if mode := read(4); mode != 0b0100 {
+		t.Fatalf("mode %04b, want byte mode", mode)
+	}
+	count := read(qrHeaderBits(version) - 4)
+	content := make([]byte, count)
+	for i := range content {
+		content[i] = byte(read(8))
+	}
+	return content
+}
+
+func TestEncodeQR(t *testing.T) {
+	rnd := rand.New(rand.NewSource(2))
+	tests := []struct {
+		name    string
+		length  int
+		version int
+	}{
+		{"empty", 0, 1},
+		{"full version 1", 14, 1},
+		{"version 2", 15, 2},
+		{"short header limit", 180, 9},
+		{"long header", 213, 10},
+		{"version info", 122, 7},
+		{"many blocks", 1000, 26},
+		{"full version 40", 2331, 40},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data := make([]byte, tt.length)
+			rnd.Read(data)
+			qr, err := encodeQR(data)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want := 4*tt.version + 17; qr.size != want {
+				t.Errorf("size %d, want %d", qr.size, want)
+			}
+			if got := decodeQR(t, qr); !bytes.Equal(got, data) {
+				t.Errorf("decoded %d bytes that differ from the %d encoded", len(got), len(data))
+			}
+		})
+	}
+
+	if _, err := encodeQR(make([]byte, 2332)); !errors.Is(err, ErrQRTooLong) {
+		t.Errorf("2332 bytes: %v, want ErrQRTooLong", err)
+	}
+}
+
+func TestQRVersionInformation(t *testing.T) {
+	// The version information of version 7 from the table of the standard
+	const want = 0b000111110010010100
+	qr := newQRCode(7)
+	got := 0
+	for i := range 18 {
+		if qr.modules[i/3][qr.size-11+i%3] {
+			got |= 1 << i
+		}
+	}
+	if got != want {
+		t.Errorf("got %018b, want %018b", got, want)
+	}
+}
+
+func TestSendQR(t *testing.T) {
+	url := "https://copypaste.example.com/file/download/0b0c1d2e"
+	tests := []struct {
+		name   string
+		target string
+		data   string
+		status int
+		ctype  string
+	}{
+		{"svg", "/qr", url, http.StatusOK, "image/svg+xml"},
+		{"png", "/qr?format=png", url, http.StatusOK, "image/png"},
+		{"too long", "/qr", strings.Repeat("a", 3000), http.StatusRequestEntityTooLarge, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			sendQR(HTMLWriter{Writer: rec, Status: http.StatusOK}, httptest.NewRequest("GET", tt.target, nil), tt.data)
+			if rec.Code != tt.status {
+				t.Fatalf("status %d, want %d", rec.Code, tt.status)
+			}
+			if ctype := rec.Header().Get("Content-Type"); tt.ctype != "" && ctype != tt.ctype {
+				t.Errorf("Content-Type %q, want %q", ctype, tt.ctype)
+			}
+		})
+	}
+
+	rec := httptest.NewRecorder()
+	sendQR(HTMLWriter{Writer: rec, Status: http.StatusOK}, httptest.NewRequest("GET", "/qr?format=png", nil), url)
+	img, err := png.Decode(rec.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	qr, _ := encodeQR([]byte(url))
+	if want := (qr.size + 2*qrQuietZone) * 8; img.Bounds().Dx() != want {
+		t.Errorf("width %d, want %d", img.Bounds().Dx(), want)
+	}
+}
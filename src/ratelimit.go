@@ -0,0 +1,219 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+	"sync"
+	"time"
+)
+
+// rateLimiter decides whether the client identified by key can make another request
+type rateLimiter interface {
+	allow(key string) bool
+}
+
+// budget is a rateLimiter whose tokens are only taken by failed attempts
+type budget interface {
+	rateLimiter
+	// spent reports whether key has no token left, without taking one
+	spent(key string) bool
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// memoryLimiter is a token bucket for every key: it holds at most burst tokens,
+// refilled at rate tokens per second, and every request takes one
+type memoryLimiter struct {
+	rate    float64
+	burst   float64
+	buckets map[string]*bucket
+	sync.Mutex
+}
+
+func newMemoryLimiter(rate float64, burst int) *memoryLimiter {
+	l := &memoryLimiter{rate: rate, burst: float64(burst), buckets: map[string]*bucket{}}
+	l.cleanRoutine()
+	return l
+}
+
+func (l *memoryLimiter) allow(key string) bool {
+	l.Lock()
+	defer l.Unlock()
+
+	now := time.Now()
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &bucket{l.burst, now}
+		l.buckets[key] = b
+	}
+
+	b.tokens = min(l.burst, b.tokens+now.Sub(b.last).Seconds()*l.rate)
+	b.last = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+func (l *memoryLimiter) spent(key string) bool {
+	l.Lock()
+	defer l.Unlock()
+	b, ok := l.buckets[key]
+	return ok && b.tokens+time.Since(b.last).Seconds()*l.rate < 1
+}
+
+// cleanRoutine periodically forgets the buckets that are full again
+func (l *memoryLimiter) cleanRoutine() {
+	go func() {
+		for {
+			time.Sleep(10 * time.Minute)
+			l.Lock()
+			for k, b := range l.buckets {
+				if b.tokens+time.Since(b.last).Seconds()*l.rate >= l.burst {
+					delete(l.buckets, k)
+				}
+			}
+			l.Unlock()
+		}
+	}()
+}
+
+// lockout blocks a key after too many failed attempts, for a time that doubles with every
+// further failure. Like rateLimiter it can be backed by the database to share it between instances
+type lockout interface {
+	// blocked returns how long key must still wait, zero if it can try
+	blocked(key string) time.Duration
+	// fail records a failed attempt of key and returns how long it is blocked for
+	fail(key string) time.Duration
+	// reset forgets the failures of key after a successful attempt
+	reset(key string)
+}
+
+// Failures are forgotten after an hour without new ones
+const lockoutForget = time.Hour
+
+type strikes struct {
+	count int
+	last  time.Time
+	until time.Time
+}
+
+// memoryLockout allows free failures, then blocks a key for base, doubling up to max
+type memoryLockout struct {
+	free    int
+	base    time.Duration
+	max     time.Duration
+	entries map[string]*strikes
+	sync.Mutex
+}
+
+func newMemoryLockout(free int, base time.Duration, max time.Duration) *memoryLockout {
+	l := &memoryLockout{free: free, base: base, max: max, entries: map[string]*strikes{}}
+	l.cleanRoutine()
+	return l
+}
+
+func (l *memoryLockout) blocked(key string) time.Duration {
+	l.Lock()
+	defer l.Unlock()
+	if s, ok := l.entries[key]; ok {
+		return max(0, time.Until(s.until))
+	}
+	return 0
+}
+
+func (l *memoryLockout) fail(key string) time.Duration {
+	l.Lock()
+	defer l.Unlock()
+
+	now := time.Now()
+	s, ok := l.entries[key]
+	if !ok || now.Sub(s.last) > lockoutForget {
+		s = &strikes{}
+		l.entries[key] = s
+	}
+	s.count++
+	s.last = now
+	if s.count <= l.free {
+		return 0
+	}
+
+	wait := l.max
+	if n := s.count - l.free - 1; n < 32 && l.base<<n < l.max {
+		wait = l.base << n
+	}
+	s.until = now.Add(wait)
+	return wait
+}
+
+func (l *memoryLockout) reset(key string) {
+	l.Lock()
+	defer l.Unlock()
+	delete(l.entries, key)
+}
+
+// cleanRoutine periodically forgets the keys that are not blocked and have no recent failures
+func (l *memoryLockout) cleanRoutine() {
+	go func() {
+		for {
+			time.Sleep(10 * time.Minute)
+			l.Lock()
+			for k, s := range l.entries {
+				if time.Since(s.last) > lockoutForget && time.Now().After(s.until) {
+					delete(l.entries, k)
+				}
+			}
+			l.Unlock()
+		}
+	}()
+}
+
+// clientNetwork is the key of the limits that must hold against clients with many addresses:
+// the address of IPv4 clients and the /64 network of IPv6 ones, which is usually given to a single host
+func clientNetwork(r *http.Request) string {
+	ip := clientIP(r)
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return ip
+	}
+	addr = addr.Unmap().WithZone("")
+	if addr.Is4() {
+		return addr.String()
+	}
+	prefix, _ := addr.Prefix(64)
+	return prefix.String()
+}
+
+// clientIP returns the address of the client without the port. Behind a trusted proxy it's the
+// last address in X-Forwarded-For that isn't a proxy, or X-Real-IP
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	if !trustedProxy(host) {
+		return host
+	}
+
+	// Every proxy appends the address it got the request from, the ones on the left can be forged
+	forwarded := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(forwarded) - 1; i >= 0; i-- {
+		addr, err := netip.ParseAddr(strings.TrimSpace(forwarded[i]))
+		if err != nil {
+			break
+		}
+		if !trustedProxy(addr.String()) {
+			return addr.Unmap().String()
+		}
+	}
+	if addr, err := netip.ParseAddr(strings.TrimSpace(r.Header.Get("X-Real-IP"))); err == nil {
+		return addr.Unmap().String()
+	}
+	return host
+}
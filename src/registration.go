@@ -0,0 +1,143 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"regexp"
+	"strconv"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Who can create an account on the sign-up page, set by REGISTRATION_MODE.
+// Users created by single sign-on or by the reverse proxy don't use the page, see autoCreate
+const (
+	registrationOpen   = "open"
+	registrationInvite = "invite" // a code from an existing user is needed
+	registrationClosed = "closed"
+)
+
+var (
+	ErrRegistrationClosed = errors.New("sign-ups are closed")
+	ErrUsername           = errors.New("the username has characters that are not allowed or it is too long")
+)
+
+const (
+	defaultInviteDays = 7
+	maxInviteDays     = 30
+)
+
+// Usernames are part of some paths, so they keep to characters that don't need escaping
+var usernameRe = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._@-]{0,24}$`)
+
+// checkUsername returns ErrUsername if name can't be the username of a new user.
+// The users table limits usernames to 25 characters
+func checkUsername(name string) error {
+	if !usernameRe.MatchString(name) {
+		return ErrUsername
+	}
+	return nil
+}
+
+func newRegistrationMode() (string, error) {
+	switch mode := os.Getenv("REGISTRATION_MODE"); mode {
+	case "":
+		return registrationOpen, nil
+	case registrationOpen, registrationInvite, registrationClosed:
+		return mode, nil
+	default:
+		return "", fmt.Errorf("REGISTRATION_MODE: unknown mode %q, it can be open, invite or closed", mode)
+	}
+}
+
+// autoCreate reads the variable name, which lets single sign-on or the reverse proxy create
+// the users that don't exist yet. When it's not set they are created only if registration is open
+func autoCreate(name string, registration string) (bool, error) {
+	v := os.Getenv(name)
+	if v == "" {
+		return registration == registrationOpen, nil
+	}
+	create, err := strconv.ParseBool(v)
+	if err != nil {
+		return false, fmt.Errorf("%s: %q is not true or false", name, v)
+	}
+	return create, nil
+}
+
+// registerForm is the content of the sign-up page, Invite fills the code in from the link of an invite
+type registerForm struct {
+	Mode    string
+	Invite  string
+	Message string
+}
+
+func (env *Env) registerForm(r *http.Request, msg string) registerForm {
+	return registerForm{Mode: env.registration, Invite: r.FormValue("invite"), Message: msg}
+}
+
+// Expired reports whether the invite can't be used anymore because of its age
+func (i invite) Expired() bool {
+	return i.UsedAt == nil && !i.ExpiresAt.After(time.Now())
+}
+
+// GET //
+
+func (env *Env) getRegister(w HTMLWriter, r *http.Request, _ session) {
+	w.HTMX = true // Login does not need index template even if the request is not from HTMX
+	sendTemplate(w, env.registerForm(r, ""), "login_base", "./html/login_base.html", "./html/register.html")
+}
+
+// POST //
+
+// postInvite creates an invite code of the user, it's shown only once
+func (env *Env) postInvite(w HTMLWriter, r *http.Request, s session) {
+	if env.registration != registrationInvite {
+		w.Status = http.StatusNotFound
+		w.WriteHeader()
+		return
+	}
+
+	days, err := strconv.Atoi(r.PostFormValue("expires"))
+	if err != nil || days < 1 || days > maxInviteDays {
+		days = defaultInviteDays
+	}
+	i := invite{
+		Id:        uuid.New(),
+		CreatedBy: s.user.Username,
+		ExpiresAt: time.Now().AddDate(0, 0, days),
+	}
+
+	code, err := newLinkToken()
+	if err == nil {
+		i.CodeHash = hashToken(code)
+		err = env.dataManager.insertInvite(env.db, i)
+	}
+	if err != nil {
+		log.Printf("err: %v\n", err)
+		w.Status = http.StatusInternalServerError
+		w.WriteHeader()
+		return
+	}
+
+	obj := env.userPage(s)
+	obj["NewInvite"] = code
+	obj["InviteLink"] = publicURL(r, "/register") + "?invite=" + code
+	sendTemplate(w, obj, "user", "./html/user.html")
+}
+
+// DELETE //
+
+// deleteInvite revokes an invite of the user, used ones only leave the list
+func (env *Env) deleteInvite(w HTMLWriter, r *http.Request, s session) {
+	if err := env.dataManager.deleteInvite(env.db, s.user.Username, r.PathValue("inviteId")); err != nil {
+		log.Printf("err: %v\n", err)
+		w.Status = folderErrStatus(err)
+		w.WriteHeader()
+		return
+	}
+	env.getUser(w, r, s)
+}
@@ -0,0 +1,246 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	scanTimeout  = 2 * time.Minute
+	scanInterval = 5 * time.Minute
+	scanWorkers  = 2
+)
+
+// A version is marked scanError after this many failed scans, failures to reach the scanner don't count
+const maxScanAttempts = 3
+
+var (
+	ErrScannerUnreachable = errors.New("the scanner can't be reached")
+	ErrScanTooLarge       = errors.New("the file is larger than the scanner accepts")
+)
+
+type scanResult struct {
+	Clean  bool
+	Reason string // the name of the threat when the content is not clean
+}
+
+// fileScanner checks uploaded content before it is made available
+type fileScanner interface {
+	scan(ctx context.Context, r io.Reader) (scanResult, error)
+}
+
+// clamdScanner sends the content to a clamd daemon using the INSTREAM command
+type clamdScanner struct {
+	addr      string
+	chunkSize int
+}
+
+func newClamdScanner(addr string) clamdScanner {
+	return clamdScanner{addr, 32 * 1024}
+}
+
+func (c clamdScanner) scan(ctx context.Context, r io.Reader) (scanResult, error) {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", c.addr)
+	if err != nil {
+		return scanResult{}, fmt.Errorf("%w: %v", ErrScannerUnreachable, err)
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	if _, err := conn.Write([]byte("zINSTREAM\x00")); err != nil {
+		return scanResult{}, err
+	}
+
+	// Every chunk is prefixed by its length, a chunk of length 0 ends the stream
+	buf := make([]byte, 4+c.chunkSize)
+	for {
+		n, err := io.ReadFull(r, buf[4:])
+		if n > 0 {
+			binary.BigEndian.PutUint32(buf[:4], uint32(n))
+			if _, err := conn.Write(buf[:4+n]); err != nil {
+				return scanResult{}, err
+			}
+		}
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			break
+		} else if err != nil {
+			return scanResult{}, err
+		}
+	}
+	if _, err := conn.Write([]byte{0, 0, 0, 0}); err != nil {
+		return scanResult{}, err
+	}
+
+	reply, err := io.ReadAll(conn)
+	if err != nil {
+		return scanResult{}, err
+	}
+	return parseClamdReply(reply)
+}
+
+// parseClamdReply reads replies such as "stream: OK" or "stream: Eicar-Signature FOUND"
+func parseClamdReply(reply []byte) (scanResult, error) {
+	msg := string(bytes.TrimRight(reply, "\x00\n"))
+	msg = strings.TrimPrefix(msg, "stream: ")
+
+	switch {
+	case msg == "OK":
+		return scanResult{Clean: true}, nil
+	case strings.HasSuffix(msg, " FOUND"):
+		return scanResult{Reason: strings.TrimSuffix(msg, " FOUND")}, nil
+	default:
+		return scanResult{}, fmt.Errorf("clamd: %s", msg)
+	}
+}
+
+// quarantinePath is where a version waits for its scan, and where it stays if it's infected
+func quarantinePath(versionId string) string {
+	return path.Join("./filedir", "quarantine", versionId)
+}
+
+// scanQueue runs the scans in the background, each version is queued at most once at a time
+type scanQueue struct {
+	jobs   chan blobRef
+	queued map[string]bool
+	sync.Mutex
+}
+
+func newScanQueue() *scanQueue {
+	return &scanQueue{jobs: make(chan blobRef, 64), queued: map[string]bool{}}
+}
+
+func (q *scanQueue) push(b blobRef) {
+	q.Lock()
+	if q.queued[b.Id.String()] {
+		q.Unlock()
+		return
+	}
+	q.queued[b.Id.String()] = true
+	q.Unlock()
+
+	q.jobs <- b
+}
+
+func (q *scanQueue) done(b blobRef) {
+	q.Lock()
+	delete(q.queued, b.Id.String())
+	q.Unlock()
+}
+
+// startScanner runs the scan workers and periodically requeues the versions that are still pending,
+// for example because clamd was not reachable or the server was restarted
+func (env *Env) startScanner() error {
+	if err := os.MkdirAll(path.Join("./filedir", "quarantine"), 0750); err != nil {
+		return err
+	}
+
+	for range scanWorkers {
+		go func() {
+			for b := range env.scans.jobs {
+				env.scanVersion(b)
+				env.scans.done(b)
+			}
+		}()
+	}
+
+	go func() {
+		for {
+			pending, err := env.dataManager.pendingScans(env.db, time.Now().Add(-time.Minute))
+			if err != nil {
+				log.Printf("err: %v\n", err)
+			}
+			for _, b := range pending {
+				env.scans.push(b)
+			}
+			time.Sleep(scanInterval)
+		}
+	}()
+
+	return nil
+}
+
+// scanVersion scans a version in quarantine. Clean blobs are moved to the directory of the user,
+// infected ones stay in quarantine. If the scanner can't be reached the version is left pending,
+// after maxScanAttempts other failures it's marked scanError
+func (env *Env) scanVersion(b blobRef) {
+	id := b.Id.String()
+	dst := path.Join("./filedir", b.UserId.String(), id)
+	f, err := os.Open(quarantinePath(id))
+	if errors.Is(err, os.ErrNotExist) {
+		// The blob was found clean and moved, but the version could not be updated
+		if _, err := os.Stat(dst); err == nil {
+			env.recordScan(id, scanClean, "")
+			return
+		}
+	}
+	if err != nil {
+		log.Printf("err: %v\n", err)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), scanTimeout)
+	res, err := env.scanner.scan(ctx, f)
+	cancel()
+	f.Close()
+	if err != nil {
+		log.Printf("err: scanning %s: %v\n", id, err)
+		if !errors.Is(err, ErrScannerUnreachable) {
+			env.scanFailed(id, err)
+		}
+		return
+	}
+
+	status := scanInfected
+	if res.Clean {
+		status = scanClean
+		if err := os.Rename(quarantinePath(id), dst); err != nil {
+			log.Printf("err: %v\n", err)
+			return
+		}
+	} else {
+		log.Printf("log: version %s quarantined: %s\n", id, res.Reason)
+	}
+	env.recordScan(id, status, res.Reason)
+}
+
+// scanFailed counts a failed scan of the version and gives up after maxScanAttempts
+func (env *Env) scanFailed(id string, scanErr error) {
+	attempts, err := env.dataManager.scanFailed(env.db, id)
+	if err != nil {
+		log.Printf("err: %v\n", err)
+		return
+	}
+	if attempts >= maxScanAttempts {
+		log.Printf("log: version %s could not be scanned %d times, giving up\n", id, attempts)
+		env.recordScan(id, scanError, scanErr.Error())
+	}
+}
+
+// recordScan stores the outcome of the scan of a version and updates the pages that list its file
+func (env *Env) recordScan(id string, status string, reason string) {
+	fl, err := env.dataManager.setScanResult(env.db, id, status, reason)
+	if err != nil {
+		log.Printf("err: %v\n", err)
+		return
+	}
+	if fl.SpaceId != nil {
+		env.spaceBroker.Publish(spaceChannel(fl.SpaceId.String()), "")
+		return
+	}
+	env.fileBroker.Publish(userChannel(fl.Username), folderEvent(idString(fl.Folder)))
+	env.publishGrantees("", fl.Id.String())
+}
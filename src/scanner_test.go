@@ -0,0 +1,301 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const eicar = `X5O!P%@AP[4\PZX54(P^)7CC)7}$EICAR-STANDARD-ANTIVIRUS-TEST-FILE!H+H*`
+
+// fakeClamd answers INSTREAM commands like clamd, it reports the EICAR test string as infected.
+// The content of the streams is sent to received, unless the previous one hasn't been read
+func fakeClamd(t *testing.T, reply string) (string, <-chan []byte) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	received := make(chan []byte, 1)
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			content, err := readInstream(conn)
+			if err != nil {
+				conn.Close()
+				continue
+			}
+			select {
+			case received <- content:
+			default: // Nobody is checking the content
+			}
+
+			msg := reply
+			if msg == "" {
+				msg = "stream: OK"
+				if bytes.Contains(content, []byte(eicar)) {
+					msg = "stream: Eicar-Test-Signature FOUND"
+				}
+			}
+			conn.Write([]byte(msg + "\x00"))
+			conn.Close()
+		}
+	}()
+	return ln.Addr().String(), received
+}
+
+func readInstream(conn net.Conn) ([]byte, error) {
+	cmd := make([]byte, len("zINSTREAM\x00"))
+	if _, err := io.ReadFull(conn, cmd); err != nil {
+		return nil, err
+	}
+	if string(cmd) != "zINSTREAM\x00" {
+		return nil, io.ErrUnexpectedEOF
+	}
+
+	var content []byte
+	for {
+		var size uint32
+		if err := binary.Read(conn, binary.BigEndian, &size); err != nil {
+			return nil, err
+		}
+		if size == 0 {
+			return content, nil
+		}
+		chunk := make([]byte, size)
+		if _, err := io.ReadFull(conn, chunk); err != nil {
+			return nil, err
+		}
+		content = append(content, chunk...)
+	}
+}
+
+func TestClamdScan(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		clean   bool
+		reason  string
+	}{
+		{"clean", "hello world", true, ""},
+		{"empty", "", true, ""},
+		{"several chunks", strings.Repeat("abcdefgh", 100), true, ""},
+		{"infected", eicar, false, "Eicar-Test-Signature"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			addr, received := fakeClamd(t, "")
+			c := clamdScanner{addr: addr, chunkSize: 64}
+
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			res, err := c.scan(ctx, strings.NewReader(tt.content))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if res.Clean != tt.clean || res.Reason != tt.reason {
+				t.Errorf("got %+v, want clean %v reason %q", res, tt.clean, tt.reason)
+			}
+			if got := <-received; string(got) != tt.content {
+				t.Errorf("clamd received %d bytes, want %d", len(got), len(tt.content))
+			}
+		})
+	}
+}
+
+func TestClamdScanError(t *testing.T) {
+	addr, _ := fakeClamd(t, "INSTREAM size limit exceeded. ERROR")
+	c := newClamdScanner(addr)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if _, err := c.scan(ctx, strings.NewReader("content")); err == nil {
+		t.Error("an error reply was reported as a result")
+	}
+}
+
+func TestClamdUnreachable(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if _, err := newClamdScanner(addr).scan(ctx, strings.NewReader("content")); err == nil {
+		t.Error("scanning without clamd succeeded")
+	}
+}
+
+func TestParseClamdReply(t *testing.T) {
+	tests := []struct {
+		reply  string
+		clean  bool
+		reason string
+		err    bool
+	}{
+		{"stream: OK\x00", true, "", false},
+		{"stream: OK\n", true, "", false},
+		{"stream: Win.Test.EICAR_HDB-1 FOUND\x00", false, "Win.Test.EICAR_HDB-1", false},
+		{"stream: Can't allocate memory ERROR\x00", false, "", true},
+		{"", false, "", true},
+	}
+	for _, tt := range tests {
+		res, err := parseClamdReply([]byte(tt.reply))
+		if (err != nil) != tt.err {
+			t.Errorf("%q: error %v", tt.reply, err)
+			continue
+		}
+		if res.Clean != tt.clean || res.Reason != tt.reason {
+			t.Errorf("%q: got %+v", tt.reply, res)
+		}
+	}
+}
+
+// chdir runs the rest of the test in dir, the storage and the templates are read from the working directory
+func chdir(t *testing.T, dir string) {
+	t.Helper()
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chdir(wd) })
+}
+
+func TestScanVersion(t *testing.T) {
+	addr, _ := fakeClamd(t, "")
+	chdir(t, t.TempDir())
+
+	userId := uuid.New()
+	for _, dir := range []string{"./filedir/quarantine", path.Join("./filedir", userId.String())} {
+		if err := os.MkdirAll(dir, 0750); err != nil {
+			t.Fatal(err)
+		}
+	}
+	clean, infected := uuid.New(), uuid.New()
+	os.WriteFile(quarantinePath(clean.String()), []byte("hello"), 0640)
+	os.WriteFile(quarantinePath(infected.String()), []byte(eicar), 0640)
+
+	db := newFakeDb()
+	env := &Env{dataManager: db, scanner: newClamdScanner(addr), clipBroker: NewEventBroker(), fileBroker: NewEventBroker()}
+	env.scanVersion(blobRef{Id: clean, UserId: userId, ScanStatus: scanPending})
+	env.scanVersion(blobRef{Id: infected, UserId: userId, ScanStatus: scanPending})
+
+	if db.scanStatus[clean.String()] != scanClean {
+		t.Errorf("clean version marked %q", db.scanStatus[clean.String()])
+	}
+	if _, err := os.Stat(path.Join("./filedir", userId.String(), clean.String())); err != nil {
+		t.Errorf("clean blob not moved to the user: %v", err)
+	}
+	if db.scanStatus[infected.String()] != scanInfected || db.scanReason[infected.String()] != "Eicar-Test-Signature" {
+		t.Errorf("infected version marked %q: %q", db.scanStatus[infected.String()], db.scanReason[infected.String()])
+	}
+	if _, err := os.Stat(quarantinePath(infected.String())); err != nil {
+		t.Errorf("infected blob left the quarantine: %v", err)
+	}
+}
+
+func TestScanVersionUnreachable(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+	chdir(t, t.TempDir())
+
+	os.MkdirAll("./filedir/quarantine", 0750)
+	id := uuid.New()
+	os.WriteFile(quarantinePath(id.String()), []byte("hello"), 0640)
+
+	db := newFakeDb()
+	env := &Env{dataManager: db, scanner: newClamdScanner(addr)}
+	env.scanVersion(blobRef{Id: id, UserId: uuid.New(), ScanStatus: scanPending})
+
+	if len(db.scanStatus) != 0 {
+		t.Errorf("a failed scan recorded %v, the version must stay pending", db.scanStatus)
+	}
+	if _, err := os.Stat(quarantinePath(id.String())); err != nil {
+		t.Errorf("the blob left the quarantine: %v", err)
+	}
+}
+
+func TestScanVersionRefused(t *testing.T) {
+	addr, _ := fakeClamd(t, "INSTREAM size limit exceeded. ERROR")
+	chdir(t, t.TempDir())
+
+	os.MkdirAll("./filedir/quarantine", 0750)
+	id := uuid.New()
+	os.WriteFile(quarantinePath(id.String()), []byte("hello"), 0640)
+
+	db := newFakeDb()
+	env := &Env{dataManager: db, scanner: newClamdScanner(addr), clipBroker: NewEventBroker(), fileBroker: NewEventBroker()}
+	b := blobRef{Id: id, UserId: uuid.New(), ScanStatus: scanPending}
+	for i := 1; i < maxScanAttempts; i++ {
+		env.scanVersion(b)
+		if len(db.scanStatus) != 0 {
+			t.Fatalf("marked %v after %d failed scans", db.scanStatus, i)
+		}
+	}
+	env.scanVersion(b)
+
+	if db.scanStatus[id.String()] != scanError || !strings.Contains(db.scanReason[id.String()], "size limit exceeded") {
+		t.Errorf("version marked %q: %q", db.scanStatus[id.String()], db.scanReason[id.String()])
+	}
+	if _, err := os.Stat(quarantinePath(id.String())); err != nil {
+		t.Errorf("the blob left the quarantine: %v", err)
+	}
+}
+
+// A clean blob that was moved before the version could be updated is found in the directory of the user
+func TestScanVersionAlreadyMoved(t *testing.T) {
+	chdir(t, t.TempDir())
+
+	userId, id := uuid.New(), uuid.New()
+	dir := path.Join("./filedir", userId.String())
+	os.MkdirAll("./filedir/quarantine", 0750)
+	os.MkdirAll(dir, 0750)
+	os.WriteFile(path.Join(dir, id.String()), []byte("hello"), 0640)
+
+	db := newFakeDb()
+	env := &Env{dataManager: db, scanner: newClamdScanner("127.0.0.1:1"), clipBroker: NewEventBroker(), fileBroker: NewEventBroker()}
+	env.scanVersion(blobRef{Id: id, UserId: userId, ScanStatus: scanPending})
+
+	if db.scanStatus[id.String()] != scanClean {
+		t.Errorf("version marked %q", db.scanStatus[id.String()])
+	}
+}
+
+func TestCheckUploadSize(t *testing.T) {
+	env := &Env{scanMaxSize: 10}
+	if err := env.checkUploadSize(100); err != nil {
+		t.Errorf("without a scanner: %v", err)
+	}
+	env.scanner = newClamdScanner("127.0.0.1:1")
+	if err := env.checkUploadSize(10); err != nil {
+		t.Errorf("at the limit: %v", err)
+	}
+	if err := env.checkUploadSize(11); !errors.Is(err, ErrScanTooLarge) {
+		t.Errorf("over the limit: %v", err)
+	}
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"html"
+	"log"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+)
+
+var (
+	defaultSecretExpir = 24 * time.Hour
+	maxSecretExpir     = 7 * 24 * time.Hour
+)
+
+func (env *Env) secretsCleanRoutine() {
+	go func() {
+		for {
+			if err := env.dataManager.deleteExpiredSecrets(env.db); err != nil {
+				log.Printf("err: %v\n", err)
+			}
+			time.Sleep(time.Hour)
+		}
+	}()
+}
+
+// GET //
+
+func (env *Env) newSecret(w HTMLWriter, r *http.Request, _ session) {
+	sendTemplate(w, map[string]any{}, "newsecret", "./html/secrets.html")
+}
+
+func (env *Env) getSecrets(w HTMLWriter, r *http.Request, s session) {
+	secrets, err := env.dataManager.userSecrets(env.db, s.user.Username)
+	if err != nil {
+		log.Printf("err: %v\n", err)
+		secrets = make([]secret, 0)
+	}
+
+	w.HTMX = true // The list is always loaded inside the clipboard page
+	sendTemplate(w, secrets, "secretlist", "./html/secrets.html")
+}
+
+// POST //
+
+func (env *Env) postSecret(w HTMLWriter, r *http.Request, s session) {
+	if err := r.ParseForm(); err != nil {
+		w.Status = http.StatusBadRequest
+		w.WriteHeader()
+		log.Printf("err: %v\n", err)
+		return
+	}
+	form := r.PostForm
+	if form.Get("text") == "" {
+		w.Status = http.StatusBadRequest
+		w.WriteHeader()
+		return
+	}
+
+	expir := defaultSecretExpir
+	if hours, err := strconv.Atoi(form.Get("expires")); err == nil && hours > 0 {
+		expir = min(time.Duration(hours)*time.Hour, maxSecretExpir)
+	}
+
+	token, err := newLinkToken()
+	if err != nil {
+		log.Printf("err: %v\n", err)
+		w.Status = http.StatusInternalServerError
+		w.WriteHeader()
+		return
+	}
+	sec := secret{
+		Id:        uuid.New(),
+		TokenHash: hashToken(token),
+		Username:  s.user.Username,
+		Label:     strings.TrimSpace(form.Get("label")),
+		Text:      form.Get("text"),
+		ExpiresAt: time.Now().Add(expir),
+	}
+	if err := env.dataManager.insertSecret(env.db, sec); err != nil {
+		log.Printf("err: %v\n", err)
+		w.Status = http.StatusInternalServerError
+		w.WriteHeader()
+		return
+	}
+
+	env.clipBroker.Publish(userChannel(s.user.Username), "")
+	obj := map[string]any{"Link": publicURL(r, path.Join("/once", token))}
+	sendTemplate(w, obj, "newsecret", "./html/secrets.html")
+}
+
+// DELETE //
+
+func (env *Env) deleteSecret(w HTMLWriter, r *http.Request, s session) {
+	if err := env.dataManager.deleteSecret(env.db, s.user.Username, r.PathValue("secretId")); err != nil {
+		log.Printf("err: %v\n", err)
+		w.Status = http.StatusInternalServerError
+		w.WriteHeader()
+		return
+	}
+
+	env.clipBroker.Publish(userChannel(s.user.Username), "")
+	w.Status = http.StatusNoContent
+	w.WriteHeader()
+}
+
+// PUBLIC //
+
+// viewSecret only tells whether the secret can still be read. The text is sent by revealSecret
+// after a click, so bots that preview links don't burn it
+func (env *Env) viewSecret(w HTMLWriter, r *http.Request) {
+	secretHeaders(w)
+	if !env.allowPublic(w, r) {
+		return
+	}
+
+	token := r.PathValue("token")
+	ok, err := env.dataManager.secretExists(env.db, hashToken(token))
+	if err != nil {
+		log.Printf("err: %v\n", err)
+	}
+	if !ok {
+		w.Status = http.StatusNotFound
+		w.WriteHeader()
+		sendSecretPage(w, map[string]any{"Message": "This secret has already been read or has expired"})
+		return
+	}
+	sendSecretPage(w, map[string]any{"Token": token})
+}
+
+func (env *Env) revealSecret(w HTMLWriter, r *http.Request) {
+	secretHeaders(w)
+	if !env.allowPublic(w, r) {
+		return
+	}
+
+	sec, err := env.dataManager.readSecret(env.db, hashToken(r.PathValue("token")))
+	if err != nil {
+		if !errors.Is(err, pgx.ErrNoRows) {
+			log.Printf("err: %v\n", err)
+		}
+		w.Status = http.StatusNotFound
+		w.WriteHeader()
+		sendSecretPage(w, map[string]any{"Message": "This secret has already been read or has expired"})
+		return
+	}
+
+	name := "A one-time secret"
+	if sec.Label != "" {
+		name = fmt.Sprintf("The secret %q", sec.Label)
+	}
+	msg := fmt.Sprintf("%s has been read at %s", name, time.Now().Format("15:04"))
+	env.clipBroker.PublishEvent(userChannel(sec.Username), brokerEvent{Scope: "secret-read", Data: html.EscapeString(msg)})
+
+	sendSecretPage(w, map[string]any{"Text": sec.Text})
+}
+
+// allowPublic applies the rate limit of public pages.
+// If it returns false the response has already been sent
+func (env *Env) allowPublic(w HTMLWriter, r *http.Request) bool {
+	if env.linkLimiter.allow(clientIP(r)) {
+		return true
+	}
+	w.Status = http.StatusTooManyRequests
+	w.WriteHeader()
+	sendPublic(w, map[string]any{"Message": "Too many requests, try again later"})
+	return false
+}
+
+// secretHeaders keeps secrets out of caches, referrers and search engines
+func secretHeaders(w HTMLWriter) {
+	h := w.Writer.Header()
+	h.Set("Cache-Control", "no-store")
+	h.Set("Referrer-Policy", "no-referrer")
+	h.Set("X-Robots-Tag", "noindex, nofollow")
+}
+
+func sendSecretPage(w HTMLWriter, obj any) {
+	w.HTMX = true // Public pages never use the index template
+	sendTemplate(w, obj, "login_base", "./html/login_base.html", "./html/once.html")
+}
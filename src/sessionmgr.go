@@ -8,17 +8,28 @@ import (
 	"net/http"
 	"os"
 	"path"
+	"strings"
 	"sync"
 	"time"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
 )
 
 const SESSIONCOOKIE = "Session-id"
 
 var (
 	defaultExpir = 36 * time.Hour
-	sessions     = newSessionMap()
+	sessions     *sessionMap // set by main, it needs the database
 )
 
+// Cached sessions are checked against the database again after sessionCacheTTL,
+// so a session removed by another instance stops working
+const sessionCacheTTL = time.Minute
+
+var ErrUserDisabled = errors.New("the account has been disabled by an administrator")
+
 type ErrWrongPassword struct {
 	message string
 }
@@ -29,130 +40,355 @@ func (e *ErrWrongPassword) Error() string {
 
 // Associate a cookie to a user and provide some utility functions
 type session struct {
-	user      user
-	clipEvtCh chan int8 // there is no need to send actual data through the channel
-	cookie    http.Cookie
+	id      uuid.UUID
+	user    user
+	done    chan struct{} // closed when the session ends, its streams unsubscribe and stop
+	cookie  http.Cookie
+	checked time.Time // when the session was last read from the database
 }
 
-func (s *session) revitalize() {
-	s.cookie.Expires = time.Now().Add(defaultExpir)
+// newSession returns a cached session, closing done stops its streams
+func newSession(id uuid.UUID, u user, cookie http.Cookie) session {
+	return session{
+		id:      id,
+		user:    u,
+		done:    make(chan struct{}),
+		cookie:  cookie,
+		checked: time.Now(),
+	}
 }
 
 func (s *session) expired() bool {
 	exp := s.cookie.Expires
-	if exp.After(time.Now()) && !exp.IsZero() {
-		return true
-	} else {
-		return false
-	}
+	return exp.IsZero() || !exp.After(time.Now())
 }
 
+// sessionMap stores the sessions in the database and caches them in memory.
+// The event channel of a session only lives in the cache of the instance that serves its streams
 type sessionMap struct {
-	m map[string]session
+	m           map[string]session
+	byUser      map[string]map[string]struct{} // the cookies of the cached sessions of every user
+	db          *pgxpool.Pool
+	dataManager dbData
+	proxy       *proxyAuth // nil unless a reverse proxy authenticates the users
 	sync.RWMutex
 }
 
-func newSessionMap() *sessionMap {
-	newMap := sessionMap{make(map[string]session), sync.RWMutex{}}
+func newSessionMap(db *pgxpool.Pool, dataManager dbData) *sessionMap {
+	newMap := sessionMap{
+		m:           make(map[string]session),
+		byUser:      make(map[string]map[string]struct{}),
+		db:          db,
+		dataManager: dataManager,
+	}
 	newMap.cleanRoutine()
 	return &newMap
 }
 
-func (m *sessionMap) session(r *http.Request) (s session, exists bool) {
-	exists = false
-
+func (m *sessionMap) session(r *http.Request) (session, bool) {
 	cookie, err := r.Cookie(SESSIONCOOKIE)
 	if err != nil {
 		log.Printf("err: %v\n", err)
-		return
+		return session{}, false
 	}
 
 	m.RLock()
-	s, exists = m.m[cookie.Value]
+	s, cached := m.m[cookie.Value]
 	m.RUnlock()
-	return
+	if cached && time.Since(s.checked) < sessionCacheTTL {
+		if s.expired() {
+			m.remove(s)
+			return session{}, false
+		}
+		return s, true
+	}
+
+	stored, err := m.dataManager.touchSession(m.db, hashToken(cookie.Value), clientIP(r))
+	var u user
+	if err == nil {
+		u, err = m.dataManager.userExists(m.db, stored.Username)
+	}
+	if err != nil {
+		if !errors.Is(err, pgx.ErrNoRows) {
+			log.Printf("err: %v\n", err)
+			return s, cached // The database is not reachable, trust the cache
+		}
+		m.drop(cookie.Value)
+		return session{}, false
+	}
+	if u.Disabled {
+		m.drop(cookie.Value)
+		return session{}, false
+	}
+
+	m.Lock()
+	defer m.Unlock()
+	s, cached = m.m[cookie.Value]
+	if !cached {
+		s = newSession(stored.Id, u, sessionCookie(cookie.Value, stored.ExpiresAt))
+	}
+	s.id = stored.Id
+	s.user = u
+	s.cookie.Expires = stored.ExpiresAt
+	s.checked = time.Now()
+	m.put(cookie.Value, s)
+	return s, true
 }
 
-func (m *sessionMap) remove(s session) {
-	k := s.cookie.Value
-	if _, ok := m.m[k]; !ok { // This should never happen
-		log.Printf("info: triyng to logout from session %s, but it does not exist", s.cookie.Value)
-		return
+// create starts a session for user on the device that sent r
+func (m *sessionMap) create(r *http.Request, user user, remember string) (*http.Cookie, error) {
+	if user.Disabled {
+		return nil, ErrUserDisabled
+	}
+	exp := time.Now().Add(defaultExpir)
+	if remember == "on" {
+		exp = time.Now().AddDate(50, 0, 0)
+	}
+
+	cookieBytes := make([]byte, 20)
+	if _, err := rand.Read(cookieBytes); err != nil {
+		return nil, err
 	}
-	close(m.m[k].clipEvtCh)
+	cookie := sessionCookie(base64.URLEncoding.EncodeToString(cookieBytes), exp)
+
+	stored := storedSession{
+		Id:        uuid.New(),
+		TokenHash: hashToken(cookie.Value),
+		Username:  user.Username,
+		ExpiresAt: exp,
+		UserAgent: r.UserAgent(),
+		Ip:        clientIP(r),
+	}
+	if err := m.dataManager.insertSession(m.db, stored); err != nil {
+		return nil, err
+	}
+
 	m.Lock()
-	delete(m.m, k)
+	m.put(cookie.Value, newSession(stored.Id, user, cookie))
 	m.Unlock()
+	return &cookie, nil
+}
+
+// remove ends a session, on every instance
+func (m *sessionMap) remove(s session) {
+	if err := m.dataManager.deleteSession(m.db, hashToken(s.cookie.Value)); err != nil {
+		log.Printf("err: %v\n", err)
+	}
+	m.drop(s.cookie.Value)
+}
+
+// removeUser forgets the cached sessions of a user on this instance, their rows are left alone.
+// To log the user out, delete them first with deleteUserSessions
+func (m *sessionMap) removeUser(username string) {
+	m.Lock()
+	defer m.Unlock()
+	for k := range m.byUser[username] {
+		m.del(k)
+	}
+}
+
+// removeId ends the session of user with the given id, on every instance
+func (m *sessionMap) removeId(username string, id string) error {
+	if err := m.dataManager.deleteUserSession(m.db, username, id); err != nil {
+		return err
+	}
+
+	m.Lock()
+	defer m.Unlock()
+	for k := range m.byUser[username] {
+		if m.m[k].id.String() == id {
+			m.del(k)
+		}
+	}
+	return nil
+}
+
+// removeOthers ends every session of the user of s except s itself
+func (m *sessionMap) removeOthers(s session) error {
+	if err := m.dataManager.deleteOtherSessions(m.db, s.user.Username, s.id.String()); err != nil {
+		return err
+	}
+
+	m.Lock()
+	defer m.Unlock()
+	for k := range m.byUser[s.user.Username] {
+		if k != s.cookie.Value {
+			m.del(k)
+		}
+	}
+	return nil
+}
+
+// drop removes a session from the cache and closes its streams
+func (m *sessionMap) drop(key string) {
+	m.Lock()
+	defer m.Unlock()
+	m.del(key)
 }
 
+// put caches a session, the caller holds the lock
+func (m *sessionMap) put(key string, s session) {
+	m.m[key] = s
+	if _, ok := m.byUser[s.user.Username]; !ok {
+		m.byUser[s.user.Username] = make(map[string]struct{})
+	}
+	m.byUser[s.user.Username][key] = struct{}{}
+}
+
+// del removes a session from the cache and ends its streams, the caller holds the lock.
+// The event channel stays open: the brokers may still send to it until the streams unsubscribe
+func (m *sessionMap) del(key string) {
+	s, ok := m.m[key]
+	if !ok {
+		return
+	}
+	close(s.done)
+	delete(m.m, key)
+
+	keys := m.byUser[s.user.Username]
+	delete(keys, key)
+	if len(keys) == 0 {
+		delete(m.byUser, s.user.Username)
+	}
+}
+
+// cleanRoutine periodically deletes the expired sessions from the database and the cache
 func (m *sessionMap) cleanRoutine() {
-	time.AfterFunc(6*time.Hour, func() {
-		log.Println("log: Removing expired sessions")
-		for k, session := range m.m {
-			if session.expired() {
-				close(m.m[k].clipEvtCh)
-				m.Lock()
-				delete(m.m, k)
-				m.Unlock()
+	go func() {
+		for {
+			time.Sleep(time.Hour)
+			if err := m.dataManager.deleteExpiredSessions(m.db); err != nil {
+				log.Printf("err: %v\n", err)
+			}
+
+			m.Lock()
+			for k, s := range m.m {
+				if s.expired() {
+					m.del(k)
+				}
 			}
+			m.Unlock()
 		}
-	})
+	}()
+}
+
+func sessionCookie(value string, expires time.Time) http.Cookie {
+	return http.Cookie{
+		Name:     SESSIONCOOKIE,
+		Value:    value,
+		Path:     "/",
+		Expires:  expires,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode, // Other sites can link to the instance, but not post to it
+	}
 }
 
-// checkUser is the authentication function for already registered users.
+// dummyHash is compared with the passwords of users that don't exist
+var dummyHash = sync.OnceValue(func() string {
+	h, err := hashPassword("")
+	if err != nil {
+		log.Printf("err: %v\n", err)
+	}
+	return h
+})
+
+// checkUser is the authentication function for already registered users,
+// it returns the user and the value of the "remember" field of the login form.
 // If the user isn't found, *pgx.ErrNoRows will be returned.
 // If the password is incorrect *ErrWrongPassword will be returned.
-func (env *Env) checkUser(r *http.Request) (*http.Cookie, error) {
+func (env *Env) checkUser(r *http.Request) (user, string, error) {
 	uname, pw, rem, err := loginInfo(r)
 	if err != nil {
-		return nil, err
+		return user{}, "", err
 	}
 
 	// Get the user's password hash and compare it with the received pw.
-	user, err := env.dataManager.userExists(env.db, uname)
+	u, err := env.dataManager.userExists(env.db, uname)
 	if err != nil {
-		return nil, err
+		if errors.Is(err, pgx.ErrNoRows) {
+			// Hash anyway, so the time of the answer doesn't tell that the user doesn't exist
+			hashCompare(pw, dummyHash())
+		}
+		return user{}, "", err
 	} else {
-		ok, err := hashCompare(pw, user.Password)
+		ok, err := hashCompare(pw, u.Password)
 		if err != nil {
-			return nil, err
+			return user{}, "", err
 		}
 		if !ok {
-			return nil, &ErrWrongPassword{"user was found, but password is incorrect"}
+			return user{}, "", &ErrWrongPassword{"user was found, but password is incorrect"}
+		}
+	}
+	if u.Disabled {
+		return user{}, "", ErrUserDisabled
+	}
+
+	// The password is known only now, hashes from older versions or weaker settings are upgraded
+	if needsRehash(u.Password) {
+		hash, err := hashPassword(pw)
+		if err == nil {
+			err = env.dataManager.rehashPassword(env.db, u.Username, u.Password, hash)
+		}
+		if err != nil {
+			log.Printf("err: %v\n", err)
+		} else {
+			u.Password = hash
 		}
 	}
+	return u, rem, nil
+}
 
+// startSession logs in a user that has been authenticated
+func (env *Env) startSession(r *http.Request, user user, remember string) (*http.Cookie, error) {
 	// Create the cookie
-	cookie, err := makeSession(user, rem)
+	cookie, err := sessions.create(r, user, remember)
 	if err != nil {
 		return nil, err
 	}
 
-	// Check if there is a file directory for the user.
-	// If there is an error try to make a new one.
+	if err := userDir(user); err != nil {
+		return nil, err
+	}
+	return cookie, nil
+}
+
+// userDir checks if there is a file directory for the user.
+// If there is an error it tries to make a new one.
+func userDir(user user) error {
 	pth := path.Join("./filedir/", user.Id.String())
 	if _, err := os.Lstat(pth); err != nil {
 		log.Printf("err: %v --- trying to create a new directory\n", err)
-		if err := os.Mkdir(pth, 0664); err != nil {
+		if err := os.Mkdir(pth, 0750); err != nil {
 			if errors.Is(err, os.ErrExist) {
 				log.Printf("err: %v\n", err)
 			} else {
-				return nil, err
+				return err
 			}
 		}
 	}
-
-	return cookie, nil
+	return nil
 }
 
 // registerUser creates a new user and make a directory to store files.
 func (env *Env) registerUser(r *http.Request) (*http.Cookie, error) {
+	if env.registration == registrationClosed {
+		return nil, ErrRegistrationClosed
+	}
 	username, pw, rem, err := loginInfo(r)
 	if err != nil {
 		return nil, err
 	}
+	if err := checkUsername(username); err != nil {
+		return nil, err
+	}
 
-	if err := env.dataManager.insertUser(env.db, username, pw); err != nil {
+	if env.registration == registrationInvite {
+		code := strings.TrimSpace(r.PostForm.Get("invite"))
+		err = env.dataManager.insertInvitedUser(env.db, username, pw, hashToken(code))
+	} else {
+		err = env.dataManager.insertUser(env.db, username, pw)
+	}
+	if err != nil {
 		return nil, err
 	}
 	user, err := env.dataManager.userExists(env.db, username)
@@ -161,14 +397,14 @@ func (env *Env) registerUser(r *http.Request) (*http.Cookie, error) {
 	}
 
 	// Create the cookie
-	cookie, err := makeSession(user, rem)
+	cookie, err := sessions.create(r, user, rem)
 	if err != nil {
 		return nil, err
 	}
 
 	// Create a file directory for the user
 	pth := path.Join("./filedir/", user.Id.String())
-	if err := os.Mkdir(pth, 0664); err != nil {
+	if err := os.Mkdir(pth, 0750); err != nil {
 		return nil, err
 	}
 
@@ -192,29 +428,3 @@ func loginInfo(r *http.Request) (string, string, string, error) {
 
 	return uname, pw, rem, nil
 }
-
-func makeSession(user user, remember string) (*http.Cookie, error) {
-	exp := time.Now().Add(defaultExpir)
-	if remember == "on" {
-		exp = time.Now().AddDate(50, 0, 0)
-	}
-
-	cookieBytes := make([]byte, 20)
-	if _, err := rand.Read(cookieBytes); err != nil {
-		log.Printf("err: %v\n", err)
-		return nil, err
-	}
-	cookieVal := base64.URLEncoding.EncodeToString(cookieBytes[:20])
-	cookie := http.Cookie{
-		Name:     SESSIONCOOKIE,
-		Value:    cookieVal,
-		Path:     "/",
-		Expires:  exp,
-		HttpOnly: true,
-	}
-
-	sessions.Lock()
-	sessions.m[cookie.Value] = session{user, make(chan int8), cookie}
-	sessions.Unlock()
-	return &cookie, nil
-}
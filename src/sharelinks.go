@@ -0,0 +1,330 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strconv"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+)
+
+// publicURL returns the absolute URL of pth, using PUBLIC_URL when it is set
+func publicURL(r *http.Request, pth string) string {
+	if base := os.Getenv("PUBLIC_URL"); base != "" {
+		if u, err := url.Parse(base); err == nil {
+			return u.JoinPath(pth).String()
+		}
+		log.Printf("err: invalid PUBLIC_URL %q\n", base)
+	}
+
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	return (&url.URL{Scheme: scheme, Host: r.Host, Path: pth}).String()
+}
+
+// available reports whether the link can still be used
+func (l shareLink) available() bool {
+	if l.RevokedAt != nil {
+		return false
+	}
+	if l.ExpiresAt != nil && l.ExpiresAt.Before(time.Now()) {
+		return false
+	}
+	return l.MaxUses == nil || l.Uses < *l.MaxUses
+}
+
+// GET //
+
+func (env *Env) newShare(w HTMLWriter, r *http.Request, _ session) {
+	obj := map[string]any{
+		"ClipId": r.URL.Query().Get("clip"),
+		"FileId": r.URL.Query().Get("file"),
+	}
+	sendTemplate(w, obj, "newshare", "./html/newshare.html")
+}
+
+func (env *Env) getShares(w HTMLWriter, r *http.Request, s session) {
+	links, err := env.dataManager.userShareLinks(env.db, s.user.Username)
+	if err != nil {
+		log.Printf("err: %v\n", err)
+		links = make([]listedShareLink, 0)
+	}
+
+	uploads, err := env.dataManager.userUploadLinks(env.db, s.user.Username)
+	if err != nil {
+		log.Printf("err: %v\n", err)
+		uploads = make([]listedUploadLink, 0)
+	}
+
+	urls := map[string]string{}
+	for _, l := range links {
+		urls[l.Id.String()] = publicURL(r, path.Join("/s", l.Token))
+	}
+	for _, l := range uploads {
+		urls[l.Id.String()] = publicURL(r, path.Join("/u", l.Token))
+	}
+
+	obj := map[string]any{
+		"Links":   links,
+		"Uploads": uploads,
+		"URLs":    urls,
+	}
+	sendTemplate(w, obj, "sharelist", "./html/sharelist.html")
+}
+
+func (env *Env) getShareAccesses(w HTMLWriter, r *http.Request, s session) {
+	accesses, err := env.dataManager.shareAccesses(env.db, s.user.Username, r.PathValue("linkId"))
+	if err != nil {
+		log.Printf("err: %v\n", err)
+		w.Status = http.StatusInternalServerError
+		w.WriteHeader()
+		return
+	}
+
+	w.HTMX = true // The log is always loaded inside the list of links
+	sendTemplate(w, accesses, "shareaccesses", "./html/sharelist.html")
+}
+
+// shareQR encodes the public URL of a link
+func (env *Env) shareQR(w HTMLWriter, r *http.Request, s session) {
+	link, err := env.dataManager.userShareLink(env.db, s.user.Username, r.PathValue("linkId"))
+	if err != nil {
+		log.Printf("err: %v\n", err)
+		if errors.Is(err, pgx.ErrNoRows) {
+			w.Status = http.StatusNotFound
+		} else {
+			w.Status = http.StatusInternalServerError
+		}
+		w.WriteHeader()
+		return
+	}
+	sendQR(w, r, publicURL(r, path.Join("/s", link.Token)))
+}
+
+// POST //
+
+func (env *Env) postShare(w HTMLWriter, r *http.Request, s session) {
+	if err := r.ParseForm(); err != nil {
+		w.Status = http.StatusBadRequest
+		w.WriteHeader()
+		log.Printf("err: %v\n", err)
+		return
+	}
+	form := r.PostForm
+
+	token, err := newLinkToken()
+	if err != nil {
+		log.Printf("err: %v\n", err)
+		w.Status = http.StatusInternalServerError
+		w.WriteHeader()
+		return
+	}
+	link := shareLink{Id: uuid.New(), Token: token, Username: s.user.Username}
+
+	if id, err := uuid.Parse(form.Get("clip")); err == nil {
+		link.ClipId = &id
+	} else if id, err := uuid.Parse(form.Get("file")); err == nil {
+		link.FileId = &id
+	} else {
+		w.Status = http.StatusBadRequest
+		w.WriteHeader()
+		return
+	}
+
+	if hours, err := strconv.Atoi(form.Get("expires")); err == nil && hours > 0 {
+		exp := time.Now().Add(time.Duration(hours) * time.Hour)
+		link.ExpiresAt = &exp
+	}
+	if uses, err := strconv.Atoi(form.Get("uses")); err == nil && uses > 0 {
+		max := int32(uses)
+		link.MaxUses = &max
+	}
+	if pw := form.Get("password"); pw != "" {
+		hash, err := hashPassword(pw)
+		if err != nil {
+			log.Printf("err: %v\n", err)
+			w.Status = http.StatusInternalServerError
+			w.WriteHeader()
+			return
+		}
+		link.Password = &hash
+	}
+
+	if err := env.dataManager.insertShareLink(env.db, link); err != nil {
+		log.Printf("err: %v\n", err)
+		if errors.Is(err, pgx.ErrNoRows) {
+			w.Status = http.StatusNotFound
+		} else {
+			w.Status = http.StatusInternalServerError
+		}
+		w.WriteHeader()
+		return
+	}
+
+	obj := map[string]any{"Link": publicURL(r, path.Join("/s", token))}
+	sendTemplate(w, obj, "newshare", "./html/newshare.html")
+}
+
+// DELETE //
+
+func (env *Env) revokeShare(w HTMLWriter, r *http.Request, s session) {
+	if err := env.dataManager.revokeShareLink(env.db, s.user.Username, r.PathValue("linkId")); err != nil {
+		log.Printf("err: %v\n", err)
+		if errors.Is(err, pgx.ErrNoRows) {
+			w.Status = http.StatusNotFound
+		} else {
+			w.Status = http.StatusInternalServerError
+		}
+		w.WriteHeader()
+		return
+	}
+	env.getShares(w, r, s)
+}
+
+// PUBLIC //
+
+// viewShare shows the landing page of a link. The content is only sent by openShare,
+// so link previews don't consume uses
+func (env *Env) viewShare(w HTMLWriter, r *http.Request) {
+	link, ok := env.publicLink(w, r)
+	if !ok {
+		return
+	}
+	env.recordAccess(link, r, "view")
+
+	obj := map[string]any{
+		"Token":    link.Token,
+		"Password": link.Password != nil,
+		"File":     link.FileId != nil,
+	}
+	if !link.available() {
+		obj = map[string]any{"Message": "This link is no longer available"}
+	}
+	sendPublic(w, obj)
+}
+
+func (env *Env) openShare(w HTMLWriter, r *http.Request) {
+	link, ok := env.publicLink(w, r)
+	if !ok {
+		return
+	}
+
+	if link.Password != nil {
+		if err := r.ParseForm(); err != nil {
+			w.Status = http.StatusBadRequest
+			w.WriteHeader()
+			return
+		}
+		ok, err := hashCompare(r.PostForm.Get("password"), *link.Password)
+		if err != nil {
+			log.Printf("err: %v\n", err)
+		}
+		if !ok {
+			env.recordAccess(link, r, "wrong-password")
+			w.Status = http.StatusForbidden
+			w.WriteHeader()
+			sendPublic(w, map[string]any{
+				"Token":    link.Token,
+				"Password": true,
+				"File":     link.FileId != nil,
+				"Message":  "The password is not correct",
+			})
+			return
+		}
+	}
+
+	consumed, err := env.dataManager.consumeShareLink(env.db, link.Token)
+	if err != nil {
+		if !errors.Is(err, pgx.ErrNoRows) {
+			log.Printf("err: %v\n", err)
+		}
+		env.recordAccess(link, r, "unavailable")
+		w.Status = http.StatusGone
+		w.WriteHeader()
+		sendPublic(w, map[string]any{"Message": "This link is no longer available"})
+		return
+	}
+	link = consumed
+	env.recordAccess(link, r, "open")
+
+	if link.ClipId != nil {
+		clip, err := env.dataManager.userClip(env.db, link.Username, link.ClipId.String())
+		if err != nil {
+			log.Printf("err: %v\n", err)
+			w.Status = http.StatusNotFound
+			w.WriteHeader()
+			sendPublic(w, map[string]any{"Message": "This link is no longer available"})
+			return
+		}
+		sendPublic(w, map[string]any{"Text": clip.Text})
+		return
+	}
+
+	env.sendSharedFile(w, r, link.Username, link.FileId.String())
+}
+
+// sendSharedFile sends the latest clean version of a file of owner
+func (env *Env) sendSharedFile(w HTMLWriter, r *http.Request, owner string, fileId string) {
+	u, err := env.dataManager.userExists(env.db, owner)
+	var f file
+	if err == nil {
+		f, err = env.dataManager.userFile(env.db, owner, fileId)
+	}
+	var version fileVersion
+	if err == nil {
+		version, err = env.dataManager.fileVersion(env.db, owner, fileId, "")
+	}
+	if err != nil {
+		log.Printf("err: %v\n", err)
+		w.Status = http.StatusNotFound
+		w.WriteHeader()
+		sendPublic(w, map[string]any{"Message": "This file is not available"})
+		return
+	}
+
+	if origin, ok := downloadOrigin(); ok {
+		token := downloadToken(u.Id.String(), version.Id.String(), f.Filename)
+		http.Redirect(w.Writer, r, origin.JoinPath("dl", token).String(), http.StatusSeeOther)
+		return
+	}
+	serveBlob(w, r, path.Join("./filedir", u.Id.String(), version.Id.String()), f.Filename)
+}
+
+// publicLink applies the rate limit and loads the link in the request.
+// If it returns false the response has already been sent
+func (env *Env) publicLink(w HTMLWriter, r *http.Request) (shareLink, bool) {
+	if !env.allowPublic(w, r) {
+		return shareLink{}, false
+	}
+
+	link, err := env.dataManager.shareLink(env.db, r.PathValue("token"))
+	if err != nil {
+		if !errors.Is(err, pgx.ErrNoRows) {
+			log.Printf("err: %v\n", err)
+		}
+		w.Status = http.StatusNotFound
+		w.WriteHeader()
+		sendPublic(w, map[string]any{"Message": "This link does not exist"})
+		return shareLink{}, false
+	}
+	return link, true
+}
+
+func (env *Env) recordAccess(link shareLink, r *http.Request, outcome string) {
+	if err := env.dataManager.insertShareAccess(env.db, link.Id, clientIP(r), r.UserAgent(), outcome); err != nil {
+		log.Printf("err: %v\n", err)
+	}
+}
+
+func sendPublic(w HTMLWriter, obj any) {
+	w.HTMX = true // Public pages never use the index template
+	sendTemplate(w, obj, "login_base", "./html/login_base.html", "./html/share.html")
+}
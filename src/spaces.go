@@ -0,0 +1,399 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"slices"
+	"strings"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// Roles that can change the content of a space
+var editorRoles = []string{roleOwner, roleEditor}
+
+// GET //
+
+func (env *Env) getSpaces(w HTMLWriter, r *http.Request, s session) {
+	spaces, err := env.dataManager.userSpaces(env.db, s.user.Username)
+	if err != nil {
+		log.Printf("err: %v\n", err)
+		spaces = make([]memberSpace, 0)
+	}
+	sendTemplate(w, spaces, "spaces", "./html/spaces.html")
+}
+
+func (env *Env) getSpace(w HTMLWriter, r *http.Request, s session) {
+	sp, ok := env.spaceRole(w, s, r.PathValue("spaceId"))
+	if !ok {
+		return
+	}
+	id := sp.Id.String()
+
+	clips, err := env.dataManager.spaceClips(env.db, id)
+	var files []listedFile
+	if err == nil {
+		files, err = env.dataManager.spaceFiles(env.db, id)
+	}
+	var members []spaceMember
+	if err == nil {
+		members, err = env.dataManager.spaceMembers(env.db, id)
+	}
+	if err != nil {
+		log.Printf("err: %v\n", err)
+		w.Status = http.StatusInternalServerError
+		w.WriteHeader()
+		return
+	}
+
+	obj := map[string]any{
+		"Space":   sp,
+		"Clips":   clips,
+		"Files":   files,
+		"Members": members,
+		"CanEdit": slices.Contains(editorRoles, sp.Role),
+		"IsOwner": sp.Role == roleOwner,
+		"Me":      s.user.Username,
+	}
+	sendTemplate(w, obj, "space", "./html/space.html")
+}
+
+func (env *Env) sendSpaceFile(w HTMLWriter, r *http.Request, s session) {
+	sp, ok := env.spaceRole(w, s, r.PathValue("spaceId"))
+	if !ok {
+		return
+	}
+
+	f, version, err := env.dataManager.spaceFile(env.db, sp.Id.String(), r.PathValue("fileId"))
+	if err != nil {
+		log.Printf("err: %v\n", err)
+		if errors.Is(err, pgx.ErrNoRows) {
+			w.Status = http.StatusNotFound
+		} else {
+			w.Status = http.StatusInternalServerError
+		}
+		w.WriteHeader()
+		return
+	}
+
+	if origin, ok := downloadOrigin(); ok {
+		token := downloadToken(sp.Id.String(), version.Id.String(), f.Filename)
+		http.Redirect(w.Writer, r, origin.JoinPath("dl", token).String(), http.StatusSeeOther)
+		return
+	}
+	serveBlob(w, r, path.Join("./filedir", sp.Id.String(), version.Id.String()), f.Filename)
+}
+
+// POST //
+
+func (env *Env) postSpace(w HTMLWriter, r *http.Request, s session) {
+	if err := r.ParseForm(); err != nil {
+		w.Status = http.StatusBadRequest
+		w.WriteHeader()
+		log.Printf("err: %v\n", err)
+		return
+	}
+	name := strings.TrimSpace(r.PostForm.Get("name"))
+	if name == "" {
+		w.Status = http.StatusBadRequest
+		w.WriteHeader()
+		return
+	}
+
+	id, err := env.dataManager.insertSpace(env.db, name, s.user.Username)
+	if err != nil {
+		log.Printf("err: %v\n", err)
+		w.Status = http.StatusInternalServerError
+		w.WriteHeader()
+		return
+	}
+	// The files of a space are stored in its own directory, like the ones of a user
+	if err := os.MkdirAll(path.Join("./filedir", id), 0750); err != nil {
+		log.Printf("err: %v\n", err)
+	}
+
+	env.getSpaces(w, r, s)
+}
+
+func (env *Env) postSpaceClip(w HTMLWriter, r *http.Request, s session) {
+	sp, ok := env.spaceRole(w, s, r.PathValue("spaceId"), editorRoles...)
+	if !ok {
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		w.Status = http.StatusBadRequest
+		w.WriteHeader()
+		log.Printf("err: %v\n", err)
+		return
+	}
+	text := r.PostForm.Get("text")
+	if text == "" {
+		w.Status = http.StatusBadRequest
+		w.WriteHeader()
+		return
+	}
+
+	if err := env.dataManager.insertSpaceClip(env.db, sp.Id.String(), s.user.Username, text); err != nil {
+		log.Printf("err: %v\n", err)
+		w.Status = http.StatusInternalServerError
+		w.WriteHeader()
+		return
+	}
+	env.spaceBroker.Publish(spaceChannel(sp.Id.String()), "")
+}
+
+func (env *Env) postSpaceFile(w HTMLWriter, r *http.Request, s session) {
+	sp, ok := env.spaceRole(w, s, r.PathValue("spaceId"), editorRoles...)
+	if !ok {
+		return
+	}
+	if err := r.ParseMultipartForm(int64(^uint64(0) >> 1)); err != nil {
+		log.Printf("err: %v\n", err)
+		w.Status = http.StatusBadRequest
+		w.WriteHeader()
+		return
+	}
+
+	for _, files := range r.MultipartForm.File {
+		for _, f := range files {
+			if err := env.checkUploadSize(f.Size); err != nil {
+				log.Printf("err: %v\n", err)
+				w.Status = http.StatusRequestEntityTooLarge
+				continue
+			}
+			file, err := f.Open()
+			if err != nil {
+				log.Printf("err: %v\n", err)
+				continue
+			}
+			defer file.Close()
+
+			status := env.uploadStatus()
+			_, version, err := env.dataManager.insertSpaceFile(env.db, sp.Id.String(), s.user.Username, f.Filename, f.Size, status)
+			if err != nil {
+				log.Printf("err: %v\n", err)
+				continue
+			}
+			if err := env.storeBlob(file, sp.Id, version, status); err != nil {
+				log.Printf("err: %v\n", err)
+			}
+		}
+	}
+	if w.Status != http.StatusOK {
+		w.WriteHeader()
+	}
+
+	env.spaceBroker.Publish(spaceChannel(sp.Id.String()), "")
+}
+
+// postSpaceMember adds a member to the space or changes their role
+func (env *Env) postSpaceMember(w HTMLWriter, r *http.Request, s session) {
+	sp, ok := env.spaceRole(w, s, r.PathValue("spaceId"), roleOwner)
+	if !ok {
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		w.Status = http.StatusBadRequest
+		w.WriteHeader()
+		log.Printf("err: %v\n", err)
+		return
+	}
+	username := strings.TrimSpace(r.PostForm.Get("username"))
+	role := r.PostForm.Get("role")
+	if username == "" || !slices.Contains([]string{roleOwner, roleEditor, roleViewer}, role) {
+		w.Status = http.StatusBadRequest
+		w.WriteHeader()
+		return
+	}
+
+	if err := env.dataManager.setSpaceMember(env.db, sp.Id.String(), username, role); err != nil {
+		log.Printf("err: %v\n", err)
+		w.Status = spaceErrStatus(err)
+		w.WriteHeader()
+		return
+	}
+	env.spaceBroker.Publish(spaceChannel(sp.Id.String()), "")
+}
+
+// DELETE //
+
+func (env *Env) deleteSpaceClip(w HTMLWriter, r *http.Request, s session) {
+	sp, ok := env.spaceRole(w, s, r.PathValue("spaceId"), editorRoles...)
+	if !ok {
+		return
+	}
+
+	if err := env.dataManager.deleteSpaceClip(env.db, sp.Id.String(), r.PathValue("clipId")); err != nil {
+		log.Printf("err: %v\n", err)
+		w.Status = http.StatusInternalServerError
+		w.WriteHeader()
+		return
+	}
+	env.spaceBroker.Publish(spaceChannel(sp.Id.String()), "")
+	w.Status = http.StatusNoContent
+	w.WriteHeader()
+}
+
+func (env *Env) deleteSpaceFile(w HTMLWriter, r *http.Request, s session) {
+	sp, ok := env.spaceRole(w, s, r.PathValue("spaceId"), editorRoles...)
+	if !ok {
+		return
+	}
+
+	blobs, err := env.dataManager.deleteSpaceFile(env.db, sp.Id.String(), r.PathValue("fileId"))
+	if err != nil {
+		log.Printf("err: %v\n", err)
+		w.Status = spaceErrStatus(err)
+		w.WriteHeader()
+		return
+	}
+	for _, blob := range blobs {
+		if err := removeBlob(sp.Id.String(), blob); err != nil {
+			log.Printf("err: %v\n", err)
+		}
+	}
+
+	env.spaceBroker.Publish(spaceChannel(sp.Id.String()), "")
+	w.Status = http.StatusNoContent
+	w.WriteHeader()
+}
+
+// deleteSpaceMember removes a member from the space. Owners can remove anyone, the other members can only leave
+func (env *Env) deleteSpaceMember(w HTMLWriter, r *http.Request, s session) {
+	username := r.PathValue("username")
+	roles := []string{roleOwner}
+	if username == s.user.Username {
+		roles = nil
+	}
+	sp, ok := env.spaceRole(w, s, r.PathValue("spaceId"), roles...)
+	if !ok {
+		return
+	}
+
+	if err := env.dataManager.removeSpaceMember(env.db, sp.Id.String(), username); err != nil {
+		log.Printf("err: %v\n", err)
+		w.Status = spaceErrStatus(err)
+		w.WriteHeader()
+		return
+	}
+	env.spaceBroker.Publish(spaceChannel(sp.Id.String()), "")
+
+	// A member that leaves goes back to the list of their spaces
+	if username == s.user.Username {
+		env.getSpaces(w, r, s)
+	}
+}
+
+func (env *Env) deleteSpace(w HTMLWriter, r *http.Request, s session) {
+	sp, ok := env.spaceRole(w, s, r.PathValue("spaceId"), roleOwner)
+	if !ok {
+		return
+	}
+	id := sp.Id.String()
+
+	blobs, err := env.dataManager.deleteSpace(env.db, id)
+	if err != nil {
+		log.Printf("err: %v\n", err)
+		w.Status = spaceErrStatus(err)
+		w.WriteHeader()
+		return
+	}
+	for _, blob := range blobs {
+		if err := removeBlob(id, blob); err != nil {
+			log.Printf("err: %v\n", err)
+		}
+	}
+	if err := os.Remove(path.Join("./filedir", id)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		log.Printf("err: %v\n", err)
+	}
+
+	env.spaceBroker.Publish(spaceChannel(id), "")
+	env.getSpaces(w, r, s)
+}
+
+// SSE //
+
+func (env *Env) spaceUpdate(w HTMLWriter, r *http.Request, s session) {
+	sp, ok := env.spaceRole(w, s, r.PathValue("spaceId"))
+	if !ok {
+		return
+	}
+	sub := newSubscription(spaceChannel(sp.Id.String()))
+
+	writer := w.Writer // set the needed headers
+	writer.Header().Set("Content-Type", "text/event-stream")
+	writer.Header().Set("Cache-Control", "no-cache")
+	writer.Header().Set("Connection", "keep-alive")
+
+	env.spaceBroker.Subscribe <- sub
+	done := r.Context().Done()
+
+	rc := http.NewResponseController(writer)
+	for {
+		select {
+		case <-done:
+			env.spaceBroker.Unsubscribe <- sub
+			return
+		case <-s.done:
+			env.spaceBroker.Unsubscribe <- sub
+			return
+		case <-sub.ch:
+			if _, err := fmt.Fprintf(writer, "event: %s-update-space\ndata:\n\n", sp.Id); err != nil {
+				log.Printf("err: %v", err)
+				continue
+			}
+			if err := rc.Flush(); err != nil {
+				log.Printf("err: %v", err)
+				continue
+			}
+		}
+	}
+}
+
+// spaceRole loads the space for a member. If roles is not empty the member must have one of them.
+// If it returns false the response has already been sent
+func (env *Env) spaceRole(w HTMLWriter, s session, spaceId string, roles ...string) (memberSpace, bool) {
+	sp, err := env.dataManager.userSpace(env.db, s.user.Username, spaceId)
+	if err != nil {
+		if !errors.Is(err, pgx.ErrNoRows) {
+			log.Printf("err: %v\n", err)
+		}
+		w.Status = spaceErrStatus(err)
+		w.WriteHeader()
+		return memberSpace{}, false
+	}
+	if len(roles) > 0 && !slices.Contains(roles, sp.Role) {
+		w.Status = http.StatusForbidden
+		w.WriteHeader()
+		return memberSpace{}, false
+	}
+	return sp, true
+}
+
+// spaceIds returns the ids of all the spaces, they name the directories of their files
+func (env *Env) spaceIds() ([]string, error) {
+	spaces, err := env.dataManager.allSpaces(env.db)
+	if err != nil {
+		return nil, err
+	}
+	ids := make([]string, len(spaces))
+	for i, sp := range spaces {
+		ids[i] = sp.Id.String()
+	}
+	return ids, nil
+}
+
+func spaceErrStatus(err error) int {
+	switch {
+	case errors.Is(err, ErrLastOwner):
+		return http.StatusConflict
+	case errors.Is(err, pgx.ErrNoRows):
+		return http.StatusNotFound
+	default:
+		return http.StatusInternalServerError
+	}
+}
@@ -0,0 +1,442 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base32"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// RFC 6238 with the parameters every authenticator app supports
+const (
+	totpPeriod = 30
+	totpDigits = 6
+	totpIssuer = "CopyPaste"
+
+	recoveryCodeCount      = 10
+	loginChallengeExpir    = 5 * time.Minute
+	loginChallengeAttempts = 5
+)
+
+const (
+	totpOff     = "off"
+	totpPending = "pending" // the secret has been shown but not confirmed with a code
+	totpOn      = "on"
+)
+
+var ErrNoSecretKey = errors.New("SECRET_KEY is not set")
+
+var totpEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// secretKey derives the key that encrypts the secrets stored in the database from SECRET_KEY
+func secretKey() ([]byte, error) {
+	k := os.Getenv("SECRET_KEY")
+	if k == "" {
+		return nil, ErrNoSecretKey
+	}
+	sum := sha256.Sum256([]byte(k))
+	return sum[:], nil
+}
+
+// encryptSecret seals plain with AES-GCM. The username is authenticated too,
+// so a secret copied to another user doesn't decrypt
+func encryptSecret(plain []byte, username string) (string, error) {
+	gcm, err := secretCipher()
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	sealed := gcm.Seal(nonce, nonce, plain, []byte(username))
+	return base64.RawStdEncoding.EncodeToString(sealed), nil
+}
+
+func decryptSecret(enc string, username string) ([]byte, error) {
+	gcm, err := secretCipher()
+	if err != nil {
+		return nil, err
+	}
+	sealed, err := base64.RawStdEncoding.DecodeString(enc)
+	if err != nil {
+		return nil, err
+	}
+	if len(sealed) < gcm.NonceSize() {
+		return nil, errors.New("encrypted secret is too short")
+	}
+	nonce, data := sealed[:gcm.NonceSize()], sealed[gcm.NonceSize():]
+	return gcm.Open(nil, nonce, data, []byte(username))
+}
+
+func secretCipher() (cipher.AEAD, error) {
+	key, err := secretKey()
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// totpCode returns the code of a time step
+func totpCode(key []byte, step int64) string {
+	msg := make([]byte, 8)
+	binary.BigEndian.PutUint64(msg, uint64(step))
+	mac := hmac.New(sha1.New, key)
+	mac.Write(msg)
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0xf
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	return fmt.Sprintf("%0*d", totpDigits, value%1_000_000)
+}
+
+// totpMatch checks code against the step of now and the ones around it, to allow for clock drift.
+// It returns the step the code belongs to
+func totpMatch(key []byte, code string, now time.Time) (int64, bool) {
+	step := now.Unix() / totpPeriod
+	for _, s := range []int64{step - 1, step, step + 1} {
+		if hmac.Equal([]byte(totpCode(key, s)), []byte(code)) {
+			return s, true
+		}
+	}
+	return 0, false
+}
+
+// totpURI is the provisioning URI that authenticator apps read from the QR code
+func totpURI(username string, key []byte) string {
+	v := url.Values{}
+	v.Set("secret", totpEncoding.EncodeToString(key))
+	v.Set("issuer", totpIssuer)
+	v.Set("algorithm", "SHA1")
+	v.Set("digits", fmt.Sprint(totpDigits))
+	v.Set("period", fmt.Sprint(totpPeriod))
+	u := url.URL{Scheme: "otpauth", Host: "totp", Path: "/" + totpIssuer + ":" + username, RawQuery: v.Encode()}
+	return u.String()
+}
+
+// newRecoveryCodes returns codes like "k3x9p-2mq7d" and their hashes
+func newRecoveryCodes() ([]string, []string, error) {
+	const alphabet = "abcdefghjkmnpqrstuvwxyz23456789"
+	codes := make([]string, recoveryCodeCount)
+	hashes := make([]string, recoveryCodeCount)
+	for i := range codes {
+		b := make([]byte, 10)
+		if _, err := rand.Read(b); err != nil {
+			return nil, nil, err
+		}
+		for j := range b {
+			b[j] = alphabet[int(b[j])%len(alphabet)]
+		}
+		codes[i] = string(b[:5]) + "-" + string(b[5:])
+		hashes[i] = hashToken(normalizeRecoveryCode(codes[i]))
+	}
+	return codes, hashes, nil
+}
+
+func normalizeRecoveryCode(code string) string {
+	return strings.ReplaceAll(strings.ToLower(strings.TrimSpace(code)), "-", "")
+}
+
+// totpState tells whether user has enabled the second factor
+func (env *Env) totpState(user string) string {
+	t, err := env.dataManager.totpSecret(env.db, user)
+	if err != nil {
+		if !errors.Is(err, pgx.ErrNoRows) {
+			log.Printf("err: %v\n", err)
+		}
+		return totpOff
+	}
+	if t.ConfirmedAt == nil {
+		return totpPending
+	}
+	return totpOn
+}
+
+func (env *Env) totpEnabled(user string) bool {
+	return env.totpState(user) == totpOn
+}
+
+// checkSecondFactor verifies a TOTP code or a recovery code of user. Both can be used only once
+func (env *Env) checkSecondFactor(user string, code string) (bool, error) {
+	code = strings.ReplaceAll(strings.TrimSpace(code), " ", "")
+	if len(code) != totpDigits {
+		return env.dataManager.useRecoveryCode(env.db, user, hashToken(normalizeRecoveryCode(code)))
+	}
+
+	t, err := env.dataManager.totpSecret(env.db, user)
+	if err != nil {
+		return false, err
+	}
+	key, err := decryptSecret(t.Secret, user)
+	if err != nil {
+		return false, err
+	}
+	step, ok := totpMatch(key, code, time.Now())
+	if !ok {
+		return false, nil
+	}
+	return env.dataManager.useTotpStep(env.db, user, step)
+}
+
+// GET //
+
+// totpQR encodes the provisioning URI of a secret that has not been confirmed yet
+func (env *Env) totpQR(w HTMLWriter, r *http.Request, s session) {
+	t, err := env.dataManager.totpSecret(env.db, s.user.Username)
+	if err == nil && t.ConfirmedAt != nil {
+		err = pgx.ErrNoRows // Once confirmed the secret is never shown again
+	}
+	var key []byte
+	if err == nil {
+		key, err = decryptSecret(t.Secret, s.user.Username)
+	}
+	if err != nil {
+		log.Printf("err: %v\n", err)
+		w.Status = folderErrStatus(err)
+		w.WriteHeader()
+		return
+	}
+	sendQR(w, r, totpURI(s.user.Username, key))
+}
+
+// POST //
+
+// enrollTotp creates a new secret, it's enabled by confirmTotp after the user enters a code
+func (env *Env) enrollTotp(w HTMLWriter, r *http.Request, s session) {
+	key := make([]byte, 20)
+	if _, err := rand.Read(key); err != nil {
+		log.Printf("err: %v\n", err)
+		w.Status = http.StatusInternalServerError
+		w.WriteHeader()
+		return
+	}
+	enc, err := encryptSecret(key, s.user.Username)
+	if err != nil {
+		log.Printf("err: %v\n", err)
+		sendTotp(w, map[string]any{"TOTP": totpOff, "Message": "Two-factor authentication is not configured on this server"})
+		return
+	}
+	if err := env.dataManager.setTotpSecret(env.db, s.user.Username, enc); err != nil {
+		log.Printf("err: %v\n", err)
+		w.Status = http.StatusConflict
+		if !errors.Is(err, pgx.ErrNoRows) {
+			w.Status = http.StatusInternalServerError
+		}
+		w.WriteHeader()
+		return
+	}
+
+	sendTotp(w, map[string]any{"TOTP": totpPending, "Secret": totpEncoding.EncodeToString(key)})
+}
+
+func (env *Env) confirmTotp(w HTMLWriter, r *http.Request, s session) {
+	if err := r.ParseForm(); err != nil {
+		w.Status = http.StatusBadRequest
+		w.WriteHeader()
+		log.Printf("err: %v\n", err)
+		return
+	}
+
+	t, err := env.dataManager.totpSecret(env.db, s.user.Username)
+	if err == nil && t.ConfirmedAt != nil {
+		err = pgx.ErrNoRows
+	}
+	var key []byte
+	if err == nil {
+		key, err = decryptSecret(t.Secret, s.user.Username)
+	}
+	if err != nil {
+		log.Printf("err: %v\n", err)
+		w.Status = folderErrStatus(err)
+		w.WriteHeader()
+		return
+	}
+
+	step, ok := totpMatch(key, strings.TrimSpace(r.PostForm.Get("code")), time.Now())
+	if ok {
+		ok, err = env.dataManager.useTotpStep(env.db, s.user.Username, step)
+	}
+	if err != nil || !ok {
+		if err != nil {
+			log.Printf("err: %v\n", err)
+		}
+		obj := map[string]any{
+			"TOTP":    totpPending,
+			"Secret":  totpEncoding.EncodeToString(key),
+			"Message": "The code is not correct, check the clock of your device",
+		}
+		sendTotp(w, obj)
+		return
+	}
+
+	codes, hashes, err := newRecoveryCodes()
+	if err == nil {
+		err = env.dataManager.confirmTotp(env.db, s.user.Username, hashes)
+	}
+	if err != nil {
+		log.Printf("err: %v\n", err)
+		w.Status = http.StatusInternalServerError
+		w.WriteHeader()
+		return
+	}
+	sendTotp(w, map[string]any{"TOTP": totpOn, "Codes": codes})
+}
+
+// renewRecoveryCodes replaces the recovery codes of the user, after checking the second factor
+func (env *Env) renewRecoveryCodes(w HTMLWriter, r *http.Request, s session) {
+	if !env.promptSecondFactor(w, r, s) {
+		return
+	}
+
+	codes, hashes, err := newRecoveryCodes()
+	if err == nil {
+		err = env.dataManager.replaceRecoveryCodes(env.db, s.user.Username, hashes)
+	}
+	if err != nil {
+		log.Printf("err: %v\n", err)
+		w.Status = http.StatusInternalServerError
+		w.WriteHeader()
+		return
+	}
+	sendTotp(w, map[string]any{"TOTP": totpOn, "Codes": codes})
+}
+
+// DELETE //
+
+func (env *Env) disableTotp(w HTMLWriter, r *http.Request, s session) {
+	// A secret that was never confirmed can be dropped without a code
+	if env.totpEnabled(s.user.Username) && !env.promptSecondFactor(w, r, s) {
+		return
+	}
+
+	if err := env.dataManager.deleteTotp(env.db, s.user.Username); err != nil {
+		log.Printf("err: %v\n", err)
+		w.Status = http.StatusInternalServerError
+		w.WriteHeader()
+		return
+	}
+	sendTotp(w, map[string]any{"TOTP": totpOff})
+}
+
+// promptSecondFactor checks the code that the user entered in the HX-Prompt of a button.
+// If it returns false the response has already been sent
+func (env *Env) promptSecondFactor(w HTMLWriter, r *http.Request, s session) bool {
+	ok, err := env.checkSecondFactor(s.user.Username, r.Header.Get("HX-Prompt"))
+	if err != nil {
+		log.Printf("err: %v\n", err)
+	}
+	if !ok {
+		sendTotp(w, map[string]any{"TOTP": totpOn, "Message": "The code is not correct"})
+		return false
+	}
+	return true
+}
+
+func sendTotp(w HTMLWriter, obj any) {
+	w.HTMX = true // The section is always loaded inside the user page
+	sendTemplate(w, obj, "totp", "./html/user.html")
+}
+
+// LOGIN //
+
+// sendLoginChallenge asks for the second factor of a user that entered the right password
+func (env *Env) sendLoginChallenge(w HTMLWriter, u user, remember string) {
+	token, err := newLinkToken()
+	if err == nil {
+		err = env.dataManager.insertLoginChallenge(env.db, loginChallenge{
+			TokenHash: hashToken(token),
+			Username:  u.Username,
+			Remember:  remember == "on",
+			ExpiresAt: time.Now().Add(loginChallengeExpir),
+		})
+	}
+	if err != nil {
+		log.Printf("err: %v\n", err)
+		w.Status = http.StatusInternalServerError
+		w.WriteHeader()
+		sendTemplate(w, err.Error(), "login_base", "./html/login.html", "./html/login_base.html")
+		return
+	}
+	sendTotpLogin(w, map[string]any{"Token": token})
+}
+
+// postLoginCode is the second step of the login of users with a second factor
+func (env *Env) postLoginCode(w HTMLWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		w.Status = http.StatusBadRequest
+		w.WriteHeader()
+		log.Printf("err: %v\n", err)
+		return
+	}
+	token := r.PostForm.Get("token")
+
+	c, err := env.dataManager.attemptLoginChallenge(env.db, hashToken(token), loginChallengeAttempts)
+	if err != nil {
+		if !errors.Is(err, pgx.ErrNoRows) {
+			log.Printf("err: %v\n", err)
+		}
+		w.HTMX = true
+		sendTemplate(w, "The login has expired, please try again", "login_base", "./html/login.html", "./html/login_base.html")
+		return
+	}
+
+	if wait := env.accountWait(r, c.Username); wait > 0 {
+		sendTotpLogin(w, map[string]any{"Token": token, "Message": "Too many failed attempts, try again in " + waitText(wait)})
+		return
+	}
+	ok, err := env.checkSecondFactor(c.Username, r.PostForm.Get("code"))
+	if err != nil {
+		log.Printf("err: %v\n", err)
+	}
+	if !ok {
+		env.loginFailed(r, c.Username)
+		sendTotpLogin(w, map[string]any{"Token": token, "Message": "The code is not correct"})
+		return
+	}
+	env.loginSucceeded(r, c.Username)
+
+	if err := env.dataManager.deleteLoginChallenge(env.db, c.TokenHash); err != nil {
+		log.Printf("err: %v\n", err)
+	}
+	u, err := env.dataManager.userExists(env.db, c.Username)
+	var cookie *http.Cookie
+	if err == nil {
+		remember := ""
+		if c.Remember {
+			remember = "on"
+		}
+		cookie, err = env.startSession(r, u, remember)
+	}
+	if err != nil {
+		log.Printf("err: %v\n", err)
+		w.Status = http.StatusInternalServerError
+		w.WriteHeader()
+		sendTotpLogin(w, map[string]any{"Message": "The login could not be completed"})
+		return
+	}
+	sendLoggedIn(w, cookie)
+}
+
+func sendTotpLogin(w HTMLWriter, obj any) {
+	w.HTMX = true // Login does not need index template even if the request is not from HTMX
+	sendTemplate(w, obj, "login_base", "./html/login_base.html", "./html/totplogin.html")
+}
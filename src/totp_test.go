@@ -0,0 +1,137 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+// The SHA-1 test vectors of RFC 6238 appendix B, truncated to six digits
+func TestTotpCode(t *testing.T) {
+	key := []byte("12345678901234567890")
+	tests := []struct {
+		unix int64
+		code string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1111111111, "050471"},
+		{1234567890, "005924"},
+		{2000000000, "279037"},
+		{20000000000, "353130"},
+	}
+	for _, tt := range tests {
+		if got := totpCode(key, tt.unix/totpPeriod); got != tt.code {
+			t.Errorf("time %d: got %s, want %s", tt.unix, got, tt.code)
+		}
+	}
+}
+
+func TestTotpMatch(t *testing.T) {
+	key := []byte("12345678901234567890")
+	now := time.Unix(1111111111, 0)
+	step := now.Unix() / totpPeriod
+
+	for _, drift := range []int64{-1, 0, 1} {
+		got, ok := totpMatch(key, totpCode(key, step+drift), now)
+		if !ok || got != step+drift {
+			t.Errorf("drift %d: got step %d %v, want %d", drift, got, ok, step+drift)
+		}
+	}
+	for _, drift := range []int64{-2, 2} {
+		if _, ok := totpMatch(key, totpCode(key, step+drift), now); ok {
+			t.Errorf("drift %d: the code is accepted", drift)
+		}
+	}
+	if _, ok := totpMatch(key, "", now); ok {
+		t.Error("an empty code is accepted")
+	}
+}
+
+func TestEncryptSecret(t *testing.T) {
+	t.Setenv("SECRET_KEY", "first key")
+	enc, err := encryptSecret([]byte("secret"), "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if plain, err := decryptSecret(enc, "alice"); err != nil || string(plain) != "secret" {
+		t.Errorf("got %q, %v", plain, err)
+	}
+	if _, err := decryptSecret(enc, "bob"); err == nil {
+		t.Error("the secret of alice decrypts for bob")
+	}
+
+	t.Setenv("SECRET_KEY", "second key")
+	if _, err := decryptSecret(enc, "alice"); err == nil {
+		t.Error("the secret decrypts with another SECRET_KEY")
+	}
+	t.Setenv("SECRET_KEY", "")
+	if _, err := encryptSecret([]byte("secret"), "alice"); !errors.Is(err, ErrNoSecretKey) {
+		t.Errorf("without SECRET_KEY: %v", err)
+	}
+}
+
+func newTotpEnv(t *testing.T) (*Env, []byte, []string) {
+	t.Helper()
+	t.Setenv("SECRET_KEY", "test key")
+	key := []byte("12345678901234567890")
+	enc, err := encryptSecret(key, "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	codes, hashes, err := newRecoveryCodes()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now()
+	db := newFakeDb()
+	db.totp["alice"] = totpSecret{Username: "alice", Secret: enc, ConfirmedAt: &now}
+	for _, h := range hashes {
+		db.recovery["alice "+h] = false
+	}
+	return &Env{dataManager: db}, key, codes
+}
+
+func TestCheckSecondFactorReplay(t *testing.T) {
+	env, key, _ := newTotpEnv(t)
+	step := time.Now().Unix() / totpPeriod
+
+	if ok, _ := env.checkSecondFactor("alice", totpCode(key, step+3)); ok {
+		t.Error("the code of a later step is accepted")
+	}
+	if ok, err := env.checkSecondFactor("alice", totpCode(key, step)); !ok || err != nil {
+		t.Fatalf("the current code is refused: %v", err)
+	}
+	if ok, _ := env.checkSecondFactor("alice", totpCode(key, step)); ok {
+		t.Error("the same code is accepted twice")
+	}
+	if ok, _ := env.checkSecondFactor("alice", totpCode(key, step-1)); ok {
+		t.Error("the code of the previous step is accepted after the current one")
+	}
+	if ok, err := env.checkSecondFactor("alice", totpCode(key, step+1)); !ok || err != nil {
+		t.Errorf("the code of the next step is refused: %v", err)
+	}
+	if ok, _ := env.checkSecondFactor("bob", totpCode(key, step+1)); ok {
+		t.Error("the code of alice is accepted for bob")
+	}
+}
+
+func TestCheckSecondFactorRecoveryCode(t *testing.T) {
+	env, _, codes := newTotpEnv(t)
+
+	// Codes are typed in any case, with or without the dash
+	if ok, err := env.checkSecondFactor("alice", "  "+codes[0]+" "); !ok || err != nil {
+		t.Fatalf("the recovery code is refused: %v", err)
+	}
+	if ok, _ := env.checkSecondFactor("alice", codes[0]); ok {
+		t.Error("a recovery code is accepted twice")
+	}
+	if ok, _ := env.checkSecondFactor("alice", strings.ToUpper(strings.ReplaceAll(codes[1], "-", ""))); !ok {
+		t.Error("an upper case recovery code is refused")
+	}
+	if ok, _ := env.checkSecondFactor("alice", "aaaaa-aaaaa"); ok {
+		t.Error("an unknown recovery code is accepted")
+	}
+}
@@ -0,0 +1,310 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+)
+
+// With a size limit the body of a guest upload is capped at this many files of the maximum size
+const guestFilesPerRequest = 20
+
+// Guest files are numbered up to this when their name is taken
+const maxNumberedNames = 100
+
+// numberedName returns "name (n).ext" for the file name
+func numberedName(name string, n int) string {
+	ext := path.Ext(name)
+	if ext == name {
+		ext = "" // A dotfile such as .env has no extension
+	}
+	return fmt.Sprintf("%s (%d)%s", strings.TrimSuffix(name, ext), n, ext)
+}
+
+// available reports whether the link can still take files
+func (l uploadLink) available() bool {
+	if l.RevokedAt != nil {
+		return false
+	}
+	if l.ExpiresAt != nil && l.ExpiresAt.Before(time.Now()) {
+		return false
+	}
+	return l.MaxFiles == nil || l.Uploads < *l.MaxFiles
+}
+
+// MaxSizeMB returns the size limit of a file in MB, 0 when there is no limit
+func (l uploadLink) MaxSizeMB() int64 {
+	if l.MaxSize == nil {
+		return 0
+	}
+	return *l.MaxSize >> 20
+}
+
+// GET //
+
+func (env *Env) newUpload(w HTMLWriter, r *http.Request, _ session) {
+	obj := map[string]any{"FolderId": r.URL.Query().Get("folder")}
+	sendTemplate(w, obj, "newupload", "./html/newupload.html")
+}
+
+// uploadQR encodes the public URL of an upload link
+func (env *Env) uploadQR(w HTMLWriter, r *http.Request, s session) {
+	link, err := env.dataManager.userUploadLink(env.db, s.user.Username, r.PathValue("linkId"))
+	if err != nil {
+		log.Printf("err: %v\n", err)
+		if errors.Is(err, pgx.ErrNoRows) {
+			w.Status = http.StatusNotFound
+		} else {
+			w.Status = http.StatusInternalServerError
+		}
+		w.WriteHeader()
+		return
+	}
+	sendQR(w, r, publicURL(r, path.Join("/u", link.Token)))
+}
+
+// POST //
+
+func (env *Env) postUpload(w HTMLWriter, r *http.Request, s session) {
+	if err := r.ParseForm(); err != nil {
+		w.Status = http.StatusBadRequest
+		w.WriteHeader()
+		log.Printf("err: %v\n", err)
+		return
+	}
+	form := r.PostForm
+
+	token, err := newLinkToken()
+	if err != nil {
+		log.Printf("err: %v\n", err)
+		w.Status = http.StatusInternalServerError
+		w.WriteHeader()
+		return
+	}
+	link := uploadLink{
+		Id:       uuid.New(),
+		Token:    token,
+		Username: s.user.Username,
+		Label:    strings.TrimSpace(form.Get("label")),
+	}
+
+	if id, err := uuid.Parse(form.Get("folder")); err == nil {
+		link.Folder = &id
+	}
+	if hours, err := strconv.Atoi(form.Get("expires")); err == nil && hours > 0 {
+		exp := time.Now().Add(time.Duration(hours) * time.Hour)
+		link.ExpiresAt = &exp
+	}
+	if files, err := strconv.Atoi(form.Get("files")); err == nil && files > 0 {
+		max := int32(files)
+		link.MaxFiles = &max
+	}
+	if mb, err := strconv.ParseInt(form.Get("size"), 10, 64); err == nil && mb > 0 {
+		max := mb << 20
+		link.MaxSize = &max
+	}
+	if pw := form.Get("password"); pw != "" {
+		hash, err := hashPassword(pw)
+		if err != nil {
+			log.Printf("err: %v\n", err)
+			w.Status = http.StatusInternalServerError
+			w.WriteHeader()
+			return
+		}
+		link.Password = &hash
+	}
+
+	if err := env.dataManager.insertUploadLink(env.db, link); err != nil {
+		log.Printf("err: %v\n", err)
+		if errors.Is(err, pgx.ErrNoRows) {
+			w.Status = http.StatusNotFound
+		} else {
+			w.Status = http.StatusInternalServerError
+		}
+		w.WriteHeader()
+		return
+	}
+
+	obj := map[string]any{"Link": publicURL(r, path.Join("/u", token))}
+	sendTemplate(w, obj, "newupload", "./html/newupload.html")
+}
+
+// DELETE //
+
+func (env *Env) revokeUpload(w HTMLWriter, r *http.Request, s session) {
+	if err := env.dataManager.revokeUploadLink(env.db, s.user.Username, r.PathValue("linkId")); err != nil {
+		log.Printf("err: %v\n", err)
+		if errors.Is(err, pgx.ErrNoRows) {
+			w.Status = http.StatusNotFound
+		} else {
+			w.Status = http.StatusInternalServerError
+		}
+		w.WriteHeader()
+		return
+	}
+	env.getShares(w, r, s)
+}
+
+// PUBLIC //
+
+func (env *Env) viewUpload(w HTMLWriter, r *http.Request) {
+	link, ok := env.publicUploadLink(w, r)
+	if !ok {
+		return
+	}
+	sendUploadPage(w, uploadPageObj(link, ""))
+}
+
+// guestUpload stores the files of someone without an account, the same way postFile does
+// for the owner of the link. Every file counts towards the limit of the link
+func (env *Env) guestUpload(w HTMLWriter, r *http.Request) {
+	link, ok := env.publicUploadLink(w, r)
+	if !ok {
+		return
+	}
+	if !link.available() {
+		w.Status = http.StatusGone
+		w.WriteHeader()
+		sendUploadPage(w, map[string]any{"Message": "This link doesn't accept files anymore"})
+		return
+	}
+
+	// Links without a size limit still get the limit of the instance
+	limit := env.guestUploadMax
+	if link.MaxSize != nil {
+		files := int64(guestFilesPerRequest)
+		if link.MaxFiles != nil {
+			files = min(files, int64(*link.MaxFiles-link.Uploads))
+		}
+		limit = min(limit, *link.MaxSize*files+1<<20)
+	}
+	r.Body = http.MaxBytesReader(w.Writer, r.Body, limit)
+	if err := r.ParseMultipartForm(32 << 20); err != nil {
+		var maxErr *http.MaxBytesError
+		if errors.As(err, &maxErr) {
+			w.Status = http.StatusRequestEntityTooLarge
+		} else {
+			w.Status = http.StatusBadRequest
+		}
+		w.WriteHeader()
+		sendUploadPage(w, uploadPageObj(link, "The upload is too large or not valid"))
+		return
+	}
+
+	if link.Password != nil {
+		ok, err := hashCompare(r.FormValue("password"), *link.Password)
+		if err != nil {
+			log.Printf("err: %v\n", err)
+		}
+		if !ok {
+			w.Status = http.StatusForbidden
+			w.WriteHeader()
+			sendUploadPage(w, uploadPageObj(link, "The password is not correct"))
+			return
+		}
+	}
+
+	owner, err := env.dataManager.userExists(env.db, link.Username)
+	if err != nil {
+		log.Printf("err: %v\n", err)
+		w.Status = http.StatusInternalServerError
+		w.WriteHeader()
+		sendUploadPage(w, map[string]any{"Message": "The files could not be uploaded"})
+		return
+	}
+	folderId := idString(link.Folder)
+
+	saved := 0
+	var problems, renamed []string
+	for _, f := range r.MultipartForm.File["file"] {
+		if (link.MaxSize != nil && f.Size > *link.MaxSize) || env.checkUploadSize(f.Size) != nil {
+			problems = append(problems, f.Filename+" is too large")
+			continue
+		}
+		consumed, err := env.dataManager.consumeUploadLink(env.db, link.Token)
+		if err != nil {
+			if !errors.Is(err, pgx.ErrNoRows) {
+				log.Printf("err: %v\n", err)
+			}
+			problems = append(problems, "the link doesn't accept more files")
+			break
+		}
+		link = consumed
+
+		name, err := env.saveUpload(owner, f, folderId, &link.Id)
+		if err != nil {
+			log.Printf("err: %v\n", err)
+			problems = append(problems, f.Filename+" could not be saved")
+			continue
+		}
+		if name != f.Filename {
+			renamed = append(renamed, f.Filename+" was saved as "+name)
+		}
+		saved++
+	}
+	if saved > 0 {
+		env.fileBroker.Publish(userChannel(owner.Username), folderEvent(folderId))
+	}
+
+	obj := uploadPageObj(link, strings.Join(problems, ", "))
+	obj["Notice"] = fmt.Sprintf("Files uploaded: %d", saved)
+	if len(renamed) > 0 {
+		obj["Notice"] = fmt.Sprintf("Files uploaded: %d (%s)", saved, strings.Join(renamed, ", "))
+	}
+	sendUploadPage(w, obj)
+}
+
+// publicUploadLink applies the rate limit and loads the upload link in the request.
+// If it returns false the response has already been sent
+func (env *Env) publicUploadLink(w HTMLWriter, r *http.Request) (uploadLink, bool) {
+	if !env.allowPublic(w, r) {
+		return uploadLink{}, false
+	}
+
+	link, err := env.dataManager.uploadLink(env.db, r.PathValue("token"))
+	if err != nil {
+		if !errors.Is(err, pgx.ErrNoRows) {
+			log.Printf("err: %v\n", err)
+		}
+		w.Status = http.StatusNotFound
+		w.WriteHeader()
+		sendUploadPage(w, map[string]any{"Message": "This link does not exist"})
+		return uploadLink{}, false
+	}
+	return link, true
+}
+
+// uploadPageObj describes the upload form of a link, or only msg when the link can't be used
+func uploadPageObj(link uploadLink, msg string) map[string]any {
+	if !link.available() {
+		if msg == "" {
+			msg = "This link doesn't accept files anymore"
+		}
+		return map[string]any{"Message": msg}
+	}
+
+	obj := map[string]any{
+		"Token":    link.Token,
+		"Label":    link.Label,
+		"Password": link.Password != nil,
+		"Message":  msg,
+	}
+	if link.MaxFiles != nil {
+		obj["FilesLeft"] = *link.MaxFiles - link.Uploads
+	}
+	obj["MaxSizeMB"] = link.MaxSizeMB()
+	return obj
+}
+
+func sendUploadPage(w HTMLWriter, obj any) {
+	w.HTMX = true // Public pages never use the index template
+	sendTemplate(w, obj, "login_base", "./html/login_base.html", "./html/upload.html")
+}
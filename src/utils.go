@@ -1,22 +1,17 @@
 package main
 
 import (
-	"crypto/rand"
-	"crypto/subtle"
-	"encoding/base64"
-	"fmt"
 	"html/template"
 	"log"
 	"net/http"
-	"strings"
-
-	"golang.org/x/crypto/argon2"
+	"path"
 )
 
 type HTMLWriter struct {
 	Writer http.ResponseWriter
 	Status int
 	HTMX   bool
+	CSRF   string // the token of the session, templates read it with csrfToken
 }
 
 func (w *HTMLWriter) WriteHeader() {
@@ -43,42 +38,22 @@ func sendTemplate(w HTMLWriter, obj any, tname string, tmplPath ...string) {
 		tname = "index"
 	}
 
-	tmpl := template.Must(template.ParseFiles(tmplPath...))
+	funcs := template.FuncMap{"csrfToken": func() string { return w.CSRF }}
+	tmpl := template.Must(template.New(path.Base(tmplPath[0])).Funcs(funcs).ParseFiles(tmplPath...))
 	if err := tmpl.ExecuteTemplate(w.Writer, tname, obj); err != nil {
 		log.Printf("err: %v\n", err)
 	}
 }
 
-func hashPassword(password string) (string, error) {
-	salt := make([]byte, 16)
-	if _, err := rand.Read(salt); err != nil {
-		return "", err
-	}
-	hash := argon2.IDKey([]byte(password), salt, 1, 64*1024, 4, 32)
-
-	// Encode salt and hash
-	encSalt := base64.RawStdEncoding.EncodeToString(salt)
-	encHash := base64.RawStdEncoding.EncodeToString(hash)
-	encodedPw := fmt.Sprintf("%s$%s", encSalt, encHash)
-
-	return encodedPw, nil
-}
-
-func hashCompare(password string, hash string) (bool, error) {
-	hashParts := strings.Split(hash, "$")
-	baseHash, err := base64.RawStdEncoding.DecodeString(hashParts[1])
-	if err != nil {
-		return false, err
-	}
-
-	salt, err := base64.RawStdEncoding.DecodeString(hashParts[0])
-	if err != nil {
-		return false, err
-	}
-	newHash := argon2.IDKey([]byte(password), salt, 1, 64*1024, 4, 32)
-
-	if subtle.ConstantTimeCompare(baseHash, newHash) == 1 {
-		return true, nil
-	}
-	return false, nil
+// sendRedirect sends the browser to url, HTMX requests are redirected by HTMX
+// because the redirects of its XHR requests are followed without changing the page
+func sendRedirect(w *HTMLWriter, r *http.Request, url string) {
+	if isHTMX(r) {
+		w.Writer.Header().Set("HX-Redirect", url)
+		w.Status = http.StatusOK
+		w.WriteHeader()
+		return
+	}
+	w.Status = http.StatusSeeOther
+	http.Redirect(w.Writer, r, url, w.Status)
 }
@@ -0,0 +1,140 @@
+// Registers passkeys on the user page and logs in with them on the login page.
+// Buttons opt in with data-passkey="register" or data-passkey="login"
+(function () {
+  if (window.passkeyLoaded) {
+    return; // htmx runs the script again when it swaps a whole page in
+  }
+  window.passkeyLoaded = true;
+
+  function decode(value) {
+    const b64 = value.replace(/-/g, "+").replace(/_/g, "/");
+    const bin = atob(b64.padEnd(b64.length + ((4 - (b64.length % 4)) % 4), "="));
+    return Uint8Array.from(bin, (c) => c.charCodeAt(0)).buffer;
+  }
+
+  function encode(buffer) {
+    const bin = String.fromCharCode(...new Uint8Array(buffer));
+    return btoa(bin).replace(/\+/g, "-").replace(/\//g, "_").replace(/=+$/, "");
+  }
+
+  function showMessage(text) {
+    const el = document.getElementById("passkey-message");
+    if (el) {
+      el.textContent = text;
+    } else {
+      alert(text);
+    }
+  }
+
+  // The headers htmx sends, with the CSRF token of the session. Login pages don't have one
+  function headers() {
+    const el = document.getElementById("csrf");
+    return el ? JSON.parse(el.getAttribute("hx-headers")) : {};
+  }
+
+  async function begin(url) {
+    const res = await fetch(url, { method: "POST", headers: headers() });
+    const type = res.headers.get("Content-Type") || "";
+    if (!res.ok || !type.startsWith("application/json")) {
+      throw new Error("The server refused to start, try again later");
+    }
+    return res.json();
+  }
+
+  async function finish(url, cred) {
+    const body = {
+      id: cred.id,
+      rawId: encode(cred.rawId),
+      type: cred.type,
+      response: {},
+    };
+    for (const key of [
+      "clientDataJSON",
+      "attestationObject",
+      "authenticatorData",
+      "signature",
+      "userHandle",
+    ]) {
+      if (cred.response[key]) {
+        body.response[key] = encode(cred.response[key]);
+      }
+    }
+    if (cred.response.getTransports) {
+      body.response.transports = cred.response.getTransports();
+    }
+    return fetch(url, {
+      method: "POST",
+      headers: { ...headers(), "Content-Type": "application/json" },
+      body: JSON.stringify(body),
+    });
+  }
+
+  async function register() {
+    const { id, options } = await begin("/user/passkey/new");
+    const pk = options.publicKey;
+    pk.challenge = decode(pk.challenge);
+    pk.user.id = decode(pk.user.id);
+    for (const c of pk.excludeCredentials || []) {
+      c.id = decode(c.id);
+    }
+    const cred = await navigator.credentials.create({ publicKey: pk });
+
+    const name = prompt("Name of the passkey", navigator.platform || "") || "";
+    const res = await finish(
+      "/user/passkey/" + id + "?name=" + encodeURIComponent(name),
+      cred,
+    );
+    if (!res.ok) {
+      throw new Error("The passkey could not be saved");
+    }
+    htmx.ajax("GET", "/user", {
+      target: "#user-page",
+      select: "#user-page",
+      swap: "outerHTML",
+    });
+  }
+
+  async function login() {
+    const { id, options } = await begin("/login/passkey");
+    const pk = options.publicKey;
+    pk.challenge = decode(pk.challenge);
+    for (const c of pk.allowCredentials || []) {
+      c.id = decode(c.id);
+    }
+    const cred = await navigator.credentials.get({ publicKey: pk });
+
+    const remember = document.getElementById("remembermenp");
+    const query = remember && remember.checked ? "?remember=on" : "";
+    const res = await finish("/login/passkey/" + id + query, cred);
+    if (!res.ok) {
+      throw new Error("The passkey was not accepted");
+    }
+    window.location.href = "/";
+  }
+
+  document.addEventListener("click", (evt) => {
+    const btn = evt.target.closest("[data-passkey]");
+    if (!btn) {
+      return;
+    }
+    evt.preventDefault();
+    if (!window.PublicKeyCredential) {
+      showMessage("This browser does not support passkeys");
+      return;
+    }
+
+    const action = btn.dataset.passkey === "login" ? login : register;
+    btn.disabled = true;
+    showMessage("");
+    action()
+      .catch((err) => {
+        // The user closed the dialog of the browser
+        if (err.name !== "NotAllowedError") {
+          showMessage(err.message);
+        }
+      })
+      .finally(() => {
+        btn.disabled = false;
+      });
+  });
+})();